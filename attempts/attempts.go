@@ -0,0 +1,175 @@
+// Package attempts counts the failed push attempts of each invoice in a side
+// table, so an invoice that keeps failing is given up on after
+// attempts.max instead of being pushed on every run.
+package attempts
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Invoice is the attempt count of one invoice
+type Invoice struct {
+	Invoice   string    `json:"invoice_id"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	LastAt    time.Time `json:"last_attempt_at"`
+}
+
+// Store reads and updates the attempts table
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.AttemptsConfig
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.AttemptsConfig) *Store {
+	return &Store{DB: db, Dialect: dialect, Config: cfg}
+}
+
+// Reload picks up the table and limit of cfg.Attempts
+func (s *Store) Reload(cfg *config.Config) {
+	s.Config = cfg.Attempts
+}
+
+// Fail adds n failed attempts to invoice and returns its new total
+func (s *Store) Fail(ctx context.Context, invoice string, n int, lastError string) (int, error) {
+	d := s.Dialect
+	table := d.QuoteQualified(s.Config.Table)
+	switch d {
+	case sqlutil.MySQL:
+		return s.upsertAndRead(ctx, fmt.Sprintf(`INSERT INTO %s (invoice_number, attempts, last_error, last_attempt_at)
+VALUES (?, ?, ?, now(6))
+ON DUPLICATE KEY UPDATE
+	attempts = attempts + VALUES(attempts),
+	last_error = VALUES(last_error),
+	last_attempt_at = VALUES(last_attempt_at)`, table), invoice, n, lastError)
+	case sqlutil.SQLServer, sqlutil.Oracle:
+		query := d.Merge(table, "invoice_number", "attempts", "last_error") + fmt.Sprintf(`
+ON (d.invoice_number = s.invoice_number)
+WHEN MATCHED THEN UPDATE SET
+	d.attempts = d.attempts + s.attempts,
+	d.last_error = s.last_error,
+	d.last_attempt_at = %[1]s
+WHEN NOT MATCHED THEN INSERT (invoice_number, attempts, last_error, last_attempt_at)
+VALUES (s.invoice_number, s.attempts, s.last_error, %[1]s)`, d.Now())
+		if d == sqlutil.Oracle {
+			return s.upsertAndRead(ctx, query, invoice, n, lastError)
+		}
+		query += "\nOUTPUT inserted.attempts" + d.EndMerge()
+		var total int
+		err := s.DB.QueryRowContext(ctx, query, invoice, n, lastError).Scan(&total)
+		return total, err
+	}
+	query := fmt.Sprintf(`INSERT INTO %[1]s AS a (invoice_number, attempts, last_error, last_attempt_at)
+VALUES ($1, $2, $3, %[2]s)
+ON CONFLICT (invoice_number) DO UPDATE SET
+	attempts = a.attempts + EXCLUDED.attempts,
+	last_error = EXCLUDED.last_error,
+	last_attempt_at = EXCLUDED.last_attempt_at
+RETURNING attempts`, table, d.Now())
+	var total int
+	err := s.DB.QueryRowContext(ctx, query, invoice, n, lastError).Scan(&total)
+	return total, err
+}
+
+// Run upsert and read the new total back in the same transaction, for
+// databases without RETURNING or OUTPUT
+func (s *Store) upsertAndRead(ctx context.Context, upsert, invoice string, n int, lastError string) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, upsert, invoice, n, lastError); err != nil {
+		return 0, err
+	}
+	var total int
+	query := fmt.Sprintf("SELECT attempts FROM %s WHERE invoice_number = %s",
+		s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	if err := tx.QueryRowContext(ctx, query, invoice).Scan(&total); err != nil {
+		return 0, err
+	}
+	return total, tx.Commit()
+}
+
+// Clear forgets the attempts of invoice, after it was pushed
+func (s *Store) Clear(ctx context.Context, invoice string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE invoice_number = %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	_, err := s.DB.ExecContext(ctx, query, invoice)
+	return err
+}
+
+// Exhausted returns which of invoices reached attempts.max
+func (s *Store) Exhausted(ctx context.Context, invoices []string) (map[string]bool, error) {
+	exhausted := make(map[string]bool)
+	for _, chunk := range sqlutil.Chunks(invoices) {
+		if err := s.exhausted(ctx, chunk, exhausted); err != nil {
+			return nil, err
+		}
+	}
+	return exhausted, nil
+}
+
+// Add those of invoices that reached attempts.max to exhausted
+func (s *Store) exhausted(ctx context.Context, invoices []string, exhausted map[string]bool) error {
+	in, args := s.Dialect.In("invoice_number", 2, invoices)
+	query := fmt.Sprintf("SELECT invoice_number FROM %s WHERE attempts >= %s AND %s",
+		s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1), in)
+	rows, err := s.DB.QueryContext(ctx, query, append([]interface{}{s.Config.Max}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var invoice string
+		if err := rows.Scan(&invoice); err != nil {
+			return err
+		}
+		exhausted[invoice] = true
+	}
+	return rows.Err()
+}
+
+// List returns the invoices that reached attempts.max, most recently failed
+// first
+func (s *Store) List(ctx context.Context) ([]Invoice, error) {
+	query := fmt.Sprintf(`SELECT invoice_number, attempts, last_error, last_attempt_at FROM %s
+WHERE attempts >= %s ORDER BY last_attempt_at DESC`, s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	rows, err := s.DB.QueryContext(ctx, query, s.Config.Max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Invoice
+	for rows.Next() {
+		var i Invoice
+		// Oracle returns empty text as NULL
+		var lastError sql.NullString
+		if err := rows.Scan(&i.Invoice, &i.Attempts, &lastError, &i.LastAt); err != nil {
+			return nil, err
+		}
+		i.LastError = lastError.String
+		list = append(list, i)
+	}
+	return list, rows.Err()
+}
+
+// Migrate creates the attempts table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	d := s.Dialect
+	query := d.CreateTable(d.QuoteQualified(s.Config.Table),
+		"invoice_number "+d.Type(sqlutil.String)+" PRIMARY KEY",
+		"attempts "+d.Type(sqlutil.Integer),
+		"last_error "+d.Type(sqlutil.Text),
+		"last_attempt_at "+d.Type(sqlutil.Timestamp))
+	_, err := s.DB.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,113 @@
+// Package audit keeps the exact request and response of every push attempt
+// for compliance, with credential headers redacted. Entries are written to
+// a table or to daily append-only JSONL files and deleted after
+// audit.retention.
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Entry is one push request and its response. StatusCode is 0 and Error
+// set when no response was received.
+type Entry struct {
+	At time.Time `json:"at"`
+	// The run that sent it, empty for requests outside of one
+	RunID           string      `json:"run_id,omitempty"`
+	Invoices        []string    `json:"invoice_ids"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body"`
+	StatusCode      int         `json:"status_code"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	ResponseBody    string      `json:"response_body"`
+	Error           string      `json:"error,omitempty"`
+	DurationMS      int64       `json:"duration_ms"`
+}
+
+// Log is where entries are kept
+type Log interface {
+	// Record redacts the headers of e and writes it
+	Record(ctx context.Context, e Entry) error
+	// Prune deletes the entries from before cutoff and returns how many
+	Prune(ctx context.Context, cutoff time.Time) (int, error)
+	// Find returns the entries matching f, oldest first
+	Find(ctx context.Context, f Filter) ([]Entry, error)
+	Reload(cfg *config.Config)
+}
+
+// Filter selects entries by run, by invoice or both
+type Filter struct {
+	RunID string
+	// Entries about any of these, including bulk requests
+	Invoices []string
+}
+
+func (f Filter) match(e Entry) bool {
+	if f.RunID != "" && e.RunID != f.RunID {
+		return false
+	}
+	if len(f.Invoices) == 0 {
+		return true
+	}
+	for _, inv := range e.Invoices {
+		for _, want := range f.Invoices {
+			if inv == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Open returns the Log of cfg: the files in audit.dir when set, the table
+// otherwise
+func Open(db *sql.DB, dialect sqlutil.Dialect, cfg config.AuditConfig) Log {
+	if cfg.Dir != "" {
+		return NewFile(cfg)
+	}
+	return NewStore(db, dialect, cfg)
+}
+
+// Redacted replaces the values of credential headers
+const Redacted = "[REDACTED]"
+
+// Always redacted, even though they do not look like credentials
+var redactedHeaders = []string{"Cookie", "Set-Cookie", "X-Api-Key"}
+
+// Copy of h with the values of credential headers and of extra replaced
+func redact(h http.Header, extra []string) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if !sensitive(name, extra) {
+			out[name] = append([]string(nil), values...)
+			continue
+		}
+		out[name] = make([]string, len(values))
+		for i := range values {
+			out[name][i] = Redacted
+		}
+	}
+	return out
+}
+
+func sensitive(name string, extra []string) bool {
+	if jsonutil.IsSensitiveKey(name) {
+		return true
+	}
+	for _, h := range append(redactedHeaders, extra...) {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// File appends entries as JSON lines to one file per day in audit.dir,
+// named after the UTC date of the attempts, so retention deletes whole
+// files
+type File struct {
+	mu     sync.Mutex
+	config config.AuditConfig
+	// The file of the current day, kept open
+	path string
+	f    *os.File
+}
+
+func NewFile(cfg config.AuditConfig) *File {
+	return &File{config: cfg}
+}
+
+// Reload picks up the directory, retention and redacted headers of
+// cfg.Audit
+func (l *File) Reload(cfg *config.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = cfg.Audit
+}
+
+const (
+	filePrefix = "audit-"
+	fileDate   = "2006-01-02"
+)
+
+func (l *File) Record(ctx context.Context, e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.RequestHeaders = redact(e.RequestHeaders, l.config.RedactHeaders)
+	e.ResponseHeaders = redact(e.ResponseHeaders, l.config.RedactHeaders)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.config.Dir, filePrefix+e.At.UTC().Format(fileDate)+".jsonl")
+	if path != l.path {
+		if err := l.open(path); err != nil {
+			return err
+		}
+	}
+	_, err = l.f.Write(append(line, '\n'))
+	return err
+}
+
+// Switch to the file at path, closing the previous day's
+func (l *File) open(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.path, l.f = path, f
+	return nil
+}
+
+// Prune deletes the files of the days that ended before cutoff and returns
+// how many
+func (l *File) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	names, err := filepath.Glob(filepath.Join(l.config.Dir, filePrefix+"*.jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range names {
+		day, err := time.Parse(fileDate, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), filePrefix), ".jsonl"))
+		if err != nil || !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		if name == l.path {
+			l.f.Close()
+			l.path, l.f = "", nil
+		}
+		if err := os.Remove(name); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (l *File) Find(ctx context.Context, f Filter) ([]Entry, error) {
+	l.mu.Lock()
+	dir := l.config.Dir
+	l.mu.Unlock()
+	// Named by date, so sorted oldest first
+	names, err := filepath.Glob(filepath.Join(dir, filePrefix+"*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, name := range names {
+		if err := readFile(name, f, &entries); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Append the entries of the file at path matching f to entries
+func readFile(path string, f Filter, entries *[]Entry) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dec := json.NewDecoder(file)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if f.match(e) {
+			*entries = append(*entries, e)
+		}
+	}
+}
+
+// Close closes the current file
+func (l *File) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.path, l.f = "", nil
+	return err
+}
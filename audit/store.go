@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Store writes entries into the audit table
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.AuditConfig
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.AuditConfig) *Store {
+	return &Store{DB: db, Dialect: dialect, Config: cfg}
+}
+
+// Reload picks up the table, retention and redacted headers of cfg.Audit
+func (s *Store) Reload(cfg *config.Config) {
+	s.Config = cfg.Audit
+}
+
+var columns = []string{"attempted_at", "run_id", "invoice_numbers", "method", "url", "request_headers", "request_body",
+	"status_code", "response_headers", "response_body", "error_message", "duration_ms"}
+
+func (s *Store) Record(ctx context.Context, e Entry) error {
+	reqHeaders, err := json.Marshal(redact(e.RequestHeaders, s.Config.RedactHeaders))
+	if err != nil {
+		return err
+	}
+	respHeaders, err := json.Marshal(redact(e.ResponseHeaders, s.Config.RedactHeaders))
+	if err != nil {
+		return err
+	}
+	params := make([]string, len(columns))
+	for i := range params {
+		params[i] = s.Dialect.Param(i + 1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", s.Dialect.QuoteQualified(s.Config.Table),
+		strings.Join(columns, ", "), strings.Join(params, ", "))
+	_, err = s.DB.ExecContext(ctx, query, e.At, e.RunID, strings.Join(e.Invoices, ","), e.Method, e.URL,
+		string(reqHeaders), e.RequestBody, e.StatusCode, string(respHeaders), e.ResponseBody, e.Error, e.DurationMS)
+	return err
+}
+
+func (s *Store) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE attempted_at < %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	res, err := s.DB.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *Store) Find(ctx context.Context, f Filter) ([]Entry, error) {
+	d := s.Dialect
+	var where []string
+	var args []interface{}
+	if f.RunID != "" {
+		args = append(args, f.RunID)
+		where = append(where, "run_id = "+d.Param(len(args)))
+	}
+	var like []string
+	for _, inv := range f.Invoices {
+		// Narrowed down to exact matches by f.match
+		args = append(args, "%"+inv+"%")
+		like = append(like, "invoice_numbers LIKE "+d.Param(len(args)))
+	}
+	if len(like) > 0 {
+		where = append(where, "("+strings.Join(like, " OR ")+")")
+	}
+	if len(where) == 0 {
+		where = append(where, "1 = 1")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY id", strings.Join(columns, ", "),
+		d.QuoteQualified(s.Config.Table), strings.Join(where, " AND "))
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var at sqlutil.Time
+		// Oracle returns empty text as NULL
+		var runID, invoices, url, reqHeaders, reqBody, respHeaders, respBody, errMsg sql.NullString
+		if err := rows.Scan(&at, &runID, &invoices, &e.Method, &url, &reqHeaders, &reqBody,
+			&e.StatusCode, &respHeaders, &respBody, &errMsg, &e.DurationMS); err != nil {
+			return nil, err
+		}
+		e.At, e.RunID, e.URL = at.Time, runID.String, url.String
+		e.Invoices = strings.Split(invoices.String, ",")
+		e.RequestBody, e.ResponseBody, e.Error = reqBody.String, respBody.String, errMsg.String
+		if err := unmarshalHeaders(reqHeaders.String, &e.RequestHeaders); err != nil {
+			return nil, err
+		}
+		if err := unmarshalHeaders(respHeaders.String, &e.ResponseHeaders); err != nil {
+			return nil, err
+		}
+		if f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, rows.Err()
+}
+
+func unmarshalHeaders(s string, h *http.Header) error {
+	if s == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), h)
+}
+
+// Migrate creates the audit table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	d := s.Dialect
+	query := d.CreateTable(d.QuoteQualified(s.Config.Table),
+		"id "+d.Type(sqlutil.Serial),
+		"attempted_at "+d.Type(sqlutil.Timestamp),
+		"run_id "+d.Type(sqlutil.Text),
+		"invoice_numbers "+d.Type(sqlutil.Text),
+		"method "+d.Type(sqlutil.String),
+		"url "+d.Type(sqlutil.Text),
+		"request_headers "+d.Type(sqlutil.Text),
+		"request_body "+d.Type(sqlutil.Text),
+		"status_code "+d.Type(sqlutil.Integer),
+		"response_headers "+d.Type(sqlutil.Text),
+		"response_body "+d.Type(sqlutil.Text),
+		"error_message "+d.Type(sqlutil.Text),
+		"duration_ms "+d.Type(sqlutil.Integer))
+	_, err := s.DB.ExecContext(ctx, query)
+	return err
+}
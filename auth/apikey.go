@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// APIKey sends a static key with every push instead of logging in
+type APIKey struct {
+	mu  sync.RWMutex
+	cfg config.APIKeyConfig
+}
+
+func NewAPIKey(cfg config.APIKeyConfig) *APIKey {
+	return &APIKey{cfg: cfg}
+}
+
+// Reload picks up the key, header and prefix of cfg
+func (a *APIKey) Reload(cfg *config.Config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = cfg.API.APIKey
+}
+
+// Login does nothing, there is no login step
+func (a *APIKey) Login(ctx context.Context) error { return nil }
+
+func (a *APIKey) Token() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.cfg.Key
+}
+
+// Refresh cannot get another key; a rejected key needs fixing in the config
+func (a *APIKey) Refresh(ctx context.Context, stale string) error {
+	return errors.New("the API key was rejected")
+}
+
+// Authorize sets the key header, e.g. "Authorization: ApiKey <key>"
+func (a *APIKey) Authorize(req *http.Request, token string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	value := token
+	if a.cfg.Prefix != "" {
+		value = a.cfg.Prefix + " " + token
+	}
+	req.Header.Set(a.cfg.Header, value)
+}
@@ -0,0 +1,292 @@
+// Package auth obtains the credentials attached to push requests.
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/metrics"
+)
+
+// Authenticator supplies the bearer token sent with every push
+type Authenticator interface {
+	// Login acquires a token, or keeps the current one while it is known
+	// to be valid
+	Login(ctx context.Context) error
+	// Token returns the token acquired by the last successful Login
+	Token() string
+	// Refresh logs in again after the API rejected stale. Concurrent
+	// callers holding the same stale token share a single login.
+	Refresh(ctx context.Context, stale string) error
+}
+
+// Authorizer is implemented by authenticators that send the token some
+// other way than "Authorization: Bearer <token>"
+type Authorizer interface {
+	Authorize(req *http.Request, token string)
+}
+
+// CredentialSetter is implemented by authenticators using api.username and
+// api.password, so rotated credentials apply to the next login
+type CredentialSetter interface {
+	SetCredentials(username, password string)
+}
+
+// New returns the authenticator selected by api.auth_type
+func New(cfg config.APIConfig, client *http.Client) (Authenticator, error) {
+	switch cfg.AuthType {
+	case "", "jwt":
+		return NewJWTLogin(cfg, client), nil
+	case "oauth2":
+		c := NewClientCredentials(cfg.OAuth2, client)
+		c.Cache = cfg.TokenCache
+		return c, nil
+	case "api_key":
+		return NewAPIKey(cfg.APIKey), nil
+	case "basic":
+		return NewBasic(cfg), nil
+	case "session":
+		return NewSession(cfg, client), nil
+	}
+	return nil, fmt.Errorf("unknown api.auth_type %q", cfg.AuthType)
+}
+
+type LoginResponse struct {
+	Token string `json:"access_token"`
+	// Lifetime in seconds, when the API reports it
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// JWTLogin logs in with email and password against the login endpoint and
+// keeps the returned access token
+type JWTLogin struct {
+	URL      string
+	Username string
+	Password string
+	Headers  map[string]string
+	Client   *http.Client
+	// Reuse the token across runs instead of logging in every time
+	Cache config.TokenCacheConfig
+
+	mu     sync.RWMutex
+	token  string
+	expiry time.Time
+	cached cachedToken
+	// Serializes Refresh so only the first caller hits the login endpoint
+	refreshMu sync.Mutex
+}
+
+func NewJWTLogin(cfg config.APIConfig, client *http.Client) *JWTLogin {
+	return &JWTLogin{
+		URL:      cfg.LoginURL,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Headers:  cfg.Headers,
+		Client:   client,
+		Cache:    cfg.TokenCache,
+	}
+}
+
+// SetCredentials replaces the username and password used by the next login
+func (l *JWTLogin) SetCredentials(username, password string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Username, l.Password = username, password
+}
+
+// Reload picks up the login URL, credentials, headers and token cache
+// settings of cfg
+func (l *JWTLogin) Reload(cfg *config.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.URL = cfg.API.LoginURL
+	l.Username, l.Password = cfg.API.Username, cfg.API.Password
+	l.Headers = cfg.API.Headers
+	l.Cache = cfg.API.TokenCache
+}
+
+func (l *JWTLogin) Expiry() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.expiry
+}
+
+func (l *JWTLogin) Token() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.token
+}
+
+// Refresh logs in again unless another caller already replaced stale with
+// a new token while this one waited for the lock
+func (l *JWTLogin) Refresh(ctx context.Context, stale string) error {
+	l.refreshMu.Lock()
+	defer l.refreshMu.Unlock()
+	if l.Token() != stale {
+		return nil
+	}
+	return l.freshLogin(ctx, stale)
+}
+
+// Login and get JWT token. A token whose exp claim is still ahead is kept,
+// and with api.token_cache one from the cache file is reused instead.
+func (l *JWTLogin) Login(ctx context.Context) error {
+	if l.reuse() {
+		return nil
+	}
+	return l.freshLogin(ctx, l.Token())
+}
+
+// Log in to replace stale. With api.token_cache only one process logs in
+// at a time, and a token another one cached meanwhile is taken instead.
+func (l *JWTLogin) freshLogin(ctx context.Context, stale string) error {
+	cache := l.tokenCache()
+	if cache.cfg.Enabled {
+		unlock, err := cache.lock(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "Logging in without the token cache lock", "error", err)
+		} else {
+			defer unlock()
+			if t, ok, _ := cache.load(); ok && t.Token != stale {
+				l.adopt(t)
+				slog.InfoContext(ctx, "Reusing JWT token cached by another process", "obtained_at", t.ObtainedAt.Format(time.RFC3339))
+				return nil
+			}
+		}
+	}
+	err := l.login(ctx)
+	metrics.Login(ctx, err)
+	if err == nil && cache.cfg.Enabled {
+		l.saveToken(cache)
+	}
+	return err
+}
+
+func (l *JWTLogin) tokenCache() tokenCache {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return tokenCache{cfg: l.Cache, key: cachedToken{LoginURL: l.URL, Username: l.Username}}
+}
+
+// Use the cached token t
+func (l *JWTLogin) adopt(t cachedToken) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.token, l.expiry, l.cached = t.Token, t.Expiry, t
+	if l.expiry.IsZero() {
+		l.expiry = jwtExpiry(t.Token)
+	}
+}
+
+// Pick up a valid cached token, reporting whether there was one
+func (l *JWTLogin) reuse() bool {
+	l.mu.RLock()
+	if l.token != "" && !l.expiry.IsZero() && time.Until(l.expiry) > expiryMargin {
+		l.mu.RUnlock()
+		return true
+	}
+	valid := l.token != "" && l.cached.Token == l.token && l.cached.valid(l.Cache.MaxAge)
+	l.mu.RUnlock()
+	cache := l.tokenCache()
+	if !cache.cfg.Enabled {
+		return false
+	}
+	if valid {
+		return true
+	}
+	t, ok, err := cache.load()
+	if err != nil {
+		slog.Warn("Ignoring unreadable token cache", "file", cache.cfg.File, "error", err)
+	}
+	if !ok {
+		return false
+	}
+	l.adopt(t)
+	slog.Info("Reusing cached JWT token", "obtained_at", t.ObtainedAt.Format(time.RFC3339))
+	return true
+}
+
+// Write the current token to the cache file. A failure only costs a login
+// next time.
+func (l *JWTLogin) saveToken(cache tokenCache) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, err := cache.save(l.token, l.expiry)
+	if err != nil {
+		slog.Warn("Failed to write token cache", "file", cache.cfg.File, "error", err)
+		return
+	}
+	l.cached = t
+}
+
+func (l *JWTLogin) login(ctx context.Context) error {
+	l.mu.RLock()
+	url, headers := l.URL, l.Headers
+	loginData := map[string]string{
+		"email":    l.Username,
+		"password": l.Password,
+	}
+	l.mu.RUnlock()
+	jsonData, _ := json.Marshal(loginData)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	slog.DebugContext(ctx, "Login response", "status_code", resp.StatusCode, "body", jsonutil.Redact(body))
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to login, status: %d", resp.StatusCode)
+	}
+
+	var loginResp LoginResponse
+	if err := json.Unmarshal(body, &loginResp); err != nil {
+		return err
+	}
+	// Some APIs answer 200 with an error object instead of a token
+	if strings.TrimSpace(loginResp.Token) == "" {
+		return fmt.Errorf("login returned status %d but no access_token in the response (run with -debug to log the redacted body)", resp.StatusCode)
+	}
+
+	l.mu.Lock()
+	l.token = loginResp.Token
+	l.expiry = jwtExpiry(loginResp.Token)
+	if l.expiry.IsZero() && loginResp.ExpiresIn > 0 {
+		l.expiry = time.Now().Add(time.Duration(loginResp.ExpiresIn) * time.Second)
+	}
+	expiry := l.expiry
+	l.mu.Unlock()
+	// Never the token itself, which would let anyone reading the logs push
+	if expiry.IsZero() {
+		slog.InfoContext(ctx, "Successfully acquired JWT token")
+	} else {
+		slog.InfoContext(ctx, "Successfully acquired JWT token", "expires_at", expiry)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Basic sends api.username and api.password with every push as HTTP Basic
+// authentication instead of logging in
+type Basic struct {
+	mu       sync.RWMutex
+	username string
+	password string
+}
+
+func NewBasic(cfg config.APIConfig) *Basic {
+	return &Basic{username: cfg.Username, password: cfg.Password}
+}
+
+// SetCredentials replaces the username and password of the next pushes
+func (b *Basic) SetCredentials(username, password string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.username, b.password = username, password
+}
+
+// Reload picks up the credentials of cfg
+func (b *Basic) Reload(cfg *config.Config) {
+	b.SetCredentials(cfg.API.Username, cfg.API.Password)
+}
+
+// Login does nothing, the credentials go with every request
+func (b *Basic) Login(ctx context.Context) error { return nil }
+
+// Token returns the encoded credentials
+func (b *Basic) Token() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return base64.StdEncoding.EncodeToString([]byte(b.username + ":" + b.password))
+}
+
+// Refresh succeeds only when the credentials were replaced since stale was
+// sent, e.g. by a secret rotation
+func (b *Basic) Refresh(ctx context.Context, stale string) error {
+	if b.Token() != stale {
+		return nil
+	}
+	return errors.New("the API rejected the basic auth credentials")
+}
+
+func (b *Basic) Authorize(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Basic "+token)
+}
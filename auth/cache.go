@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// cachedToken is a token kept by api.token_cache, tied to the login or
+// token URL and the username or client ID it was obtained for
+type cachedToken struct {
+	LoginURL string `json:"login_url"`
+	Username string `json:"username"`
+	// The OAuth2 scopes it was granted for
+	Scope      string    `json:"scope,omitempty"`
+	Token      string    `json:"token"`
+	Expiry     time.Time `json:"expiry,omitempty"`
+	ObtainedAt time.Time `json:"obtained_at"`
+}
+
+// Whether the token can still be used: until shortly before its expiry, or
+// for maxAge after it was obtained when the expiry is unknown
+func (t cachedToken) valid(maxAge time.Duration) bool {
+	if t.Token == "" {
+		return false
+	}
+	if !t.Expiry.IsZero() {
+		return time.Until(t.Expiry) > expiryMargin
+	}
+	return time.Since(t.ObtainedAt) < maxAge
+}
+
+func (t cachedToken) sameLogin(o cachedToken) bool {
+	return t.LoginURL == o.LoginURL && t.Username == o.Username && t.Scope == o.Scope
+}
+
+// tokenFile is the cache file. It holds a token per login, so processes and
+// tenants logging in to the same endpoint can share a file.
+type tokenFile struct {
+	Tokens []cachedToken `json:"tokens"`
+}
+
+func readTokenFile(path string) (tokenFile, error) {
+	var f tokenFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return f, err
+	}
+	// Written before the file held several, as a single token
+	if f.Tokens == nil {
+		var t cachedToken
+		if err := json.Unmarshal(data, &t); err == nil && t.Token != "" {
+			f.Tokens = []cachedToken{t}
+		}
+	}
+	return f, nil
+}
+
+// Write the token file readable by the owner only, replacing it atomically
+// so a concurrent run never reads half a file
+func writeTokenFile(path string, f tokenFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// tokenCache is api.token_cache for the logins of one identity, key
+type tokenCache struct {
+	cfg config.TokenCacheConfig
+	key cachedToken
+}
+
+// The cached token of the identity, if it is still valid
+func (c tokenCache) load() (cachedToken, bool, error) {
+	f, err := readTokenFile(c.cfg.File)
+	if os.IsNotExist(err) {
+		return cachedToken{}, false, nil
+	}
+	if err != nil {
+		return cachedToken{}, false, err
+	}
+	for _, t := range f.Tokens {
+		if t.sameLogin(c.key) && t.valid(c.cfg.MaxAge) {
+			return t, true, nil
+		}
+	}
+	return cachedToken{}, false, nil
+}
+
+// Store token as the one of the identity, dropping the tokens of other
+// logins that are no longer valid. Call with the lock held, so no other
+// process' token is lost.
+func (c tokenCache) save(token string, expiry time.Time) (cachedToken, error) {
+	t := c.key
+	t.Token, t.Expiry, t.ObtainedAt = token, expiry, time.Now()
+	f, err := readTokenFile(c.cfg.File)
+	if err != nil && !os.IsNotExist(err) {
+		// An unreadable file is replaced
+		f = tokenFile{}
+	}
+	kept := []cachedToken{t}
+	for _, o := range f.Tokens {
+		if !o.sameLogin(t) && o.valid(c.cfg.MaxAge) {
+			kept = append(kept, o)
+		}
+	}
+	return t, writeTokenFile(c.cfg.File, tokenFile{Tokens: kept})
+}
+
+// Take the lock file next to the cache, so of the processes needing a new
+// token only one logs in and the others reuse its token. Gives up after
+// lock_timeout, when the caller logs in without it.
+func (c tokenCache) lock(ctx context.Context) (unlock func(), err error) {
+	path := c.cfg.File + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.cfg.LockTimeout)
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return func() {
+				unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("another process held %s for over %s", path, c.cfg.LockTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// How often a held lock is tried again
+const lockPoll = 100 * time.Millisecond
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Expirer is implemented by authenticators that know when their token
+// expires, so daemon mode can replace it before a push is rejected
+type Expirer interface {
+	// Expiry of the current token, zero when unknown
+	Expiry() time.Time
+}
+
+// Read the exp claim of a JWT without verifying it, the API does that.
+// Returns the zero time for opaque tokens or a missing claim.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp json.Number `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}
+	}
+	exp, err := claims.Exp.Float64()
+	if err != nil || exp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(exp), 0)
+}
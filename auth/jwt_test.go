@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestJWTExpiry(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	token := func(payload string, encode func([]byte) string) string {
+		return header + "." + encode([]byte(payload)) + ".c2lnbmF0dXJl"
+	}
+	raw, padded := base64.RawURLEncoding.EncodeToString, base64.URLEncoding.EncodeToString
+	tests := []struct {
+		name  string
+		token string
+		want  time.Time
+	}{
+		{"exp", token(`{"sub":"pos","exp":1767225600}`, raw), time.Unix(1767225600, 0)},
+		{"padded", token(`{"exp":1767225600}`, padded), time.Unix(1767225600, 0)},
+		{"fractional", token(`{"exp":1767225600.75}`, raw), time.Unix(1767225600, 0)},
+		{"no exp", token(`{"sub":"pos"}`, raw), time.Time{}},
+		{"zero exp", token(`{"exp":0}`, raw), time.Time{}},
+		{"string exp", token(`{"exp":"tomorrow"}`, raw), time.Time{}},
+		{"not json", token(`exp=1767225600`, raw), time.Time{}},
+		{"not base64", header + ".%%%.sig", time.Time{}},
+		{"opaque", "2f1c9a7e0b8d4e6f", time.Time{}},
+		{"two parts", header + "." + raw([]byte(`{"exp":1767225600}`)), time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := jwtExpiry(tt.token); !got.Equal(tt.want) {
+			t.Errorf("%s: jwtExpiry = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+// None is the authenticator of sinks that do not call the API: there is
+// nothing to log in to and no token
+type None struct{}
+
+func (None) Login(ctx context.Context) error { return nil }
+
+func (None) Token() string { return "" }
+
+func (None) Refresh(ctx context.Context, stale string) error {
+	return errors.New("the sink has no login")
+}
@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/metrics"
+)
+
+// Tokens expiring sooner than this are replaced on the next Login
+const expiryMargin = 30 * time.Second
+
+// ClientCredentials obtains access tokens with the OAuth2 client
+// credentials grant. Login keeps the current token while it is valid, so a
+// run only hits the token endpoint when the token is about to expire.
+type ClientCredentials struct {
+	Config config.OAuth2Config
+	Client *http.Client
+	// Shares the token with other processes and runs
+	Cache config.TokenCacheConfig
+
+	mu     sync.RWMutex
+	token  string
+	expiry time.Time
+	// Serializes Refresh so only the first caller hits the token endpoint
+	refreshMu sync.Mutex
+}
+
+func NewClientCredentials(cfg config.OAuth2Config, client *http.Client) *ClientCredentials {
+	return &ClientCredentials{Config: cfg, Client: client}
+}
+
+// Reload picks up the token endpoint, client and scopes of cfg; the
+// current token is kept until it expires
+func (c *ClientCredentials) Reload(cfg *config.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Config = cfg.API.OAuth2
+	c.Cache = cfg.API.TokenCache
+}
+
+func (c *ClientCredentials) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+func (c *ClientCredentials) Expiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.expiry
+}
+
+// Login requests a token unless the current one is still valid
+func (c *ClientCredentials) Login(ctx context.Context) error {
+	c.mu.RLock()
+	valid := c.token != "" && (c.expiry.IsZero() || time.Until(c.expiry) > expiryMargin)
+	c.mu.RUnlock()
+	if valid {
+		return nil
+	}
+	cache := c.tokenCache()
+	if cache.cfg.Enabled {
+		t, ok, err := cache.load()
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring unreadable token cache", "file", cache.cfg.File, "error", err)
+		}
+		if ok {
+			c.adopt(t)
+			slog.InfoContext(ctx, "Reusing cached OAuth2 access token", "obtained_at", t.ObtainedAt.Format(time.RFC3339))
+			return nil
+		}
+	}
+	return c.freshFetch(ctx, c.Token())
+}
+
+// Refresh requests a new token unless another caller already replaced
+// stale while this one waited for the lock
+func (c *ClientCredentials) Refresh(ctx context.Context, stale string) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if c.Token() != stale {
+		return nil
+	}
+	return c.freshFetch(ctx, stale)
+}
+
+// Request a token to replace stale. With api.token_cache only one process
+// requests one at a time, and a token another one cached meanwhile is
+// taken instead.
+func (c *ClientCredentials) freshFetch(ctx context.Context, stale string) error {
+	cache := c.tokenCache()
+	if cache.cfg.Enabled {
+		unlock, err := cache.lock(ctx)
+		if err != nil {
+			slog.WarnContext(ctx, "Requesting a token without the token cache lock", "error", err)
+		} else {
+			defer unlock()
+			if t, ok, _ := cache.load(); ok && t.Token != stale {
+				c.adopt(t)
+				slog.InfoContext(ctx, "Reusing OAuth2 access token cached by another process", "obtained_at", t.ObtainedAt.Format(time.RFC3339))
+				return nil
+			}
+		}
+	}
+	err := c.fetch(ctx)
+	metrics.Login(ctx, err)
+	if err == nil && cache.cfg.Enabled {
+		c.mu.RLock()
+		token, expiry := c.token, c.expiry
+		c.mu.RUnlock()
+		if _, err := cache.save(token, expiry); err != nil {
+			slog.WarnContext(ctx, "Failed to write token cache", "file", cache.cfg.File, "error", err)
+		}
+	}
+	return err
+}
+
+func (c *ClientCredentials) tokenCache() tokenCache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return tokenCache{cfg: c.Cache, key: cachedToken{
+		LoginURL: c.Config.TokenURL, Username: c.Config.ClientID, Scope: strings.Join(c.Config.Scopes, " "),
+	}}
+}
+
+// Use the cached token t
+func (c *ClientCredentials) adopt(t cachedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.expiry = t.Token, t.Expiry
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func (c *ClientCredentials) fetch(ctx context.Context) error {
+	c.mu.RLock()
+	cfg := c.Config
+	c.mu.RUnlock()
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(cfg.Scopes, " "))
+	}
+	if cfg.Audience != "" {
+		form.Set("audience", cfg.Audience)
+	}
+	if cfg.AuthStyle == "body" {
+		form.Set("client_id", cfg.ClientID)
+		form.Set("client_secret", cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cfg.AuthStyle != "body" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Token response", "status_code", resp.StatusCode, "body", jsonutil.Redact(body))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get OAuth2 token, status: %d", resp.StatusCode)
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return err
+	}
+	if strings.TrimSpace(tr.AccessToken) == "" {
+		return fmt.Errorf("token endpoint returned status %d but no access_token", resp.StatusCode)
+	}
+
+	c.mu.Lock()
+	c.token = tr.AccessToken
+	c.expiry = time.Time{}
+	if tr.ExpiresIn > 0 {
+		c.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	c.mu.Unlock()
+	slog.InfoContext(ctx, "Acquired OAuth2 access token", "expires_in", tr.ExpiresIn)
+	return nil
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/metrics"
+)
+
+// Session logs in by posting api.username and api.password to
+// api.login_url like a login form, and sends the session cookie the
+// login sets with every push until the API rejects it or it expires
+type Session struct {
+	URL      string
+	Username string
+	Password string
+	Headers  map[string]string
+	Config   config.SessionConfig
+	Client   *http.Client
+
+	mu sync.RWMutex
+	// The Cookie header sent with pushes
+	cookies string
+	expiry  time.Time
+	// Serializes Refresh so only the first caller logs in
+	refreshMu sync.Mutex
+}
+
+func NewSession(cfg config.APIConfig, client *http.Client) *Session {
+	return &Session{
+		URL:      cfg.LoginURL,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Headers:  cfg.Headers,
+		Config:   cfg.Session,
+		Client:   client,
+	}
+}
+
+// SetCredentials replaces the username and password used by the next login
+func (s *Session) SetCredentials(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Username, s.Password = username, password
+}
+
+// Reload picks up the login URL, credentials, headers and session settings
+// of cfg; the current session is kept until it is rejected or expires
+func (s *Session) Reload(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.URL = cfg.API.LoginURL
+	s.Username, s.Password = cfg.API.Username, cfg.API.Password
+	s.Headers = cfg.API.Headers
+	s.Config = cfg.API.Session
+}
+
+func (s *Session) Token() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cookies
+}
+
+func (s *Session) Expiry() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expiry
+}
+
+// Login keeps the current session while it has not expired
+func (s *Session) Login(ctx context.Context) error {
+	s.mu.RLock()
+	valid := s.cookies != "" && (s.expiry.IsZero() || time.Until(s.expiry) > expiryMargin)
+	s.mu.RUnlock()
+	if valid {
+		return nil
+	}
+	err := s.login(ctx)
+	metrics.Login(ctx, err)
+	return err
+}
+
+// Refresh logs in again unless another caller already replaced stale with
+// a new session while this one waited for the lock
+func (s *Session) Refresh(ctx context.Context, stale string) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	if s.Token() != stale {
+		return nil
+	}
+	err := s.login(ctx)
+	metrics.Login(ctx, err)
+	return err
+}
+
+// Authorize sends the session cookies; other cookies of the request stay
+func (s *Session) Authorize(req *http.Request, token string) {
+	if existing := req.Header.Get("Cookie"); existing != "" {
+		token = existing + "; " + token
+	}
+	req.Header.Set("Cookie", token)
+}
+
+func (s *Session) login(ctx context.Context) error {
+	s.mu.RLock()
+	loginURL, headers, c := s.URL, s.Headers, s.Config
+	fields := map[string]string{c.UsernameField: s.Username, c.PasswordField: s.Password}
+	s.mu.RUnlock()
+	for k, v := range c.Fields {
+		fields[k] = v
+	}
+
+	var body []byte
+	contentType := "application/x-www-form-urlencoded"
+	if c.Format == "json" {
+		body, _ = json.Marshal(fields)
+		contentType = "application/json"
+	} else {
+		form := url.Values{}
+		for k, v := range fields {
+			form.Set(k, v)
+		}
+		body = []byte(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	// Form logins usually answer with a redirect to the application; the
+	// cookie is set on that answer
+	client := *s.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	slog.DebugContext(ctx, "Login response", "status_code", resp.StatusCode, "cookies", len(resp.Cookies()))
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("failed to login, status: %d", resp.StatusCode)
+	}
+
+	var pairs []string
+	var expiry time.Time
+	for _, ck := range resp.Cookies() {
+		if c.Cookie != "" && ck.Name != c.Cookie {
+			continue
+		}
+		pairs = append(pairs, ck.Name+"="+ck.Value)
+		// The earliest expiry of the session cookies
+		at := ck.Expires
+		if ck.MaxAge > 0 {
+			at = time.Now().Add(time.Duration(ck.MaxAge) * time.Second)
+		}
+		if !at.IsZero() && (expiry.IsZero() || at.Before(expiry)) {
+			expiry = at
+		}
+	}
+	if len(pairs) == 0 {
+		if c.Cookie != "" {
+			return fmt.Errorf("login returned status %d but did not set the %s cookie", resp.StatusCode, c.Cookie)
+		}
+		return fmt.Errorf("login returned status %d but set no cookie", resp.StatusCode)
+	}
+	if c.MaxAge > 0 && (expiry.IsZero() || time.Until(expiry) > c.MaxAge) {
+		expiry = time.Now().Add(c.MaxAge)
+	}
+
+	s.mu.Lock()
+	s.cookies, s.expiry = strings.Join(pairs, "; "), expiry
+	s.mu.Unlock()
+	// Never the cookie values, which would let anyone reading the logs push
+	if expiry.IsZero() {
+		slog.InfoContext(ctx, "Started session", "cookies", len(pairs))
+	} else {
+		slog.InfoContext(ctx, "Started session", "cookies", len(pairs), "expires_at", expiry)
+	}
+	return nil
+}
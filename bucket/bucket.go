@@ -0,0 +1,89 @@
+// Package bucket keeps a copy of every pushed invoice in an S3 or GCS
+// bucket, partitioned by date, for audits that outlive the database.
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/purwaren/trx-push/config"
+)
+
+// Object is what is stored for one pushed invoice
+type Object struct {
+	InvoiceID string    `json:"invoice_id"`
+	RunID     string    `json:"run_id,omitempty"`
+	PushedAt  time.Time `json:"pushed_at"`
+	// The document of the invoice, as built for the sinks
+	Payload    json.RawMessage `json:"payload"`
+	StatusCode int             `json:"status_code,omitempty"`
+	// The response body, as JSON when it is
+	Response interface{} `json:"response,omitempty"`
+}
+
+// Bucket is the bucket of the bucket section. It is safe for concurrent
+// use.
+type Bucket struct {
+	Config config.BucketConfig
+	client *s3.Client
+}
+
+func Open(ctx context.Context, cfg config.BucketConfig) (*Bucket, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	if cfg.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, "")))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.PathStyle
+	})
+	return &Bucket{Config: cfg, client: client}, nil
+}
+
+// Key is where the object of invoice pushed at is stored: under the prefix
+// and the UTC date, with the invoice number escaped so it stays one path
+// segment
+func (b *Bucket) Key(invoice string, at time.Time) string {
+	return path.Join(b.Config.Prefix, at.UTC().Format("2006/01/02"), url.PathEscape(invoice)+".json")
+}
+
+// Put stores o, replacing the object of an earlier push of the invoice on
+// the same day
+func (b *Bucket) Put(ctx context.Context, o Object) error {
+	body, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.Config.Timeout)
+	defer cancel()
+	key := b.Key(o.InvoiceID, o.PushedAt)
+	_, err = b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.Config.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to bucket %s: %v", key, b.Config.Bucket, err)
+	}
+	return nil
+}
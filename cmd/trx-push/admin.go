@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/results"
+)
+
+// admin is the HTTP API starting runs and pushing single invoices on
+// demand. Runs wait for the cycle in progress, and are kept in memory.
+type admin struct {
+	cfg config.AdminConfig
+	p   *pipeline.Pipeline
+	// Runs and pushes outlive the request, and stop with the process
+	ctx context.Context
+
+	mu   sync.Mutex
+	runs map[string]*adminRun
+	// Run IDs from oldest to newest, for keep_runs
+	order []string
+	// The summaries of the last keep_runs runs, however they were started
+	summaries []*pipeline.Summary
+}
+
+// adminRun is a run requested through the API
+type adminRun struct {
+	ID string `json:"id"`
+	// running (also while it waits for a cycle in progress), finished,
+	// failed or skipped (pushing was closed)
+	Status      string            `json:"status"`
+	RequestedAt time.Time         `json:"requested_at"`
+	Summary     *pipeline.Summary `json:"summary,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+func newAdmin(ctx context.Context, cfg config.AdminConfig, p *pipeline.Pipeline) *admin {
+	return &admin{cfg: cfg, p: p, ctx: ctx, runs: make(map[string]*adminRun)}
+}
+
+func (a *admin) register(mux *http.ServeMux) {
+	mux.Handle("/runs", a.authorized(a.handleRuns))
+	mux.Handle("/runs/", a.authorized(a.handleRun))
+	mux.Handle("/push/", a.authorized(a.handlePush))
+	mux.Handle("/summaries", a.authorized(a.handleSummaries))
+	mux.Handle("/history/", a.authorized(a.handleHistory))
+	// The page itself is public, it asks for the token
+	mux.Handle("/dashboard/", dashboardHandler())
+}
+
+// Notify keeps the summary of every run for the dashboard
+func (a *admin) Notify(ctx context.Context, s *pipeline.Summary) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.summaries = append(a.summaries, s)
+	if n := len(a.summaries) - a.cfg.KeepRuns; n > 0 {
+		a.summaries = a.summaries[n:]
+	}
+	return nil
+}
+
+func (a *admin) authorized(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.Token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		h(w, r)
+	})
+}
+
+// POST /runs starts a run, GET /runs lists the kept ones, newest first
+func (a *admin) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		writeJSON(w, http.StatusAccepted, a.startRun())
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.listRuns())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// GET /runs/{id}
+func (a *admin) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	run, ok := a.run(strings.TrimPrefix(r.URL.Path, "/runs/"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown run"})
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// POST /push/{invoice_id} pushes the invoice and answers with its status
+func (a *admin) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	invoice := strings.TrimPrefix(r.URL.Path, "/push/")
+	if invoice == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "missing invoice_id"})
+		return
+	}
+	slog.Info("Pushing invoice on request", "invoice_id", invoice)
+	// A push that started completes even if the client goes away
+	status, err := a.p.PushInvoice(context.WithoutCancel(a.ctx), invoice)
+	body := map[string]string{"invoice_id": invoice, "status": status}
+	code := http.StatusOK
+	switch {
+	case errors.Is(err, pipeline.ErrSkipped):
+		code = http.StatusUnprocessableEntity
+	case err != nil:
+		code = http.StatusServiceUnavailable
+	case status != results.StatusSuccess:
+		code = http.StatusBadGateway
+	}
+	if err != nil {
+		body["error"] = err.Error()
+	}
+	writeJSON(w, code, body)
+}
+
+// GET /summaries lists the summaries of the last runs, newest first
+func (a *admin) handleSummaries(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	summaries := make([]*pipeline.Summary, 0, len(a.summaries))
+	for i := len(a.summaries) - 1; i >= 0; i-- {
+		summaries = append(summaries, a.summaries[i])
+	}
+	a.mu.Unlock()
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// historyEntry is one result of GET /history/{invoice_id}
+type historyEntry struct {
+	Status   string    `json:"status"`
+	HTTPCode int       `json:"http_code"`
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+}
+
+// GET /history/{invoice_id} lists the last pushes of an invoice from the
+// results table
+func (a *admin) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if a.p.Results == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "results are disabled"})
+		return
+	}
+	invoice := strings.TrimPrefix(r.URL.Path, "/history/")
+	history, err := a.p.Results.History(r.Context(), invoice, a.cfg.KeepRuns)
+	if err != nil {
+		slog.Error("Failed to read results", "invoice_id", invoice, "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to read results"})
+		return
+	}
+	entries := make([]historyEntry, 0, len(history))
+	for _, h := range history {
+		entries = append(entries, historyEntry{Status: h.Status, HTTPCode: h.HTTPCode, Reason: h.Reason, At: h.At})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *admin) startRun() adminRun {
+	run := &adminRun{ID: newRunID(), Status: "running", RequestedAt: time.Now()}
+	a.mu.Lock()
+	a.runs[run.ID] = run
+	a.order = append(a.order, run.ID)
+	for len(a.order) > a.cfg.KeepRuns {
+		delete(a.runs, a.order[0])
+		a.order = a.order[1:]
+	}
+	snapshot := *run
+	a.mu.Unlock()
+
+	slog.Info("Run requested", "id", run.ID)
+	go func() {
+		sum, err := a.p.RunNow(a.ctx)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		run.Summary = sum
+		switch {
+		case err != nil:
+			run.Status = "failed"
+			run.Error = err.Error()
+		case sum == nil:
+			run.Status = "skipped"
+		default:
+			run.Status = "finished"
+		}
+	}()
+	return snapshot
+}
+
+func (a *admin) run(id string) (adminRun, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	run, ok := a.runs[id]
+	if !ok {
+		return adminRun{}, false
+	}
+	return *run, true
+}
+
+func (a *admin) listRuns() []adminRun {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	runs := make([]adminRun, 0, len(a.order))
+	for i := len(a.order) - 1; i >= 0; i-- {
+		runs = append(runs, *a.runs[a.order[i]])
+	}
+	return runs
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/source"
+)
+
+func benchCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("bench")
+	var o options
+	o.register(fs)
+	count := fs.Int("count", 1000, "synthetic invoices to push")
+	prefix := fs.String("prefix", "BENCH-", "prefix of the synthetic invoice numbers")
+	target := fs.String("url", "", "push URL to benchmark, overriding api.push_url")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *count < 1 {
+		return errors.New("-count must be at least 1")
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	if *target != "" {
+		cfg.API.PushURL = *target
+	}
+	login, err := newAuth(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	sink, err := newSink(cfg, httpClient, login)
+	if err != nil {
+		return err
+	}
+	if c, ok := sink.(io.Closer); ok {
+		defer c.Close()
+	}
+	if err := login.Login(ctx); err != nil {
+		return &pipeline.LoginError{Err: err}
+	}
+
+	slog.Warn("Pushing synthetic invoices, point -url at a test endpoint", "count", *count, "workers", cfg.Concurrency,
+		"push_url", cfg.API.PushURL, "prefix", *prefix)
+	latencies := make([]time.Duration, *count)
+	var failed, retried atomic.Int64
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				i := int(next.Add(1)) - 1
+				if i >= *count {
+					return
+				}
+				txn := source.Transaction{InvoiceID: fmt.Sprintf("%s%d", *prefix, i+1)}
+				t := time.Now()
+				resp, err := sink.Push(ctx, txn)
+				if err != nil {
+					failed.Add(1)
+					slog.Debug("Bench push failed", "invoice_id", txn.InvoiceID, "error", err)
+				}
+				if resp.Attempts > 1 {
+					retried.Add(1)
+				}
+				latencies[i] = time.Since(t)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	done := min(int(next.Load()), *count)
+	latencies = latencies[:done]
+	fmt.Print(benchReport(latencies, int(failed.Load()), int(retried.Load()), cfg.Concurrency, elapsed))
+	if ctx.Err() != nil {
+		return pipeline.ErrInterrupted
+	}
+	return nil
+}
+
+// Throughput and latency percentiles of the pushes that took latencies
+func benchReport(latencies []time.Duration, failed, retried, workers int, elapsed time.Duration) string {
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	pct := func(p float64) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		return sorted[int(p*float64(len(sorted)-1))].Round(time.Microsecond)
+	}
+	n := len(sorted)
+	s := fmt.Sprintf("Pushed %d invoices in %s with %d workers: %.1f/s\n", n, elapsed.Round(time.Millisecond), workers,
+		float64(n)/elapsed.Seconds())
+	s += fmt.Sprintf("Succeeded %d, failed %d, retried %d\n", n-failed, failed, retried)
+	s += fmt.Sprintf("Latency p50 %s, p90 %s, p95 %s, p99 %s, max %s\n", pct(0.5), pct(0.9), pct(0.95), pct(0.99), pct(1))
+	return s
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/source"
+)
+
+// checker prints the outcome of each check and counts the failed ones
+type checker struct {
+	failed int
+}
+
+func (c *checker) report(name string, err error) {
+	c.reportHint(name, err, "")
+}
+
+// reportHint also prints what to do about a failure
+func (c *checker) reportHint(name string, err error, hint string) {
+	if err != nil {
+		c.failed++
+		fmt.Printf("FAIL  %s: %v\n", name, err)
+		if hint != "" {
+			fmt.Printf("      hint: %s\n", hint)
+		}
+		return
+	}
+	fmt.Printf("ok    %s\n", name)
+}
+
+func (c *checker) skip(name, reason string) {
+	fmt.Printf("skip  %s: %s\n", name, reason)
+}
+
+func checkCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("check")
+	var o options
+	o.register(fs)
+	api := fs.Bool("api", false, "also GET -url, which must not answer with a 5xx")
+	apiURL := fs.String("url", "", "harmless endpoint requested with -api; defaults to warmup.url, then health.api_url")
+	timeout := fs.Duration("timeout", 10*time.Second, "limit of each database and API check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var c checker
+	httpClient := &http.Client{}
+	o.allTenants = true
+	cfg, err := o.load(ctx, httpClient)
+	c.report("config", err)
+	if err != nil {
+		return fmt.Errorf("%d check(s) failed", c.failed)
+	}
+	c.report("config keys", config.CheckKeys(o.config, o.profile, config.RemoteOptions{
+		Client: httpClient, Auth: o.configAuth, Timeout: o.configTimeout,
+	}))
+
+	for _, tc := range tenantConfigs(cfg) {
+		prefix, client := "", httpClient
+		if len(cfg.Tenants) > 0 {
+			prefix, client = "tenant "+tc.Tenant+": ", &http.Client{}
+			_, err := o.loadTenant(ctx, tc, client)
+			c.report(prefix+"secrets", err)
+			if err != nil {
+				continue
+			}
+		}
+		var bad []string
+		for _, err := range tc.CheckURLs() {
+			bad = append(bad, err.Error())
+		}
+		if len(bad) > 0 {
+			c.report(prefix+"urls", fmt.Errorf("%s", strings.Join(bad, "; ")))
+		} else {
+			c.report(prefix+"urls", nil)
+		}
+
+		if tc.Source.Type == "database" {
+			c.report(prefix+"database", checkDatabase(ctx, tc, *timeout))
+		} else {
+			c.skip(prefix+"database", "source.type is "+tc.Source.Type)
+		}
+
+		login, err := newAuth(tc, client)
+		switch {
+		case err != nil:
+			c.report(prefix+"login", err)
+		case login == auth.None{}:
+			c.skip(prefix+"login", "no sink logs in to the API")
+		default:
+			lctx, cancel := context.WithTimeout(ctx, *timeout)
+			c.report(prefix+"login", login.Login(lctx))
+			cancel()
+		}
+
+		if !*api {
+			continue
+		}
+		u := *apiURL
+		if u == "" {
+			u = tc.Warmup.URL
+		}
+		if u == "" {
+			u = tc.Health.APIURL
+		}
+		if u == "" {
+			c.skip(prefix+"api", "no -url, warmup.url or health.api_url")
+			continue
+		}
+		c.report(prefix+"api "+u, checkAPI(ctx, client, tc, u, *timeout))
+	}
+
+	if c.failed > 0 {
+		return fmt.Errorf("%d check(s) failed", c.failed)
+	}
+	return nil
+}
+
+// Connect to the database and the read database and run a query
+func checkDatabase(ctx context.Context, cfg *config.Config, timeout time.Duration) error {
+	db, err := source.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := db.Write.PingContext(ctx); err != nil {
+		return err
+	}
+	if err := db.Read.PingContext(ctx); err != nil {
+		return fmt.Errorf("read_database: %v", err)
+	}
+	_, err = db.Has(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %v", cfg.Query.Table, err)
+	}
+	return nil
+}
+
+// GET u with the api headers; any answer but a 5xx will do
+func checkAPI(ctx context.Context, client *http.Client, cfg *config.Config, u string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range cfg.API.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
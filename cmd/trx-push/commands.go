@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/attempts"
+	"github.com/purwaren/trx-push/audit"
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/bucket"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/deliveries"
+	"github.com/purwaren/trx-push/dlq"
+	"github.com/purwaren/trx-push/hooks"
+	"github.com/purwaren/trx-push/metrics"
+	"github.com/purwaren/trx-push/notify"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/queue"
+	"github.com/purwaren/trx-push/quota"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/runs"
+	"github.com/purwaren/trx-push/source"
+	"github.com/purwaren/trx-push/tracing"
+)
+
+// How a push command runs
+type mode struct {
+	daemon bool
+	listen bool
+	dryRun bool
+	// "json" writes the outcomes and summaries to standard output
+	output string
+}
+
+func runCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("run")
+	var o options
+	o.register(fs)
+	dryRun := fs.Bool("dry-run", false, "print what would be pushed without pushing or updating the database")
+	output := fs.String("output", "text", "json writes a JSON line per invoice outcome and run summary to standard output")
+	migrate := fs.Bool("migrate", false, "create or upgrade the tables of trx-push and exit, same as the migrate command")
+	// Kept from before the serve command existed
+	daemon := fs.Bool("daemon", false, "keep running, same as serve")
+	listen := fs.Bool("listen", false, "push invoices as they are announced, same as serve -listen")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *migrate {
+		return migrateTables(ctx, &o, false)
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown -output %q (expected text or json)", *output)
+	}
+	return push(ctx, &o, mode{daemon: *daemon, listen: *listen, dryRun: *dryRun, output: *output})
+}
+
+func serveCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("serve")
+	var o options
+	o.register(fs)
+	dryRun := fs.Bool("dry-run", false, "print what would be pushed each cycle without pushing")
+	listen := fs.Bool("listen", false, "push invoices as they are announced with NOTIFY on listen.channel")
+	output := fs.String("output", "text", "json writes a JSON line per invoice outcome and run summary to standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("unknown -output %q (expected text or json)", *output)
+	}
+	return push(ctx, &o, mode{daemon: true, listen: *listen, dryRun: *dryRun, output: *output})
+}
+
+func push(ctx context.Context, o *options, m mode) error {
+	// Shared HTTP client used for config fetch, login and push
+	httpClient := &http.Client{}
+	o.allTenants = true
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	logVersion(ctx)
+	listenMode := m.listen || cfg.Listen.Enabled || cfg.Webhook.Enabled
+	shutdown, err := tracing.Setup(ctx, cfg.Tracing)
+	if err != nil {
+		return fmt.Errorf("failed to set up tracing: %v", err)
+	}
+	stopStatsD, err := metrics.StartStatsD(cfg.Metrics.StatsD)
+	if err != nil {
+		return err
+	}
+	defer stopStatsD()
+	defer func() {
+		// Flush the spans of the last run, even after a signal
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
+	}()
+	if len(cfg.Tenants) > 0 {
+		return pushTenants(ctx, o, m, httpClient, cfg)
+	}
+
+	in, err := start(metrics.WithTenant(ctx, cfg.Tenant), cfg, httpClient, m)
+	if err != nil {
+		return err
+	}
+	defer in.close()
+	p := in.p
+	if m.daemon || listenMode {
+		go watchConfig(ctx, o, httpClient, in)
+		if o.secrets != nil {
+			go o.secrets.watch(ctx, p, in.login, in.db)
+		}
+		// The endpoints configured on the same address share a server
+		muxes := make(map[string]*http.ServeMux)
+		mux := func(addr string) *http.ServeMux {
+			if muxes[addr] == nil {
+				muxes[addr] = http.NewServeMux()
+			}
+			return muxes[addr]
+		}
+		if cfg.Metrics.Listen != "" {
+			mux(cfg.Metrics.Listen).Handle("/metrics", metrics.Handler())
+		}
+		if cfg.Health.Listen != "" {
+			h := &health{cfg: cfg.Health, dbs: map[string]*sql.DB{"database": in.db.Write}, client: httpClient}
+			h.register(mux(cfg.Health.Listen))
+		}
+		if cfg.Admin.Listen != "" && !m.dryRun {
+			a := newAdmin(ctx, cfg.Admin, p)
+			a.register(mux(cfg.Admin.Listen))
+			p.Notifiers = append(p.Notifiers, a)
+		}
+		if cfg.Webhook.Enabled {
+			in.webhook = newWebhook(cfg.Webhook)
+			in.webhook.register(mux(cfg.Webhook.Listen))
+		}
+		for addr, mux := range muxes {
+			go serveHTTP(ctx, addr, mux)
+		}
+		defer notifyReady(ctx)()
+	}
+	if cfg.Pprof.Listen != "" && (m.daemon || listenMode) {
+		go serveHTTP(ctx, cfg.Pprof.Listen, pprofHandler(cfg.Pprof))
+	}
+
+	if err := in.run(metrics.WithTenant(ctx, cfg.Tenant), listenMode); err != nil || m.daemon || listenMode || m.dryRun {
+		return err
+	}
+	return checkPushes(p.LastSummary())
+}
+
+// instance is the pipeline of one config, with the database and login it
+// pushes with
+type instance struct {
+	cfg    *config.Config
+	client *http.Client
+	db     *source.Database
+	login  auth.Authenticator
+	p      *pipeline.Pipeline
+	// Set with tenants, kept to refresh them while serving
+	secrets *loadedSecrets
+	// Listen to NOTIFY on listen.channel
+	notify bool
+	// Set with webhook.enabled while serving
+	webhook *webhook
+	closers []func()
+}
+
+// Open the database, source, sink and stores of cfg and build its pipeline
+func start(ctx context.Context, cfg *config.Config, client *http.Client, m mode) (*instance, error) {
+	in := &instance{cfg: cfg, client: client, notify: m.listen || cfg.Listen.Enabled}
+	var err error
+	in.db, err = source.Open(cfg)
+	if err != nil {
+		err = dbErrorf("failed to open database: %v", err)
+		if !m.dryRun {
+			notifyFailure(ctx, cfg, err)
+		}
+		return nil, err
+	}
+	in.closers = append(in.closers, func() { in.db.Close() })
+	src, err := openSource(ctx, cfg, in.db)
+	if err != nil {
+		in.close()
+		return nil, err
+	}
+	in.closers = append(in.closers, func() { closeSource(src) })
+
+	if in.login, err = newAuth(cfg, client); err != nil {
+		in.close()
+		return nil, err
+	}
+	p, err := newPipeline(cfg, client, in.login, src)
+	if err != nil {
+		in.close()
+		return nil, err
+	}
+	if c, ok := p.Sink.(io.Closer); ok {
+		in.closers = append(in.closers, func() { c.Close() })
+	}
+	if cfg.Redis.RateLimit != "" {
+		shared := pusher.NewSharedLimit(cfg)
+		in.closers = append(in.closers, func() { shared.Close() })
+		for _, h := range httpSinks(p.Sink) {
+			h.Shared = shared
+		}
+	}
+	p.DryRun = m.dryRun
+	p.Daemon = m.daemon
+	if m.output == "json" {
+		p.Output = os.Stdout
+	}
+	in.closers = append(in.closers, attachStores(cfg, in.db, p))
+	if cfg.Queue.Enabled && !p.DryRun {
+		if p.Queue, err = queue.Open(cfg.Queue.File); err != nil {
+			in.close()
+			return nil, err
+		}
+		in.closers = append(in.closers, func() { p.Queue.Close() })
+	}
+	if cfg.Bucket.Enabled && !p.DryRun {
+		if p.Bucket, err = bucket.Open(ctx, cfg.Bucket); err != nil {
+			in.close()
+			return nil, err
+		}
+	}
+	if p.Hooks, err = hooks.Load(ctx, cfg.Hooks); err != nil {
+		in.close()
+		return nil, err
+	}
+	in.closers = append(in.closers, func() { p.Hooks.Close() })
+	p.Notifiers = notify.New(cfg)
+	if a := notify.NewAlerts(cfg); a != nil && (m.daemon || m.listen || cfg.Listen.Enabled || cfg.Webhook.Enabled) {
+		p.Notifiers = append(p.Notifiers, a)
+	}
+	in.p = p
+	return in, nil
+}
+
+// Close what start opened, last first
+func (in *instance) close() {
+	for i := len(in.closers) - 1; i >= 0; i-- {
+		in.closers[i]()
+	}
+}
+
+// Push until done, as the only pusher with leader.enabled
+func (in *instance) run(ctx context.Context, listenMode bool) error {
+	cfg := in.cfg
+	if !cfg.Leader.Enabled || !(in.p.Daemon || listenMode) {
+		return run(ctx, in, listenMode)
+	}
+	lock := source.NewAdvisoryLock(in.db.Write, cfg.Leader.LockID)
+	slog.Info("Waiting to become the leader", "lock_id", cfg.Leader.LockID)
+	if err := lock.Acquire(ctx, cfg.Leader.RetryInterval); err != nil {
+		return nil
+	}
+	defer lock.Release()
+	slog.Info("Acquired the leader lock")
+
+	parent := ctx
+	var cancel context.CancelFunc
+	ctx, cancel = lock.Hold(ctx, cfg.Leader.CheckInterval)
+	defer cancel()
+	err := run(ctx, in, listenMode)
+	if parent.Err() == nil && ctx.Err() != nil {
+		return errors.New("lost the leader lock, stopped pushing")
+	}
+	return err
+}
+
+// Push for every tenant of cfg at once, each with its own database, HTTP
+// client, login and stores. The process-wide settings, the metrics,
+// health, pprof, tracing and log ones, are those of cfg.
+func pushTenants(ctx context.Context, o *options, m mode, httpClient *http.Client, cfg *config.Config) error {
+	listenMode := m.listen || cfg.Listen.Enabled
+	var instances []*instance
+	defer func() {
+		for _, in := range instances {
+			in.close()
+		}
+	}()
+	dbs := make(map[string]*sql.DB)
+	share := pusher.NewFairShare(cfg.FairShare)
+	for _, tc := range cfg.Tenants {
+		client := &http.Client{}
+		s, err := o.loadTenant(ctx, tc, client)
+		if err != nil {
+			return err
+		}
+		in, err := start(metrics.WithTenant(ctx, tc.Tenant), tc, client, m)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tc.Tenant, err)
+		}
+		in.secrets = s
+		for _, h := range httpSinks(in.p.Sink) {
+			h.Share = share
+		}
+		instances = append(instances, in)
+		dbs["database_"+tc.Tenant] = in.db.Write
+	}
+
+	if m.daemon || listenMode {
+		go watchConfig(ctx, o, httpClient, instances...)
+		for _, in := range instances {
+			if in.secrets != nil {
+				go in.secrets.watch(ctx, in.p, in.login, in.db)
+			}
+		}
+		muxes := make(map[string]*http.ServeMux)
+		mux := func(addr string) *http.ServeMux {
+			if muxes[addr] == nil {
+				muxes[addr] = http.NewServeMux()
+			}
+			return muxes[addr]
+		}
+		if cfg.Metrics.Listen != "" {
+			mux(cfg.Metrics.Listen).Handle("/metrics", metrics.Handler())
+		}
+		if cfg.Health.Listen != "" {
+			h := &health{cfg: cfg.Health, dbs: dbs, client: httpClient}
+			h.register(mux(cfg.Health.Listen))
+		}
+		for addr, mux := range muxes {
+			go serveHTTP(ctx, addr, mux)
+		}
+		if cfg.Pprof.Listen != "" {
+			go serveHTTP(ctx, cfg.Pprof.Listen, pprofHandler(cfg.Pprof))
+		}
+		defer notifyReady(ctx)()
+	}
+
+	// A tenant that stops does not stop the others
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, in := range instances {
+		wg.Add(1)
+		go func(i int, in *instance) {
+			defer wg.Done()
+			slog.Info("Pushing for tenant", "tenant", in.cfg.Tenant)
+			err := in.run(metrics.WithTenant(ctx, in.cfg.Tenant), listenMode)
+			if err == nil && !m.daemon && !listenMode && !m.dryRun {
+				err = checkPushes(in.p.LastSummary())
+			}
+			var pushes *failedPushes
+			if err != nil && !errors.Is(err, pipeline.ErrInterrupted) && !errors.As(err, &pushes) {
+				slog.Error("Tenant stopped with an error", "tenant", in.cfg.Tenant, "error", err)
+			}
+			errs[i] = err
+		}(i, in)
+	}
+	wg.Wait()
+	return tenantsError(instances, errs)
+}
+
+// Combine the errors of the tenants into the one of the command: the
+// failed pushes are added up, any other error wins with its tenant named
+func tenantsError(instances []*instance, errs []error) error {
+	var total failedPushes
+	var failed []string
+	for i, err := range errs {
+		var pushes *failedPushes
+		switch {
+		case err == nil:
+			if s := instances[i].p.LastSummary(); s != nil {
+				total.pushed += s.Pushed
+			}
+		case errors.Is(err, pipeline.ErrInterrupted):
+			return pipeline.ErrInterrupted
+		case errors.As(err, &pushes):
+			total.failed += pushes.failed
+			total.pushed += pushes.pushed
+			failed = append(failed, instances[i].cfg.Tenant)
+		default:
+			return fmt.Errorf("tenant %s: %w", instances[i].cfg.Tenant, err)
+		}
+	}
+	if total.failed > 0 {
+		slog.Warn("Some tenants left invoices unpushed", "tenants", failed)
+		return &total
+	}
+	return nil
+}
+
+// Give p the enabled results, dead-letter, attempts, runs, quota, audit and
+// fanout stores, leaving out the ones a dry run would write. The returned func
+// closes them.
+func attachStores(cfg *config.Config, db *source.Database, p *pipeline.Pipeline) func() {
+	if cfg.Results.Enabled && !p.DryRun {
+		p.Results = results.NewStore(db.Write, db.Dialect, cfg.Results)
+	}
+	if cfg.DeadLetter.Enabled && !p.DryRun {
+		p.DeadLetters = dlq.NewStore(db.Write, db.Dialect, cfg.DeadLetter)
+	}
+	if cfg.Attempts.Enabled {
+		p.Attempts = attempts.NewStore(db.Write, db.Dialect, cfg.Attempts)
+	}
+	if cfg.Runs.Enabled && !p.DryRun {
+		p.Runs = runs.NewStore(db.Write, db.Dialect, cfg.Runs, version)
+	}
+	if cfg.Quota.Daily > 0 && !p.DryRun {
+		p.Quota = quota.NewStore(db.Write, db.Dialect, cfg.Quota)
+	}
+	if f := fanOut(p.Sink); f != nil && !p.DryRun {
+		f.Deliveries = deliveries.NewStore(db.Write, db.Dialect, cfg.Fanout)
+	}
+	if !cfg.Audit.Enabled || p.DryRun {
+		return func() {}
+	}
+	p.Audit = audit.Open(db.Write, db.Dialect, cfg.Audit)
+	for _, h := range httpSinks(p.Sink) {
+		h.Audit = p.Audit
+	}
+	return func() {
+		if c, ok := p.Audit.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// Send the notifiers the summary of a run that could not even start
+func notifyFailure(ctx context.Context, cfg *config.Config, err error) {
+	now := time.Now()
+	s := &pipeline.Summary{Started: now, Finished: now, FailedInvoices: []string{}, Error: err.Error()}
+	for _, n := range notify.New(cfg) {
+		if nerr := n.Notify(context.WithoutCancel(ctx), s); nerr != nil {
+			slog.Error("Failed to send run summary", "notifier", fmt.Sprintf("%T", n), "error", nerr)
+		}
+	}
+}
+
+func run(ctx context.Context, in *instance, listenMode bool) error {
+	if listenMode {
+		return runListener(ctx, in)
+	}
+	return in.p.Run(ctx)
+}
+
+// Push the invoices announced by NOTIFY, webhooks or both
+func runListener(ctx context.Context, in *instance) error {
+	cfg := in.cfg
+	var events []<-chan string
+	if in.notify {
+		l, err := source.NewListener(cfg.Database, cfg.Listen.Channel)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		slog.Info("Listening for notifications", "channel", cfg.Listen.Channel)
+		events = append(events, l.Events(ctx))
+	}
+	if in.webhook != nil {
+		slog.Info("Receiving webhooks", "listen", cfg.Webhook.Listen, "path", cfg.Webhook.Path)
+		events = append(events, in.webhook.events)
+	}
+	return in.p.Listen(ctx, mergeEvents(events))
+}
+
+// Merge the invoice numbers of every channel of events into one, closed
+// once all of them are
+func mergeEvents(events []<-chan string) <-chan string {
+	if len(events) == 1 {
+		return events[0]
+	}
+	out := make(chan string)
+	var wg sync.WaitGroup
+	for _, ch := range events {
+		wg.Add(1)
+		go func(ch <-chan string) {
+			defer wg.Done()
+			for e := range ch {
+				out <- e
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
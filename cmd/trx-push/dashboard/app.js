@@ -0,0 +1,108 @@
+// Calls the admin API with the token kept for the browser session
+"use strict";
+
+function token() {
+  let t = sessionStorage.getItem("trx-push-token");
+  if (!t) {
+    t = prompt("Admin token") || "";
+    sessionStorage.setItem("trx-push-token", t);
+  }
+  return t;
+}
+
+async function api(method, path) {
+  const resp = await fetch("../" + path, { method, headers: { Authorization: "Bearer " + token() } });
+  if (resp.status === 401) {
+    sessionStorage.removeItem("trx-push-token");
+  }
+  const body = await resp.json();
+  if (!resp.ok && resp.status !== 502) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return body;
+}
+
+function show(text, error) {
+  const m = document.getElementById("message");
+  m.textContent = text;
+  m.className = error ? "error" : "";
+}
+
+function row(tbody, cells, failed) {
+  const tr = tbody.insertRow();
+  for (const c of cells) {
+    const td = tr.insertCell();
+    td.textContent = c;
+    if (failed) {
+      td.className = "failed";
+    }
+  }
+}
+
+async function loadRuns() {
+  const summaries = await api("GET", "summaries");
+  const tbody = document.querySelector("#runs tbody");
+  tbody.replaceChildren();
+  for (const s of summaries) {
+    row(tbody, [new Date(s.started_at).toLocaleString(), s.duration_seconds.toFixed(1) + "s", s.fetched, s.pushed,
+      s.failed, s.parked, s.review, s.failed_invoices.join(", "), s.error || ""], s.failed > 0 || s.error);
+  }
+  if (summaries.length > 0) {
+    document.getElementById("backlog").textContent = summaries[0].fetched;
+    document.getElementById("backlog-at").textContent = "at " + new Date(summaries[0].started_at).toLocaleString();
+  }
+}
+
+async function loadHistory(invoice) {
+  const history = await api("GET", "history/" + encodeURIComponent(invoice));
+  const tbody = document.querySelector("#history tbody");
+  tbody.replaceChildren();
+  for (const h of history) {
+    row(tbody, [new Date(h.at).toLocaleString(), h.status, h.http_code, h.reason], h.status !== "success");
+  }
+  if (history.length === 0) {
+    show("No results for " + invoice);
+  }
+}
+
+function guard(f) {
+  return async (event) => {
+    if (event) {
+      event.preventDefault();
+    }
+    try {
+      await f();
+    } catch (e) {
+      show(e.message, true);
+    }
+  };
+}
+
+document.getElementById("lookup").addEventListener("submit", guard(async () => {
+  show("");
+  await loadHistory(document.getElementById("invoice").value.trim());
+}));
+
+document.getElementById("retry").addEventListener("click", guard(async () => {
+  const invoice = document.getElementById("invoice").value.trim();
+  if (!invoice) {
+    return;
+  }
+  show("Pushing " + invoice + "…");
+  const r = await api("POST", "push/" + encodeURIComponent(invoice));
+  show(invoice + ": " + (r.status || "not pushed") + (r.error ? " (" + r.error + ")" : ""), r.status !== "success");
+  await loadHistory(invoice);
+}));
+
+document.getElementById("run").addEventListener("click", guard(async () => {
+  const run = await api("POST", "runs");
+  show("Run " + run.id + " started");
+}));
+
+document.getElementById("logout").addEventListener("click", () => {
+  sessionStorage.removeItem("trx-push-token");
+  show("Token forgotten");
+});
+
+guard(loadRuns)();
+setInterval(guard(loadRuns), 10000);
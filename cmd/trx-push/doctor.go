@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/httpclient"
+	"github.com/purwaren/trx-push/schema"
+	"github.com/purwaren/trx-push/source"
+)
+
+func doctorCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("doctor")
+	var o options
+	o.register(fs)
+	maxSkew := fs.Duration("max-skew", 30*time.Second, "largest difference from the API clock that passes")
+	minValidity := fs.Duration("min-validity", 14*24*time.Hour, "shortest remaining validity of the API certificates that passes")
+	timeout := fs.Duration("timeout", 10*time.Second, "limit of each network and database check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{}
+	o.allTenants = true
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	var c checker
+	for _, tc := range tenantConfigs(cfg) {
+		prefix, client := "", httpClient
+		if len(cfg.Tenants) > 0 {
+			prefix, client = "tenant "+tc.Tenant+": ", &http.Client{}
+			if _, err := o.loadTenant(ctx, tc, client); err != nil {
+				c.report(prefix+"secrets", err)
+				continue
+			}
+		}
+		d := doctor{checker: &c, cfg: tc, client: client, prefix: prefix, timeout: *timeout}
+		hosts := d.hosts()
+		for _, h := range hosts {
+			d.dns(ctx, h)
+		}
+		for _, h := range hosts {
+			if h.Scheme == "https" {
+				d.tls(h, *minValidity)
+			}
+		}
+		if len(hosts) > 0 {
+			d.clock(ctx, hosts[0], *maxSkew)
+		}
+		if tc.Source.Type == "database" {
+			d.database(ctx)
+		}
+	}
+	if c.failed > 0 {
+		return fmt.Errorf("%d check(s) failed", c.failed)
+	}
+	return nil
+}
+
+// doctor runs the diagnostics of one config
+type doctor struct {
+	*checker
+	cfg     *config.Config
+	client  *http.Client
+	prefix  string
+	timeout time.Duration
+}
+
+// The scheme and host of every endpoint, each once, in the order of
+// config.Endpoints
+func (d *doctor) hosts() []*url.URL {
+	var hosts []*url.URL
+	seen := make(map[string]bool)
+	for _, e := range d.cfg.Endpoints() {
+		u, err := url.Parse(e.URL)
+		if err != nil || u.Host == "" || seen[u.Scheme+u.Host] {
+			continue
+		}
+		seen[u.Scheme+u.Host] = true
+		hosts = append(hosts, &url.URL{Scheme: u.Scheme, Host: u.Host})
+	}
+	return hosts
+}
+
+func (d *doctor) dns(ctx context.Context, h *url.URL) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	name := d.prefix + "dns " + h.Hostname()
+	if net.ParseIP(h.Hostname()) != nil {
+		d.report(name, nil)
+		return
+	}
+	_, err := net.DefaultResolver.LookupHost(ctx, h.Hostname())
+	hint := "check the resolvers of the host (/etc/resolv.conf) and the spelling of the URL"
+	if d.cfg.HTTP.ProxyURL != "" {
+		hint += "; requests go through http.proxy_url, which may resolve it even if this host cannot"
+	}
+	d.reportHint(name, err, hint)
+}
+
+// Verify the certificate chain of h as the HTTP client does, and that it
+// does not expire within minValidity
+func (d *doctor) tls(h *url.URL, minValidity time.Duration) {
+	name := d.prefix + "tls " + h.Host
+	t, err := httpclient.NewTLSConfig(d.cfg.TLS)
+	if err != nil {
+		d.reportHint(name, err, "check tls.cert_file, tls.key_file and tls.ca_file")
+		return
+	}
+	t.ServerName = h.Hostname()
+	addr := h.Host
+	if h.Port() == "" {
+		addr = net.JoinHostPort(h.Hostname(), "443")
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: d.timeout}, "tcp", addr, t)
+	if err != nil {
+		d.reportHint(name, err, "a private or self-signed CA goes in tls.ca_file; a corporate TLS proxy needs its CA there too")
+		return
+	}
+	defer conn.Close()
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if left := time.Until(leaf.NotAfter); left < minValidity {
+		d.reportHint(name, fmt.Errorf("certificate expires %s, in %d day(s)", leaf.NotAfter.Format(time.DateOnly), int(left.Hours()/24)),
+			"ask the API provider to renew it before pushes start failing")
+		return
+	}
+	d.report(name, nil)
+}
+
+// Compare the Date of an answer of h with the local clock. JWT expiry and
+// signed request timestamps are checked against the API clock.
+func (d *doctor) clock(ctx context.Context, h *url.URL, maxSkew time.Duration) {
+	name := d.prefix + "clock"
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.String()+"/", nil)
+	if err != nil {
+		d.report(name, err)
+		return
+	}
+	sent := time.Now()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.reportHint(name, fmt.Errorf("failed to reach %s: %v", h.Host, err), "fix the dns and tls checks first")
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.skip(name, h.Host+" sent no Date header")
+		return
+	}
+	// The Date is truncated to the second, taken halfway through
+	local := sent.Add(time.Since(sent) / 2)
+	skew := local.Sub(remote)
+	if skew < -maxSkew-time.Second || skew > maxSkew+time.Second {
+		d.reportHint(name, fmt.Errorf("local clock is %s off from %s", skew.Round(time.Second), h.Host),
+			"sync the clock with NTP (timedatectl set-ntp true, or w32tm /resync on Windows); tokens and signatures are rejected otherwise")
+		return
+	}
+	d.report(name, nil)
+}
+
+// Check that the invoice table has the configured columns and that the
+// database user may change it
+func (d *doctor) database(ctx context.Context) {
+	name := d.prefix + "database"
+	db, err := source.Open(d.cfg)
+	if err != nil {
+		d.report(name, err)
+		return
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	if err := db.Write.PingContext(ctx); err != nil {
+		d.reportHint(name, err, "check the database section, and that the host accepts connections from here")
+		return
+	}
+	d.report(name, nil)
+
+	q := d.cfg.Query
+	columns, err := schema.Columns(ctx, db.Read, db.Dialect, q.Table)
+	if err != nil {
+		d.reportHint(d.prefix+"select "+q.Table, err,
+			fmt.Sprintf("check that query.table is right and run GRANT SELECT ON %s TO %s", q.Table, d.cfg.Database.User))
+		return
+	}
+	d.report(d.prefix+"select "+q.Table, nil)
+
+	var missing []string
+	for _, col := range d.requiredColumns() {
+		if !slices.ContainsFunc(columns, func(c string) bool { return strings.EqualFold(c, col.name) }) {
+			missing = append(missing, fmt.Sprintf("%s (%s)", col.name, col.key))
+		}
+	}
+	if len(missing) > 0 {
+		d.reportHint(d.prefix+"columns", fmt.Errorf("%s has no column %s", q.Table, strings.Join(missing, ", ")),
+			"fix the setting in parentheses or add the column; the table has "+strings.Join(columns, ", "))
+	} else {
+		d.report(d.prefix+"columns", nil)
+	}
+
+	privileges := []string{"UPDATE"}
+	if h := d.cfg.History; h.Enabled && h.Mode == "move" {
+		privileges = append(privileges, "DELETE")
+	}
+	d.reportHint(d.prefix+strings.ToLower(strings.Join(privileges, " and "))+" "+q.Table, d.canWrite(ctx, db),
+		fmt.Sprintf("run GRANT %s ON %s TO %s, or fix status_update", strings.Join(privileges, ", "), q.Table, d.cfg.Database.User))
+}
+
+type column struct {
+	key, name string
+}
+
+// The columns of query.table the settings name
+func (d *doctor) requiredColumns() []column {
+	q := d.cfg.Query
+	cols := []column{{"query.id_column", q.IDColumn}, {"query.status_column", q.StatusColumn}}
+	optional := []column{
+		{"query.priority_column", q.PriorityColumn},
+		{"query.push_after_column", q.PushAfterColumn},
+		{"query.created_column", q.CreatedColumn},
+		{"grouping.column", d.cfg.Grouping.Column},
+	}
+	if d.cfg.Watermark.Enabled {
+		optional = append(optional, column{"watermark.column", d.cfg.Watermark.Column})
+	}
+	if d.cfg.Capture.Update == "" {
+		for i, f := range d.cfg.Capture.Fields {
+			optional = append(optional, column{fmt.Sprintf("capture.fields[%d].column", i), f.Column})
+		}
+	}
+	for _, c := range optional {
+		if c.name != "" {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// Try the statements of a push on no row, in a transaction rolled back
+func (d *doctor) canWrite(ctx context.Context, db *source.Database) error {
+	tx, err := db.Write.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	table, status := db.Dialect.QuoteQualified(d.cfg.Query.Table), db.Dialect.Quote(d.cfg.Query.StatusColumn)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = %s WHERE 1 = 0", table, status, status)); err != nil {
+		return err
+	}
+	if h := d.cfg.History; h.Enabled {
+		columns, into := "*", ""
+		if len(h.Columns) > 0 {
+			quoted := make([]string, len(h.Columns))
+			for i, c := range h.Columns {
+				quoted[i] = db.Dialect.Quote(c)
+			}
+			columns = strings.Join(quoted, ", ")
+			into = " (" + columns + ")"
+		}
+		insert := fmt.Sprintf("INSERT INTO %s%s SELECT %s FROM %s WHERE 1 = 0", db.Dialect.QuoteQualified(h.Table), into, columns, table)
+		if _, err := tx.ExecContext(ctx, insert); err != nil {
+			return fmt.Errorf("history.table: %v", err)
+		}
+		if h.Mode == "move" {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE 1 = 0", table)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
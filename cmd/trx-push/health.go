@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// health answers the liveness and readiness probes of an orchestrator
+type health struct {
+	cfg config.HealthConfig
+	// Pinged under their names, "database" or one per tenant
+	dbs    map[string]*sql.DB
+	client *http.Client
+
+	// The last API check, reused for api_cache
+	mu      sync.Mutex
+	checked time.Time
+	apiErr  error
+}
+
+func (h *health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, h.pingDBs(r.Context()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks := h.pingDBs(r.Context())
+		if h.cfg.APIURL != "" {
+			checks["api"] = h.checkAPI(r.Context())
+		}
+		respond(w, checks)
+	})
+}
+
+func (h *health) pingDBs(ctx context.Context) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	checks := make(map[string]error)
+	for name, db := range h.dbs {
+		checks[name] = db.PingContext(ctx)
+	}
+	return checks
+}
+
+// Whether the API answered within api_cache, asking it again when the
+// last answer is older
+func (h *health) checkAPI(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checked) < h.cfg.APICache {
+		return h.apiErr
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	h.apiErr = h.requestAPI(ctx)
+	h.checked = time.Now()
+	return h.apiErr
+}
+
+func (h *health) requestAPI(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.cfg.APIURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Write the result of checks as JSON, with 503 when one of them failed
+func respond(w http.ResponseWriter, checks map[string]error) {
+	body := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+	for name, err := range checks {
+		body.Checks[name] = "ok"
+		if err != nil {
+			body.Checks[name] = err.Error()
+			body.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,266 @@
+//go:build integration
+
+// Integration tests running the push command against Postgres in Docker
+// and the mock API. They need a Docker daemon:
+//
+//	go test -tags integration ./cmd/trx-push/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+const (
+	loginPath = "/v1/dashboard/auth/login"
+	pushPath  = "/v1/pos/push-transaction"
+)
+
+var (
+	testDB   *sql.DB
+	testPort string
+)
+
+func TestMain(m *testing.M) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Fatalf("failed to connect to Docker: %v", err)
+	}
+	if err := pool.Client.Ping(); err != nil {
+		log.Fatalf("failed to connect to Docker: %v", err)
+	}
+	pg, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "16-alpine",
+		Env:        []string{"POSTGRES_PASSWORD=postgres", "POSTGRES_DB=mpos"},
+	}, func(hc *docker.HostConfig) {
+		hc.AutoRemove = true
+		hc.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		log.Fatalf("failed to start Postgres: %v", err)
+	}
+	// Removed by Docker even if the tests are killed
+	pg.Expire(600)
+
+	testPort = pg.GetPort("5432/tcp")
+	dsn := fmt.Sprintf("host=localhost port=%s user=postgres password=postgres dbname=mpos sslmode=disable", testPort)
+	pool.MaxWait = 60 * time.Second
+	err = pool.Retry(func() error {
+		if testDB, err = sql.Open("pgx", dsn); err != nil {
+			return err
+		}
+		return testDB.Ping()
+	})
+	if err != nil {
+		pool.Purge(pg)
+		log.Fatalf("Postgres did not come up: %v", err)
+	}
+
+	code := m.Run()
+	testDB.Close()
+	pool.Purge(pg)
+	os.Exit(code)
+}
+
+// Create table with n pending invoices numbered <table>-1 to <table>-n
+func seedInvoices(t *testing.T, table string, n int) {
+	t.Helper()
+	_, err := testDB.Exec(fmt.Sprintf(`CREATE TABLE %s (
+	number TEXT PRIMARY KEY,
+	status INTEGER NOT NULL,
+	date TIMESTAMPTZ NOT NULL DEFAULT now()
+)`, table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		if _, err := testDB.Exec(fmt.Sprintf("INSERT INTO %s (number, status) VALUES ($1, 1)", table), fmt.Sprintf("%s-%d", table, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The number of invoices of table in each status
+func statusCounts(t *testing.T, table string) map[int]int {
+	t.Helper()
+	rows, err := testDB.Query(fmt.Sprintf("SELECT status, count(*) FROM %s GROUP BY status", table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	counts := make(map[int]int)
+	for rows.Next() {
+		var status, n int
+		if err := rows.Scan(&status, &n); err != nil {
+			t.Fatal(err)
+		}
+		counts[status] = n
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+// Run the push command on the invoices of table against api, with extra
+// appended to the config
+func runPush(t *testing.T, table string, api *mockAPI, extra string) error {
+	t.Helper()
+	srv := httptest.NewServer(api.handler(loginPath, pushPath))
+	t.Cleanup(srv.Close)
+
+	cfg := fmt.Sprintf(`api:
+  login_url: "%[1]s%[2]s"
+  push_url: "%[1]s%[3]s"
+  username: "pos@example.com"
+  password: "secret"
+database:
+  host: localhost
+  port: %[4]s
+  user: postgres
+  password: postgres
+  dbname: mpos
+  sslmode: disable
+query:
+  table: %[5]s
+status_update:
+  on_success: "UPDATE %[5]s SET status = 2 WHERE number = $1"
+retry:
+  max_attempts: 2
+  base_delay: 1ms
+  max_delay: 5ms
+concurrency: 4
+%[6]s`, srv.URL, loginPath, pushPath, testPort, table, extra)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(cfg), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return runCommand(ctx, []string{"-config", path})
+}
+
+func TestPushMarksInvoicesPushed(t *testing.T) {
+	seedInvoices(t, "pushed_ok", 25)
+	api := newMockAPI()
+	if err := runPush(t, "pushed_ok", api, ""); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if got := statusCounts(t, "pushed_ok"); got[2] != 25 || len(got) != 1 {
+		t.Errorf("statuses = %v, want all 25 invoices in status 2", got)
+	}
+	if s := api.snapshot(); s.Invoices != 25 || s.Duplicates != 0 {
+		t.Errorf("mock stats = %+v, want 25 invoices without duplicates", s)
+	}
+
+	// Nothing is pending any more, so a second run pushes nothing
+	if err := runPush(t, "pushed_ok", api, ""); err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	if s := api.snapshot(); s.Pushed != 25 {
+		t.Errorf("mock pushes = %d after the second run, want still 25", s.Pushed)
+	}
+}
+
+func TestFailedPushesStayPending(t *testing.T) {
+	seedInvoices(t, "pushed_failing", 5)
+	api := newMockAPI()
+	api.failureRate = 1
+	err := runPush(t, "pushed_failing", api, "")
+	var pushes *failedPushes
+	if !errors.As(err, &pushes) || exitCode(err) != exitAllFailed {
+		t.Fatalf("run error = %v, want all pushes failed", err)
+	}
+	if got := statusCounts(t, "pushed_failing"); got[1] != 5 {
+		t.Errorf("statuses = %v, want all 5 invoices still pending", got)
+	}
+	// Every invoice got max_attempts requests
+	if s := api.snapshot(); s.Failed != 10 {
+		t.Errorf("mock failures = %d, want 10", s.Failed)
+	}
+}
+
+func TestRejectedPushesAreParked(t *testing.T) {
+	seedInvoices(t, "pushed_rejected", 4)
+	api := newMockAPI()
+	api.rejectRate = 1
+	err := runPush(t, "pushed_rejected", api, `push:
+  permanent_codes: ["422"]
+  parked_status: 9
+`)
+	if exitCode(err) != exitAllFailed {
+		t.Fatalf("run error = %v, want all pushes failed", err)
+	}
+	if got := statusCounts(t, "pushed_rejected"); got[9] != 4 {
+		t.Errorf("statuses = %v, want all 4 invoices parked in status 9", got)
+	}
+	// Permanent failures are not retried
+	if s := api.snapshot(); s.Rejected != 4 {
+		t.Errorf("mock rejections = %d, want 4", s.Rejected)
+	}
+}
+
+func TestPartialFailuresExitPartial(t *testing.T) {
+	seedInvoices(t, "pushed_partial", 40)
+	api := newMockAPI()
+	api.failureRate = 0.5
+	err := runPush(t, "pushed_partial", api, "retry: {max_attempts: 1}\n")
+	got := statusCounts(t, "pushed_partial")
+	if got[1]+got[2] != 40 || got[1] == 0 || got[2] == 0 {
+		t.Fatalf("statuses = %v, want a mix of pending and pushed", got)
+	}
+	if exitCode(err) != exitPartial {
+		t.Errorf("exit code = %d for %v, want %d", exitCode(err), err, exitPartial)
+	}
+	if s := api.snapshot(); s.Invoices != got[2] {
+		t.Errorf("mock saw %d invoices pushed, the table %d", s.Invoices, got[2])
+	}
+}
+
+func TestResultsAndRunsAreRecorded(t *testing.T) {
+	seedInvoices(t, "pushed_history", 3)
+	api := newMockAPI()
+	extra := `results: {enabled: true, table: pushed_history_results}
+runs: {enabled: true, table: pushed_history_runs}
+`
+	path := filepath.Join(t.TempDir(), "migrate.yaml")
+	migrate := fmt.Sprintf("database: {host: localhost, port: %s, user: postgres, password: postgres, dbname: mpos, sslmode: disable}\n%s", testPort, extra)
+	if err := os.WriteFile(path, []byte(migrate), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCommand(context.Background(), []string{"-config", path, "-migrate"}); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if err := runPush(t, "pushed_history", api, extra); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	var results int
+	if err := testDB.QueryRow("SELECT count(*) FROM pushed_history_results WHERE status = 'success'").Scan(&results); err != nil {
+		t.Fatal(err)
+	}
+	if results != 3 {
+		t.Errorf("success results = %d, want 3", results)
+	}
+	var trigger string
+	var pushed int
+	if err := testDB.QueryRow("SELECT triggered_by, pushed FROM pushed_history_runs").Scan(&trigger, &pushed); err != nil {
+		t.Fatal(err)
+	}
+	if trigger != "once" || pushed != 3 {
+		t.Errorf("run = %s with %d pushed, want once with 3", trigger, pushed)
+	}
+}
@@ -0,0 +1,574 @@
+// Command trx-push pushes pending invoices from the POS database to the
+// transaction API.
+//
+// Usage:
+//
+//	trx-push [run] [flags]      push the pending invoices once
+//	trx-push serve [flags]      keep pushing on schedule or as invoices are announced
+//	trx-push push [flags]       push one invoice with -invoice, whatever its status
+//	trx-push status [flags]     show the backlog and recent push results
+//	trx-push requeue [flags]    move dead-lettered invoices back to pending
+//	trx-push replay [flags]     resend requests recorded in the audit log
+//	trx-push reconcile [flags]  compare pushed invoices with the ones the API lists
+//	trx-push pull [flags]       store the status of pushed invoices fetched from the API
+//	trx-push sync [flags]       push and pull in turn, resolving conflicts by sync.conflict
+//	trx-push mockserver [flags] serve a mock login and push API for trying trx-push out
+//	trx-push bench [flags]      measure push throughput and latency with synthetic invoices
+//	trx-push check [flags]      validate the config and test the database, login and API
+//	trx-push doctor [flags]     diagnose clock skew, DNS, TLS and database permissions
+//	trx-push migrate [flags]    create or upgrade the tables trx-push keeps its records in
+//	trx-push prune [flags]      delete old runs, audit entries and dead letters
+//	trx-push secret <action>    store or delete a credential in the OS keyring
+//	trx-push service <action>   install, uninstall, start or stop the Windows service or systemd unit
+//	trx-push version            print the version, commit, build date and Go version
+//
+// Running without a command is the same as run.
+//
+// Exit codes:
+//
+//	0   all invoices were pushed
+//	1   config or other error
+//	2   database error
+//	3   some invoices were not pushed
+//	4   no invoice was pushed, all of them failed
+//	5   login failed or the API rejected the credentials
+//	130 interrupted by a signal
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/httpclient"
+	"github.com/purwaren/trx-push/logging"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/progress"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/secrets"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Exit codes, see the package documentation
+const (
+	exitFailure     = 1
+	exitDatabase    = 2
+	exitPartial     = 3
+	exitAllFailed   = 4
+	exitAuth        = 5
+	exitInterrupted = 130
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{"run", "push the pending invoices once", runCommand},
+	{"serve", "keep pushing on schedule, or as invoices are announced with -listen", serveCommand},
+	{"push", "push the invoice -invoice whatever its status, with -force also past validation, attempts.max and the quotas", pushCommand},
+	{"status", "show the backlog, the last run and recent push results", statusCommand},
+	{"requeue", "move dead-lettered invoices back to pending, with -invoice or -all", requeueCommand},
+	{"replay", "resend the requests recorded in the audit log, with -run or -invoice", replayCommand},
+	{"reconcile", "compare the invoices pushed from -from to -to with the API listing, with -repush for the gaps", reconcileCommand},
+	{"pull", "fetch the status of the invoices of pull.query and store it with them", pullCommand},
+	{"sync", "push the pending invoices, then pull the status of the pushed ones, resolving conflicts by sync.conflict", syncCommand},
+	{"mockserver", "serve a mock login and push API with configurable failures and latency", mockServerCommand},
+	{"bench", "push -count synthetic invoices with -concurrency workers and report throughput and latency", benchCommand},
+	{"check", "validate the config, test the database connection and login, and with -api call a harmless endpoint", checkCommand},
+	{"doctor", "check clock skew, DNS and TLS of the API hosts, and the columns and permissions of the invoice table, with hints", doctorCommand},
+	{"migrate", "create or upgrade the results, dead-letter, attempts, runs, audit and fanout tables, or list their migrations with -status", migrateCommand},
+	{"prune", "delete the runs, audit entries and dead letters older than their retention, or -older-than", pruneCommand},
+	{"secret", "set or delete a credential in the OS keyring, referenced from the config as keyring:<name>", secretCommand},
+	{"service", "install, uninstall, start or stop serve as a Windows service or a systemd unit with Type=notify", serviceCommand},
+	{"version", "print the version, git commit, build date and Go version", versionCommand},
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	if len(args) == 1 && (args[0] == "-version" || args[0] == "--version") {
+		name, args = "version", nil
+	}
+	httpclient.UserAgent = userAgent()
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(exitFailure)
+	}
+
+	// On SIGINT/SIGTERM finish in-flight pushes, skip the rest and exit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	var err error
+	if inService() {
+		err = runService(ctx, func(ctx context.Context) error { return cmd.run(ctx, args) })
+	} else {
+		err = cmd.run(ctx, args)
+	}
+	stop()
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return
+	case errors.Is(err, pipeline.ErrInterrupted):
+		slog.Warn(err.Error())
+	default:
+		slog.Error(err.Error())
+	}
+	os.Exit(exitCode(err))
+}
+
+func exitCode(err error) int {
+	var fetch *pipeline.FetchError
+	var db *databaseError
+	var login *pipeline.LoginError
+	var pushes *failedPushes
+	switch {
+	case errors.Is(err, pipeline.ErrInterrupted):
+		return exitInterrupted
+	case errors.As(err, &fetch), errors.As(err, &db):
+		return exitDatabase
+	case errors.As(err, &login):
+		return exitAuth
+	case errors.As(err, &pushes):
+		if pushes.pushed == 0 {
+			return exitAllFailed
+		}
+		return exitPartial
+	}
+	return exitFailure
+}
+
+// databaseError is a failed database operation of a command
+type databaseError struct {
+	err error
+}
+
+func (e *databaseError) Error() string { return e.err.Error() }
+
+func (e *databaseError) Unwrap() error { return e.err }
+
+func dbErrorf(format string, args ...interface{}) error {
+	return &databaseError{fmt.Errorf(format, args...)}
+}
+
+// failedPushes ends a one-off run in which some invoices were not pushed
+type failedPushes struct {
+	failed, pushed int
+}
+
+func (e *failedPushes) Error() string {
+	return fmt.Sprintf("%d of %d invoices were not pushed", e.failed, e.failed+e.pushed)
+}
+
+// The error of a run that ended with summary s
+func checkPushes(s *pipeline.Summary) error {
+	if s == nil || s.NotPushed() == 0 {
+		return nil
+	}
+	return &failedPushes{failed: s.NotPushed(), pushed: s.Pushed}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: trx-push <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'trx-push <command> -h' for the flags of a command.\n")
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	// Parse errors are returned, so they exit with exitFailure
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trx-push %s [flags]\n\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// Flags shared by all commands. The config and log flags override the
+// matching config.yaml values when set.
+type options struct {
+	config         string
+	profile        string
+	configAuth     string
+	configTimeout  time.Duration
+	configCache    string
+	configFallback bool
+	logLevel       string
+	debug          bool
+	concurrency    int
+	chaos          float64
+	logHTTP        bool
+	tenant         string
+
+	// Set by the commands pushing for every tenant of a config with
+	// tenants; the others need -tenant
+	allTenants bool
+	// Set by load when secrets.backend is configured. With tenants they
+	// are loaded per tenant by loadTenant instead.
+	secrets *loadedSecrets
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.config, "config", envOr("TRX_PUSH_CONFIG", "config.yaml"), "config file path or http(s):// URL")
+	fs.StringVar(&o.profile, "profile", os.Getenv("TRX_PUSH_PROFILE"), "config profile to merge over the shared settings, e.g. staging")
+	fs.StringVar(&o.configAuth, "config-auth", os.Getenv("TRX_PUSH_CONFIG_AUTH"), "Authorization header value sent when fetching a remote config")
+	fs.DurationVar(&o.configTimeout, "config-timeout", envDuration("TRX_PUSH_CONFIG_TIMEOUT", 10*time.Second), "timeout for fetching a remote config")
+	fs.StringVar(&o.configCache, "config-cache", os.Getenv("TRX_PUSH_CONFIG_CACHE"), "file where the last fetched remote config is cached")
+	fs.BoolVar(&o.configFallback, "config-fallback", true, "use the cached remote config when the fetch fails")
+	fs.StringVar(&o.logLevel, "log-level", "", "debug, info, warn or error, overriding log.level")
+	fs.BoolVar(&o.debug, "debug", os.Getenv("TRX_PUSH_DEBUG") != "", "same as -log-level debug")
+	fs.IntVar(&o.concurrency, "concurrency", 0, "parallel push workers, overriding concurrency")
+	fs.Float64Var(&o.chaos, "chaos", 0, "share of requests to fail on purpose, overriding http.chaos.rate; for testing only")
+	fs.BoolVar(&o.logHTTP, "log-http", false, "log every HTTP request and response with credentials redacted, same as http.log")
+	fs.StringVar(&o.tenant, "tenant", os.Getenv("TRX_PUSH_TENANT"), "tenant of the tenants section to work on")
+}
+
+// Load the config, apply the flag overrides, set up logging and fill in
+// credentials from the secret store
+func (o *options) load(ctx context.Context, client *http.Client) (*config.Config, error) {
+	cfg, err := config.Load(o.config, o.profile, config.RemoteOptions{
+		Client:    client,
+		Auth:      o.configAuth,
+		Timeout:   o.configTimeout,
+		CachePath: o.configCache,
+		Fallback:  o.configFallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	switch {
+	case o.tenant != "":
+		if cfg, err = cfg.ForTenant(o.tenant); err != nil {
+			return nil, err
+		}
+	case len(cfg.Tenants) > 0 && !o.allTenants:
+		return nil, errors.New("the config has tenants, choose one with -tenant")
+	}
+	if o.chaos > 1 {
+		return nil, fmt.Errorf("-chaos must be between 0 and 1, got %v", o.chaos)
+	}
+	for _, c := range append([]*config.Config{cfg}, cfg.Tenants...) {
+		o.override(c)
+	}
+	if err := logging.Setup(progress.Stderr(), cfg.Log); err != nil {
+		return nil, fmt.Errorf("failed to set up logging: %v", err)
+	}
+	// Tuned once; a reload keeps the transport in use
+	if client.Transport == nil {
+		if err := httpclient.Configure(client, cfg); err != nil {
+			return nil, fmt.Errorf("failed to set up the HTTP client: %v", err)
+		}
+	}
+	if len(cfg.Tenants) > 0 {
+		return cfg, nil
+	}
+	if o.secrets, err = loadSecrets(ctx, cfg, client); err != nil {
+		return nil, err
+	}
+	if err := secrets.ResolveAWS(ctx, cfg); err != nil {
+		return nil, err
+	}
+	if err := secrets.ResolveKeyring(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Apply the flags overriding config values to cfg
+func (o *options) override(cfg *config.Config) {
+	if o.logLevel != "" {
+		cfg.Log.Level = o.logLevel
+	}
+	if o.debug {
+		cfg.Log.Level = "debug"
+	}
+	if o.concurrency > 0 {
+		cfg.Concurrency = o.concurrency
+	}
+	if o.chaos > 0 {
+		cfg.HTTP.Chaos.Rate = o.chaos
+	}
+	if o.logHTTP {
+		cfg.HTTP.Log = true
+	}
+}
+
+// Finish loading the tenant config cfg, loaded by load with allTenants:
+// tune client, the tenant's own, and fill in the credentials from its
+// secret store
+func (o *options) loadTenant(ctx context.Context, cfg *config.Config, client *http.Client) (*loadedSecrets, error) {
+	if client.Transport == nil {
+		if err := httpclient.Configure(client, cfg); err != nil {
+			return nil, fmt.Errorf("tenant %s: failed to set up the HTTP client: %v", cfg.Tenant, err)
+		}
+	}
+	s, err := loadSecrets(ctx, cfg, client)
+	if err == nil {
+		err = secrets.ResolveAWS(ctx, cfg)
+	}
+	if err == nil {
+		err = secrets.ResolveKeyring(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %v", cfg.Tenant, err)
+	}
+	return s, nil
+}
+
+// The configs pushed for, those of the tenants when cfg has any
+func tenantConfigs(cfg *config.Config) []*config.Config {
+	if len(cfg.Tenants) > 0 {
+		return cfg.Tenants
+	}
+	return []*config.Config{cfg}
+}
+
+// Open the source.type source; db is the database source, unless the
+// invoices are read from shards
+func openSource(ctx context.Context, cfg *config.Config, db *source.Database) (source.Source, error) {
+	switch cfg.Source.Type {
+	case "file":
+		return source.NewFile(cfg.Source.File), nil
+	case "kafka":
+		k, err := source.NewKafka(cfg.Source.Kafka)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the Kafka consumer: %v", err)
+		}
+		return k, nil
+	case "amqp":
+		return source.NewAMQP(cfg.Source.AMQP), nil
+	case "sqs":
+		return source.NewSQS(ctx, cfg.Source.SQS)
+	case "nats":
+		n, err := source.NewNATS(cfg.Source.NATS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the NATS consumer: %v", err)
+		}
+		return n, nil
+	case "pubsub":
+		ps, err := source.NewPubSub(ctx, cfg.Source.PubSub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up the Pub/Sub subscriber: %v", err)
+		}
+		return ps, nil
+	default:
+		if len(cfg.Shards) > 0 {
+			s, err := source.OpenShards(cfg)
+			if err != nil {
+				return nil, dbErrorf("failed to open shards: %v", err)
+			}
+			return s, nil
+		}
+		if cfg.Redis.Queue.Enabled {
+			return source.NewRedisQueue(db, cfg), nil
+		}
+		return db, nil
+	}
+}
+
+// Close src unless it is the database, which the caller closes
+func closeSource(src source.Source) {
+	if _, ok := src.(*source.Database); ok {
+		return
+	}
+	if c, ok := src.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			slog.Error("Failed to close source", "error", err)
+		}
+	}
+}
+
+// The authenticator of api.auth_type, or none when no sink calls the API.
+// Fanout targets log in on their own.
+func newAuth(cfg *config.Config, client *http.Client) (auth.Authenticator, error) {
+	for _, sink := range append([]string{cfg.Sink.Type}, cfg.Sink.Also...) {
+		if (sink == "http" && len(cfg.Fanout.Targets) == 0) || sink == "graphql" || sink == "soap" || (sink == "grpc" && cfg.Sink.GRPC.Auth) {
+			return auth.New(cfg.API, client)
+		}
+	}
+	return auth.None{}, nil
+}
+
+// The sink.type sink, followed by the sink.also ones
+func newSink(cfg *config.Config, client *http.Client, login auth.Authenticator) (pusher.Sink, error) {
+	tee := &pusher.Tee{}
+	for _, name := range append([]string{cfg.Sink.Type}, cfg.Sink.Also...) {
+		var sink pusher.Sink
+		switch name {
+		case "file":
+			sink = pusher.NewFile(cfg)
+		case "graphql":
+			sink = pusher.NewGraphQL(cfg, client, login)
+		case "soap":
+			sink = pusher.NewSOAP(cfg, client, login)
+		case "sftp":
+			sink = pusher.NewSFTP(cfg)
+		case "grpc":
+			a := login
+			if !cfg.Sink.GRPC.Auth {
+				a = auth.None{}
+			}
+			g, err := pusher.NewGRPC(cfg, client, a)
+			if err != nil {
+				tee.Close()
+				return nil, fmt.Errorf("failed to set up the gRPC client: %v", err)
+			}
+			sink = g
+		case "kafka":
+			k, err := pusher.NewKafka(cfg)
+			if err != nil {
+				tee.Close()
+				return nil, fmt.Errorf("failed to set up the Kafka producer: %v", err)
+			}
+			sink = k
+		case "nats":
+			n, err := pusher.NewNATS(cfg)
+			if err != nil {
+				tee.Close()
+				return nil, fmt.Errorf("failed to set up the NATS publisher: %v", err)
+			}
+			sink = n
+		case "pubsub":
+			ps, err := pusher.NewPubSub(cfg)
+			if err != nil {
+				tee.Close()
+				return nil, fmt.Errorf("failed to set up the Pub/Sub publisher: %v", err)
+			}
+			sink = ps
+		default:
+			if err := checkEncryption(cfg); err != nil {
+				tee.Close()
+				return nil, err
+			}
+			if len(cfg.Fanout.Targets) == 0 {
+				sink = pusher.NewHTTP(cfg, client, login)
+				break
+			}
+			f, err := pusher.NewFanOut(cfg, client)
+			if err != nil {
+				tee.Close()
+				return nil, fmt.Errorf("failed to set up fanout: %v", err)
+			}
+			sink = f
+		}
+		tee.Sinks = append(tee.Sinks, sink)
+	}
+	if len(tee.Sinks) == 1 {
+		return tee.Sinks[0], nil
+	}
+	return tee, nil
+}
+
+// The fan-out among the sinks of sink, nil without fanout targets
+func fanOut(sink pusher.Sink) *pusher.FanOut {
+	sinks := []pusher.Sink{sink}
+	if t, ok := sink.(*pusher.Tee); ok {
+		sinks = t.Sinks
+	}
+	for _, s := range sinks {
+		if f, ok := s.(*pusher.FanOut); ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// Load the api.encryption keys of the HTTP sink or the fanout targets, so
+// a bad one stops the start rather than every push
+func checkEncryption(cfg *config.Config) error {
+	if len(cfg.Fanout.Targets) == 0 {
+		if _, err := pusher.NewEncrypter(cfg.API.Encryption); err != nil {
+			return fmt.Errorf("api.encryption: %v", err)
+		}
+		return nil
+	}
+	for _, t := range cfg.Fanout.Targets {
+		if _, err := pusher.NewEncrypter(t.API.Encryption); err != nil {
+			return fmt.Errorf("fanout target %s: api.encryption: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// The HTTP sinks in sink, including the targets of a fanout
+func httpSinks(sink pusher.Sink) []*pusher.HTTP {
+	sinks := []pusher.Sink{sink}
+	if t, ok := sink.(*pusher.Tee); ok {
+		sinks = t.Sinks
+	}
+	var found []*pusher.HTTP
+	for _, s := range sinks {
+		switch s := s.(type) {
+		case *pusher.HTTP:
+			found = append(found, s)
+		case *pusher.GraphQL:
+			found = append(found, s.HTTP)
+		case *pusher.SOAP:
+			found = append(found, s.HTTP)
+		case *pusher.FanOut:
+			for _, t := range s.Targets {
+				found = append(found, t.HTTP)
+			}
+		}
+	}
+	return found
+}
+
+// Build the pipeline pushing from src with the shared client
+func newPipeline(cfg *config.Config, client *http.Client, login auth.Authenticator, src source.Source) (*pipeline.Pipeline, error) {
+	sink, err := newSink(cfg, client, login)
+	if err != nil {
+		return nil, err
+	}
+	p, err := pipeline.New(cfg, login, src, sink)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up pipeline: %v", err)
+	}
+	return p, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return d
+	}
+	return def
+}
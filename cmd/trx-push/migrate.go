@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/purwaren/trx-push/attempts"
+	"github.com/purwaren/trx-push/audit"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/deliveries"
+	"github.com/purwaren/trx-push/dlq"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+	"github.com/purwaren/trx-push/quota"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/runs"
+	"github.com/purwaren/trx-push/schema"
+	"github.com/purwaren/trx-push/source"
+)
+
+func migrateCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate")
+	var o options
+	o.register(fs)
+	status := fs.Bool("status", false, "list the applied and pending migrations without applying any")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return migrateTables(ctx, &o, *status)
+}
+
+// Migrate the tables of every tenant, or of the config without tenants
+func migrateTables(ctx context.Context, o *options, status bool) error {
+	o.allTenants = true
+	cfg, err := o.load(ctx, &http.Client{})
+	if err != nil {
+		return err
+	}
+	for _, c := range tenantConfigs(cfg) {
+		if len(cfg.Tenants) == 0 {
+			return migrate(ctx, c, status)
+		}
+		if _, err := o.loadTenant(ctx, c, &http.Client{}); err != nil {
+			return err
+		}
+		slog.Info("Migrating the tables of tenant", "tenant", c.Tenant)
+		if err := migrate(ctx, c, status); err != nil {
+			return fmt.Errorf("tenant %s: %w", c.Tenant, err)
+		}
+	}
+	return nil
+}
+
+// Apply the pending migrations of the tables of cfg, or only list them
+func migrate(ctx context.Context, cfg *config.Config, status bool) error {
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	m := schema.NewMigrator(db.Write, db.Dialect, cfg.Migrations.Table)
+	if status {
+		return printMigrations(ctx, m, migrations(cfg, db))
+	}
+	applied, err := m.Migrate(ctx, migrations(cfg, db))
+	for _, mg := range applied {
+		slog.Info("Applied migration", "table", mg.Table, "version", mg.Version, "description", mg.Description)
+	}
+	if err != nil {
+		return dbErrorf("%v", err)
+	}
+	if len(applied) == 0 {
+		slog.Info("Tables are up to date", "migrations_table", cfg.Migrations.Table)
+	}
+	return nil
+}
+
+func printMigrations(ctx context.Context, m *schema.Migrator, all []schema.Migration) error {
+	if err := m.Init(ctx); err != nil {
+		return dbErrorf("failed to create %s: %v", m.Table, err)
+	}
+	applied, err := m.Applied(ctx)
+	if err != nil {
+		return dbErrorf("failed to read %s: %v", m.Table, err)
+	}
+	pending, err := m.Pending(ctx, all)
+	if err != nil {
+		return dbErrorf("failed to read %s: %v", m.Table, err)
+	}
+	for _, a := range applied {
+		fmt.Printf("  %s %d applied %s: %s\n", a.Table, a.Version, a.At.Local().Format("2006-01-02 15:04:05"), a.Description)
+	}
+	for _, mg := range pending {
+		fmt.Printf("  %s %d pending: %s\n", mg.Table, mg.Version, mg.Description)
+	}
+	fmt.Printf("%d migration(s) applied, %d pending\n", len(applied), len(pending))
+	return nil
+}
+
+// The migrations of the tables cfg uses, oldest first for each table. New
+// steps go at the end of their table's list with the next version; the
+// create steps always create the latest layout, so the steps after them
+// must tolerate a table that already has their change.
+func migrations(cfg *config.Config, db *source.Database) []schema.Migration {
+	d := db.Dialect
+	var all []schema.Migration
+	add := func(table string, steps ...schema.Migration) {
+		for i, s := range steps {
+			s.Table, s.Version = table, i+1
+			all = append(all, s)
+		}
+	}
+
+	r := results.NewStore(db.Write, d, cfg.Results)
+	add(cfg.Results.Table,
+		schema.Migration{Description: "create the results table", Up: r.Migrate},
+		schema.Migration{Description: "add the run id column", Up: func(ctx context.Context) error {
+			return schema.AddColumn(ctx, db.Write, d, cfg.Results.Table, cfg.Results.Columns.RunID, d.Type(sqlutil.Text))
+		}},
+		schema.Migration{Description: "add the api version column", Up: func(ctx context.Context) error {
+			return schema.AddColumn(ctx, db.Write, d, cfg.Results.Table, cfg.Results.Columns.APIVersion, d.Type(sqlutil.Text))
+		}})
+	if cfg.DeadLetter.Enabled {
+		add(cfg.DeadLetter.Table,
+			schema.Migration{Description: "create the dead-letter table", Up: dlq.NewStore(db.Write, d, cfg.DeadLetter).Migrate},
+			schema.Migration{Description: "add the error class column", Up: func(ctx context.Context) error {
+				return schema.AddColumn(ctx, db.Write, d, cfg.DeadLetter.Table, "error_class", d.Type(sqlutil.Text))
+			}})
+	}
+	if cfg.Attempts.Enabled {
+		add(cfg.Attempts.Table, schema.Migration{Description: "create the attempts table",
+			Up: attempts.NewStore(db.Write, d, cfg.Attempts).Migrate})
+	}
+	if cfg.Runs.Enabled {
+		add(cfg.Runs.Table, schema.Migration{Description: "create the runs table",
+			Up: runs.NewStore(db.Write, d, cfg.Runs, version).Migrate})
+	}
+	if cfg.Quota.Daily > 0 && cfg.Quota.Store == "table" {
+		add(cfg.Quota.Table, schema.Migration{Description: "create the quota table",
+			Up: quota.NewStore(db.Write, d, cfg.Quota).Migrate})
+	}
+	if cfg.Audit.Enabled && cfg.Audit.Dir == "" {
+		add(cfg.Audit.Table, schema.Migration{Description: "create the audit table",
+			Up: audit.NewStore(db.Write, d, cfg.Audit).Migrate})
+	}
+	if len(cfg.Fanout.Targets) > 0 {
+		add(cfg.Fanout.Table, schema.Migration{Description: "create the fanout table",
+			Up: deliveries.NewStore(db.Write, d, cfg.Fanout).Migrate})
+	}
+	return all
+}
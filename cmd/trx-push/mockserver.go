@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/logging"
+)
+
+// mockAPI answers like the partner API: a JWT login and a push endpoint
+// failing, throttling or rejecting a share of the pushes at random
+type mockAPI struct {
+	email, password string
+	tokenTTL        time.Duration
+	invoiceField    string
+	failureRate     float64
+	throttleRate    float64
+	rejectRate      float64
+	latency         time.Duration
+	jitter          time.Duration
+
+	mu     sync.Mutex
+	rand   *mrand.Rand
+	tokens map[string]time.Time
+	stats  mockStats
+	pushes map[string]int
+}
+
+type mockStats struct {
+	Logins     int `json:"logins"`
+	Pushed     int `json:"pushed"`
+	Failed     int `json:"failed"`
+	Throttled  int `json:"throttled"`
+	Rejected   int `json:"rejected"`
+	Duplicates int `json:"duplicates"`
+	// Distinct invoices pushed successfully
+	Invoices int `json:"invoices"`
+}
+
+func mockServerCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("mockserver")
+	listen := fs.String("listen", "127.0.0.1:8081", "address to serve on")
+	loginPath := fs.String("login-path", "/v1/dashboard/auth/login", "path of the login endpoint")
+	pushPath := fs.String("push-path", "/v1/pos/push-transaction", "path of the push endpoint")
+	m := newMockAPI()
+	fs.StringVar(&m.email, "email", "", "login email to accept; empty accepts any")
+	fs.StringVar(&m.password, "password", "", "login password to accept with -email")
+	fs.DurationVar(&m.tokenTTL, "token-ttl", time.Hour, "lifetime of the issued tokens")
+	fs.StringVar(&m.invoiceField, "invoice-field", "invoice_number", "query parameter or body field holding the invoice number")
+	fs.Float64Var(&m.failureRate, "failure-rate", 0, "share of pushes answered with 500, e.g. 0.1")
+	fs.Float64Var(&m.throttleRate, "throttle-rate", 0, "share of pushes answered with 429 and Retry-After: 1")
+	fs.Float64Var(&m.rejectRate, "reject-rate", 0, "share of pushes rejected with 422")
+	fs.DurationVar(&m.latency, "latency", 0, "delay before every answer, e.g. 50ms")
+	fs.DurationVar(&m.jitter, "jitter", 0, "random extra delay of up to this long")
+	seed := fs.Int64("seed", 0, "seed of the random failures; 0 picks one")
+	logFormat := fs.String("log-format", "console", "console or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := logging.Setup(os.Stderr, config.LogConfig{Format: *logFormat}); err != nil {
+		return fmt.Errorf("failed to set up logging: %v", err)
+	}
+	if r := m.failureRate + m.throttleRate + m.rejectRate; r < 0 || r > 1 {
+		return fmt.Errorf("-failure-rate, -throttle-rate and -reject-rate must add up to between 0 and 1, got %v", r)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	m.rand = mrand.New(mrand.NewSource(*seed))
+
+	slog.Info("Mock API ready", "login_url", "http://"+*listen+*loginPath, "push_url", "http://"+*listen+*pushPath, "seed", *seed)
+	serveHTTP(ctx, *listen, m.handler(*loginPath, *pushPath))
+	slog.Info("Mock API stopped", "stats", m.snapshot())
+	return nil
+}
+
+// A mock accepting any login and every push, until its rates are set
+func newMockAPI() *mockAPI {
+	return &mockAPI{
+		tokenTTL:     time.Hour,
+		invoiceField: "invoice_number",
+		rand:         mrand.New(mrand.NewSource(1)),
+		tokens:       make(map[string]time.Time),
+		pushes:       make(map[string]int),
+	}
+}
+
+func (m *mockAPI) handler(loginPath, pushPath string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(loginPath, m.login)
+	mux.HandleFunc(pushPath, m.push)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/_mock/stats", m.serveStats)
+	return mux
+}
+
+func (m *mockAPI) login(w http.ResponseWriter, r *http.Request) {
+	m.wait()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var creds struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"code": "BAD_REQUEST", "message": err.Error()})
+		return
+	}
+	if m.email != "" && (creds.Email != m.email || creds.Password != m.password) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"code": "INVALID_CREDENTIALS", "message": "wrong email or password"})
+		return
+	}
+	exp := time.Now().Add(m.tokenTTL)
+	token := mockToken(creds.Email, exp)
+	m.mu.Lock()
+	m.tokens[token] = exp
+	m.stats.Logins++
+	m.mu.Unlock()
+	slog.Info("Mock login", "email", creds.Email)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": token, "expires_in": int64(m.tokenTTL.Seconds())})
+}
+
+// An unsigned JWT with the exp claim, so clients can read its expiry
+func mockToken(subject string, exp time.Time) string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{"sub": subject, "exp": exp.Unix(), "jti": hex.EncodeToString(nonce)})
+	return header + "." + enc.EncodeToString(claims) + "."
+}
+
+func (m *mockAPI) push(w http.ResponseWriter, r *http.Request) {
+	m.wait()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	m.mu.Lock()
+	exp, ok := m.tokens[token]
+	m.mu.Unlock()
+	if !ok || time.Now().After(exp) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"code": "UNAUTHORIZED", "message": "missing, unknown or expired token"})
+		return
+	}
+	invoice, err := m.invoice(r)
+	if err != nil || invoice == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"code": "BAD_REQUEST", "message": "no " + m.invoiceField + " in the request"})
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roll := m.rand.Float64()
+	switch {
+	case roll < m.failureRate:
+		m.stats.Failed++
+		slog.Info("Mock push failed", "invoice_id", invoice)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"code": "INTERNAL_ERROR", "message": "simulated failure"})
+	case roll < m.failureRate+m.throttleRate:
+		m.stats.Throttled++
+		slog.Info("Mock push throttled", "invoice_id", invoice)
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"code": "RATE_LIMITED", "message": "simulated throttling"})
+	case roll < m.failureRate+m.throttleRate+m.rejectRate:
+		m.stats.Rejected++
+		slog.Info("Mock push rejected", "invoice_id", invoice)
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"code": "INVALID_INVOICE", "message": "simulated rejection"})
+	default:
+		m.pushes[invoice]++
+		m.stats.Pushed++
+		if m.pushes[invoice] > 1 {
+			m.stats.Duplicates++
+			slog.Warn("Mock push of an invoice pushed before", "invoice_id", invoice, "times", m.pushes[invoice])
+		} else {
+			m.stats.Invoices++
+			slog.Info("Mock push", "invoice_id", invoice)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"code": "0", "message": "OK",
+			"data": map[string]string{"transaction_id": fmt.Sprintf("MOCK-%06d", m.stats.Pushed)}})
+	}
+}
+
+// The invoice number of a push in any of the api.push_format formats
+func (m *mockAPI) invoice(r *http.Request) (string, error) {
+	if v := r.URL.Query().Get(m.invoiceField); v != "" {
+		return v, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		v, _ := jsonutil.Lookup(body, m.invoiceField)
+		return v, nil
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", errors.New("invalid form body")
+	}
+	return values.Get(m.invoiceField), nil
+}
+
+// Sleep for -latency and up to -jitter more
+func (m *mockAPI) wait() {
+	d := m.latency
+	if m.jitter > 0 {
+		m.mu.Lock()
+		d += time.Duration(m.rand.Int63n(int64(m.jitter)))
+		m.mu.Unlock()
+	}
+	time.Sleep(d)
+}
+
+func (m *mockAPI) serveStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.snapshot())
+}
+
+func (m *mockAPI) snapshot() mockStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/audit"
+	"github.com/purwaren/trx-push/dlq"
+	"github.com/purwaren/trx-push/runs"
+	"github.com/purwaren/trx-push/source"
+)
+
+// age is a duration flag that also takes whole days, e.g. 90d
+type age time.Duration
+
+func (a *age) String() string { return time.Duration(*a).String() }
+
+func (a *age) Set(s string) error {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number of days %q", days)
+		}
+		*a = age(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return errors.New("must not be negative")
+	}
+	*a = age(d)
+	return nil
+}
+
+// pruner is a table of the tool's own bookkeeping
+type pruner struct {
+	name      string
+	table     string
+	retention time.Duration
+	prune     func(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+func pruneCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("prune")
+	var o options
+	o.register(fs)
+	var olderThan age
+	fs.Var(&olderThan, "older-than", "delete what is older than this, e.g. 90d or 720h, instead of each table's retention")
+	dryRun := fs.Bool("dry-run", false, "only list what would be pruned and the cutoff")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := o.load(ctx, &http.Client{})
+	if err != nil {
+		return err
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var pruners []pruner
+	if cfg.Runs.Enabled {
+		s := runs.NewStore(db.Write, db.Dialect, cfg.Runs, version)
+		pruners = append(pruners, pruner{"runs", cfg.Runs.Table, cfg.Runs.Retention, s.Prune})
+	}
+	if cfg.Audit.Enabled {
+		table := cfg.Audit.Table
+		if cfg.Audit.Dir != "" {
+			table = cfg.Audit.Dir
+		}
+		l := audit.Open(db.Write, db.Dialect, cfg.Audit)
+		pruners = append(pruners, pruner{"audit", table, cfg.Audit.Retention, l.Prune})
+	}
+	if cfg.DeadLetter.Enabled {
+		s := dlq.NewStore(db.Write, db.Dialect, cfg.DeadLetter)
+		pruners = append(pruners, pruner{"dead_letter", cfg.DeadLetter.Table, cfg.DeadLetter.Retention, s.Prune})
+	}
+	if len(pruners) == 0 {
+		return errors.New("none of runs, audit and dead_letter is enabled")
+	}
+
+	now := time.Now()
+	for _, p := range pruners {
+		retention := p.retention
+		if olderThan > 0 {
+			retention = time.Duration(olderThan)
+		}
+		if retention <= 0 {
+			slog.InfoContext(ctx, "No retention, keeping everything", "section", p.name, "table", p.table)
+			continue
+		}
+		cutoff := now.Add(-retention)
+		if *dryRun {
+			slog.InfoContext(ctx, "Would prune", "section", p.name, "table", p.table, "before", cutoff.Format(time.RFC3339))
+			continue
+		}
+		n, err := p.prune(ctx, cutoff)
+		if err != nil {
+			return dbErrorf("failed to prune %s: %v", p.table, err)
+		}
+		slog.InfoContext(ctx, "Pruned", "section", p.name, "table", p.table, "deleted", n, "before", cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
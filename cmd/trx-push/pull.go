@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/pull"
+	"github.com/purwaren/trx-push/source"
+)
+
+func pullCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("pull")
+	var o options
+	o.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	if cfg.Pull.StatusURL == "" {
+		return errors.New("pull.status_url is not configured")
+	}
+	if len(cfg.Shards) > 0 {
+		return errors.New("pull does not support shards")
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	login, err := newAuth(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	sink, err := newSink(cfg, httpClient, login)
+	if err != nil {
+		return err
+	}
+	if c, ok := sink.(io.Closer); ok {
+		defer c.Close()
+	}
+	sinks := httpSinks(sink)
+	if len(sinks) == 0 {
+		return errors.New("pull needs the http sink")
+	}
+	p := &pull.Puller{HTTP: sinks[0], DB: db, Config: cfg.Pull}
+	if err := p.HTTP.Auth.Login(ctx); err != nil {
+		return &pipeline.LoginError{Err: err}
+	}
+
+	for {
+		sum, err := p.Run(ctx)
+		if ctx.Err() != nil {
+			return pipeline.ErrInterrupted
+		}
+		if err != nil {
+			return dbErrorf("%v", err)
+		}
+		slog.Info("Pull finished", "polled", sum.Polled, "updated", sum.Updated, "failed", sum.Failed)
+		if cfg.Pull.Interval == 0 {
+			if sum.Failed > 0 {
+				return fmt.Errorf("%d of %d invoice statuses were not pulled", sum.Failed, sum.Polled)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.Pull.Interval):
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/results"
+)
+
+func pushCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("push")
+	var o options
+	o.register(fs)
+	invoice := fs.String("invoice", "", "number of the invoice to push, whatever its status")
+	force := fs.Bool("force", false, "push even if it fails validation, reached attempts.max, was pushed already with dedup.history or is over a quota")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *invoice == "" {
+		fs.Usage()
+		return errors.New("push needs -invoice")
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	if cfg.Source.Type != "database" {
+		return fmt.Errorf("push needs source.type database, not %s", cfg.Source.Type)
+	}
+	if len(cfg.Shards) > 0 {
+		return errors.New("push does not support shards")
+	}
+	in, err := start(ctx, cfg, httpClient, mode{})
+	if err != nil {
+		return err
+	}
+	defer in.close()
+	p := in.p
+
+	found, err := in.db.Has(ctx, *invoice)
+	if err != nil {
+		return dbErrorf("failed to look up invoice %s: %v", *invoice, err)
+	}
+	if !found {
+		return fmt.Errorf("invoice %s is not in %s", *invoice, cfg.Query.Table)
+	}
+	if p.Results != nil && cfg.Dedup.History && !*force {
+		pushed, err := p.Results.Pushed(ctx, []string{*invoice})
+		if err != nil {
+			return dbErrorf("failed to read results: %v", err)
+		}
+		if pushed[*invoice] {
+			return fmt.Errorf("invoice %s was pushed already; push it again with -force", *invoice)
+		}
+	}
+
+	push := p.PushInvoice
+	if *force {
+		push = p.ForceInvoice
+	}
+	slog.Info("Pushing invoice", "invoice_id", *invoice, "force", *force)
+	status, err := push(ctx, *invoice)
+	switch {
+	case errors.Is(err, pipeline.ErrSkipped):
+		return fmt.Errorf("invoice %s failed validation or reached attempts.max; push it anyway with -force", *invoice)
+	case err != nil:
+		return err
+	case status == pipeline.StatusSkipped:
+		return fmt.Errorf("invoice %s was skipped by a hook or a quota", *invoice)
+	case status != results.StatusSuccess:
+		slog.Error("Invoice was not pushed", "invoice_id", *invoice, "status", status)
+		return &failedPushes{failed: 1}
+	}
+	slog.Info("Pushed invoice", "invoice_id", *invoice)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/hooks"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/reconcile"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/source"
+)
+
+func reconcileCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("reconcile")
+	var o options
+	o.register(fs)
+	today := time.Now().Format(reconcile.DateLayout)
+	from := fs.String("from", today, "first invoice date compared, YYYY-MM-DD")
+	to := fs.String("to", today, "last invoice date compared, YYYY-MM-DD")
+	repush := fs.Bool("repush", false, "push again the invoices pushed locally but missing remotely")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var rng reconcile.Range
+	var err error
+	if rng.From, err = time.ParseInLocation(reconcile.DateLayout, *from, time.Local); err != nil {
+		return fmt.Errorf("invalid -from: %v", err)
+	}
+	if rng.To, err = time.ParseInLocation(reconcile.DateLayout, *to, time.Local); err != nil {
+		return fmt.Errorf("invalid -to: %v", err)
+	}
+	if rng.To.Before(rng.From) {
+		return errors.New("-to is before -from")
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	if cfg.Reconcile.ListURL == "" {
+		return errors.New("reconcile.list_url is not configured")
+	}
+	if len(cfg.Shards) > 0 {
+		return errors.New("reconcile does not support shards")
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	pushed, err := reconcile.Pushed(ctx, db, cfg.Reconcile, rng)
+	if err != nil {
+		return dbErrorf("failed to read pushed invoices: %v", err)
+	}
+
+	login, err := newAuth(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	sink, err := newSink(cfg, httpClient, login)
+	if err != nil {
+		return err
+	}
+	if c, ok := sink.(io.Closer); ok {
+		defer c.Close()
+	}
+	sinks := httpSinks(sink)
+	if len(sinks) == 0 {
+		return errors.New("reconcile needs the http sink")
+	}
+	h := sinks[0]
+	if err := h.Auth.Login(ctx); err != nil {
+		return &pipeline.LoginError{Err: err}
+	}
+	remote, err := (&reconcile.Remote{HTTP: h, Config: cfg.Reconcile}).List(ctx, rng)
+	if err != nil {
+		return fmt.Errorf("failed to list remote invoices: %v", err)
+	}
+
+	report := reconcile.Compare(pushed, remote)
+	fmt.Printf("%s to %s: %d matched, %d missing remotely, %d missing locally\n",
+		*from, *to, report.Matched, len(report.MissingRemote), len(report.MissingLocal))
+	for _, id := range report.MissingRemote {
+		fmt.Printf("missing remotely: %s\n", id)
+	}
+	for _, id := range report.MissingLocal {
+		fmt.Printf("missing locally: %s\n", id)
+	}
+	if report.Clean() {
+		return nil
+	}
+	if !*repush || len(report.MissingRemote) == 0 {
+		return fmt.Errorf("%d invoices missing remotely, %d missing locally", len(report.MissingRemote), len(report.MissingLocal))
+	}
+
+	src, err := openSource(ctx, cfg, db)
+	if err != nil {
+		return err
+	}
+	defer closeSource(src)
+	p, err := newPipeline(cfg, httpClient, login, src)
+	if err != nil {
+		return err
+	}
+	if c, ok := p.Sink.(io.Closer); ok {
+		defer c.Close()
+	}
+	if p.Hooks, err = hooks.Load(ctx, cfg.Hooks); err != nil {
+		return err
+	}
+	defer p.Hooks.Close()
+	var failed []string
+	for _, id := range report.MissingRemote {
+		if ctx.Err() != nil {
+			return pipeline.ErrInterrupted
+		}
+		status, err := p.PushInvoice(ctx, id)
+		if err != nil || status != results.StatusSuccess {
+			slog.Error("Failed to repush invoice", "invoice_id", id, "status", status, "error", err)
+			failed = append(failed, id)
+			continue
+		}
+		slog.Info("Repushed invoice", "invoice_id", id)
+	}
+	if len(failed) > 0 {
+		return &failedPushes{failed: len(failed), pushed: len(report.MissingRemote) - len(failed)}
+	}
+	if len(report.MissingLocal) > 0 {
+		return fmt.Errorf("%d invoices missing locally: %s", len(report.MissingLocal), strings.Join(report.MissingLocal, ","))
+	}
+	return nil
+}
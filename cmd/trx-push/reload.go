@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sdnotify"
+)
+
+// How often a local config file is checked for changes
+const configPollInterval = 5 * time.Second
+
+// Reload the config into the pipelines of instances on SIGHUP and, for a
+// local file, whenever it changes, until ctx is cancelled. A config that
+// fails to load or validate is logged and the current one kept.
+func watchConfig(ctx context.Context, o *options, client *http.Client, instances ...*instance) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var poll <-chan time.Time
+	var last os.FileInfo
+	if !config.IsRemote(o.config) {
+		last, _ = os.Stat(o.config)
+		t := time.NewTicker(configPollInterval)
+		defer t.Stop()
+		poll = t.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("Received SIGHUP, reloading config")
+		case <-poll:
+			fi, err := os.Stat(o.config)
+			if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size()) {
+				continue
+			}
+			last = fi
+			slog.Info("Config file changed, reloading", "path", o.config)
+		}
+		// Units with Type=notify show the reload in systemctl status
+		sdnotify.Notify(sdnotify.Reloading)
+		reloadConfig(ctx, o, client, instances)
+		sdnotify.Notify(sdnotify.Ready)
+	}
+}
+
+func reloadConfig(ctx context.Context, o *options, client *http.Client, instances []*instance) {
+	// Load with a copy so the secrets loaded at startup stay untouched
+	ro := *o
+	cfg, err := ro.load(ctx, client)
+	if err != nil {
+		slog.Error("Failed to reload config, keeping the current one", "error", err)
+		return
+	}
+	if len(cfg.Tenants) == 0 {
+		if err := instances[0].p.Reload(cfg); err != nil {
+			slog.Error("Failed to reload config, keeping the current one", "error", err)
+			return
+		}
+		slog.Info("Config reloaded")
+		return
+	}
+
+	// Each tenant keeps its config when its new one is broken
+	for _, in := range instances {
+		tenant := in.cfg.Tenant
+		next, err := cfg.ForTenant(tenant)
+		if err == nil {
+			_, err = ro.loadTenant(ctx, next, in.client)
+		}
+		if err == nil {
+			err = in.p.Reload(next)
+		}
+		if err != nil {
+			slog.Error("Failed to reload config, keeping the current one", "tenant", tenant, "error", err)
+			continue
+		}
+		slog.Info("Config reloaded", "tenant", tenant)
+	}
+	if len(cfg.Tenants) != len(instances) {
+		slog.Warn("Adding or removing tenants needs a restart", "configured", len(cfg.Tenants), "running", len(instances))
+	}
+}
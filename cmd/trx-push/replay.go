@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/purwaren/trx-push/audit"
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+func replayCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("replay")
+	var o options
+	o.register(fs)
+	runID := fs.String("run", "", "resend the requests of this run")
+	var invoices invoiceList
+	fs.Var(&invoices, "invoice", "resend the last request of this invoice number; repeat or separate with commas")
+	target := fs.String("url", "", "send to this URL instead of the recorded one, keeping its query unless the URL has one")
+	dryRun := fs.Bool("dry-run", false, "list the requests that would be resent without sending them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *runID == "" && len(invoices) == 0 {
+		fs.Usage()
+		return errors.New("replay needs -run or -invoice")
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	if !cfg.Audit.Enabled {
+		return errors.New("audit is not enabled")
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	log := audit.Open(db.Write, db.Dialect, cfg.Audit)
+	if c, ok := log.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	entries, err := log.Find(ctx, audit.Filter{RunID: *runID, Invoices: invoices})
+	if err != nil {
+		return dbErrorf("failed to read audit log: %v", err)
+	}
+
+	login, err := newAuth(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	sink, err := newSink(cfg, httpClient, login)
+	if err != nil {
+		return err
+	}
+	if c, ok := sink.(io.Closer); ok {
+		defer c.Close()
+	}
+	sinks := httpSinks(sink)
+	if len(sinks) == 0 {
+		return errors.New("replay needs the http sink")
+	}
+	entries = lastAttempts(entries, sinks)
+	if len(entries) == 0 {
+		slog.Warn("No recorded requests to replay")
+		return nil
+	}
+	if *dryRun {
+		for _, e := range entries {
+			fmt.Printf("%s %s %s invoice_ids=%s\n", e.At.Format("2006-01-02T15:04:05Z07:00"), e.Method, e.URL, strings.Join(e.Invoices, ","))
+		}
+		return nil
+	}
+	// The replay is recorded as a run of its own
+	replayID := pipeline.NewRunID()
+	ctx = correlation.WithRun(ctx, replayID)
+	for _, h := range sinks {
+		h.Audit = log
+	}
+	slog.Info("Replaying recorded requests", "requests", len(entries), "replay_run_id", replayID)
+
+	var failed, pushed int
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return pipeline.ErrInterrupted
+		}
+		h := sinkFor(sinks, e.URL)
+		if h.Auth.Token() == "" {
+			if err := h.Auth.Login(ctx); err != nil {
+				return &pipeline.LoginError{Err: err}
+			}
+		}
+		ids := strings.Join(e.Invoices, ",")
+		resp, err := h.Resend(ctx, e, *target)
+		if err != nil {
+			slog.Error("Failed to replay request", "invoice_ids", ids, "status_code", resp.StatusCode, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("Replayed request", "invoice_ids", ids, "status_code", resp.StatusCode)
+		pushed++
+	}
+	slog.Info("Replay finished", "replayed", pushed, "failed", failed)
+	if failed > 0 {
+		return &failedPushes{failed: failed, pushed: pushed}
+	}
+	return nil
+}
+
+// Keep only the last request of the same invoices to each sink, so
+// retries and earlier replays are not resent as well, in the order the
+// requests were first sent
+func lastAttempts(entries []audit.Entry, sinks []*pusher.HTTP) []audit.Entry {
+	type request struct {
+		sink     *pusher.HTTP
+		invoices string
+	}
+	index := make(map[request]int)
+	var last []audit.Entry
+	for _, e := range entries {
+		key := request{sinkFor(sinks, e.URL), strings.Join(e.Invoices, ",")}
+		if i, ok := index[key]; ok {
+			last[i] = e
+			continue
+		}
+		index[key] = len(last)
+		last = append(last, e)
+	}
+	return last
+}
+
+// The sink that sent to recorded, for its login and signing; the first
+// one when none matches
+func sinkFor(sinks []*pusher.HTTP, recorded string) *pusher.HTTP {
+	for _, h := range sinks {
+		for _, u := range []string{h.URL, h.Bulk.URL} {
+			if u != "" && sameEndpoint(u, recorded) {
+				return h
+			}
+		}
+	}
+	return sinks[0]
+}
+
+// Whether a and b differ at most in their query
+func sameEndpoint(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	ua.RawQuery, ub.RawQuery = "", ""
+	ua.User, ub.User = nil, nil
+	return ua.String() == ub.String()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/attempts"
+	"github.com/purwaren/trx-push/dlq"
+	"github.com/purwaren/trx-push/source"
+)
+
+// invoiceList collects a repeatable -invoice flag; each value may also hold
+// several comma-separated invoice numbers
+type invoiceList []string
+
+func (l *invoiceList) String() string { return strings.Join(*l, ",") }
+
+func (l *invoiceList) Set(s string) error {
+	for _, inv := range strings.Split(s, ",") {
+		if inv = strings.TrimSpace(inv); inv != "" {
+			*l = append(*l, inv)
+		}
+	}
+	return nil
+}
+
+func requeueCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("requeue")
+	var o options
+	o.register(fs)
+	var invoices invoiceList
+	fs.Var(&invoices, "invoice", "invoice number to requeue; repeat or separate with commas")
+	all := fs.Bool("all", false, "requeue every dead-lettered invoice")
+	since := fs.Duration("since", 0, "with -all, only the invoices that failed within this long, e.g. 24h")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(invoices) == 0 && !*all {
+		fs.Usage()
+		return errors.New("requeue needs -invoice or -all")
+	}
+	if len(invoices) > 0 && *all {
+		return errors.New("-invoice and -all cannot be combined")
+	}
+
+	cfg, err := o.load(ctx, &http.Client{})
+	if err != nil {
+		return err
+	}
+	if !cfg.DeadLetter.Enabled {
+		return errors.New("dead_letter is not enabled")
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var from time.Time
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+	store := dlq.NewStore(db.Write, db.Dialect, cfg.DeadLetter)
+	entries, err := store.Find(ctx, invoices, from)
+	if err != nil {
+		return dbErrorf("failed to read dead letters: %v", err)
+	}
+	if len(invoices) > len(entries) {
+		found := make(map[string]bool)
+		for _, e := range entries {
+			found[e.Invoice] = true
+		}
+		for _, inv := range invoices {
+			if !found[inv] {
+				slog.Warn("Invoice is not in the dead-letter table", "invoice_id", inv)
+			}
+		}
+	}
+
+	var pending source.Requeuer = db
+	if len(cfg.Shards) > 0 {
+		s, err := source.OpenShards(cfg)
+		if err != nil {
+			return dbErrorf("failed to open shards: %v", err)
+		}
+		defer s.Close()
+		pending = s
+	}
+	var counter *attempts.Store
+	if cfg.Attempts.Enabled {
+		counter = attempts.NewStore(db.Write, db.Dialect, cfg.Attempts)
+	}
+	requeued := 0
+	for _, e := range entries {
+		if err := requeue(ctx, pending, counter, store, e.Invoice); err != nil {
+			return dbErrorf("failed to requeue invoice_id %s: %v", e.Invoice, err)
+		}
+		slog.Info("Requeued invoice", "invoice_id", e.Invoice, "status", e.Status)
+		requeued++
+	}
+	slog.Info("Requeue finished", "requeued", requeued)
+	return nil
+}
+
+// Move invoice back to pending, reset its attempts and only then drop its
+// dead letter, so a failure part way leaves it in the table to retry
+func requeue(ctx context.Context, pending source.Requeuer, counter *attempts.Store, store *dlq.Store, invoice string) error {
+	if err := pending.Requeue(ctx, invoice); err != nil {
+		return &databaseError{err}
+	}
+	if counter != nil {
+		if err := counter.Clear(ctx, invoice); err != nil {
+			return err
+		}
+	}
+	return store.Remove(ctx, invoice)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/purwaren/trx-push/secrets"
+	"golang.org/x/term"
+)
+
+func secretCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("expected set or delete, e.g. trx-push secret set db_password")
+	}
+	action, args := args[0], args[1:]
+	fs := newFlagSet("secret " + action)
+	service := fs.String("service", "trx-push", "keyring service of the secret, as secrets.keyring_service")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trx-push secret %s [flags] <name>\n\n", action)
+		if action == "set" {
+			fmt.Fprintf(fs.Output(), "The value is prompted for on a terminal, or read from standard input.\n\n")
+		}
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected the name of the secret")
+	}
+	name := fs.Arg(0)
+
+	switch action {
+	case "set":
+		value, err := readSecret(name)
+		if err != nil {
+			return err
+		}
+		if err := secrets.SetKeyring(*service, name, value); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Stored secret, reference it in the config as keyring:"+name, "service", *service, "name", name)
+		return nil
+	case "delete":
+		if err := secrets.DeleteKeyring(*service, name); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Deleted secret", "service", *service, "name", name)
+		return nil
+	}
+	return fmt.Errorf("unknown secret action %q (expected set or delete)", action)
+}
+
+// Prompt for the value without echoing it, or read the first line of
+// standard input when it is not a terminal
+func readSecret(name string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read the value of %s from standard input: %v", name, err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprintf(os.Stderr, "Value of %s: ", name)
+	value, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the value of %s: %v", name, err)
+	}
+	if len(value) == 0 {
+		return "", errors.New("empty value, nothing stored")
+	}
+	return string(value), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/secrets"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Secrets loaded at startup, kept to refresh them while serving
+type loadedSecrets struct {
+	provider secrets.Provider
+	values   map[string]string
+	ttl      time.Duration
+}
+
+// Fill the credentials in cfg from secrets.backend, if one is configured
+func loadSecrets(ctx context.Context, cfg *config.Config, client *http.Client) (*loadedSecrets, error) {
+	provider, err := secrets.New(cfg.Secrets, client)
+	if provider == nil || err != nil {
+		return nil, err
+	}
+	values, ttl, err := provider.Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %v", err)
+	}
+	if err := secrets.Apply(cfg, cfg.Secrets.Keys, values); err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %v", err)
+	}
+	slog.Info("Loaded credentials from secret store", "backend", cfg.Secrets.Backend, "keys", len(cfg.Secrets.Keys))
+	return &loadedSecrets{provider: provider, values: values, ttl: ttl}, nil
+}
+
+// Keep the login and database credentials in sync with the secret store
+// until ctx is cancelled
+func (s *loadedSecrets) watch(ctx context.Context, p *pipeline.Pipeline, login auth.Authenticator, db *source.Database) {
+	cfg := p.Config()
+	secrets.Watch(ctx, s.provider, s.values, s.ttl, cfg.Secrets.Vault.RefreshInterval, func(values map[string]string) {
+		// Work on a copy of the current config, which is in use by the
+		// running components
+		cfg := p.Config()
+		updated := *cfg
+		if err := secrets.Apply(&updated, cfg.Secrets.Keys, values); err != nil {
+			slog.Warn("Ignoring refreshed secrets", "error", err)
+			return
+		}
+		if cs, ok := login.(auth.CredentialSetter); ok {
+			cs.SetCredentials(updated.API.Username, updated.API.Password)
+		}
+		db.SetCredentials(&updated)
+	})
+}
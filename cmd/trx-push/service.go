@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/internal/sdnotify"
+)
+
+// serviceSpec is the daemon a service runs
+type serviceSpec struct {
+	name string
+	// Absolute path of this executable
+	exe string
+	// serve and its flags
+	args []string
+	// Account the service runs as; systemd only
+	user string
+	// WatchdogSec of the systemd unit, 0 for none
+	watchdog time.Duration
+	// Directory of the systemd unit
+	unitDir string
+}
+
+func serviceCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errors.New("expected install, uninstall, start or stop, e.g. trx-push service install -config /etc/trx-push/config.yaml")
+	}
+	action, args := args[0], args[1:]
+	fs := newFlagSet("service " + action)
+	name := fs.String("name", "trx-push", "name of the service, or of the systemd unit")
+	s := serviceSpec{}
+	fs.StringVar(&s.unitDir, "unit-dir", "/etc/systemd/system", "directory of the systemd unit")
+	var config, profile, tenant string
+	if action == "install" {
+		fs.StringVar(&config, "config", envOr("TRX_PUSH_CONFIG", "config.yaml"), "config file path or http(s):// URL the service runs with")
+		fs.StringVar(&profile, "profile", "", "config profile the service runs with")
+		fs.StringVar(&tenant, "tenant", "", "tenant the service pushes for, instead of all of them")
+		fs.StringVar(&s.user, "user", "", "account the systemd unit runs as; on Windows set it in services.msc")
+		fs.DurationVar(&s.watchdog, "watchdog", time.Minute, "WatchdogSec of the systemd unit, 0 for none")
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: trx-push service install [flags] [-- serve flags]\n\n")
+			fs.PrintDefaults()
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	s.name = *name
+
+	switch action {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to find the executable: %v", err)
+		}
+		if s.exe, err = filepath.Abs(exe); err != nil {
+			return err
+		}
+		// Services do not start in the directory installed from
+		if !strings.Contains(config, "://") {
+			if config, err = filepath.Abs(config); err != nil {
+				return err
+			}
+		}
+		s.args = []string{"serve", "-config", config}
+		if profile != "" {
+			s.args = append(s.args, "-profile", profile)
+		}
+		if tenant != "" {
+			s.args = append(s.args, "-tenant", tenant)
+		}
+		s.args = append(s.args, fs.Args()...)
+		return installService(ctx, s)
+	case "uninstall":
+		return uninstallService(ctx, s)
+	case "start":
+		return startService(ctx, s.name)
+	case "stop":
+		return stopService(ctx, s.name)
+	}
+	return fmt.Errorf("unknown service action %q (expected install, uninstall, start or stop)", action)
+}
+
+// Tell systemd the daemon is up and keep its watchdog fed until ctx is
+// done, when started by a unit with Type=notify. The returned func tells
+// it the daemon is stopping.
+func notifyReady(ctx context.Context) func() {
+	ok, err := sdnotify.Notify(sdnotify.Ready)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to notify systemd", "error", err)
+	}
+	if !ok {
+		return func() {}
+	}
+	if d := sdnotify.WatchdogInterval(); d > 0 {
+		go sdnotify.PingWatchdog(ctx, d)
+	}
+	return func() { sdnotify.Notify(sdnotify.Stopping) }
+}
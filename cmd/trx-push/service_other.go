@@ -0,0 +1,87 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Services are systemd units here, run by systemd rather than by main
+func inService() bool { return false }
+
+func runService(ctx context.Context, run func(ctx context.Context) error) error {
+	return run(ctx)
+}
+
+func installService(ctx context.Context, s serviceSpec) error {
+	path := filepath.Join(s.unitDir, s.name+".service")
+	if err := os.WriteFile(path, []byte(systemdUnit(s)), 0o644); err != nil {
+		return fmt.Errorf("failed to write the unit: %v", err)
+	}
+	slog.InfoContext(ctx, "Installed systemd unit, enable it with systemctl daemon-reload && systemctl enable --now "+s.name, "path", path)
+	return nil
+}
+
+func uninstallService(ctx context.Context, s serviceSpec) error {
+	path := filepath.Join(s.unitDir, s.name+".service")
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove the unit: %v", err)
+	}
+	slog.InfoContext(ctx, "Removed systemd unit, stop it with systemctl disable --now "+s.name+" && systemctl daemon-reload", "path", path)
+	return nil
+}
+
+func startService(ctx context.Context, name string) error {
+	return systemctl(ctx, "start", name)
+}
+
+func stopService(ctx context.Context, name string) error {
+	return systemctl(ctx, "stop", name)
+}
+
+func systemctl(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "systemctl", args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// The unit running s with Type=notify: systemd considers it started once
+// the pipeline is up, restarts it when it exits with an error or misses
+// the watchdog, and reloads it with SIGHUP
+func systemdUnit(s serviceSpec) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=trx-push invoice push daemon\nWants=network-online.target\nAfter=network-online.target\n\n")
+	fmt.Fprintf(&b, "[Service]\nType=notify\nExecStart=%s\n", execLine(append([]string{s.exe}, s.args...)))
+	b.WriteString("ExecReload=/bin/kill -HUP $MAINPID\nRestart=on-failure\nRestartSec=10\n")
+	if s.watchdog > 0 {
+		fmt.Fprintf(&b, "WatchdogSec=%d\n", int(s.watchdog.Seconds()))
+	}
+	if s.user != "" {
+		fmt.Fprintf(&b, "User=%s\n", s.user)
+	}
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// Quote args for ExecStart, which expands % specifiers and $ variables
+func execLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		a = strings.NewReplacer("%", "%%", "$", "$$").Replace(a)
+		if a == "" || strings.ContainsAny(a, " \t\"'\\;") {
+			a = strconv.Quote(a)
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,183 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/purwaren/trx-push/pipeline"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Whether the service control manager started this process
+func inService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// Run run as a service, cancelling its context when the service is
+// stopped or Windows shuts down
+func runService(ctx context.Context, run func(ctx context.Context) error) error {
+	s := &windowsService{ctx: ctx, run: run}
+	// The name is only used by services sharing a process
+	if err := svc.Run("", s); err != nil {
+		return fmt.Errorf("failed to run as a service: %v", err)
+	}
+	return s.err
+}
+
+type windowsService struct {
+	ctx context.Context
+	run func(ctx context.Context) error
+	err error
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	stopping := false
+	for {
+		select {
+		case s.err = <-done:
+			if stopping && errors.Is(s.err, pipeline.ErrInterrupted) {
+				s.err = nil
+			}
+			if s.err == nil {
+				return false, 0
+			}
+			// Logs usually go nowhere in a service without log.file
+			if elog, err := eventlog.Open(args[0]); err == nil {
+				elog.Error(1, s.err.Error())
+				elog.Close()
+			}
+			return true, uint32(exitCode(s.err))
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				stopping = true
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
+
+func installService(ctx context.Context, s serviceSpec) error {
+	if s.user != "" {
+		return errors.New("-user is for systemd; set the account of the service in services.msc")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	if existing, err := m.OpenService(s.name); err == nil {
+		existing.Close()
+		return fmt.Errorf("service %s already exists", s.name)
+	}
+	service, err := m.CreateService(s.name, s.exe, mgr.Config{
+		DisplayName:      s.name,
+		Description:      "Pushes pending invoices from the POS database to the transaction API",
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true,
+	}, s.args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service %s: %v", s.name, err)
+	}
+	defer service.Close()
+	// Restart after a crash or an exit with an error, like Restart=on-failure
+	restart := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 10 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}
+	if err := service.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("failed to set the recovery actions: %v", err)
+	}
+	if err := service.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		return fmt.Errorf("failed to set the recovery actions: %v", err)
+	}
+	if err := eventlog.InstallAsEventCreate(s.name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		slog.WarnContext(ctx, "Failed to register the event log source", "error", err)
+	}
+	slog.InfoContext(ctx, "Installed service, start it with trx-push service start", "name", s.name, "args", s.args)
+	return nil
+}
+
+func uninstallService(ctx context.Context, s serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(s.name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", s.name)
+	}
+	defer service.Close()
+	if err := service.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service %s: %v", s.name, err)
+	}
+	eventlog.Remove(s.name)
+	slog.InfoContext(ctx, "Removed service; a running one stops using it once stopped", "name", s.name)
+	return nil
+}
+
+func startService(ctx context.Context, name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer service.Close()
+	if err := service.Start(); err != nil {
+		return fmt.Errorf("failed to start service %s: %v", name, err)
+	}
+	return nil
+}
+
+// Stop the service and wait until its in-flight pushes finished
+func stopService(ctx context.Context, name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	service, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer service.Close()
+	status, err := service.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("failed to stop service %s: %v", name, err)
+	}
+	for status.State != svc.Stopped {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+		if status, err = service.Query(); err != nil {
+			return fmt.Errorf("failed to query service %s: %v", name, err)
+		}
+	}
+	return nil
+}
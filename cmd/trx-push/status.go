@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/purwaren/trx-push/attempts"
+	"github.com/purwaren/trx-push/dlq"
+	"github.com/purwaren/trx-push/quota"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/source"
+)
+
+// report is what status prints; parts whose table is disabled are left out
+type report struct {
+	Pending         int      `json:"pending"`
+	PendingInvoices []string `json:"pending_invoices"`
+	// With query.created_column set
+	OldestPending *time.Time         `json:"oldest_pending_at,omitempty"`
+	LastSuccess   *time.Time         `json:"last_success_at,omitempty"`
+	LastRun       *runReport         `json:"last_run,omitempty"`
+	Recent        *recentReport      `json:"recent,omitempty"`
+	DeadLettered  *int               `json:"dead_lettered,omitempty"`
+	Quota         *quotaReport       `json:"quota,omitempty"`
+	Exhausted     []attempts.Invoice `json:"exhausted,omitempty"`
+}
+
+type runReport struct {
+	ID          string         `json:"run_id"`
+	Started     time.Time      `json:"started_at"`
+	Finished    time.Time      `json:"finished_at"`
+	Counts      results.Counts `json:"counts"`
+	SuccessRate float64        `json:"success_rate"`
+}
+
+// With quota.daily set
+type quotaReport struct {
+	Day    string `json:"day"`
+	Pushed int    `json:"pushed"`
+	Daily  int    `json:"daily"`
+}
+
+type recentReport struct {
+	Since       time.Time      `json:"since"`
+	Counts      results.Counts `json:"counts"`
+	SuccessRate float64        `json:"success_rate"`
+}
+
+func statusCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("status")
+	var o options
+	o.register(fs)
+	limit := fs.Int("limit", 20, "maximum number of invoice numbers to list, 0 for all")
+	window := fs.Duration("since", 24*time.Hour, "period the pushed and failed counts cover")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	// A queue cannot be looked into without consuming it, so its backlog
+	// is left out
+	queue := cfg.Source.Type != "database" && cfg.Source.Type != "file"
+	var src source.Source = db
+	switch {
+	case cfg.Source.Type == "file":
+		src = source.NewFile(cfg.Source.File)
+	case len(cfg.Shards) > 0:
+		if src, err = openSource(ctx, cfg, db); err != nil {
+			return err
+		}
+		defer closeSource(src)
+	}
+
+	login, err := newAuth(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	p, err := newPipeline(cfg, httpClient, login, src)
+	if err != nil {
+		return err
+	}
+	if cfg.Attempts.Enabled {
+		p.Attempts = attempts.NewStore(db.Write, db.Dialect, cfg.Attempts)
+	}
+	var pending []source.Transaction
+	if !queue {
+		if pending, err = p.Pending(ctx); err != nil {
+			return err
+		}
+	}
+	r := report{Pending: len(pending), PendingInvoices: []string{}}
+	for i, txn := range pending {
+		if *limit > 0 && i == *limit {
+			break
+		}
+		r.PendingInvoices = append(r.PendingInvoices, txn.InvoiceID)
+	}
+
+	if a, ok := src.(source.Ager); ok && !queue && cfg.Query.CreatedColumn != "" && len(pending) > 0 {
+		oldest, err := a.OldestPending(ctx)
+		if err != nil {
+			return dbErrorf("failed to read the oldest pending invoice: %v", err)
+		}
+		if !oldest.IsZero() {
+			r.OldestPending = &oldest
+		}
+	}
+	if cfg.Results.Enabled {
+		store := results.NewStore(db.Read, db.Dialect, cfg.Results)
+		last, err := store.LastSuccess(ctx)
+		if err != nil {
+			return dbErrorf("failed to read results: %v", err)
+		}
+		if !last.IsZero() {
+			r.LastSuccess = &last
+		}
+		run, ok, err := store.LastRun(ctx)
+		if err != nil {
+			return dbErrorf("failed to read results: %v", err)
+		}
+		if ok {
+			r.LastRun = &runReport{ID: run.ID, Started: run.Started, Finished: run.Finished,
+				Counts: run.Counts, SuccessRate: run.SuccessRate()}
+		}
+		since := time.Now().Add(-*window)
+		counts, err := store.Counts(ctx, since)
+		if err != nil {
+			return dbErrorf("failed to read results: %v", err)
+		}
+		r.Recent = &recentReport{Since: since, Counts: counts, SuccessRate: counts.SuccessRate()}
+	}
+	if cfg.DeadLetter.Enabled {
+		n, err := dlq.NewStore(db.Read, db.Dialect, cfg.DeadLetter).Count(ctx)
+		if err != nil {
+			return dbErrorf("failed to read dead letters: %v", err)
+		}
+		r.DeadLettered = &n
+	}
+	if cfg.Quota.Daily > 0 {
+		day := p.QuotaDay(time.Now())
+		n, err := quota.NewStore(db.Read, db.Dialect, cfg.Quota).Used(ctx, day)
+		if err != nil {
+			return dbErrorf("failed to read the quota: %v", err)
+		}
+		r.Quota = &quotaReport{Day: day, Pushed: n, Daily: cfg.Quota.Daily}
+	}
+	if p.Attempts != nil {
+		if r.Exhausted, err = p.Attempts.List(ctx); err != nil {
+			return dbErrorf("failed to read attempts: %v", err)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	if queue {
+		fmt.Printf("Pending invoices are queued in %s\n", cfg.Source.Type)
+	} else {
+		fmt.Printf("%d invoice(s) pending\n", len(pending))
+	}
+	printReport(r, pending, cfg.Attempts.Max, *limit)
+	return nil
+}
+
+func printReport(r report, pending []source.Transaction, maxAttempts, limit int) {
+	for i, txn := range pending {
+		if limit > 0 && i == limit {
+			fmt.Printf("... and %d more\n", len(pending)-limit)
+			break
+		}
+		if txn.Group != "" {
+			fmt.Printf("  %s (group %s)\n", txn.InvoiceID, txn.Group)
+		} else {
+			fmt.Printf("  %s\n", txn.InvoiceID)
+		}
+	}
+
+	if r.OldestPending != nil {
+		fmt.Printf("Oldest pending invoice created %s, %s ago\n", r.OldestPending.Local().Format(time.RFC3339), time.Since(*r.OldestPending).Round(time.Second))
+	}
+	if r.LastSuccess != nil {
+		fmt.Printf("Last successful push %s, %s ago\n", r.LastSuccess.Local().Format(time.RFC3339), time.Since(*r.LastSuccess).Round(time.Second))
+	}
+	if r.LastRun != nil {
+		c := r.LastRun.Counts
+		fmt.Printf("Last run %s at %s: %d pushed, %d failed, %d parked, %d for review, %d rejected (%.1f%% success)\n",
+			r.LastRun.ID, r.LastRun.Finished.Local().Format(time.RFC3339), c.Success, c.Failed, c.Parked, c.Review, c.Rejected, r.LastRun.SuccessRate*100)
+	}
+	if r.Recent != nil {
+		c := r.Recent.Counts
+		fmt.Printf("Since %s: %d pushed, %d failed, %d parked, %d for review, %d rejected (%.1f%% success)\n",
+			r.Recent.Since.Local().Format(time.RFC3339), c.Success, c.Failed, c.Parked, c.Review, c.Rejected, r.Recent.SuccessRate*100)
+	}
+	if r.DeadLettered != nil {
+		fmt.Printf("%d invoice(s) dead-lettered\n", *r.DeadLettered)
+	}
+	if r.Quota != nil {
+		fmt.Printf("%d of the daily quota of %d pushed on %s\n", r.Quota.Pushed, r.Quota.Daily, r.Quota.Day)
+	}
+	if len(r.Exhausted) > 0 {
+		fmt.Printf("%d invoice(s) reached %d attempts and are no longer pushed\n", len(r.Exhausted), maxAttempts)
+		for i, inv := range r.Exhausted {
+			if limit > 0 && i == limit {
+				fmt.Printf("... and %d more\n", len(r.Exhausted)-limit)
+				break
+			}
+			fmt.Printf("  %s: %d attempts, last at %s: %s\n", inv.Invoice, inv.Attempts,
+				inv.LastAt.Local().Format(time.RFC3339), inv.LastError)
+		}
+	}
+}
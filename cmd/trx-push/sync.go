@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/purwaren/trx-push/hooks"
+	"github.com/purwaren/trx-push/pipeline"
+	"github.com/purwaren/trx-push/pull"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/source"
+)
+
+func syncCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("sync")
+	var o options
+	o.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{}
+	cfg, err := o.load(ctx, httpClient)
+	if err != nil {
+		return err
+	}
+	if cfg.Pull.StatusURL == "" {
+		return errors.New("pull.status_url is not configured")
+	}
+	if len(cfg.Shards) > 0 {
+		return errors.New("sync does not support shards")
+	}
+	db, err := source.Open(cfg)
+	if err != nil {
+		return dbErrorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	src, err := openSource(ctx, cfg, db)
+	if err != nil {
+		return err
+	}
+	defer closeSource(src)
+
+	login, err := newAuth(cfg, httpClient)
+	if err != nil {
+		return err
+	}
+	p, err := newPipeline(cfg, httpClient, login, src)
+	if err != nil {
+		return err
+	}
+	if c, ok := p.Sink.(io.Closer); ok {
+		defer c.Close()
+	}
+	defer attachStores(cfg, db, p)()
+	if p.Hooks, err = hooks.Load(ctx, cfg.Hooks); err != nil {
+		return err
+	}
+	defer p.Hooks.Close()
+	sinks := httpSinks(p.Sink)
+	if len(sinks) == 0 {
+		return errors.New("sync needs the http sink")
+	}
+	s := &pull.Syncer{
+		Puller: &pull.Puller{HTTP: sinks[0], DB: db, Config: cfg.Pull},
+		Rules:  cfg.Sync,
+		Repush: func(ctx context.Context, invoiceID string) error {
+			status, err := p.PushInvoice(ctx, invoiceID)
+			if err == nil && status != results.StatusSuccess {
+				err = fmt.Errorf("push %s", status)
+			}
+			return err
+		},
+	}
+
+	for {
+		// Push first, so the pull sees the invoices pushed by this cycle
+		pushErr := p.RunOnce(ctx)
+		if ctx.Err() != nil {
+			return pipeline.ErrInterrupted
+		}
+		if pushErr != nil {
+			slog.Error("Push failed", "error", pushErr)
+		}
+		if s.HTTP.Auth.Token() == "" {
+			if err := s.HTTP.Auth.Login(ctx); err != nil {
+				return &pipeline.LoginError{Err: err}
+			}
+		}
+		sum, err := s.Run(ctx)
+		if ctx.Err() != nil {
+			return pipeline.ErrInterrupted
+		}
+		if err != nil {
+			err = dbErrorf("%v", err)
+			slog.Error("Pull failed", "error", err)
+		} else {
+			slog.Info("Pull finished", "polled", sum.Polled, "updated", sum.Updated, "unchanged", sum.Unchanged,
+				"repushed", sum.Repushed, "failed", sum.Failed)
+		}
+
+		if cfg.Sync.Interval == 0 {
+			switch {
+			case pushErr != nil:
+				return pushErr
+			case err != nil:
+				return err
+			case sum.Failed > 0:
+				return fmt.Errorf("%d of %d invoice statuses were not synced", sum.Failed, sum.Polled)
+			}
+			return checkPushes(p.LastSummary())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(cfg.Sync.Interval):
+		}
+	}
+}
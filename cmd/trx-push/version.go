@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with
+//
+//	-ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+//
+// Without them the commit and its time stamped by go build are shown.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+		case s.Key == "vcs.time" && date == "":
+			date = s.Value
+		}
+	}
+	if v := info.Main.Version; version == "dev" && v != "" && v != "(devel)" {
+		version = v
+	}
+}
+
+// The User-Agent of every request to the API and the other services
+func userAgent() string {
+	return fmt.Sprintf("trx-push/%s (%s; %s/%s)", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func logVersion(ctx context.Context) {
+	slog.InfoContext(ctx, "Starting trx-push", "version", version, "commit", commit, "built", date, "go_version", runtime.Version())
+}
+
+func versionCommand(ctx context.Context, args []string) error {
+	fs := newFlagSet("version")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fmt.Printf("trx-push %s\n", version)
+	fmt.Printf("  commit: %s\n", orUnknown(commit))
+	fmt.Printf("  built:  %s\n", orUnknown(date))
+	fmt.Printf("  go:     %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/pusher"
+)
+
+// Webhooks accepted ahead of the pushes; more are answered with 503 so the
+// sender retries them later
+const webhookBacklog = 100
+
+// Largest webhook body read
+const maxWebhookBody = 1 << 20
+
+// webhook receives the signed webhooks announcing invoices and passes
+// their numbers on to the listening pipeline
+type webhook struct {
+	cfg    config.WebhookConfig
+	events chan string
+}
+
+func newWebhook(cfg config.WebhookConfig) *webhook {
+	return &webhook{cfg: cfg, events: make(chan string, webhookBacklog)}
+}
+
+func (wh *webhook) register(mux *http.ServeMux) {
+	mux.HandleFunc(wh.cfg.Path, wh.handle)
+}
+
+// POST webhook.path with an invoice number in webhook.invoice_field
+// answers 202 once the invoice is queued for a push
+func (wh *webhook) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "failed to read body"})
+		return
+	}
+	if msg := wh.verify(r, body); msg != "" {
+		slog.Warn("Refused webhook", "remote_addr", r.RemoteAddr, "reason", msg)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": msg})
+		return
+	}
+	if wh.cfg.EventField != "" && len(wh.cfg.Events) > 0 {
+		event, _ := jsonutil.Lookup(body, wh.cfg.EventField)
+		if !slices.Contains(wh.cfg.Events, event) {
+			slog.Debug("Ignored webhook event", "event", event)
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "ignored"})
+			return
+		}
+	}
+	invoice, ok := jsonutil.Lookup(body, wh.cfg.InvoiceField)
+	if !ok || invoice == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing " + wh.cfg.InvoiceField})
+		return
+	}
+	select {
+	case wh.events <- invoice:
+		slog.Info("Received webhook", "invoice_id", invoice)
+		writeJSON(w, http.StatusAccepted, map[string]string{"invoice_id": invoice, "status": "queued"})
+	default:
+		// The next catch-up run picks it up if the sender gives up
+		slog.Warn("Too many webhooks waiting, refusing one", "invoice_id", invoice)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "busy, retry later"})
+	}
+}
+
+// Check the timestamp and signature headers of r, returning why they are
+// refused or ""
+func (wh *webhook) verify(r *http.Request, body []byte) string {
+	ts := r.Header.Get(wh.cfg.TimestampHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "missing or invalid " + wh.cfg.TimestampHeader
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > wh.cfg.MaxAge || age < -wh.cfg.MaxAge {
+		return wh.cfg.TimestampHeader + " is more than webhook.max_age off"
+	}
+	sig := r.Header.Get(wh.cfg.SignatureHeader)
+	var got []byte
+	if wh.cfg.Encoding == "base64" {
+		got, err = base64.StdEncoding.DecodeString(sig)
+	} else {
+		got, err = hex.DecodeString(sig)
+	}
+	if err != nil || !hmac.Equal(got, pusher.MAC(wh.cfg.Algorithm, wh.cfg.Secret, body, ts)) {
+		return "invalid " + wh.cfg.SignatureHeader
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CheckKeys returns an error listing the keys of the config at path that
+// no setting reads, such as misspelt ones, which Load ignores
+func CheckKeys(path, profile string, remote RemoteOptions) error {
+	var data []byte
+	var err error
+	if IsRemote(path) {
+		data, _, err = fetchRemote(path, remote)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = decryptSOPS(data); err != nil {
+		return err
+	}
+	if data, err = applyProfile(data, profile); err != nil {
+		return err
+	}
+	shared, tenants, err := splitTenants(data)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	problems = append(problems, unknownKeys(shared, "")...)
+	for _, t := range tenants {
+		problems = append(problems, unknownKeys(t.data, "tenant "+t.name+": ")...)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func unknownKeys(data []byte, prefix string) []string {
+	err := yaml.UnmarshalStrict(data, &Config{})
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		problems := make([]string, len(te.Errors))
+		for i, e := range te.Errors {
+			problems[i] = prefix + e
+		}
+		return problems
+	}
+	if err != nil {
+		return []string{prefix + err.Error()}
+	}
+	return nil
+}
+
+// Endpoint is a configured URL and its key, e.g. api.push_url
+type Endpoint struct {
+	Key string
+	URL string
+}
+
+// Endpoints returns the configured URLs of the API and the services the
+// sinks call, leaving out the empty ones
+func (c *Config) Endpoints() []Endpoint {
+	all := []Endpoint{
+		{"api.login_url", c.API.LoginURL},
+		{"api.push_url", c.API.PushURL},
+		{"api.oauth2.token_url", c.API.OAuth2.TokenURL},
+		{"bulk.url", c.Bulk.URL},
+		{"warmup.url", c.Warmup.URL},
+		{"health.api_url", c.Health.APIURL},
+		{"reconcile.list_url", c.Reconcile.ListURL},
+		{"pull.status_url", c.Pull.StatusURL},
+		{"sink.graphql.url", c.Sink.GraphQL.URL},
+		{"sink.soap.url", c.Sink.SOAP.URL},
+	}
+	var set []Endpoint
+	for _, e := range all {
+		if e.URL != "" {
+			set = append(set, e)
+		}
+	}
+	return set
+}
+
+// CheckURLs returns an error for every endpoint that is not an absolute
+// http(s) URL; the others are left to the clients
+func (c *Config) CheckURLs() []error {
+	var errs []error
+	for _, e := range c.Endpoints() {
+		parsed, err := url.Parse(e.URL)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %v", e.Key, err))
+		case parsed.Scheme != "http" && parsed.Scheme != "https":
+			errs = append(errs, fmt.Errorf("%s %q is not an http or https URL", e.Key, e.URL))
+		case parsed.Host == "":
+			errs = append(errs, fmt.Errorf("%s %q has no host", e.Key, e.URL))
+		}
+	}
+	return errs
+}
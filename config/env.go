@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the environment variables overriding config keys. The
+// rest of the name is the upper-cased key path joined with underscores,
+// e.g. TRX_PUSH_DATABASE_PASSWORD for database.password.
+const EnvPrefix = "TRX_PUSH"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Override config values from environment variables. Lists are comma
+// separated, or given as a YAML flow sequence (e.g. ["0,30 * * * *"]) when
+// the items contain commas or are objects.
+func (c *Config) applyEnv() error {
+	return applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix)
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if t.Field(i).Tag.Get("yaml") == ",inline" {
+			// Keys of an inlined struct belong to the enclosing one
+			if err := applyEnv(f, prefix); err != nil {
+				return err
+			}
+			continue
+		}
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(tag)
+
+		switch {
+		case f.Kind() == reflect.Struct:
+			if err := applyEnv(f, key); err != nil {
+				return err
+			}
+			continue
+		case f.Kind() == reflect.Ptr && f.Type().Elem().Kind() == reflect.Struct:
+			// Only allocate optional sections that are actually overridden
+			n := reflect.New(f.Type().Elem())
+			if f.IsNil() {
+				if !hasEnvPrefix(key + "_") {
+					continue
+				}
+			} else {
+				n.Elem().Set(f.Elem())
+			}
+			if err := applyEnv(n.Elem(), key); err != nil {
+				return err
+			}
+			f.Set(n)
+			continue
+		}
+
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(f, s); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setFromEnv(f reflect.Value, s string) error {
+	if f.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Ptr:
+		n := reflect.New(f.Type().Elem())
+		if err := setFromEnv(n.Elem(), s); err != nil {
+			return err
+		}
+		f.Set(n)
+	case reflect.Slice:
+		if strings.HasPrefix(strings.TrimSpace(s), "[") {
+			return yaml.Unmarshal([]byte(s), f.Addr().Interface())
+		}
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		list := reflect.MakeSlice(f.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setFromEnv(list.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		f.Set(list)
+	case reflect.Map:
+		// A YAML flow mapping such as {X-Channel: pos}
+		m := reflect.New(f.Type())
+		if err := yaml.Unmarshal([]byte(s), m.Interface()); err != nil {
+			return err
+		}
+		f.Set(m.Elem())
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+// Set assigns value to the config key at the dotted path, e.g.
+// "database.password", parsed the same way as an environment override
+func (c *Config) Set(key, value string) error {
+	f, err := c.field(key, true)
+	if err != nil {
+		return err
+	}
+	if err := setFromEnv(f, value); err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return nil
+}
+
+// Find the field for a dotted key. Nil sections on the way are allocated
+// when alloc is set; otherwise only the key's existence is checked.
+func (c *Config) field(key string, alloc bool) (reflect.Value, error) {
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(key, ".") {
+		if v.Kind() == reflect.Ptr {
+			switch {
+			case !v.IsNil():
+			case alloc:
+				v.Set(reflect.New(v.Type().Elem()))
+			default:
+				v = reflect.New(v.Type().Elem())
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("unknown config key %q", key)
+		}
+		f, ok := fieldByTag(v, name)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("unknown config key %q", key)
+		}
+		v = f
+	}
+	return v, nil
+}
+
+func fieldByTag(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("yaml")
+		if tag == ",inline" {
+			if f, ok := fieldByTag(v.Field(i), name); ok {
+				return f, true
+			}
+			continue
+		}
+		if strings.Split(tag, ",")[0] == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ${NAME} or ${NAME:-default}; $${ is a literal ${
+var envRef = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Replace ${NAME} references in string values with the environment
+// variable, so secrets can stay out of the file. Other $ uses, like the $1
+// placeholders in status_update, are left alone.
+func (c *Config) expandEnv() error {
+	return c.RewriteStrings(func(_, s string) (string, error) {
+		return expandString(s)
+	})
+}
+
+// RewriteStrings replaces every string value in the config with the result
+// of fn, which gets the dotted key of the value as well. The first error
+// stops the walk and is returned prefixed with the key.
+func (c *Config) RewriteStrings(fn func(key, s string) (string, error)) error {
+	return rewriteValue(reflect.ValueOf(c).Elem(), "", fn)
+}
+
+func rewriteValue(v reflect.Value, path string, fn func(key, s string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := fn(path, v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return rewriteValue(v.Elem(), path, fn)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := rewriteValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			key := fmt.Sprintf("%s.%v", path, iter.Key())
+			s, err := fn(key, iter.Value().String())
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			v.SetMapIndex(iter.Key(), reflect.ValueOf(s).Convert(v.Type().Elem()))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			yamlTag := t.Field(i).Tag.Get("yaml")
+			tag := strings.Split(yamlTag, ",")[0]
+			if yamlTag == ",inline" {
+				// Keys of an inlined struct belong to the enclosing one
+				if err := rewriteValue(v.Field(i), path, fn); err != nil {
+					return err
+				}
+				continue
+			}
+			if tag == "" || tag == "-" {
+				continue
+			}
+			key := tag
+			if path != "" {
+				key = path + "." + tag
+			}
+			if err := rewriteValue(v.Field(i), key, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func expandString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	out := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		m := envRef.FindStringSubmatch(ref)
+		if v, ok := os.LookupEnv(m[1]); ok {
+			return v
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return ref
+	})
+	return out, err
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/purwaren/trx-push/internal/tmpl"
+)
+
+// NotifyConfig sends the summary of each run to the people looking after
+// the pushes
+type NotifyConfig struct {
+	Email    EmailConfig    `yaml:"email"`
+	Slack    SlackConfig    `yaml:"slack"`
+	Telegram TelegramConfig `yaml:"telegram"`
+	// Links each failed invoice of the chat messages to this template of
+	// the invoice ID, e.g. "https://erp.example.com/invoices/{{.}}"
+	InvoiceURL string `yaml:"invoice_url"`
+}
+
+// ChatConfig decides which runs are posted to a chat. A run is posted
+// when at least MinFailures invoices were not pushed, or when it failed
+// outright, e.g. on login or the database.
+type ChatConfig struct {
+	MinFailures int           `yaml:"min_failures"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// SlackConfig posts failed runs to an incoming webhook. It is off without
+// a webhook URL.
+type SlackConfig struct {
+	WebhookURL string     `yaml:"webhook_url"`
+	Chat       ChatConfig `yaml:",inline"`
+}
+
+// TelegramConfig posts failed runs to a chat through a bot. It is off
+// without a bot token.
+type TelegramConfig struct {
+	BotToken string `yaml:"bot_token"`
+	ChatID   string `yaml:"chat_id"`
+	// The Bot API server
+	APIURL string     `yaml:"api_url"`
+	Chat   ChatConfig `yaml:",inline"`
+}
+
+// EmailConfig mails the run summary through an SMTP server. It is off
+// without recipients.
+type EmailConfig struct {
+	To   []string `yaml:"to"`
+	From string   `yaml:"from"`
+	Host string   `yaml:"host"`
+	// Defaults to 587, or 465 with tls
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// starttls (the default), tls for implicit TLS, or none
+	TLS string `yaml:"tls"`
+	// "failure" mails only runs that left invoices unpushed or stopped
+	// early, "always" mails every run
+	When    string        `yaml:"when"`
+	Subject string        `yaml:"subject"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (n *NotifyConfig) applyDefaults() {
+	e := &n.Email
+	setDefault(&e.TLS, "starttls")
+	if e.Port == 0 {
+		e.Port = 587
+		if e.TLS == "tls" {
+			e.Port = 465
+		}
+	}
+	setDefault(&e.When, "failure")
+	setDefault(&e.Subject, "trx-push run summary")
+	setDefaultDuration(&e.Timeout, 30*time.Second)
+	n.Slack.Chat.applyDefaults()
+	n.Telegram.Chat.applyDefaults()
+	setDefault(&n.Telegram.APIURL, "https://api.telegram.org")
+}
+
+func (c *ChatConfig) applyDefaults() {
+	if c.MinFailures <= 0 {
+		c.MinFailures = 1
+	}
+	setDefaultDuration(&c.Timeout, 10*time.Second)
+}
+
+func (n NotifyConfig) validate() error {
+	if n.Telegram.BotToken != "" && n.Telegram.ChatID == "" {
+		return errors.New("notify.telegram.chat_id is required with notify.telegram.bot_token")
+	}
+	if _, err := tmpl.Parse("invoice_url", n.InvoiceURL); err != nil {
+		return fmt.Errorf("notify.invoice_url: %v", err)
+	}
+	e := n.Email
+	if len(e.To) == 0 {
+		return nil
+	}
+	if e.Host == "" || e.From == "" {
+		return errors.New("notify.email.host and notify.email.from are required with notify.email.to")
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		return fmt.Errorf("invalid notify.email.from: %v", err)
+	}
+	for _, to := range e.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid notify.email.to %q: %v", to, err)
+		}
+	}
+	if !contains([]string{"starttls", "tls", "none"}, e.TLS) {
+		return fmt.Errorf("unknown notify.email.tls %q (expected starttls, tls or none)", e.TLS)
+	}
+	return validateNotifyWhen("notify.email.when", e.When)
+}
+
+func validateNotifyWhen(key, when string) error {
+	if when != "failure" && when != "always" {
+		return fmt.Errorf("unknown %s %q (expected failure or always)", key, when)
+	}
+	return nil
+}
+
+// AlertsConfig opens incidents in daemon mode when pushing falls behind,
+// and resolves them once it recovers
+type AlertsConfig struct {
+	// > 0 alerts when a run finds more pending invoices than this
+	Backlog int `yaml:"backlog"`
+	// > 0 alerts when pushes have been failing without a success for this
+	// long
+	FailingFor time.Duration `yaml:"failing_for"`
+	// > 0 alerts when the oldest pending invoice is older than this after a
+	// run; needs query.created_column
+	MaxAge time.Duration `yaml:"max_age"`
+	// Identifies the incidents of this instance, defaults to trx-push
+	Key       string          `yaml:"key"`
+	PagerDuty PagerDutyConfig `yaml:"pagerduty"`
+	Opsgenie  OpsgenieConfig  `yaml:"opsgenie"`
+	Timeout   time.Duration   `yaml:"timeout"`
+}
+
+// PagerDutyConfig sends alerts through the Events API v2. It is off
+// without a routing key.
+type PagerDutyConfig struct {
+	RoutingKey string `yaml:"routing_key"`
+	URL        string `yaml:"url"`
+}
+
+// OpsgenieConfig sends alerts through the Alert API. It is off without an
+// API key.
+type OpsgenieConfig struct {
+	APIKey string `yaml:"api_key"`
+	// https://api.eu.opsgenie.com for the EU instance
+	URL string `yaml:"url"`
+}
+
+func (a *AlertsConfig) applyDefaults() {
+	setDefault(&a.Key, "trx-push")
+	setDefault(&a.PagerDuty.URL, "https://events.pagerduty.com/v2/enqueue")
+	setDefault(&a.Opsgenie.URL, "https://api.opsgenie.com")
+	setDefaultDuration(&a.Timeout, 10*time.Second)
+}
+
+// Enabled tells whether a condition and a service are set
+func (a AlertsConfig) Enabled() bool {
+	return (a.Backlog > 0 || a.FailingFor > 0 || a.MaxAge > 0) && (a.PagerDuty.RoutingKey != "" || a.Opsgenie.APIKey != "")
+}
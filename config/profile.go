@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Merge the section of profiles selected by profile over the rest of the
+// file: mappings are merged key by key, any other value (including lists)
+// replaces the shared one. The profiles section itself is dropped.
+func applyProfile(data []byte, profile string) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return data, nil // reported by the real unmarshal
+	}
+	var profiles yaml.MapSlice
+	found := false
+	for i, item := range doc {
+		if item.Key == "profiles" {
+			profiles, _ = item.Value.(yaml.MapSlice)
+			doc = append(doc[:i], doc[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found && profile == "" {
+		return data, nil
+	}
+	if profile == "" {
+		return yaml.Marshal(doc)
+	}
+
+	var names []string
+	for _, p := range profiles {
+		name := fmt.Sprint(p.Key)
+		if name != profile {
+			names = append(names, name)
+			continue
+		}
+		override, ok := p.Value.(yaml.MapSlice)
+		if !ok && p.Value != nil {
+			return nil, fmt.Errorf("profile %q must be a mapping", profile)
+		}
+		return yaml.Marshal(mergeYAML(doc, override))
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("unknown profile %q (the config has no profiles)", profile)
+	}
+	return nil, fmt.Errorf("unknown profile %q (available: %s)", profile, strings.Join(names, ", "))
+}
+
+func mergeYAML(base, override yaml.MapSlice) yaml.MapSlice {
+	for _, o := range override {
+		merged := false
+		for i := range base {
+			if base[i].Key != o.Key {
+				continue
+			}
+			b, bok := base[i].Value.(yaml.MapSlice)
+			ov, ook := o.Value.(yaml.MapSlice)
+			if bok && ook {
+				base[i].Value = mergeYAML(b, ov)
+			} else {
+				base[i].Value = o.Value
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			base = append(base, o)
+		}
+	}
+	return base
+}
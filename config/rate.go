@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseRate parses a rate such as "10/s", "600/m" or "5/100ms" into events
+// per second. An empty string is no limit and returns 0.
+func ParseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q (expected e.g. 10/s)", s)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q: count must be a positive number", s)
+	}
+	per = strings.TrimSpace(per)
+	var d time.Duration
+	switch per {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		if d, err = time.ParseDuration(per); err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid rate %q: unknown period %q", s, per)
+		}
+	}
+	return n / d.Seconds(), nil
+}
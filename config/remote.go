@@ -0,0 +1,92 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RemoteOptions control how a config is fetched from an http(s):// URL
+type RemoteOptions struct {
+	// Client used for the fetch; http.DefaultClient when nil
+	Client *http.Client
+	// Authorization header value, e.g. "Bearer ..."
+	Auth    string
+	Timeout time.Duration
+	// File where the last fetched config is cached
+	CachePath string
+	// Use the cached copy when the fetch fails
+	Fallback bool
+}
+
+// IsRemote reports whether path refers to a config service URL
+func IsRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// Fetch the config from the config service, falling back to the cached
+// copy when the service is unreachable. cached reports whether the fallback
+// was used; a fresh copy is only cached by saveRemote once it parsed.
+func fetchRemote(url string, opts RemoteOptions) (data []byte, cached bool, err error) {
+	data, err = getRemote(url, opts)
+	if err == nil {
+		return data, false, nil
+	}
+
+	if opts.CachePath == "" || !opts.Fallback {
+		return nil, false, err
+	}
+	data, cacheErr := os.ReadFile(opts.CachePath)
+	if cacheErr != nil {
+		return nil, false, fmt.Errorf("%v (no usable cache: %v)", err, cacheErr)
+	}
+	slog.Warn("Failed to fetch config, using cached copy", "url", url, "cache", opts.CachePath, "error", err)
+	return data, true, nil
+}
+
+// Cache a fetched config as the last good copy
+func saveRemote(data []byte, opts RemoteOptions) {
+	if opts.CachePath == "" {
+		return
+	}
+	if err := os.WriteFile(opts.CachePath, data, 0600); err != nil {
+		slog.Warn("Failed to write config cache", "path", opts.CachePath, "error", err)
+	}
+}
+
+func getRemote(url string, opts RemoteOptions) ([]byte, error) {
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Auth != "" {
+		req.Header.Set("Authorization", opts.Auth)
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch config, status: %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRemoteCache(t *testing.T) {
+	const good = "api: {login_url: \"http://api.invalid/login\", push_url: \"http://api.invalid/push\"}\n"
+	body, status := good, http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	opts := RemoteOptions{CachePath: filepath.Join(t.TempDir(), "config.cache.yaml"), Fallback: true}
+	cached := func() string {
+		t.Helper()
+		data, err := os.ReadFile(opts.CachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	if _, err := Load(srv.URL, "", opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := cached(); got != good {
+		t.Fatalf("cached %q, want %q", got, good)
+	}
+
+	// A config that does not parse leaves the last good copy alone
+	body = good + "retry: {jitter: sometimes}\n"
+	if _, err := Load(srv.URL, "", opts); err == nil {
+		t.Fatal("loaded a config with an invalid retry.jitter")
+	}
+	if got := cached(); got != good {
+		t.Fatalf("cache overwritten with %q", got)
+	}
+
+	status = http.StatusServiceUnavailable
+	cfg, err := Load(srv.URL, "", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.API.PushURL != "http://api.invalid/push" {
+		t.Fatalf("push_url = %q, want the cached one", cfg.API.PushURL)
+	}
+}
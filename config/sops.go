@@ -0,0 +1,250 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v2"
+)
+
+// Values encrypted by SOPS look like ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:(str|int|float|bool)\]$`)
+
+// Decrypt a SOPS file encrypted for age recipients: the data key in
+// sops.age is decrypted with the identities from SOPS_AGE_KEY,
+// SOPS_AGE_KEY_FILE or ~/.config/sops/age/keys.txt, then every ENC[...]
+// value with it, checking the SOPS MAC over the values. Files without a
+// sops section are returned unchanged.
+func decryptSOPS(data []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return data, nil // reported by the real unmarshal
+	}
+	var meta struct {
+		Age []struct {
+			Recipient string `yaml:"recipient"`
+			Enc       string `yaml:"enc"`
+		} `yaml:"age"`
+		LastModified     string `yaml:"lastmodified"`
+		MAC              string `yaml:"mac"`
+		MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+	}
+	found := false
+	for i, item := range doc {
+		if item.Key == "sops" {
+			raw, _ := yaml.Marshal(item.Value)
+			if err := yaml.Unmarshal(raw, &meta); err != nil {
+				return nil, fmt.Errorf("invalid sops metadata: %v", err)
+			}
+			doc = append(doc[:i], doc[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return data, nil
+	}
+	if len(meta.Age) == 0 {
+		return nil, errors.New("config is encrypted with SOPS but not for an age recipient")
+	}
+
+	identities, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	for _, r := range meta.Age {
+		rd, err := age.Decrypt(armor.NewReader(strings.NewReader(r.Enc)), identities...)
+		if err != nil {
+			continue
+		}
+		if key, err = io.ReadAll(rd); err == nil {
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.New("none of the age identities can decrypt the SOPS data key")
+	}
+
+	mac := &sopsMAC{hash: sha512.New(), onlyEncrypted: meta.MACOnlyEncrypted}
+	if mac.onlyEncrypted {
+		mac.hash.Write(macOnlyEncryptedInit)
+	}
+	plain, err := decryptSOPSValue(doc, nil, key, mac)
+	if err != nil {
+		return nil, err
+	}
+	if err := mac.verify(meta.MAC, meta.LastModified, key); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(plain)
+}
+
+// What sops starts the MAC with under mac_only_encrypted, so it never
+// matches the MAC over all values
+var macOnlyEncryptedInit = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+// sopsMAC sums the values of a SOPS file in order, as sops does for its
+// MAC: SHA-512 over each value written out, bools as True and False
+type sopsMAC struct {
+	hash hash.Hash
+	// Leave out the values stored in plain text
+	onlyEncrypted bool
+}
+
+func (m *sopsMAC) add(v interface{}, encrypted bool) {
+	if m.onlyEncrypted && !encrypted {
+		return
+	}
+	switch v := v.(type) {
+	case nil:
+	case string:
+		m.hash.Write([]byte(v))
+	case bool:
+		if v {
+			m.hash.Write([]byte("True"))
+		} else {
+			m.hash.Write([]byte("False"))
+		}
+	case float64:
+		m.hash.Write([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
+	default:
+		m.hash.Write([]byte(fmt.Sprint(v)))
+	}
+}
+
+// Compare the sum with sops.mac, encrypted with the data key and
+// authenticated with sops.lastmodified
+func (m *sopsMAC) verify(enc, lastModified string, key []byte) error {
+	parts := sopsValue.FindStringSubmatch(enc)
+	if parts == nil {
+		return errors.New("the SOPS file has no valid sops.mac")
+	}
+	modified, err := time.Parse(time.RFC3339, lastModified)
+	if err != nil {
+		return fmt.Errorf("invalid sops.lastmodified %q", lastModified)
+	}
+	want, err := openSOPS(parts[1], parts[2], parts[3], modified.Format(time.RFC3339), key)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt sops.mac: %v", err)
+	}
+	if got := fmt.Sprintf("%X", m.hash.Sum(nil)); got != want {
+		return errors.New("SOPS MAC mismatch, the file was changed after it was encrypted")
+	}
+	return nil
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	if k := os.Getenv("SOPS_AGE_KEY"); k != "" {
+		return age.ParseIdentities(strings.NewReader(k))
+	}
+	path := os.Getenv("SOPS_AGE_KEY_FILE")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "sops", "age", "keys.txt")
+	}
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no age key to decrypt the config (set SOPS_AGE_KEY or SOPS_AGE_KEY_FILE): %v", err)
+	}
+	return age.ParseIdentities(bytes.NewReader(f))
+}
+
+// SOPS authenticates each value with the path of mapping keys leading to
+// it, joined and terminated by ":"; list indexes are not part of the path.
+// Every value is added to mac in order.
+func decryptSOPSValue(v interface{}, path []string, key []byte, mac *sopsMAC) (interface{}, error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			k := fmt.Sprint(v[i].Key)
+			dec, err := decryptSOPSValue(v[i].Value, append(path, k), key, mac)
+			if err != nil {
+				return nil, err
+			}
+			v[i].Value = dec
+		}
+		return v, nil
+	case []interface{}:
+		for i := range v {
+			dec, err := decryptSOPSValue(v[i], path, key, mac)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = dec
+		}
+		return v, nil
+	case string:
+		m := sopsValue.FindStringSubmatch(v)
+		if m == nil {
+			mac.add(v, false)
+			return v, nil
+		}
+		plain, err := openSOPS(m[1], m[2], m[3], strings.Join(path, ":")+":", key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %v", strings.Join(path, "."), err)
+		}
+		var value interface{} = plain
+		switch m[4] {
+		case "int":
+			value, err = strconv.Atoi(plain)
+		case "float":
+			value, err = strconv.ParseFloat(plain, 64)
+		case "bool":
+			value, err = strconv.ParseBool(plain)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %v", strings.Join(path, "."), err)
+		}
+		mac.add(value, true)
+		return value, nil
+	}
+	mac.add(v, false)
+	return v, nil
+}
+
+func openSOPS(data, iv, tag, aad string, key []byte) (string, error) {
+	ct, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(iv)
+	if err != nil {
+		return "", err
+	}
+	t, err := base64.StdEncoding.DecodeString(tag)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return "", err
+	}
+	plain, err := gcm.Open(nil, nonce, append(ct, t...), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v2"
+)
+
+// Decrypted from both testdata files
+const sopsPlain = `
+database:
+  host: db.internal
+  port: 5432
+  password: s3cret
+api:
+  username: pos
+  password: hunter2
+  verify: true
+  ratio: 0.5
+tags:
+  - edge
+  - pos
+`
+
+func readSOPS(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecryptSOPS(t *testing.T) {
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("SOPS_AGE_KEY_FILE", "testdata/age_keys.txt")
+	var want map[string]interface{}
+	if err := yaml.Unmarshal([]byte(sopsPlain), &want); err != nil {
+		t.Fatal(err)
+	}
+	// Every value encrypted, or only the passwords
+	for _, name := range []string{"secrets.sops.yaml", "partial.sops.yaml"} {
+		t.Run(name, func(t *testing.T) {
+			plain, err := decryptSOPS(readSOPS(t, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := yaml.Unmarshal(plain, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("decrypted:\n%s\nwant:\n%s", plain, sopsPlain)
+			}
+		})
+	}
+}
+
+func TestDecryptSOPSErrors(t *testing.T) {
+	data := string(readSOPS(t, "partial.sops.yaml"))
+	lines := strings.Split(data, "\n")
+	// The encrypted passwords of database and api
+	var db, api string
+	for _, l := range lines {
+		if v, ok := strings.CutPrefix(l, "    password: "); ok {
+			if db == "" {
+				db = v
+			} else {
+				api = v
+			}
+		}
+	}
+	swapped := strings.NewReplacer(db, api, api, db).Replace(data)
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		data string
+		want string
+	}{
+		// A value is authenticated with its path
+		{"moved value", "", swapped, "failed to decrypt database.password"},
+		{"wrong key", other.String(), data, "none of the age identities"},
+		{"no age recipient", "", "a: 1\nsops:\n    version: 3.9.0\n", "not for an age recipient"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SOPS_AGE_KEY", tt.key)
+			t.Setenv("SOPS_AGE_KEY_FILE", "testdata/age_keys.txt")
+			_, err := decryptSOPS([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecryptSOPSPlain(t *testing.T) {
+	data := []byte("database:\n  password: ENC[not sops]\n")
+	got, err := decryptSOPS(data)
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("got %q, %v; want the file unchanged", got, err)
+	}
+}
+
+func TestDecryptSOPSMAC(t *testing.T) {
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("SOPS_AGE_KEY_FILE", "testdata/age_keys.txt")
+	partial := string(readSOPS(t, "partial.sops.yaml"))
+	macOnly := string(readSOPS(t, "maconly.sops.yaml"))
+	lastModified := regexp.MustCompile(`lastmodified: ".*"`)
+	tests := []struct {
+		name string
+		data string
+		// Empty when the file decrypts
+		want string
+	}{
+		{"changed plain value", strings.Replace(partial, "host: db.internal", "host: db.example", 1), "SOPS MAC mismatch"},
+		{"removed value", strings.Replace(partial, "    - edge\n", "", 1), "SOPS MAC mismatch"},
+		{"changed bool", strings.Replace(partial, "verify: true", "verify: false", 1), "SOPS MAC mismatch"},
+		{"no mac", regexp.MustCompile(`(?m)^    mac: .*\n`).ReplaceAllString(partial, ""), "no valid sops.mac"},
+		// The MAC is authenticated with the modification time
+		{"changed lastmodified", lastModified.ReplaceAllString(partial, `lastmodified: "2020-01-01T00:00:00Z"`), "failed to decrypt sops.mac"},
+		// Only the encrypted values are covered by the MAC
+		{"mac_only_encrypted", macOnly, ""},
+		{"mac_only_encrypted plain value", strings.Replace(macOnly, "host: db.internal", "host: db.example", 1), ""},
+		{"mac_only_encrypted removed secrets", regexp.MustCompile(`(?m)^    password: ENC.*\n`).ReplaceAllLiteralString(macOnly, ""), "SOPS MAC mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decryptSOPS([]byte(tt.data))
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// MatchStatus reports whether code is one of patterns, each a status code
+// such as "429" or a class such as "5xx"
+func MatchStatus(patterns []string, code int) bool {
+	for _, p := range patterns {
+		if n, err := strconv.Atoi(p); err == nil {
+			if n == code {
+				return true
+			}
+		} else if len(p) == 3 && p[1:] == "xx" && code/100 == int(p[0]-'0') {
+			return true
+		}
+	}
+	return false
+}
+
+func validateStatusPatterns(key string, patterns []string) error {
+	for _, p := range patterns {
+		if n, err := strconv.Atoi(p); err == nil && n >= 100 && n <= 599 {
+			continue
+		}
+		if len(p) == 3 && p[0] >= '1' && p[0] <= '5' && p[1:] == "xx" {
+			continue
+		}
+		return fmt.Errorf("%s: invalid status %q (expected e.g. 422 or 5xx)", key, p)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Tenant names end up in file names and metric labels
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// A tenant of the tenants section: its name and the settings merged over
+// the shared ones
+type tenantDoc struct {
+	name string
+	data []byte
+}
+
+// Remove the tenants section from data, returning the rest and each tenant
+// as the rest with its own settings merged over it, the same way as a
+// profile
+func splitTenants(data []byte) ([]byte, []tenantDoc, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return data, nil, nil // reported by the real unmarshal
+	}
+	var list []interface{}
+	found := false
+	for i, item := range doc {
+		if item.Key == "tenants" {
+			var ok bool
+			if list, ok = item.Value.([]interface{}); !ok && item.Value != nil {
+				return nil, nil, errors.New("tenants must be a list")
+			}
+			doc = append(doc[:i], doc[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return data, nil, nil
+	}
+	shared, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tenants []tenantDoc
+	for i, item := range list {
+		override, ok := item.(yaml.MapSlice)
+		if !ok {
+			return nil, nil, fmt.Errorf("tenants[%d] must be a mapping", i)
+		}
+		t := tenantDoc{}
+		for j, o := range override {
+			if o.Key == "name" {
+				t.name = fmt.Sprint(o.Value)
+				override = append(override[:j], override[j+1:]...)
+				break
+			}
+		}
+		if !tenantName.MatchString(t.name) {
+			return nil, nil, fmt.Errorf("tenants[%d].name must be letters, digits, - and _, got %q", i, t.name)
+		}
+		// A fresh copy, mergeYAML changes the mappings of its base
+		var base yaml.MapSlice
+		if err := yaml.Unmarshal(shared, &base); err != nil {
+			return nil, nil, err
+		}
+		if t.data, err = yaml.Marshal(mergeYAML(base, override)); err != nil {
+			return nil, nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	if len(tenants) == 0 {
+		return nil, nil, errors.New("tenants is empty")
+	}
+	return shared, tenants, nil
+}
+
+// Settings that cannot differ between or be shared by tenants
+func validateTenants(tenants []*Config) error {
+	seen := make(map[string]bool)
+	caches := make(map[string]string)
+	for _, t := range tenants {
+		if seen[t.Tenant] {
+			return fmt.Errorf("tenant %s is listed twice", t.Tenant)
+		}
+		seen[t.Tenant] = true
+		if t.Admin.Listen != "" {
+			return fmt.Errorf("tenant %s: admin is not supported with tenants", t.Tenant)
+		}
+		if t.Webhook.Enabled {
+			return fmt.Errorf("tenant %s: webhook is not supported with tenants", t.Tenant)
+		}
+		if tc := t.API.TokenCache; tc.Enabled {
+			if other, ok := caches[tc.File]; ok {
+				return fmt.Errorf("tenants %s and %s share api.token_cache.file %s", other, t.Tenant, tc.File)
+			}
+			caches[tc.File] = t.Tenant
+		}
+	}
+	return nil
+}
+
+// ForTenant returns the config of the tenant called name
+func (c *Config) ForTenant(name string) (*Config, error) {
+	if len(c.Tenants) == 0 {
+		return nil, fmt.Errorf("unknown tenant %q (the config has no tenants)", name)
+	}
+	var names []string
+	for _, t := range c.Tenants {
+		if t.Tenant == name {
+			return t, nil
+		}
+		names = append(names, t.Tenant)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("unknown tenant %q (available: %s)", name, strings.Join(names, ", "))
+}
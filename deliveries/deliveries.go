@@ -0,0 +1,75 @@
+// Package deliveries records which fanout targets already took an invoice,
+// so a retry after a partial failure only pushes to the others.
+package deliveries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Store reads and updates the fanout table
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.FanoutConfig
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.FanoutConfig) *Store {
+	return &Store{DB: db, Dialect: dialect, Config: cfg}
+}
+
+// Reload picks up the table of cfg.Fanout
+func (s *Store) Reload(cfg *config.Config) {
+	s.Config = cfg.Fanout
+}
+
+// Delivered returns the targets invoice was pushed to
+func (s *Store) Delivered(ctx context.Context, invoice string) (map[string]bool, error) {
+	query := fmt.Sprintf("SELECT target FROM %s WHERE invoice_number = %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	rows, err := s.DB.QueryContext(ctx, query, invoice)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	delivered := make(map[string]bool)
+	for rows.Next() {
+		var target string
+		if err := rows.Scan(&target); err != nil {
+			return nil, err
+		}
+		delivered[target] = true
+	}
+	return delivered, rows.Err()
+}
+
+// Mark records that target took invoice
+func (s *Store) Mark(ctx context.Context, invoice, target string) error {
+	d := s.Dialect
+	query := fmt.Sprintf("INSERT INTO %s (invoice_number, target) VALUES (%s, %s)", d.QuoteQualified(s.Config.Table), d.Param(1), d.Param(2))
+	_, err := s.DB.ExecContext(ctx, query, invoice, target)
+	return err
+}
+
+// Clear forgets the targets of invoice, once all of them took it
+func (s *Store) Clear(ctx context.Context, invoice string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE invoice_number = %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	_, err := s.DB.ExecContext(ctx, query, invoice)
+	return err
+}
+
+// Migrate creates the fanout table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	d := s.Dialect
+	query := d.CreateTable(d.QuoteQualified(s.Config.Table),
+		"invoice_number "+d.Type(sqlutil.String),
+		"target "+d.Type(sqlutil.String),
+		"delivered_at "+d.Type(sqlutil.Timestamp),
+		"PRIMARY KEY (invoice_number, target)")
+	_, err := s.DB.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,199 @@
+// Package dlq keeps the invoices that could not be pushed in a dead-letter
+// table, with what the push API answered, so they can be investigated and
+// reprocessed later.
+package dlq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Entry is one dead-lettered invoice
+type Entry struct {
+	Invoice  string
+	Status   string
+	HTTPCode int
+	// The pusher.Class of the failure
+	Class    string
+	Error    string
+	Response []byte
+	Attempts int
+	At       time.Time
+}
+
+// Store writes entries into the dead_letter table
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.DeadLetterConfig
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.DeadLetterConfig) *Store {
+	return &Store{DB: db, Dialect: dialect, Config: cfg}
+}
+
+// Reload picks up the table of cfg.DeadLetter for the next entry
+func (s *Store) Reload(cfg *config.Config) {
+	s.Config = cfg.DeadLetter
+}
+
+// Add records a failed invoice. An invoice already in the table is updated
+// with the latest failure and its failure count increased.
+func (s *Store) Add(ctx context.Context, e Entry) error {
+	table := s.Dialect.QuoteQualified(s.Config.Table)
+	args := []interface{}{e.Invoice, e.Status, e.HTTPCode, e.Class, e.Error, text(e.Response), e.Attempts, e.At}
+	var query string
+	switch s.Dialect {
+	case sqlutil.Postgres, sqlutil.SQLite:
+		query = fmt.Sprintf(`INSERT INTO %s AS d
+	(invoice_number, status, http_code, error_class, error, response_body, attempts, failures, first_failed_at, last_failed_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, 1, $8, $8)
+ON CONFLICT (invoice_number) DO UPDATE SET
+	status = EXCLUDED.status,
+	http_code = EXCLUDED.http_code,
+	error_class = EXCLUDED.error_class,
+	error = EXCLUDED.error,
+	response_body = EXCLUDED.response_body,
+	attempts = EXCLUDED.attempts,
+	failures = d.failures + 1,
+	last_failed_at = EXCLUDED.last_failed_at`, table)
+	case sqlutil.MySQL:
+		args = append(args, e.At)
+		query = fmt.Sprintf(`INSERT INTO %s
+	(invoice_number, status, http_code, error_class, error, response_body, attempts, failures, first_failed_at, last_failed_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?, ?)
+ON DUPLICATE KEY UPDATE
+	status = VALUES(status),
+	http_code = VALUES(http_code),
+	error_class = VALUES(error_class),
+	error = VALUES(error),
+	response_body = VALUES(response_body),
+	attempts = VALUES(attempts),
+	failures = failures + 1,
+	last_failed_at = VALUES(last_failed_at)`, table)
+	default:
+		query = s.Dialect.Merge(table, "invoice_number", "status", "http_code", "error_class", "error", "response_body", "attempts", "failed_at") + `
+ON (d.invoice_number = s.invoice_number)
+WHEN MATCHED THEN UPDATE SET
+	d.status = s.status,
+	d.http_code = s.http_code,
+	d.error_class = s.error_class,
+	d.error = s.error,
+	d.response_body = s.response_body,
+	d.attempts = s.attempts,
+	d.failures = d.failures + 1,
+	d.last_failed_at = s.failed_at
+WHEN NOT MATCHED THEN INSERT
+	(invoice_number, status, http_code, error_class, error, response_body, attempts, failures, first_failed_at, last_failed_at)
+VALUES (s.invoice_number, s.status, s.http_code, s.error_class, s.error, s.response_body, s.attempts, 1, s.failed_at, s.failed_at)` + s.Dialect.EndMerge()
+	}
+	_, err := s.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Find returns the entries for invoices, or all of them when invoices is
+// empty, that last failed at or after since
+func (s *Store) Find(ctx context.Context, invoices []string, since time.Time) ([]Entry, error) {
+	if len(invoices) == 0 {
+		return s.find(ctx, nil, since)
+	}
+	var entries []Entry
+	for _, chunk := range sqlutil.Chunks(invoices) {
+		found, err := s.find(ctx, chunk, since)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, found...)
+	}
+	// Each chunk comes back in order on its own
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].At.Before(entries[j].At) })
+	return entries, nil
+}
+
+// Find with at most sqlutil.MaxIn invoices
+func (s *Store) find(ctx context.Context, invoices []string, since time.Time) ([]Entry, error) {
+	query := fmt.Sprintf(`SELECT invoice_number, status, http_code, error_class, error, response_body, attempts, last_failed_at
+FROM %s WHERE last_failed_at >= %s`, s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	args := []interface{}{since}
+	if len(invoices) > 0 {
+		cond, in := s.Dialect.In("invoice_number", 2, invoices)
+		query += " AND " + cond
+		args = append(args, in...)
+	}
+	rows, err := s.DB.QueryContext(ctx, query+" ORDER BY last_failed_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		// Oracle returns empty text as NULL
+		var class, message, body sql.NullString
+		if err := rows.Scan(&e.Invoice, &e.Status, &e.HTTPCode, &class, &message, &body, &e.Attempts, &e.At); err != nil {
+			return nil, err
+		}
+		e.Class, e.Error, e.Response = class.String, message.String, []byte(body.String)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Count returns the number of dead-lettered invoices
+func (s *Store) Count(ctx context.Context) (int, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, "SELECT count(*) FROM "+s.Dialect.QuoteQualified(s.Config.Table)).Scan(&n)
+	return n, err
+}
+
+// Remove deletes the entry of invoice
+func (s *Store) Remove(ctx context.Context, invoice string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE invoice_number = %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	_, err := s.DB.ExecContext(ctx, query, invoice)
+	return err
+}
+
+// Prune deletes the entries that last failed before cutoff and returns how
+// many
+func (s *Store) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE last_failed_at < %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	res, err := s.DB.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Migrate creates the dead-letter table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	d := s.Dialect
+	query := d.CreateTable(d.QuoteQualified(s.Config.Table),
+		"invoice_number "+d.Type(sqlutil.String)+" PRIMARY KEY",
+		"status "+d.Type(sqlutil.String),
+		"http_code "+d.Type(sqlutil.Integer),
+		"error_class "+d.Type(sqlutil.Text),
+		"error "+d.Type(sqlutil.Text),
+		"response_body "+d.Type(sqlutil.Text),
+		"attempts "+d.Type(sqlutil.Integer),
+		"failures "+d.Type(sqlutil.Integer),
+		"first_failed_at "+d.Type(sqlutil.Timestamp),
+		"last_failed_at "+d.Type(sqlutil.Timestamp))
+	_, err := s.DB.ExecContext(ctx, query)
+	return err
+}
+
+// Response bodies are stored as text; Postgres rejects NUL bytes and
+// invalid UTF-8 there
+func text(b []byte) string {
+	s := strings.ToValidUTF8(string(b), "�")
+	return strings.ReplaceAll(s, "\x00", "")
+}
@@ -0,0 +1,118 @@
+// Package hooks runs custom code around every push, loaded from Go plugins,
+// WebAssembly modules or Lua scripts, so field mappings and side effects
+// particular to one deployment need no fork.
+//
+// A hook implements any of BeforePusher, Transformer and AfterResponder.
+// A Go plugin exports it as the symbol Hook; a WebAssembly module exports
+// the functions described in wasm.go and a Lua script defines the ones in
+// lua.go.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// ErrSkip is returned by BeforePush to leave the invoice pending instead of
+// pushing it
+var ErrSkip = errors.New("skipped by a hook")
+
+// BeforePusher is called before each push. Any error but ErrSkip fails
+// the push.
+type BeforePusher interface {
+	BeforePush(ctx context.Context, txn source.Transaction) error
+}
+
+// Transformer returns the payload to push in place of txn.Payload. It is
+// called for invoices with a payload, see payload.query.
+type Transformer interface {
+	TransformPayload(ctx context.Context, txn source.Transaction) (map[string]interface{}, error)
+}
+
+// AfterResponder is called with the outcome of each push, err being nil
+// when it succeeded
+type AfterResponder interface {
+	AfterResponse(ctx context.Context, txn source.Transaction, resp pusher.Response, err error)
+}
+
+// Chain is the hooks of the config, called in order
+type Chain []interface{}
+
+// Load opens the hooks configured in cfgs
+func Load(ctx context.Context, cfgs []config.HookConfig) (Chain, error) {
+	var chain Chain
+	for _, c := range cfgs {
+		var h interface{}
+		var err error
+		switch c.Type {
+		case "plugin":
+			h, err = openPlugin(c.Path)
+		case "wasm":
+			h, err = openWASM(ctx, c.Path)
+		case "lua":
+			h, err = openLua(c.Path)
+		default:
+			err = fmt.Errorf("unknown hook type %q", c.Type)
+		}
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("failed to load hook %s: %v", c.Path, err)
+		}
+		chain = append(chain, h)
+	}
+	return chain, nil
+}
+
+// BeforePush calls every BeforePusher, stopping at the first error
+func (c Chain) BeforePush(ctx context.Context, txn source.Transaction) error {
+	for _, h := range c {
+		if b, ok := h.(BeforePusher); ok {
+			if err := b.BeforePush(ctx, txn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// TransformPayload passes the payload of txn through every Transformer
+func (c Chain) TransformPayload(ctx context.Context, txn source.Transaction) (source.Transaction, error) {
+	for _, h := range c {
+		t, ok := h.(Transformer)
+		if !ok || txn.Payload == nil {
+			continue
+		}
+		payload, err := t.TransformPayload(ctx, txn)
+		if err != nil {
+			return txn, fmt.Errorf("failed to transform payload: %v", err)
+		}
+		txn.Payload = payload
+	}
+	return txn, nil
+}
+
+// AfterResponse calls every AfterResponder
+func (c Chain) AfterResponse(ctx context.Context, txn source.Transaction, resp pusher.Response, err error) {
+	for _, h := range c {
+		if a, ok := h.(AfterResponder); ok {
+			a.AfterResponse(ctx, txn, resp, err)
+		}
+	}
+}
+
+// Close releases the hooks holding resources, such as WebAssembly runtimes
+func (c Chain) Close() error {
+	var errs []error
+	for _, h := range c {
+		if cl, ok := h.(io.Closer); ok {
+			errs = append(errs, cl.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,211 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// A Lua script defines any of these global functions; the missing ones do
+// nothing:
+//
+//	before_push(txn)                      return false to skip the invoice
+//	transform_payload(payload, invoice_id) return the payload to push, or
+//	                                      nothing to push the one it changed
+//	after_response(txn, status_code, body, err)
+//
+// txn is a table with invoice_id and payload. Payload fields are Lua
+// values: numbers, strings, booleans and tables for nested objects and
+// lists.
+type luaHook struct {
+	state *lua.LState
+	// A Lua state runs one call at a time
+	mu sync.Mutex
+}
+
+func openLua(path string) (interface{}, error) {
+	l := lua.NewState()
+	if err := l.DoFile(path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	h := &luaHook{state: l}
+	if h.function("before_push") == nil && h.function("transform_payload") == nil && h.function("after_response") == nil {
+		l.Close()
+		return nil, errors.New("script defines none of before_push, transform_payload and after_response")
+	}
+	return h, nil
+}
+
+// The global function name, nil when the script does not define it
+func (h *luaHook) function(name string) *lua.LFunction {
+	fn, _ := h.state.GetGlobal(name).(*lua.LFunction)
+	return fn
+}
+
+// Call the global function name with args, returning its first result.
+// ok is false when the script does not define it.
+func (h *luaHook) call(ctx context.Context, name string, args ...lua.LValue) (lua.LValue, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fn := h.function(name)
+	if fn == nil {
+		return lua.LNil, false, nil
+	}
+	h.state.SetContext(ctx)
+	defer h.state.RemoveContext()
+	if err := h.state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args...); err != nil {
+		return lua.LNil, true, err
+	}
+	ret := h.state.Get(-1)
+	h.state.Pop(1)
+	return ret, true, nil
+}
+
+func (h *luaHook) txn(txn source.Transaction) *lua.LTable {
+	t := h.state.NewTable()
+	t.RawSetString("invoice_id", lua.LString(txn.InvoiceID))
+	t.RawSetString("payload", h.toLua(txn.Payload))
+	return t
+}
+
+func (h *luaHook) BeforePush(ctx context.Context, txn source.Transaction) error {
+	h.mu.Lock()
+	t := h.txn(txn)
+	h.mu.Unlock()
+	ret, _, err := h.call(ctx, "before_push", t)
+	if err != nil {
+		return fmt.Errorf("before_push: %v", err)
+	}
+	if ret == lua.LFalse {
+		return ErrSkip
+	}
+	return nil
+}
+
+func (h *luaHook) TransformPayload(ctx context.Context, txn source.Transaction) (map[string]interface{}, error) {
+	h.mu.Lock()
+	payload := h.toLua(txn.Payload)
+	h.mu.Unlock()
+	ret, ok, err := h.call(ctx, "transform_payload", payload, lua.LString(txn.InvoiceID))
+	if err != nil {
+		return nil, fmt.Errorf("transform_payload: %v", err)
+	}
+	if !ok {
+		return txn.Payload, nil
+	}
+	if ret == lua.LNil {
+		ret = payload
+	}
+	t, isTable := ret.(*lua.LTable)
+	if !isTable {
+		return nil, fmt.Errorf("transform_payload returned a %s instead of a table", ret.Type())
+	}
+	m, isMap := fromLua(t).(map[string]interface{})
+	if !isMap {
+		return nil, errors.New("transform_payload returned a list instead of a table")
+	}
+	return m, nil
+}
+
+func (h *luaHook) AfterResponse(ctx context.Context, txn source.Transaction, resp pusher.Response, err error) {
+	h.mu.Lock()
+	t := h.txn(txn)
+	h.mu.Unlock()
+	var msg lua.LValue = lua.LNil
+	if err != nil {
+		msg = lua.LString(err.Error())
+	}
+	if _, _, err := h.call(ctx, "after_response", t, lua.LNumber(resp.StatusCode), lua.LString(resp.Body), msg); err != nil {
+		slog.Error("Hook after_response failed", "invoice_id", txn.InvoiceID, "error", err)
+	}
+}
+
+func (h *luaHook) Close() error {
+	h.state.Close()
+	return nil
+}
+
+// Convert a payload value to Lua
+func (h *luaHook) toLua(v interface{}) lua.LValue {
+	switch t := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(t)
+	case string:
+		return lua.LString(t)
+	case []byte:
+		return lua.LString(t)
+	case int:
+		return lua.LNumber(t)
+	case int64:
+		return lua.LNumber(t)
+	case float64:
+		return lua.LNumber(t)
+	case time.Time:
+		return lua.LString(t.Format(time.RFC3339Nano))
+	case map[string]interface{}:
+		tbl := h.state.NewTable()
+		for k, v := range t {
+			tbl.RawSetString(k, h.toLua(v))
+		}
+		return tbl
+	case []interface{}:
+		tbl := h.state.NewTable()
+		for _, v := range t {
+			tbl.Append(h.toLua(v))
+		}
+		return tbl
+	case []map[string]interface{}:
+		tbl := h.state.NewTable()
+		for _, v := range t {
+			tbl.Append(h.toLua(v))
+		}
+		return tbl
+	default:
+		return lua.LString(fmt.Sprint(t))
+	}
+}
+
+// Convert a Lua value back. A table with keys 1..n only is a list, other
+// tables are objects.
+func fromLua(v lua.LValue) interface{} {
+	switch t := v.(type) {
+	case lua.LBool:
+		return bool(t)
+	case lua.LString:
+		return string(t)
+	case lua.LNumber:
+		if f := float64(t); f == float64(int64(f)) {
+			return int64(f)
+		}
+		return float64(t)
+	case *lua.LTable:
+		if n := t.Len(); n > 0 {
+			list := make([]interface{}, 0, n)
+			count := 0
+			t.ForEach(func(lua.LValue, lua.LValue) { count++ })
+			if count == n {
+				for i := 1; i <= n; i++ {
+					list = append(list, fromLua(t.RawGetInt(i)))
+				}
+				return list
+			}
+		}
+		m := make(map[string]interface{})
+		t.ForEach(func(k, v lua.LValue) {
+			m[k.String()] = fromLua(v)
+		})
+		return m
+	default:
+		return nil
+	}
+}
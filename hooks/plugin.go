@@ -0,0 +1,32 @@
+package hooks
+
+import (
+	"errors"
+	"plugin"
+)
+
+// Open a Go plugin built with -buildmode=plugin against the same trx-push
+// version. It exports its hook as Hook, a variable or a function
+// returning it.
+func openPlugin(path string) (interface{}, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("Hook")
+	if err != nil {
+		return nil, err
+	}
+	h := interface{}(sym)
+	switch s := sym.(type) {
+	case func() interface{}:
+		h = s()
+	case *interface{}:
+		h = *s
+	}
+	switch h.(type) {
+	case BeforePusher, Transformer, AfterResponder:
+		return h, nil
+	}
+	return nil, errors.New("Hook implements none of BeforePush, TransformPayload and AfterResponse")
+}
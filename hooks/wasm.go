@@ -0,0 +1,164 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// A WebAssembly module exchanges JSON with trx-push through its memory.
+// It exports alloc(size i32) i32 returning a buffer trx-push writes the
+// input into, and any of the following; the missing ones do nothing:
+//
+//	before_push(ptr, len i32) i32           0 to push, 1 to skip, else fail
+//	transform_payload(ptr, len i32) i64     ptr<<32 | len of the new payload, 0 to keep it
+//	after_response(ptr, len i32)
+//
+// before_push and transform_payload get {"invoice_id", "payload"},
+// after_response also "status_code", "body" and "error". WASI is
+// available, so modules built for wasip1 as reactors work.
+type wasmHook struct {
+	runtime wazero.Runtime
+	module  api.Module
+	alloc   api.Function
+	before  api.Function
+	trans   api.Function
+	after   api.Function
+	// A module instance runs one call at a time
+	mu sync.Mutex
+}
+
+func openWASM(ctx context.Context, path string) (interface{}, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := wazero.NewRuntime(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	m, err := r.InstantiateWithConfig(ctx, code, wazero.NewModuleConfig().
+		WithStartFunctions("_initialize").WithStdout(os.Stdout).WithStderr(os.Stderr))
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	h := &wasmHook{runtime: r, module: m, alloc: m.ExportedFunction("alloc"),
+		before: m.ExportedFunction("before_push"), trans: m.ExportedFunction("transform_payload"),
+		after: m.ExportedFunction("after_response")}
+	if h.alloc == nil {
+		r.Close(ctx)
+		return nil, errors.New("module does not export alloc")
+	}
+	if h.before == nil && h.trans == nil && h.after == nil {
+		r.Close(ctx)
+		return nil, errors.New("module exports none of before_push, transform_payload and after_response")
+	}
+	return h, nil
+}
+
+// The input of the module functions
+type wasmInput struct {
+	InvoiceID  string                 `json:"invoice_id"`
+	Payload    map[string]interface{} `json:"payload"`
+	StatusCode int                    `json:"status_code,omitempty"`
+	Body       string                 `json:"body,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Call fn with in written into the module memory
+func (h *wasmHook) call(ctx context.Context, fn api.Function, in wasmInput) (uint64, error) {
+	rc, _, err := h.callRead(ctx, fn, in, false)
+	return rc, err
+}
+
+// Call fn like call, and with output copy the ptr<<32 | len buffer it
+// returns before another call can overwrite it
+func (h *wasmHook) callRead(ctx context.Context, fn api.Function, in wasmInput, output bool) (uint64, []byte, error) {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return 0, nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res, err := h.alloc.Call(ctx, uint64(len(b)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("alloc: %v", err)
+	}
+	ptr := uint32(res[0])
+	if !h.module.Memory().Write(ptr, b) {
+		return 0, nil, errors.New("alloc returned a buffer out of memory")
+	}
+	res, err = fn.Call(ctx, uint64(ptr), uint64(len(b)))
+	if err != nil || len(res) == 0 {
+		return 0, nil, err
+	}
+	rc := res[0]
+	if !output || rc == 0 {
+		return rc, nil, nil
+	}
+	out, ok := h.module.Memory().Read(uint32(rc>>32), uint32(rc))
+	if !ok {
+		return rc, nil, errors.New("returned a buffer out of memory")
+	}
+	return rc, append([]byte(nil), out...), nil
+}
+
+func (h *wasmHook) BeforePush(ctx context.Context, txn source.Transaction) error {
+	if h.before == nil {
+		return nil
+	}
+	rc, err := h.call(ctx, h.before, wasmInput{InvoiceID: txn.InvoiceID, Payload: txn.Payload})
+	switch {
+	case err != nil:
+		return fmt.Errorf("before_push: %v", err)
+	case rc == 1:
+		return ErrSkip
+	case rc != 0:
+		return fmt.Errorf("before_push returned %d", rc)
+	}
+	return nil
+}
+
+func (h *wasmHook) TransformPayload(ctx context.Context, txn source.Transaction) (map[string]interface{}, error) {
+	if h.trans == nil {
+		return txn.Payload, nil
+	}
+	rc, out, err := h.callRead(ctx, h.trans, wasmInput{InvoiceID: txn.InvoiceID, Payload: txn.Payload}, true)
+	if err != nil {
+		return nil, fmt.Errorf("transform_payload: %v", err)
+	}
+	if rc == 0 {
+		return txn.Payload, nil
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(out, &payload); err != nil {
+		return nil, fmt.Errorf("transform_payload returned invalid JSON: %v", err)
+	}
+	return payload, nil
+}
+
+func (h *wasmHook) AfterResponse(ctx context.Context, txn source.Transaction, resp pusher.Response, err error) {
+	if h.after == nil {
+		return
+	}
+	in := wasmInput{InvoiceID: txn.InvoiceID, Payload: txn.Payload, StatusCode: resp.StatusCode, Body: string(resp.Body)}
+	if err != nil {
+		in.Error = err.Error()
+	}
+	if _, err := h.call(ctx, h.after, in); err != nil {
+		slog.Error("Hook after_response failed", "invoice_id", txn.InvoiceID, "error", err)
+	}
+}
+
+func (h *wasmHook) Close() error {
+	return h.runtime.Close(context.Background())
+}
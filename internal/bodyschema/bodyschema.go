@@ -0,0 +1,133 @@
+// Package bodyschema checks request bodies against a JSON Schema, on its
+// own or inside an OpenAPI document, before they are sent.
+package bodyschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+)
+
+// Problems listed in an Error; the rest are counted
+const maxProblems = 5
+
+// Schema is a compiled schema for request bodies
+type Schema struct {
+	schema *gojsonschema.Schema
+}
+
+// Error lists why a body does not match its schema
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	msg := "body does not match the schema: " + strings.Join(e.Problems[:min(len(e.Problems), maxProblems)], "; ")
+	if n := len(e.Problems) - maxProblems; n > 0 {
+		msg += fmt.Sprintf(" (and %d more)", n)
+	}
+	return msg
+}
+
+// Load the schema in file, JSON or YAML. With pointer, a JSON pointer such
+// as "/components/schemas/Transaction", the schema is that part of the
+// document, so an OpenAPI document can be used as is; its references
+// resolve against the whole document.
+func Load(file, pointer string) (*Schema, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		doc = jsonValue(doc)
+	default:
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+	}
+	nullable(doc)
+	if pointer = strings.TrimPrefix(pointer, "#"); pointer != "" {
+		root, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object, it has no %s", file, pointer)
+		}
+		if !strings.HasPrefix(pointer, "/") {
+			pointer = "/" + pointer
+		}
+		// Keywords next to $ref are ignored, the rest of the document is
+		// only there to be referenced
+		root["$ref"] = "#" + pointer
+	}
+	loader := gojsonschema.NewSchemaLoader()
+	loader.Draft = gojsonschema.Draft7
+	loader.AutoDetect = false
+	s, err := loader.Compile(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", file, err)
+	}
+	return &Schema{schema: s}, nil
+}
+
+// Check body against the schema, returning an *Error when it does not
+// match
+func (s *Schema) Check(body []byte) error {
+	res, err := s.schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return fmt.Errorf("failed to check body against the schema: %v", err)
+	}
+	if res.Valid() {
+		return nil
+	}
+	e := &Error{}
+	for _, re := range res.Errors() {
+		e.Problems = append(e.Problems, re.Field()+": "+re.Description())
+	}
+	return e
+}
+
+// The maps of YAML with string keys, as JSON has them
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonValue(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonValue(e)
+		}
+	}
+	return v
+}
+
+// Turn the "nullable: true" of OpenAPI 3.0 into the null type JSON Schema
+// knows
+func nullable(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v["nullable"] == true {
+			if t, ok := v["type"].(string); ok {
+				v["type"] = []interface{}{t, "null"}
+			}
+		}
+		for _, e := range v {
+			nullable(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			nullable(e)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Package cassette records the HTTP requests of the client and their
+// responses to a file and answers requests from it later, VCR style, so
+// trx-push can run against a recording instead of the partner API.
+package cassette
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/purwaren/trx-push/internal/jsonutil"
+)
+
+// Interaction is one request and its response
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type Response struct {
+	Status  int         `json:"status"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+}
+
+type cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Recorder sends requests with Next and adds them with their responses to
+// the cassette at Path, which is rewritten after every response. Requests
+// that got no response are not recorded.
+type Recorder struct {
+	Path string
+	Next http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []Interaction
+}
+
+// NewRecorder starts a new cassette at path, replacing any earlier one
+func NewRecorder(path string, next http.RoundTripper) *Recorder {
+	return &Recorder{Path: path, Next: next}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	in := Interaction{
+		Request: Request{Method: req.Method, URL: req.URL.Redacted(), Headers: redactHeaders(req.Header),
+			Body: requestBody(req.Header, body)},
+		Response: Response{Status: resp.StatusCode, Headers: redactHeaders(resp.Header),
+			Body: jsonutil.RedactBody(resp.Header.Get("Content-Type"), respBody)},
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, in)
+	if err := save(r.Path, r.interactions); err != nil {
+		return nil, fmt.Errorf("failed to write cassette %s: %v", r.Path, err)
+	}
+	return resp, nil
+}
+
+// Replace path with the cassette in one step
+func save(path string, interactions []Interaction) error {
+	b, err := json.MarshalIndent(cassette{Interactions: interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Player answers requests with the recorded response of the same method,
+// URL and body, without sending them. Identical requests get their
+// responses in recording order, the last one again once they run out.
+type Player struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// Load the cassette at path
+func Load(path string) (*Player, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c cassette
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %v", path, err)
+	}
+	return &Player{interactions: c.Interactions, used: make([]bool, len(c.Interactions))}, nil
+}
+
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	want := Request{Method: req.Method, URL: req.URL.Redacted(), Body: requestBody(req.Header, body)}
+
+	p.mu.Lock()
+	last := -1
+	for i, in := range p.interactions {
+		if in.Request.Method != want.Method || in.Request.URL != want.URL || in.Request.Body != want.Body {
+			continue
+		}
+		last = i
+		if !p.used[i] {
+			break
+		}
+	}
+	if last >= 0 {
+		p.used[last] = true
+	}
+	p.mu.Unlock()
+	if last < 0 {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, want.URL)
+	}
+
+	in := p.interactions[last].Response
+	header := in.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+		StatusCode:    in.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(in.Body)),
+		ContentLength: int64(len(in.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Read the body of req, leaving it in place to be sent
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// The body of a request as kept and matched: decompressed and with its
+// credentials masked
+func requestBody(h http.Header, body []byte) string {
+	if h.Get("Content-Encoding") == "gzip" {
+		if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if plain, err := io.ReadAll(zr); err == nil {
+				body = plain
+			}
+		}
+	}
+	return jsonutil.RedactBody(h.Get("Content-Type"), body)
+}
+
+// Without the credential headers, which differ on every run anyway
+func redactHeaders(h http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range h {
+		if jsonutil.IsSensitiveKey(name) || strings.EqualFold(name, "Cookie") || strings.EqualFold(name, "Set-Cookie") {
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+// Package correlation carries the IDs of the run and of the push request
+// in progress in a context, for the log lines and the request headers that
+// let our logs be matched with the partner's.
+package correlation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+type runKey struct{}
+
+type requestKey struct{}
+
+// WithRun tags ctx with the ID of the run it belongs to
+func WithRun(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runKey{}, runID)
+}
+
+// Run is the run ID of ctx, empty outside a run
+func Run(ctx context.Context) string {
+	id, _ := ctx.Value(runKey{}).(string)
+	return id
+}
+
+// WithRequest tags ctx with a new request ID, shared by the retries of one
+// push
+func WithRequest(ctx context.Context) context.Context {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return context.WithValue(ctx, requestKey{}, hex.EncodeToString(b))
+}
+
+// Request is the request ID of ctx, empty outside a push
+func Request(ctx context.Context) string {
+	id, _ := ctx.Value(requestKey{}).(string)
+	return id
+}
+
+// Handler adds run_id and request_id to the records logged with a context
+// carrying them
+type Handler struct {
+	slog.Handler
+}
+
+func (h Handler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id := Run(ctx); id != "" {
+			r.AddAttrs(slog.String("run_id", id))
+		}
+		if id := Request(ctx); id != "" {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return Handler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h Handler) WithGroup(name string) slog.Handler {
+	return Handler{h.Handler.WithGroup(name)}
+}
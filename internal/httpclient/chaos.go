@@ -0,0 +1,81 @@
+package httpclient
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// chaos fails cfg.Rate of the requests with one of cfg.Faults instead of
+// sending them with next
+type chaos struct {
+	next http.RoundTripper
+	cfg  config.ChaosConfig
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaos(next http.RoundTripper, cfg config.ChaosConfig) *chaos {
+	return &chaos{next: next, cfg: cfg, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// timeoutError looks like a client timeout to the retry and breaker code
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "chaos: injected timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (c *chaos) RoundTrip(req *http.Request) (*http.Response, error) {
+	fault := c.pick()
+	if fault == "" {
+		return c.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	switch fault {
+	case "timeout":
+		t := time.NewTimer(c.cfg.Delay)
+		defer t.Stop()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}
+	case "reset":
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("chaos: injected %w", syscall.ECONNRESET)}
+	}
+	body := fmt.Sprintf(`{"code":"CHAOS","message":"injected status %d"}`, c.cfg.Status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", c.cfg.Status, http.StatusText(c.cfg.Status)),
+		StatusCode:    c.cfg.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// The fault for the next request, "" to send it
+func (c *chaos) pick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rand.Float64() >= c.cfg.Rate {
+		return ""
+	}
+	return c.cfg.Faults[c.rand.Intn(len(c.cfg.Faults))]
+}
@@ -0,0 +1,164 @@
+// Package httpclient tunes the HTTP client shared by login, push, the
+// config service and the secrets backends.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/cassette"
+	"github.com/purwaren/trx-push/tracing"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// UserAgent is sent with the requests setting none, such as the ones of
+// api.headers. Set by main at start.
+var UserAgent string
+
+// userAgent sets the User-Agent of the requests without one
+type userAgent struct {
+	next  http.RoundTripper
+	value string
+}
+
+func (u userAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Header["User-Agent"]; ok || u.value == "" {
+		return u.next.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", u.value)
+	return u.next.RoundTrip(req)
+}
+
+// Configure sets the timeouts, transport, TLS, cassette and chaos settings
+// of cfg on c. It must be called before c is used; the transport is not
+// swapped on a reload.
+func Configure(c *http.Client, cfg *config.Config) error {
+	tlsConfig, err := NewTLSConfig(cfg.TLS)
+	if err != nil {
+		return err
+	}
+	t := newTransport(cfg.HTTP)
+	t.TLSClientConfig = tlsConfig
+	if cfg.HTTP.ProxyURL != "" {
+		if t.Proxy, err = proxy(cfg.HTTP); err != nil {
+			return err
+		}
+	}
+	c.Transport = t
+	switch cc := cfg.HTTP.Cassette; cc.Mode {
+	case "record":
+		slog.Warn("Recording every request and response", "cassette", cc.File)
+		c.Transport = cassette.NewRecorder(cc.File, t)
+	case "replay":
+		p, err := cassette.Load(cc.File)
+		if err != nil {
+			return fmt.Errorf("failed to load cassette: %v", err)
+		}
+		slog.Warn("Answering requests from a cassette, nothing is sent", "cassette", cc.File)
+		c.Transport = p
+	}
+	if cc := cfg.HTTP.Chaos; cc.Rate > 0 {
+		slog.Warn("Chaos mode, failing requests on purpose", "rate", cc.Rate, "faults", strings.Join(cc.Faults, ","))
+		c.Transport = newChaos(c.Transport, cc)
+	}
+	if cfg.HTTP.Log {
+		slog.Warn("Logging every request and response")
+		c.Transport = logging{next: c.Transport}
+	}
+	if cfg.Tracing.Enabled {
+		c.Transport = tracing.Transport(c.Transport)
+	}
+	c.Transport = userAgent{next: c.Transport, value: UserAgent}
+	c.Timeout = cfg.HTTP.Timeout
+	return nil
+}
+
+func newTransport(cfg config.HTTPConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ReadTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+	}
+	if cfg.KeepAlive < 0 {
+		t.DisableKeepAlives = true
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map turns off the automatic HTTP/2 upgrade
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+// Proxy from http.proxy_url, with the credentials in the URL or in
+// proxy_username and proxy_password, for the hosts not in NO_PROXY
+func proxy(cfg config.HTTPConfig) (func(*http.Request) (*url.URL, error), error) {
+	u, err := url.Parse(cfg.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if cfg.ProxyUsername != "" {
+		u.User = url.UserPassword(cfg.ProxyUsername, cfg.ProxyPassword)
+	}
+	pc := httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    httpproxy.FromEnvironment().NoProxy,
+	}
+	proxyFunc := pc.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) {
+		return proxyFunc(r.URL)
+	}, nil
+}
+
+// NewTLSConfig returns the client certificate and trusted CAs of cfg, for
+// the connections made outside of the HTTP client
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	t := &tls.Config{}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		t.RootCAs = pool
+	}
+	if cfg.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled, do not use this in production")
+		t.InsecureSkipVerify = true
+	}
+	return t, nil
+}
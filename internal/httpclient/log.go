@@ -0,0 +1,100 @@
+package httpclient
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/internal/jsonutil"
+)
+
+// Longest part of a body that is logged
+const logBodyLimit = 2048
+
+// logging logs every request sent with next and its response, with the
+// credential headers, query parameters and body fields redacted
+type logging struct {
+	next http.RoundTripper
+}
+
+func (l logging) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	slog.Info("HTTP request", "method", req.Method, "url", redactURL(req.URL),
+		"headers", redactHeaders(req.Header), "body", logBody(req.Header, body))
+
+	start := time.Now()
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		slog.Info("HTTP request failed", "method", req.Method, "url", redactURL(req.URL),
+			"duration_ms", time.Since(start).Milliseconds(), "error", err)
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err != nil {
+		// Let the caller see the read error too
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(respBody), errReader{err}))
+	}
+	slog.Info("HTTP response", "method", req.Method, "url", redactURL(req.URL), "status", resp.Status,
+		"duration_ms", time.Since(start).Milliseconds(), "headers", redactHeaders(resp.Header),
+		"body", logBody(resp.Header, respBody))
+	return resp, nil
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// The URL without its password and credential query parameters
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for k := range q {
+		if jsonutil.IsSensitiveKey(k) {
+			q[k] = []string{"[REDACTED]"}
+			redacted = true
+		}
+	}
+	if redacted {
+		c := *u
+		c.RawQuery = q.Encode()
+		u = &c
+	}
+	return u.Redacted()
+}
+
+// One "Name: value" line per header, credential ones masked
+func redactHeaders(h http.Header) string {
+	lines := make([]string, 0, len(h))
+	for name, values := range h {
+		v := strings.Join(values, ", ")
+		if jsonutil.IsSensitiveKey(name) || strings.EqualFold(name, "Cookie") || strings.EqualFold(name, "Set-Cookie") {
+			v = "[REDACTED]"
+		}
+		lines = append(lines, name+": "+v)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func logBody(h http.Header, body []byte) string {
+	s := jsonutil.RedactBody(h.Get("Content-Type"), body)
+	if len(s) > logBodyLimit {
+		s = s[:logBodyLimit] + "..."
+	}
+	return s
+}
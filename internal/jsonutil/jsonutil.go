@@ -0,0 +1,113 @@
+// Package jsonutil holds the small JSON helpers shared by the auth and push
+// code: dotted-path field lookup and credential redaction for logs.
+package jsonutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Lookup finds a dotted path such as "error.code" in a JSON body and returns
+// the value as a string
+func Lookup(body []byte, path string) (string, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case nil:
+		return "", true
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b), true
+	default:
+		return fmt.Sprint(t), true
+	}
+}
+
+// sensitiveKeys are JSON keys whose values are masked by Redact
+var sensitiveKeys = []string{"token", "password", "secret", "authorization"}
+
+// Redact masks credential-looking fields of a JSON body for logging.
+// Non-JSON bodies are only truncated.
+func Redact(body []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		if len(body) > 512 {
+			return string(body[:512]) + "..."
+		}
+		return string(body)
+	}
+	redacted, _ := json.Marshal(redactValue(v))
+	return string(redacted)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if IsSensitiveKey(k) {
+				t[k] = "[REDACTED]"
+			} else {
+				t[k] = redactValue(val)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redactValue(t[i])
+		}
+	}
+	return v
+}
+
+// IsSensitiveKey reports whether a field or header name looks like it holds
+// a credential
+func IsSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactBody masks the credential fields of a JSON or form body of the
+// given content type. Other bodies are returned as they are.
+func RedactBody(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return string(body)
+		}
+		for k := range values {
+			if IsSensitiveKey(k) {
+				values[k] = []string{"[REDACTED]"}
+			}
+		}
+		return values.Encode()
+	}
+	if json.Valid(body) {
+		return Redact(body)
+	}
+	return string(body)
+}
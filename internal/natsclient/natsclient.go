@@ -0,0 +1,34 @@
+// Package natsclient connects the NATS source and sink to the servers.
+package natsclient
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/purwaren/trx-push/config"
+)
+
+// Connect connects to the servers of cfg, as name in the server's
+// connection list. Servers down at startup are retried in the background
+// like a lost connection, so a publish or fetch fails until one is up.
+func Connect(cfg config.NATSClientConfig, name string) (*nats.Conn, error) {
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.Timeout(cfg.DialTimeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	switch {
+	case cfg.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(cfg.CredsFile))
+	case cfg.Token != "":
+		opts = append(opts, nats.Token(cfg.Token))
+	case cfg.Username != "":
+		opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+	if cfg.TLS {
+		opts = append(opts, nats.Secure(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	return nats.Connect(strings.Join(cfg.Servers, ","), opts...)
+}
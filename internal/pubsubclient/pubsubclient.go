@@ -0,0 +1,21 @@
+// Package pubsubclient builds the Google Cloud Pub/Sub client shared by the
+// Pub/Sub source and sink.
+package pubsubclient
+
+import (
+	"context"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/purwaren/trx-push/config"
+	"google.golang.org/api/option"
+)
+
+// New returns a client for the project of cfg, with its credentials file
+// or the application default credentials
+func New(ctx context.Context, cfg config.PubSubClientConfig) (*pubsub.Client, error) {
+	var opts []option.ClientOption
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+	return pubsub.NewClient(ctx, cfg.Project, opts...)
+}
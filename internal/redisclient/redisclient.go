@@ -0,0 +1,28 @@
+// Package redisclient builds the Redis client shared by the Redis queue
+// and the shared rate limit.
+package redisclient
+
+import (
+	"crypto/tls"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// New returns a client for the server of cfg.Redis
+func New(cfg *config.Config) *redis.Client {
+	r := cfg.Redis
+	opts := &redis.Options{Addr: r.Address, Username: r.Username, Password: r.Password, DB: r.DB}
+	if r.TLS {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return redis.NewClient(opts)
+}
+
+// Prefix returns the start of the keys of cfg, which tenants do not share
+func Prefix(cfg *config.Config) string {
+	if cfg.Tenant != "" {
+		return cfg.Redis.Prefix + ":" + cfg.Tenant
+	}
+	return cfg.Redis.Prefix
+}
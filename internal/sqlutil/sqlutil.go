@@ -0,0 +1,258 @@
+// Package sqlutil holds SQL helpers shared by the database-backed packages.
+package sqlutil
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Dialect is the database.driver the generated SQL is written for
+type Dialect string
+
+const (
+	Postgres  Dialect = "postgres"
+	MySQL     Dialect = "mysql"
+	SQLite    Dialect = "sqlite"
+	SQLServer Dialect = "mssql"
+	Oracle    Dialect = "oracle"
+)
+
+// Oracle folds unquoted identifiers to upper case
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$#]*$`)
+
+// Quote quotes an identifier such as a column name. On Oracle a plain
+// lower-case name is upper-cased first, so "invoice" finds the table created
+// as INVOICE.
+func (d Dialect) Quote(name string) string {
+	switch d {
+	case MySQL:
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	case SQLServer:
+		return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+	case Oracle:
+		if plainIdentifier.MatchString(name) {
+			name = strings.ToUpper(name)
+		}
+	}
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// QuoteQualified quotes a possibly schema-qualified table name such as
+// reporting.push_results
+func (d Dialect) QuoteQualified(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = d.Quote(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Param is the placeholder of the nth argument, counting from 1. SQLite
+// takes the Postgres form.
+func (d Dialect) Param(n int) string {
+	switch d {
+	case MySQL:
+		return "?"
+	case SQLServer:
+		return fmt.Sprintf("@p%d", n)
+	case Oracle:
+		return fmt.Sprintf(":%d", n)
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// Positional reports whether arguments are bound in the order their
+// placeholders appear in the statement rather than by number, so a
+// statement must use each argument once and in order
+func (d Dialect) Positional() bool {
+	return d == MySQL || d == Oracle
+}
+
+// Text casts expr to a string
+func (d Dialect) Text(expr string) string {
+	switch d {
+	case MySQL:
+		return fmt.Sprintf("CAST(%s AS CHAR)", expr)
+	case SQLite:
+		return fmt.Sprintf("CAST(%s AS TEXT)", expr)
+	case SQLServer:
+		return fmt.Sprintf("CAST(%s AS NVARCHAR(4000))", expr)
+	case Oracle:
+		return fmt.Sprintf("TO_CHAR(%s)", expr)
+	}
+	return expr + "::text"
+}
+
+// Now is the current time
+func (d Dialect) Now() string {
+	switch d {
+	case MySQL:
+		return "now(6)"
+	case SQLite:
+		return "CURRENT_TIMESTAMP"
+	case SQLServer:
+		return "SYSDATETIMEOFFSET()"
+	case Oracle:
+		return "SYSTIMESTAMP"
+	}
+	return "now()"
+}
+
+// Limit ends a query ordered by ORDER BY after n rows
+func (d Dialect) Limit(n int) string {
+	if d == SQLServer || d == Oracle {
+		return fmt.Sprintf(" OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", n)
+	}
+	return fmt.Sprintf(" LIMIT %d", n)
+}
+
+// RowValues reports whether rows can be compared as (a, b) > (x, y)
+func (d Dialect) RowValues() bool {
+	return d == Postgres || d == MySQL || d == SQLite
+}
+
+// MaxIn is the most values one In takes: Oracle allows 1000 items in an IN
+// list and SQL Server about 2100 parameters in a statement
+const MaxIn = 1000
+
+// Chunks splits values into slices of at most MaxIn, one In each
+func Chunks(values []string) [][]string {
+	var chunks [][]string
+	for len(values) > MaxIn {
+		chunks = append(chunks, values[:MaxIn:MaxIn])
+		values = values[MaxIn:]
+	}
+	if len(values) > 0 {
+		chunks = append(chunks, values)
+	}
+	return chunks
+}
+
+// In is the condition "expr is one of values" with its arguments, the
+// first one being argument n. values must not be empty nor longer than
+// MaxIn.
+func (d Dialect) In(expr string, n int, values []string) (string, []interface{}) {
+	if d != Postgres {
+		params := make([]string, len(values))
+		args := make([]interface{}, len(values))
+		for i, v := range values {
+			params[i], args[i] = d.Param(n+i), v
+		}
+		return fmt.Sprintf("%s IN (%s)", expr, strings.Join(params, ", ")), args
+	}
+	return fmt.Sprintf("%s = ANY($%d)", expr, n), []interface{}{values}
+}
+
+// ColumnType is a kind of column in the tables trx-push creates
+type ColumnType int
+
+const (
+	// Short text such as an invoice number or status, may be a key
+	String ColumnType = iota
+	// Text of any length that may be empty
+	Text
+	Integer
+	// Defaults to the current time
+	Timestamp
+	// Auto-incremented primary key
+	Serial
+)
+
+// Type is the column definition of t, including NOT NULL. Text columns
+// are nullable on Oracle, which stores empty strings as NULL.
+func (d Dialect) Type(t ColumnType) string {
+	return columnTypes[d][t]
+}
+
+var columnTypes = map[Dialect][5]string{
+	Postgres:  {"TEXT NOT NULL", "TEXT NOT NULL DEFAULT ''", "INTEGER NOT NULL", "TIMESTAMPTZ NOT NULL DEFAULT now()", "BIGSERIAL PRIMARY KEY"},
+	MySQL:     {"VARCHAR(191) NOT NULL", "MEDIUMTEXT NOT NULL", "INTEGER NOT NULL", "DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)", "BIGINT AUTO_INCREMENT PRIMARY KEY"},
+	SQLite:    {"TEXT NOT NULL", "TEXT NOT NULL DEFAULT ''", "INTEGER NOT NULL", "TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP", "INTEGER PRIMARY KEY AUTOINCREMENT"},
+	SQLServer: {"NVARCHAR(191) NOT NULL", "NVARCHAR(MAX) NOT NULL DEFAULT ''", "INT NOT NULL", "DATETIMEOFFSET NOT NULL DEFAULT SYSDATETIMEOFFSET()", "BIGINT IDENTITY PRIMARY KEY"},
+	Oracle:    {"VARCHAR2(191) NOT NULL", "CLOB", "NUMBER(10) NOT NULL", "TIMESTAMP WITH TIME ZONE DEFAULT SYSTIMESTAMP NOT NULL", "NUMBER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"},
+}
+
+// CreateTable creates table with the column definitions unless it exists.
+// table must already be quoted.
+func (d Dialect) CreateTable(table string, columns ...string) string {
+	create := fmt.Sprintf("CREATE TABLE %s (\n\t%s\n)", table, strings.Join(columns, ",\n\t"))
+	switch d {
+	case SQLServer:
+		return fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL\n%s", strings.ReplaceAll(table, "'", "''"), create)
+	case Oracle:
+		// ORA-00955: name is already used by an existing object
+		return fmt.Sprintf("BEGIN\n\tEXECUTE IMMEDIATE '%s';\nEXCEPTION WHEN OTHERS THEN\n\tIF SQLCODE != -955 THEN RAISE; END IF;\nEND;",
+			strings.ReplaceAll(create, "'", "''"))
+	}
+	return strings.Replace(create, "CREATE TABLE", "CREATE TABLE IF NOT EXISTS", 1)
+}
+
+// Time scans a timestamp that may come back as text, as SQLite returns
+// computed columns such as min(created_at). NULL scans as the zero time.
+type Time struct {
+	time.Time
+}
+
+var timeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func (t *Time) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v
+		return nil
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	}
+	return fmt.Errorf("cannot scan %T into a time", v)
+}
+
+func (t *Time) parse(s string) error {
+	for _, f := range timeFormats {
+		if parsed, err := time.Parse(f, s); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q", s)
+}
+
+// Merge starts the MERGE statement SQL Server and Oracle use instead of
+// ON CONFLICT: it upserts into table, aliased d, the row s made of one
+// parameter per name, in order. Close the statement with EndMerge.
+func (d Dialect) Merge(table string, names ...string) string {
+	cols := make([]string, len(names))
+	for i, n := range names {
+		cols[i] = fmt.Sprintf("%s AS %s", d.Param(i+1), n)
+	}
+	source, hint := "SELECT "+strings.Join(cols, ", "), ""
+	if d == Oracle {
+		source += " FROM dual"
+	} else {
+		// Without it two concurrent merges of a new key can both insert
+		hint = " WITH (HOLDLOCK)"
+	}
+	return fmt.Sprintf("MERGE INTO %s%s d\nUSING (%s) s", table, hint, source)
+}
+
+// EndMerge closes a MERGE statement: SQL Server requires a semicolon,
+// Oracle rejects one
+func (d Dialect) EndMerge() string {
+	if d == SQLServer {
+		return ";"
+	}
+	return ""
+}
@@ -0,0 +1,188 @@
+package sqlutil
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParam(t *testing.T) {
+	tests := []struct {
+		dialect      Dialect
+		first, third string
+	}{
+		{Postgres, "$1", "$3"},
+		{MySQL, "?", "?"},
+		{SQLite, "$1", "$3"},
+		{SQLServer, "@p1", "@p3"},
+		{Oracle, ":1", ":3"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Param(1); got != tt.first {
+			t.Errorf("%s Param(1) = %q, want %q", tt.dialect, got, tt.first)
+		}
+		if got := tt.dialect.Param(3); got != tt.third {
+			t.Errorf("%s Param(3) = %q, want %q", tt.dialect, got, tt.third)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	values := []string{"INV-1", "INV-2"}
+	tests := []struct {
+		dialect Dialect
+		want    string
+		args    []interface{}
+	}{
+		{Postgres, `"number" = ANY($3)`, []interface{}{values}},
+		{MySQL, `"number" IN (?, ?)`, []interface{}{"INV-1", "INV-2"}},
+		{SQLite, `"number" IN ($3, $4)`, []interface{}{"INV-1", "INV-2"}},
+		{SQLServer, `"number" IN (@p3, @p4)`, []interface{}{"INV-1", "INV-2"}},
+		{Oracle, `"number" IN (:3, :4)`, []interface{}{"INV-1", "INV-2"}},
+	}
+	for _, tt := range tests {
+		got, args := tt.dialect.In(`"number"`, 3, values)
+		if got != tt.want {
+			t.Errorf("%s In = %q, want %q", tt.dialect, got, tt.want)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s In args = %v, want %v", tt.dialect, args, tt.args)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	values := make([]string, 2*MaxIn+1)
+	for i := range values {
+		values[i] = fmt.Sprintf("INV-%d", i)
+	}
+	tests := []struct {
+		n    int
+		want []int
+	}{
+		{0, nil},
+		{1, []int{1}},
+		{MaxIn, []int{MaxIn}},
+		{MaxIn + 1, []int{MaxIn, 1}},
+		{2*MaxIn + 1, []int{MaxIn, MaxIn, 1}},
+	}
+	for _, tt := range tests {
+		chunks := Chunks(values[:tt.n])
+		var sizes []int
+		var joined []string
+		for _, c := range chunks {
+			sizes = append(sizes, len(c))
+			joined = append(joined, c...)
+		}
+		if !reflect.DeepEqual(sizes, tt.want) {
+			t.Errorf("Chunks of %d = sizes %v, want %v", tt.n, sizes, tt.want)
+		}
+		if tt.n > 0 && !reflect.DeepEqual(joined, values[:tt.n]) {
+			t.Errorf("Chunks of %d reordered or lost values", tt.n)
+		}
+	}
+	// Appending to a chunk must not overwrite the next one
+	chunks := Chunks(values[:MaxIn+1])
+	_ = append(chunks[0], "X")
+	if chunks[1][0] != values[MaxIn] {
+		t.Error("chunks share capacity")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{Postgres, " LIMIT 50"},
+		{SQLite, " LIMIT 50"},
+		{MySQL, " LIMIT 50"},
+		{SQLServer, " OFFSET 0 ROWS FETCH NEXT 50 ROWS ONLY"},
+		{Oracle, " OFFSET 0 ROWS FETCH NEXT 50 ROWS ONLY"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Limit(50); got != tt.want {
+			t.Errorf("%s Limit(50) = %q, want %q", tt.dialect, got, tt.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		name    string
+		want    string
+	}{
+		{Postgres, "invoice", `"invoice"`},
+		{Postgres, `odd"name`, `"odd""name"`},
+		{MySQL, "invoice", "`invoice`"},
+		{MySQL, "odd`name", "`odd``name`"},
+		{SQLite, "invoice", `"invoice"`},
+		{SQLServer, "invoice", "[invoice]"},
+		{SQLServer, "odd]name", "[odd]]name]"},
+		{Oracle, "invoice", `"INVOICE"`},
+		{Oracle, "Invoice", `"Invoice"`},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Quote(tt.name); got != tt.want {
+			t.Errorf("%s Quote(%q) = %s, want %s", tt.dialect, tt.name, got, tt.want)
+		}
+	}
+	if got := MySQL.QuoteQualified("reporting.push_results"); got != "`reporting`.`push_results`" {
+		t.Errorf("QuoteQualified = %s", got)
+	}
+}
+
+func TestPositional(t *testing.T) {
+	for d, want := range map[Dialect]bool{Postgres: false, SQLite: false, MySQL: true, SQLServer: false, Oracle: true} {
+		if got := d.Positional(); got != want {
+			t.Errorf("%s Positional() = %v, want %v", d, got, want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{Postgres, "attempts::text"},
+		{MySQL, "CAST(attempts AS CHAR)"},
+		{SQLite, "CAST(attempts AS TEXT)"},
+		{SQLServer, "CAST(attempts AS NVARCHAR(4000))"},
+		{Oracle, "TO_CHAR(attempts)"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.Text("attempts"); got != tt.want {
+			t.Errorf("%s Text = %q, want %q", tt.dialect, got, tt.want)
+		}
+	}
+}
+
+func TestTimeScan(t *testing.T) {
+	want := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  time.Time
+	}{
+		{"time", want, want},
+		{"sqlite text", "2026-03-01 12:30:00", want},
+		{"with zone", []byte("2026-03-01T19:30:00+07:00"), want},
+	}
+	for _, tt := range tests {
+		var got Time
+		if err := got.Scan(tt.value); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got.Time, tt.want)
+		}
+	}
+	var bad Time
+	if err := bad.Scan("yesterday"); err == nil {
+		t.Error("scanned an invalid time")
+	}
+}
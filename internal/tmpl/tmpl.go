@@ -0,0 +1,45 @@
+// Package tmpl parses the Go templates used in the config, with a small
+// set of functions for building request bodies.
+package tmpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var funcs = template.FuncMap{
+	// JSON encoding of a value, e.g. {{json .Row.customer}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// Value, or def when the value is empty
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	// XML escaping of a value, for SOAP envelopes, e.g. {{xml .Row.name}}
+	"xml": func(v interface{}) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(fmt.Sprint(v)))
+		return b.String()
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	// Current time in RFC 3339
+	"now": func() string { return time.Now().Format(time.RFC3339) },
+}
+
+// Parse parses text as a template named name. Referencing a missing map
+// key is an error instead of rendering "<no value>".
+func Parse(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+}
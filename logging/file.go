@@ -0,0 +1,171 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Layout of the time in the names of rotated files, safe on Windows
+const backupTime = "2006-01-02T15-04-05"
+
+// rotatingFile appends to the log file, rotating it by size and time as
+// configured. It is safe for concurrent use.
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	cfg  config.LogRotationConfig
+	f    *os.File
+	size int64
+	// When the file was last written to
+	written time.Time
+}
+
+// The file in use, kept across config reloads that do not change its path
+var (
+	fileMu  sync.Mutex
+	logFile *rotatingFile
+)
+
+// Open path for the log, or return the one open already with the rotation
+// settings of cfg
+func openLogFile(path string, cfg config.LogRotationConfig) (*rotatingFile, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	if logFile != nil && logFile.path == path {
+		logFile.mu.Lock()
+		logFile.cfg = cfg
+		logFile.mu.Unlock()
+		return logFile, nil
+	}
+	r := &rotatingFile{path: path, cfg: cfg}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	if logFile != nil {
+		logFile.close()
+	}
+	logFile = r
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.written = f, info.Size(), info.ModTime()
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.due(now, len(b)) {
+		if err := r.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file %s: %v\n", r.path, err)
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	r.written = now
+	return n, err
+}
+
+// Whether writing n more bytes at now needs a new file first
+func (r *rotatingFile) due(now time.Time, n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if limit := int64(r.cfg.MaxSizeMB) << 20; limit > 0 && r.size+int64(n) > limit {
+		return true
+	}
+	every := r.cfg.Every
+	return every > 0 && !now.UTC().Truncate(every).Equal(r.written.UTC().Truncate(every))
+}
+
+// Rename the current file after now, start a new one and remove the
+// rotated files beyond the retention settings
+func (r *rotatingFile) rotate(now time.Time) error {
+	r.f.Close()
+	r.f = nil
+	if err := os.Rename(r.path, r.backupName(now)); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune(now)
+	return nil
+}
+
+func (r *rotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.path)
+	return strings.TrimSuffix(r.path, ext) + "-" + t.Format(backupTime) + ext
+}
+
+// Remove the oldest rotated files beyond max_backups and the ones older
+// than max_age
+func (r *rotatingFile) prune(now time.Time) {
+	if r.cfg.MaxBackups == 0 && r.cfg.MaxAge == 0 {
+		return
+	}
+	ext := filepath.Ext(r.path)
+	prefix := strings.TrimSuffix(filepath.Base(r.path), ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path string
+		at   time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		at, err := time.ParseInLocation(backupTime, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(filepath.Dir(r.path), name), at})
+	}
+	// Newest first
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+	for i, b := range backups {
+		if (r.cfg.MaxBackups > 0 && i >= r.cfg.MaxBackups) || (r.cfg.MaxAge > 0 && now.Sub(b.at) > r.cfg.MaxAge) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+func (r *rotatingFile) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+}
@@ -0,0 +1,59 @@
+// Package logging configures the process-wide structured logger.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/correlation"
+)
+
+// Setup installs a logger writing to w, or to log.file when set, in the
+// configured format and level as the slog default. Messages from the
+// standard log package go through it as well.
+func Setup(w io.Writer, cfg config.LogConfig) error {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	if cfg.File != "" {
+		f, err := openLogFile(cfg.File, cfg.Rotation)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		w = f
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var h slog.Handler
+	switch cfg.Format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "console", "":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (expected console or json)", cfg.Format)
+	}
+	if cfg.Syslog.Enabled {
+		if h, err = newSyslogHandler(cfg, opts); err != nil {
+			return fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+	}
+	slog.SetDefault(slog.New(correlation.Handler{Handler: h}))
+	return nil
+}
+
+// ParseLevel accepts debug, info, warn and error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(strings.ToLower(s))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+	}
+	return level, nil
+}
@@ -0,0 +1,117 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG, "lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// The connection in use, kept across config reloads that do not change it
+var (
+	syslogMu     sync.Mutex
+	syslogConfig config.SyslogConfig
+	syslogWriter *syslog.Writer
+)
+
+// syslogHandler formats records with the console or JSON handler, without
+// the time syslog adds itself, and sends each with the priority of its
+// level
+type syslogHandler struct {
+	inner slog.Handler
+	out   *syslogOutput
+}
+
+// The line the inner handlers write, sent once Handle has the priority
+type syslogOutput struct {
+	mu  sync.Mutex
+	w   *syslog.Writer
+	buf bytes.Buffer
+}
+
+func (o *syslogOutput) Write(b []byte) (int, error) {
+	return o.buf.Write(b)
+}
+
+func newSyslogHandler(cfg config.LogConfig, opts *slog.HandlerOptions) (slog.Handler, error) {
+	w, err := dialSyslog(cfg.Syslog)
+	if err != nil {
+		return nil, err
+	}
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && a.Key == slog.TimeKey {
+			return slog.Attr{}
+		}
+		return a
+	}
+	out := &syslogOutput{w: w}
+	h := &syslogHandler{out: out}
+	if cfg.Format == "json" {
+		h.inner = slog.NewJSONHandler(out, opts)
+	} else {
+		h.inner = slog.NewTextHandler(out, opts)
+	}
+	return h, nil
+}
+
+func dialSyslog(cfg config.SyslogConfig) (*syslog.Writer, error) {
+	syslogMu.Lock()
+	defer syslogMu.Unlock()
+	if syslogWriter != nil && syslogConfig == cfg {
+		return syslogWriter, nil
+	}
+	w, err := syslog.Dial(cfg.Network, cfg.Address, facilities[cfg.Facility]|syslog.LOG_INFO, cfg.Tag)
+	if err != nil {
+		return nil, err
+	}
+	if syslogWriter != nil {
+		syslogWriter.Close()
+	}
+	syslogConfig, syslogWriter = cfg, w
+	return w, nil
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	line := strings.TrimSuffix(h.out.buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.out.w.Err(line)
+	case r.Level >= slog.LevelWarn:
+		return h.out.w.Warning(line)
+	case r.Level >= slog.LevelInfo:
+		return h.out.w.Info(line)
+	}
+	return h.out.w.Debug(line)
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithAttrs(attrs), out: h.out}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{inner: h.inner.WithGroup(name), out: h.out}
+}
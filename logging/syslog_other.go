@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func newSyslogHandler(config.LogConfig, *slog.HandlerOptions) (slog.Handler, error) {
+	return nil, errors.New("syslog is not available on this system")
+}
@@ -0,0 +1,143 @@
+// Package metrics records pipeline activity as Prometheus metrics, served
+// on /metrics in daemon mode. Every metric has a tenant label, empty
+// without tenants.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	pushAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trx_push_push_attempts_total",
+		Help: "HTTP push requests sent, including retries.",
+	}, []string{"tenant"})
+	pushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trx_push_pushes_total",
+		Help: "Invoices processed, by final result (success, failed, parked).",
+	}, []string{"tenant", "result"})
+	pushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trx_push_push_duration_seconds",
+		Help:    "Latency of individual push requests.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"tenant"})
+	pushFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trx_push_push_failures_total",
+		Help: "Failed pushes, by class (timeout, dns, network, auth, throttled, client, server, ...).",
+	}, []string{"tenant", "class"})
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "trx_push_login_attempts_total",
+		Help: "Login attempts, by result (success, failure).",
+	}, []string{"tenant", "result"})
+	backlog = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trx_push_backlog",
+		Help: "Pending invoices found by the last fetch.",
+	}, []string{"tenant"})
+	oldestPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trx_push_oldest_pending_age_seconds",
+		Help: "Age of the oldest invoice still pending after the last run, by query.created_column; 0 when none is.",
+	}, []string{"tenant"})
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trx_push_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful push.",
+	}, []string{"tenant"})
+	circuit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "trx_push_circuit_state",
+		Help: "Push API circuit breaker state; 1 for the current one (closed, open, half-open).",
+	}, []string{"tenant", "state"})
+)
+
+func init() {
+	prometheus.MustRegister(pushAttempts, pushes, pushFailures, pushDuration, logins, backlog, oldestPending, lastSuccess, circuit)
+}
+
+type tenantKey struct{}
+
+// WithTenant returns ctx recording the metrics of tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func tenantOf(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// PushAttempt records one push request and how long it took
+func PushAttempt(ctx context.Context, d time.Duration) {
+	tenant := tenantOf(ctx)
+	pushAttempts.WithLabelValues(tenant).Inc()
+	pushDuration.WithLabelValues(tenant).Observe(d.Seconds())
+	send(tenant, "push_attempts", "1", "c", "", "")
+	send(tenant, "push_duration", strconv.FormatInt(d.Milliseconds(), 10), "ms", "", "")
+}
+
+// PushResult records the final outcome of one invoice
+func PushResult(ctx context.Context, result string) {
+	tenant := tenantOf(ctx)
+	pushes.WithLabelValues(tenant, result).Inc()
+	send(tenant, "pushes", "1", "c", "result", result)
+}
+
+// PushFailure records the class of a failed push
+func PushFailure(ctx context.Context, class string) {
+	tenant := tenantOf(ctx)
+	pushFailures.WithLabelValues(tenant, class).Inc()
+	send(tenant, "push_failures", "1", "c", "class", class)
+}
+
+// Login records a login attempt
+func Login(ctx context.Context, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	tenant := tenantOf(ctx)
+	logins.WithLabelValues(tenant, result).Inc()
+	send(tenant, "logins", "1", "c", "result", result)
+}
+
+// Backlog records the number of pending invoices
+func Backlog(ctx context.Context, n int) {
+	tenant := tenantOf(ctx)
+	backlog.WithLabelValues(tenant).Set(float64(n))
+	send(tenant, "backlog", strconv.Itoa(n), "g", "", "")
+}
+
+// OldestPending records the age of the oldest pending invoice
+func OldestPending(ctx context.Context, age time.Duration) {
+	tenant := tenantOf(ctx)
+	oldestPending.WithLabelValues(tenant).Set(age.Seconds())
+	send(tenant, "oldest_pending_age", strconv.FormatInt(int64(age.Seconds()), 10), "g", "", "")
+}
+
+// LastSuccess records the time of a successful push
+func LastSuccess(ctx context.Context, t time.Time) {
+	tenant := tenantOf(ctx)
+	lastSuccess.WithLabelValues(tenant).Set(float64(t.Unix()))
+	send(tenant, "last_success", strconv.FormatInt(t.Unix(), 10), "g", "", "")
+}
+
+// CircuitState records the state the circuit breaker moved to
+func CircuitState(ctx context.Context, state string) {
+	tenant := tenantOf(ctx)
+	for _, s := range []string{"closed", "open", "half-open"} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		circuit.WithLabelValues(tenant, s).Set(v)
+		send(tenant, "circuit_state", strconv.Itoa(int(v)), "g", "state", s)
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
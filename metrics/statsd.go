@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// statsD sends each metric to the agent as one UDP packet
+type statsD struct {
+	conn   net.Conn
+	prefix string
+	dog    bool
+	// The DogStatsD tags of every metric, "k:v,k:v"
+	tags string
+}
+
+var (
+	statsDMu sync.RWMutex
+	agent    *statsD
+)
+
+// StartStatsD sends the metrics recorded from now on to the agent of cfg
+// as well, until the returned function is called. Without an address
+// nothing is sent.
+func StartStatsD(cfg config.StatsDConfig) (func(), error) {
+	if cfg.Address == "" {
+		return func() {}, nil
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to StatsD agent %s: %v", cfg.Address, err)
+	}
+	var tags []string
+	for k, v := range cfg.Tags {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+	s := &statsD{conn: conn, prefix: cfg.Prefix, dog: cfg.DogStatsD, tags: strings.Join(tags, ",")}
+	statsDMu.Lock()
+	agent = s
+	statsDMu.Unlock()
+	return func() {
+		statsDMu.Lock()
+		agent = nil
+		statsDMu.Unlock()
+		conn.Close()
+	}, nil
+}
+
+// Send name with value of kind (c, g or ms), the tenant and the label
+// name=value, if any, to the agent. Without DogStatsD tags they are parts of
+// the name, <prefix><tenant>.<name>.<value>.
+func send(tenant, name, value, kind, label, labelValue string) {
+	statsDMu.RLock()
+	s := agent
+	statsDMu.RUnlock()
+	if s == nil {
+		return
+	}
+	tags := s.tags
+	if tenant != "" {
+		if s.dog {
+			tags = strings.TrimPrefix(tags+",tenant:"+tenant, ",")
+		} else {
+			name = tenant + "." + name
+		}
+	}
+	name = s.prefix + name
+	if label != "" {
+		if s.dog {
+			tags = strings.TrimPrefix(tags+","+label+":"+labelValue, ",")
+		} else {
+			name += "." + labelValue
+		}
+	}
+	line := name + ":" + value + "|" + kind
+	if tags != "" {
+		line += "|#" + tags
+	}
+	// Metrics are best effort, an agent that is down loses them
+	s.conn.Write([]byte(line))
+}
@@ -0,0 +1,134 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+)
+
+// incidents is an alerting service, keeping one incident open per key
+type incidents interface {
+	trigger(ctx context.Context, key, summary string, details map[string]interface{}) error
+	resolve(ctx context.Context, key string) error
+}
+
+// Alerts follows the runs of a daemon and opens an incident when the
+// backlog grows past alerts.backlog, pushes keep failing for
+// alerts.failing_for or the oldest pending invoice gets older than
+// alerts.max_age, resolving it when the next run is healthy again
+type Alerts struct {
+	Config   config.AlertsConfig
+	services []incidents
+
+	mu sync.Mutex
+	// Start of the first failing run since the last push went through
+	failingSince time.Time
+	// The conditions with an open incident, by key
+	open map[string]bool
+}
+
+// NewAlerts returns the alerts of cfg.Alerts, nil when they are off
+func NewAlerts(cfg *config.Config) *Alerts {
+	a := &Alerts{open: make(map[string]bool)}
+	a.Reload(cfg)
+	if !a.Config.Enabled() {
+		return nil
+	}
+	return a
+}
+
+// Reload picks up the thresholds and services of cfg.Alerts. Open
+// incidents stay open and are resolved through the new services.
+func (a *Alerts) Reload(cfg *config.Config) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Config = cfg.Alerts
+	a.services = nil
+	if k := a.Config.PagerDuty; k.RoutingKey != "" {
+		a.services = append(a.services, &pagerDuty{Config: k})
+	}
+	if k := a.Config.Opsgenie; k.APIKey != "" {
+		a.services = append(a.services, &opsgenie{Config: k})
+	}
+}
+
+func (a *Alerts) Notify(ctx context.Context, s *pipeline.Summary) error {
+	// A shutdown says nothing about the health of pushing
+	if s.Interrupted {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c := a.Config
+	if s.Failed > 0 || s.Error != "" {
+		if s.Pushed > 0 {
+			a.failingSince = time.Time{}
+		} else if a.failingSince.IsZero() {
+			a.failingSince = s.Started
+		}
+	} else {
+		a.failingSince = time.Time{}
+	}
+
+	details := map[string]interface{}{"fetched": s.Fetched, "pushed": s.Pushed, "failed": s.Failed}
+	if s.Error != "" {
+		details["error"] = s.Error
+	}
+	name := "trx-push"
+	if s.Tenant != "" {
+		name += " " + s.Tenant
+		details["tenant"] = s.Tenant
+	}
+	var errs []error
+	backlog := c.Backlog > 0 && s.Fetched > c.Backlog
+	summary := fmt.Sprintf("%s backlog of %d pending invoices is over %d", name, s.Fetched, c.Backlog)
+	errs = append(errs, a.set(ctx, c.Key+"-backlog", backlog, summary, details))
+
+	failing := c.FailingFor > 0 && !a.failingSince.IsZero() && time.Since(a.failingSince) >= c.FailingFor
+	summary = fmt.Sprintf("%s pushes have been failing since %s", name, a.failingSince.Format(time.RFC3339))
+	errs = append(errs, a.set(ctx, c.Key+"-failing", failing, summary, details))
+
+	age := time.Duration(s.OldestPendingAge * float64(time.Second))
+	old := c.MaxAge > 0 && age > c.MaxAge
+	summary = fmt.Sprintf("%s oldest pending invoice is %s old, over %s", name, age.Round(time.Second), c.MaxAge)
+	errs = append(errs, a.set(ctx, c.Key+"-age", old, summary, details))
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open or resolve the incident of key as active says, when it changed. A
+// failed call is made again after the next run.
+func (a *Alerts) set(ctx context.Context, key string, active bool, summary string, details map[string]interface{}) error {
+	if active == a.open[key] {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.Config.Timeout)
+	defer cancel()
+	for _, svc := range a.services {
+		var err error
+		if active {
+			err = svc.trigger(ctx, key, summary, details)
+		} else {
+			err = svc.resolve(ctx, key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update incident %s: %v", key, err)
+		}
+	}
+	if active {
+		slog.Warn("Opened incident", "key", key, "summary", summary)
+	} else {
+		slog.Info("Resolved incident", "key", key)
+	}
+	a.open[key] = active
+	return nil
+}
@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/tmpl"
+	"github.com/purwaren/trx-push/pipeline"
+)
+
+// Failed invoices listed in a chat message, the rest are counted
+const maxListed = 50
+
+// Whether a run with summary s is posted to a chat with settings c.
+// Shutting down is not a failure worth a message.
+func postWanted(c config.ChatConfig, s *pipeline.Summary) bool {
+	return s.NotPushed() >= c.MinFailures || (s.Error != "" && !s.Interrupted)
+}
+
+// links renders notify.invoice_url for the failed invoices of a message
+type links struct {
+	t *template.Template
+}
+
+func newLinks(text string) links {
+	if text == "" {
+		return links{}
+	}
+	// Checked by the config validation
+	t, _ := tmpl.Parse("invoice_url", text)
+	return links{t: t}
+}
+
+// The URL of invoice, "" without notify.invoice_url
+func (l links) url(invoice string) string {
+	if l.t == nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := l.t.Execute(&b, url.PathEscape(invoice)); err != nil {
+		slog.Warn("Failed to render notify.invoice_url", "invoice_id", invoice, "error", err)
+		return ""
+	}
+	return b.String()
+}
+
+// The message about s, with each failed invoice formatted by item and
+// text escaped by escape
+func chatMessage(s *pipeline.Summary, escape func(string) string, item func(invoice string) string) string {
+	var b strings.Builder
+	b.WriteString(escape(headline("trx-push", s)))
+	fmt.Fprintf(&b, "\n%d fetched, %d pushed, %d failed, %d parked, %d for review, %d rejected, %d skipped",
+		s.Fetched, s.Pushed, s.Failed, s.Parked, s.Review, s.Rejected, s.Skipped)
+	if s.Error != "" {
+		b.WriteString("\nError: " + escape(s.Error))
+	}
+	if len(s.FailedInvoices) > 0 {
+		b.WriteString("\nFailed invoices:")
+		for i, inv := range s.FailedInvoices {
+			if i == maxListed {
+				fmt.Fprintf(&b, "\n… and %d more", len(s.FailedInvoices)-maxListed)
+				break
+			}
+			b.WriteString("\n• " + item(inv))
+		}
+	}
+	return b.String()
+}
+
+// Post body as JSON to endpoint with header, failing on anything but a
+// 2xx response
+func postJSON(ctx context.Context, endpoint string, header http.Header, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Without the URL, which can hold a token
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+)
+
+// Email mails the run summary through an SMTP server
+type Email struct {
+	Config config.EmailConfig
+}
+
+func (e *Email) Notify(ctx context.Context, s *pipeline.Summary) error {
+	if !wanted(e.Config.When, s) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.Config.Timeout)
+	defer cancel()
+	if err := e.send(ctx, e.message(s, time.Now())); err != nil {
+		return fmt.Errorf("failed to email run summary via %s: %v", e.Config.Host, err)
+	}
+	return nil
+}
+
+// Reload picks up the settings of cfg.Notify.Email for the next run
+func (e *Email) Reload(cfg *config.Config) {
+	e.Config = cfg.Notify.Email
+}
+
+func (e *Email) message(s *pipeline.Summary, now time.Time) []byte {
+	c := e.Config
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", c.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headline(c.Subject, s)))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(s.String(), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func (e *Email) send(ctx context.Context, msg []byte) error {
+	c := e.Config
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	tlsConfig := &tls.Config{ServerName: c.Host, MinVersion: tls.VersionTLS12}
+	var conn net.Conn
+	var err error
+	if c.TLS == "tls" {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	// The SMTP client has no context, the deadline bounds the whole session
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if c.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	// From may carry a display name, the envelope takes the address
+	from, err := mail.ParseAddress(c.From)
+	if err != nil {
+		return err
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %v", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,45 @@
+// Package notify sends the summary of each run to the people looking after
+// the pushes.
+package notify
+
+import (
+	"fmt"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+)
+
+// New returns the notifiers enabled in cfg.Notify
+func New(cfg *config.Config) []pipeline.Notifier {
+	n := cfg.Notify
+	var notifiers []pipeline.Notifier
+	if len(n.Email.To) > 0 {
+		notifiers = append(notifiers, &Email{Config: n.Email})
+	}
+	if n.Slack.WebhookURL != "" {
+		notifiers = append(notifiers, &Slack{Config: n.Slack, links: newLinks(n.InvoiceURL)})
+	}
+	if n.Telegram.BotToken != "" {
+		notifiers = append(notifiers, &Telegram{Config: n.Telegram, links: newLinks(n.InvoiceURL)})
+	}
+	return notifiers
+}
+
+// Whether a run with summary s is sent in the when mode, failure or always
+func wanted(when string, s *pipeline.Summary) bool {
+	return when == "always" || s.HasFailures()
+}
+
+// The one line gist of s, after prefix
+func headline(prefix string, s *pipeline.Summary) string {
+	if s.Tenant != "" {
+		prefix += " " + s.Tenant
+	}
+	if n := s.NotPushed(); n > 0 {
+		return fmt.Sprintf("%s: %d of %d invoices not pushed", prefix, n, n+s.Pushed)
+	}
+	if s.Error != "" {
+		return fmt.Sprintf("%s: run failed", prefix)
+	}
+	return fmt.Sprintf("%s: %d invoices pushed", prefix, s.Pushed)
+}
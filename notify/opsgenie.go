@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// opsgenie opens alerts through the Alert API, with the key as alias
+type opsgenie struct {
+	Config config.OpsgenieConfig
+}
+
+func (o *opsgenie) trigger(ctx context.Context, key, summary string, details map[string]interface{}) error {
+	props := make(map[string]string, len(details))
+	for k, v := range details {
+		props[k] = fmt.Sprint(v)
+	}
+	return o.send(ctx, "/v2/alerts", map[string]interface{}{
+		"message":  summary,
+		"alias":    key,
+		"priority": "P1",
+		"source":   "trx-push",
+		"details":  props,
+	})
+}
+
+func (o *opsgenie) resolve(ctx context.Context, key string) error {
+	return o.send(ctx, "/v2/alerts/"+url.PathEscape(key)+"/close?identifierType=alias", map[string]interface{}{
+		"source": "trx-push",
+	})
+}
+
+func (o *opsgenie) send(ctx context.Context, path string, body interface{}) error {
+	header := http.Header{"Authorization": {"GenieKey " + o.Config.APIKey}}
+	if err := postJSON(ctx, strings.TrimRight(o.Config.URL, "/")+path, header, body); err != nil {
+		return fmt.Errorf("Opsgenie: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// pagerDuty opens incidents through the Events API v2, deduplicated by key
+type pagerDuty struct {
+	Config config.PagerDutyConfig
+}
+
+func (p *pagerDuty) trigger(ctx context.Context, key, summary string, details map[string]interface{}) error {
+	source, _ := os.Hostname()
+	if source == "" {
+		source = "trx-push"
+	}
+	return p.send(ctx, map[string]interface{}{
+		"routing_key":  p.Config.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    key,
+		"payload": map[string]interface{}{
+			"summary":        summary,
+			"source":         source,
+			"severity":       "critical",
+			"custom_details": details,
+		},
+	})
+}
+
+func (p *pagerDuty) resolve(ctx context.Context, key string) error {
+	return p.send(ctx, map[string]interface{}{
+		"routing_key":  p.Config.RoutingKey,
+		"event_action": "resolve",
+		"dedup_key":    key,
+	})
+}
+
+func (p *pagerDuty) send(ctx context.Context, event map[string]interface{}) error {
+	if err := postJSON(ctx, p.Config.URL, nil, event); err != nil {
+		return fmt.Errorf("PagerDuty: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+)
+
+// Slack posts failed runs to an incoming webhook
+type Slack struct {
+	Config config.SlackConfig
+	links  links
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func (n *Slack) Notify(ctx context.Context, s *pipeline.Summary) error {
+	if !postWanted(n.Config.Chat, s) {
+		return nil
+	}
+	text := chatMessage(s, slackEscaper.Replace, func(invoice string) string {
+		if u := n.links.url(invoice); u != "" {
+			return fmt.Sprintf("<%s|%s>", u, slackEscaper.Replace(invoice))
+		}
+		return slackEscaper.Replace(invoice)
+	})
+	ctx, cancel := context.WithTimeout(ctx, n.Config.Chat.Timeout)
+	defer cancel()
+	if err := postJSON(ctx, n.Config.WebhookURL, nil, map[string]string{"text": text}); err != nil {
+		return fmt.Errorf("failed to post run summary to Slack: %v", err)
+	}
+	return nil
+}
+
+// Reload picks up the settings of cfg.Notify.Slack for the next run
+func (n *Slack) Reload(cfg *config.Config) {
+	n.Config = cfg.Notify.Slack
+	n.links = newLinks(cfg.Notify.InvoiceURL)
+}
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/pipeline"
+)
+
+// Telegram posts failed runs to a chat through a bot
+type Telegram struct {
+	Config config.TelegramConfig
+	links  links
+}
+
+func (n *Telegram) Notify(ctx context.Context, s *pipeline.Summary) error {
+	if !postWanted(n.Config.Chat, s) {
+		return nil
+	}
+	text := chatMessage(s, html.EscapeString, func(invoice string) string {
+		if u := n.links.url(invoice); u != "" {
+			return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(u), html.EscapeString(invoice))
+		}
+		return html.EscapeString(invoice)
+	})
+	msg := map[string]interface{}{
+		"chat_id":                  n.Config.ChatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}
+	endpoint := strings.TrimRight(n.Config.APIURL, "/") + "/bot" + n.Config.BotToken + "/sendMessage"
+	ctx, cancel := context.WithTimeout(ctx, n.Config.Chat.Timeout)
+	defer cancel()
+	if err := postJSON(ctx, endpoint, nil, msg); err != nil {
+		return fmt.Errorf("failed to post run summary to Telegram chat %s: %v", n.Config.ChatID, err)
+	}
+	return nil
+}
+
+// Reload picks up the settings of cfg.Notify.Telegram for the next run
+func (n *Telegram) Reload(cfg *config.Config) {
+	n.Config = cfg.Notify.Telegram
+	n.links = newLinks(cfg.Notify.InvoiceURL)
+}
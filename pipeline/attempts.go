@@ -0,0 +1,81 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Drop the transactions whose invoice reached attempts.max. When the
+// attempts table cannot be read they are all kept, pushing an invoice once
+// too often is better than not pushing it at all.
+func (p *Pipeline) skipExhausted(ctx context.Context, transactions []source.Transaction) []source.Transaction {
+	if p.Attempts == nil || len(transactions) == 0 {
+		return transactions
+	}
+	invoices := make([]string, len(transactions))
+	for i, txn := range transactions {
+		invoices[i] = txn.InvoiceID
+	}
+	exhausted, err := p.Attempts.Exhausted(ctx, invoices)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read push attempts", "table", p.Attempts.Config.Table, "error", err)
+		return transactions
+	}
+	if len(exhausted) == 0 {
+		return transactions
+	}
+
+	kept := transactions[:0]
+	var skipped []string
+	skipper, _ := p.Source.(source.Skipper)
+	for _, txn := range transactions {
+		if !exhausted[txn.InvoiceID] {
+			kept = append(kept, txn)
+			continue
+		}
+		skipped = append(skipped, txn.InvoiceID)
+		// A claimed invoice would otherwise stay claimed until claim.ttl
+		// and a queued one be handed out again
+		var err error
+		if skipper != nil {
+			err = skipper.Skip(context.WithoutCancel(ctx), txn)
+		} else {
+			err = p.Source.Nack(context.WithoutCancel(ctx), txn, true)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to release invoice", "invoice_id", txn.InvoiceID, "error", err)
+		}
+	}
+	slog.WarnContext(ctx, "Skipping invoices that reached the maximum attempts", "count", len(skipped),
+		"max_attempts", p.Attempts.Config.Max, "invoice_ids", skipped)
+	return kept
+}
+
+// Add the attempts of a failed push to the invoice's count, or clear the
+// count once it was pushed
+func (p *Pipeline) countAttempts(ctx context.Context, log *slog.Logger, txn source.Transaction, resp pusher.Response, err error) {
+	if p.Attempts == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil {
+		if err := p.Attempts.Clear(ctx, txn.InvoiceID); err != nil {
+			log.ErrorContext(ctx, "Failed to clear push attempts", "error", err)
+		}
+		return
+	}
+
+	// A payload that failed to load sent no request but still counts
+	total, aerr := p.Attempts.Fail(ctx, txn.InvoiceID, max(resp.Attempts, 1), err.Error())
+	if aerr != nil {
+		log.ErrorContext(ctx, "Failed to count push attempts", "error", aerr)
+		return
+	}
+	if total >= p.Attempts.Config.Max && !pusher.IsPermanent(err) && !pusher.NeedsReview(err) {
+		log.WarnContext(ctx, "Invoice reached the maximum attempts, it will no longer be pushed",
+			"attempts", total, "max_attempts", p.Attempts.Config.Max)
+	}
+}
@@ -0,0 +1,24 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Delete the audit entries older than audit.retention, at most once an hour
+func (p *Pipeline) pruneAudit(ctx context.Context) {
+	retention := p.cfg.Audit.Retention
+	if p.Audit == nil || retention <= 0 || time.Since(p.auditPruned) < time.Hour {
+		return
+	}
+	p.auditPruned = time.Now()
+	n, err := p.Audit.Prune(context.WithoutCancel(ctx), time.Now().Add(-retention))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to prune audit log", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.InfoContext(ctx, "Pruned audit log", "deleted", n, "retention", retention.String())
+	}
+}
@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/purwaren/trx-push/bucket"
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Upload the document of the pushed txn and the response to the bucket.
+// The invoice was pushed either way, so a failure is only logged.
+func (p *Pipeline) archive(ctx context.Context, log *slog.Logger, txn source.Transaction, resp pusher.Response) {
+	if p.Bucket == nil {
+		return
+	}
+	doc, err := pusher.NewEncoder(p.cfg).Encode(txn)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to archive pushed invoice", "error", err)
+		return
+	}
+	o := bucket.Object{InvoiceID: txn.InvoiceID, RunID: correlation.Run(ctx), PushedAt: time.Now(), Payload: doc, StatusCode: resp.StatusCode}
+	if json.Valid(resp.Body) {
+		o.Response = json.RawMessage(resp.Body)
+	} else if len(resp.Body) > 0 {
+		o.Response = string(resp.Body)
+	}
+	if err := p.Bucket.Put(ctx, o); err != nil {
+		log.ErrorContext(ctx, "Failed to archive pushed invoice", "error", err)
+	}
+}
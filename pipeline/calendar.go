@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Read the dates of schedule.holidays_file: one YYYY-MM-DD per line,
+// anything after it and lines starting with # ignored, or an iCalendar
+// file whose all-day events are the holidays
+func loadHolidays(file string) (map[string]bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("BEGIN:VCALENDAR")) {
+		return parseICal(data)
+	}
+	days := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		day, _, _ := strings.Cut(line, " ")
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			return nil, fmt.Errorf("line %d: %q is not a YYYY-MM-DD date", n, day)
+		}
+		days[day] = true
+	}
+	return days, sc.Err()
+}
+
+// The days of the all-day events of an iCalendar file, from DTSTART up to
+// the day before DTEND (just DTSTART without one)
+func parseICal(data []byte) (map[string]bool, error) {
+	days := make(map[string]bool)
+	var start, end time.Time
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// Parameters as in DTSTART;VALUE=DATE
+		name, _, _ = strings.Cut(name, ";")
+		switch name {
+		case "BEGIN":
+			if value == "VEVENT" {
+				start, end = time.Time{}, time.Time{}
+			}
+		case "DTSTART", "DTEND":
+			// Events with a time of day are not holidays
+			if strings.Contains(value, "T") {
+				continue
+			}
+			t, err := time.Parse("20060102", value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", name, value)
+			}
+			if name == "DTSTART" {
+				start = t
+			} else {
+				end = t
+			}
+		case "END":
+			if value != "VEVENT" || start.IsZero() {
+				continue
+			}
+			days[start.Format(time.DateOnly)] = true
+			for t := start.AddDate(0, 0, 1); t.Before(end); t = t.AddDate(0, 0, 1) {
+				days[t.Format(time.DateOnly)] = true
+			}
+		}
+	}
+	return days, sc.Err()
+}
@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadHolidays(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []string
+		ok   bool
+	}{
+		{
+			name: "dates",
+			file: "# National holidays\n2026-01-01 New Year\n\n2026-03-19\n  2026-12-25 Christmas  \n",
+			want: []string{"2026-01-01", "2026-03-19", "2026-12-25"},
+			ok:   true,
+		},
+		{
+			name: "bad date",
+			file: "2026-01-01\n01/05/2026\n",
+			ok:   false,
+		},
+		{
+			name: "empty",
+			file: "# none yet\n",
+			want: []string{},
+			ok:   true,
+		},
+		{
+			name: "ical",
+			file: "BEGIN:VCALENDAR\r\n" +
+				"BEGIN:VEVENT\r\nSUMMARY:New Year\r\nDTSTART;VALUE=DATE:20260101\r\nEND:VEVENT\r\n" +
+				// DTEND is exclusive
+				"BEGIN:VEVENT\r\nSUMMARY:Eid\r\nDTSTART;VALUE=DATE:20260320\r\nDTEND;VALUE=DATE:20260323\r\nEND:VEVENT\r\n" +
+				"BEGIN:VEVENT\r\nSUMMARY:Meeting\r\nDTSTART:20260305T090000Z\r\nDTEND:20260305T100000Z\r\nEND:VEVENT\r\n" +
+				"END:VCALENDAR\r\n",
+			want: []string{"2026-01-01", "2026-03-20", "2026-03-21", "2026-03-22"},
+			ok:   true,
+		},
+		{
+			name: "ical bad date",
+			file: "BEGIN:VCALENDAR\nBEGIN:VEVENT\nDTSTART;VALUE=DATE:2026-01-01\nEND:VEVENT\nEND:VCALENDAR\n",
+			ok:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "holidays")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			days, err := loadHolidays(path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			want := make(map[string]bool)
+			for _, d := range tt.want {
+				want[d] = true
+			}
+			if !reflect.DeepEqual(days, want) {
+				t.Fatalf("holidays = %v, want %v", days, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Store the capture.fields of a successful push response with the invoice.
+// The push already happened, so a failure here is only logged.
+func (p *Pipeline) capture(ctx context.Context, log *slog.Logger, txn source.Transaction, resp pusher.Response) {
+	c, ok := p.Source.(source.Capturer)
+	if !ok || len(p.cfg.Capture.Fields) == 0 {
+		return
+	}
+	values := make([]*string, len(p.cfg.Capture.Fields))
+	for i, f := range p.cfg.Capture.Fields {
+		if v, ok := jsonutil.Lookup(resp.Body, f.Path); ok {
+			values[i] = &v
+		} else {
+			log.WarnContext(ctx, "Push response has no captured field", "path", f.Path)
+		}
+	}
+	if err := c.Capture(ctx, txn.InvoiceID, values); err != nil {
+		log.ErrorContext(ctx, "Failed to store push response fields", "error", err)
+	}
+}
+
+// Move the row of the pushed txn into the history table, after its status
+// and captured fields are written
+func (p *Pipeline) moveToHistory(ctx context.Context, log *slog.Logger, txn source.Transaction) {
+	h, ok := p.Source.(source.Historian)
+	if !ok || !p.cfg.History.Enabled {
+		return
+	}
+	if err := h.MoveToHistory(ctx, txn.InvoiceID); err != nil {
+		log.ErrorContext(ctx, "Failed to move invoice to the history table", "table", p.cfg.History.Table, "error", err)
+	}
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Progress of a paged run, kept in checkpoint.file
+type checkpoint struct {
+	RunID string `json:"run_id"`
+	// Last invoice number of the last page pushed
+	After string    `json:"after"`
+	At    time.Time `json:"at"`
+}
+
+// The invoice number to resume after, empty when checkpoints are disabled
+// or the last run completed
+func (p *Pipeline) loadCheckpoint() string {
+	if !p.cfg.Checkpoint.Enabled || p.DryRun {
+		return ""
+	}
+	data, err := os.ReadFile(p.cfg.Checkpoint.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	var cp checkpoint
+	if err == nil {
+		err = json.Unmarshal(data, &cp)
+	}
+	if err != nil {
+		slog.Error("Failed to read checkpoint, starting from the first page", "file", p.cfg.Checkpoint.File, "error", err)
+		return ""
+	}
+	slog.Info("Resuming interrupted run", "run_id", cp.RunID, "after", cp.After, "checkpoint_at", cp.At)
+	return cp.After
+}
+
+// Record that run runID pushed every page up to the invoice after
+func (p *Pipeline) saveCheckpoint(runID, after string) {
+	if !p.cfg.Checkpoint.Enabled || p.DryRun {
+		return
+	}
+	data, _ := json.Marshal(checkpoint{RunID: runID, After: after, At: time.Now()})
+	f := p.cfg.Checkpoint.File
+	err := os.WriteFile(f+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(f+".tmp", f)
+	}
+	if err != nil {
+		slog.Error("Failed to write checkpoint", "file", f, "error", err)
+	}
+}
+
+// Forget the checkpoint once a run went through every page
+func (p *Pipeline) clearCheckpoint() {
+	if !p.cfg.Checkpoint.Enabled || p.DryRun {
+		return
+	}
+	if err := os.Remove(p.cfg.Checkpoint.File); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove checkpoint", "file", p.cfg.Checkpoint.File, "error", err)
+	}
+}
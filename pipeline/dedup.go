@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/source"
+)
+
+// Drop the transactions whose invoice is already in seen, adding the rest,
+// then with dedup.history mark the ones pushed in an earlier run pushed
+// without pushing them again. seen holds the invoices of the run so far.
+func (p *Pipeline) dedup(ctx context.Context, seen map[string]bool, transactions []source.Transaction) []source.Transaction {
+	kept := transactions[:0]
+	skipper, _ := p.Source.(source.Skipper)
+	var duplicates []string
+	for _, txn := range transactions {
+		if !seen[txn.InvoiceID] {
+			seen[txn.InvoiceID] = true
+			kept = append(kept, txn)
+			continue
+		}
+		duplicates = append(duplicates, txn.InvoiceID)
+		if skipper != nil {
+			if err := skipper.Skip(context.WithoutCancel(ctx), txn); err != nil {
+				slog.ErrorContext(ctx, "Failed to skip transaction", "invoice_id", txn.InvoiceID, "error", err)
+			}
+		}
+	}
+	if len(duplicates) > 0 {
+		slog.WarnContext(ctx, "Skipping invoices fetched more than once", "count", len(duplicates), "invoice_ids", duplicates)
+	}
+	return p.skipPushed(ctx, kept)
+}
+
+// Drop the transactions with a success result, marking them pushed. When
+// the results table cannot be read they are all kept.
+func (p *Pipeline) skipPushed(ctx context.Context, transactions []source.Transaction) []source.Transaction {
+	if !p.cfg.Dedup.History || p.Results == nil || len(transactions) == 0 {
+		return transactions
+	}
+	invoices := make([]string, len(transactions))
+	for i, txn := range transactions {
+		invoices[i] = txn.InvoiceID
+	}
+	pushed, err := p.Results.Pushed(ctx, invoices)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to look up pushed invoices", "table", p.Results.Config.Table, "error", err)
+		return transactions
+	}
+	if len(pushed) == 0 {
+		return transactions
+	}
+
+	kept := transactions[:0]
+	var skipped []string
+	for _, txn := range transactions {
+		if !pushed[txn.InvoiceID] {
+			kept = append(kept, txn)
+			continue
+		}
+		skipped = append(skipped, txn.InvoiceID)
+		// Its status update was lost, so it keeps being fetched
+		if err := p.Source.Ack(context.WithoutCancel(ctx), txn); err != nil {
+			slog.ErrorContext(ctx, "Failed to mark invoice pushed", "invoice_id", txn.InvoiceID, "error", err)
+		}
+	}
+	slog.WarnContext(ctx, "Skipping invoices pushed in an earlier run", "count", len(skipped), "invoice_ids", skipped)
+	return kept
+}
@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/hooks"
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/source"
+	"github.com/purwaren/trx-push/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// workerStats counts the outcomes handled by one worker
+type workerStats struct {
+	pushed, failed, parked, review, rejected, skipped int
+}
+
+func (s *workerStats) count(status string) {
+	switch status {
+	case results.StatusSuccess:
+		s.pushed++
+	case results.StatusParked:
+		s.parked++
+	case results.StatusReview:
+		s.review++
+	case results.StatusRejected:
+		s.rejected++
+	case "", outcomeSkipped:
+		// Skipped by a hook or a quota, or never dispatched because the
+		// run was interrupted
+		s.skipped++
+	default:
+		s.failed++
+	}
+}
+
+// Push all transactions with a pool of workers. Without grouping every
+// transaction is its own job and concurrency workers share the queue;
+// with grouping.column each group is one job, so a group is handled by a
+// single worker in selection order while grouping.parallelism groups run
+// in parallel. With bulk each job is one bulk request of up to bulk.size
+// transactions. grouping.partitioned goes through pushPartitioned instead.
+// Once ctx is cancelled no new jobs are started. Returns the
+// results status of each transaction, "" for the ones skipped that way.
+func (p *Pipeline) pushAll(ctx context.Context, transactions []source.Transaction, batch *results.Batch) []string {
+	var jobs [][]int
+	workers := p.cfg.Concurrency
+	bulk, _ := p.Sink.(pusher.BulkSink)
+	if !p.cfg.Bulk.Enabled {
+		bulk = nil
+	}
+	if p.cfg.Grouping.Partitioned {
+		return p.pushPartitioned(ctx, transactions, batch)
+	}
+	if p.cfg.Grouping.Column != "" {
+		jobs = groupJobs(transactions)
+		workers = p.cfg.Grouping.Parallelism
+	} else if bulk != nil {
+		jobs = bulkJobs(len(transactions), p.cfg.Bulk.Size)
+	} else {
+		for i := range transactions {
+			jobs = append(jobs, []int{i})
+		}
+	}
+
+	outcomes := make([]string, len(transactions))
+	stats := make([]workerStats, workers)
+	queue := make(chan []int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for job := range queue {
+				if bulk != nil {
+					for k, status := range p.pushBulk(ctx, bulk, job, transactions, batch) {
+						outcomes[job[k]] = status
+						stats[w].count(status)
+						p.progress.Done(1)
+					}
+					continue
+				}
+				for n, i := range job {
+					// Stop a group midway on shutdown; the rest of it
+					// stays pending for the next run
+					if ctx.Err() != nil {
+						break
+					}
+					outcomes[i] = p.pushOne(ctx, transactions[i], batch)
+					stats[w].count(outcomes[i])
+					p.progress.Done(1)
+					if leftPending(outcomes[i]) {
+						p.holdGroup(ctx, job[n+1:], transactions, outcomes, &stats[w])
+						break
+					}
+				}
+			}
+		}(w)
+	}
+dispatch:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case <-ctx.Done():
+			slog.WarnContext(ctx, "Interrupted, finishing in-flight pushes and skipping the rest")
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	logSummary(ctx, transactions, outcomes, stats)
+	return outcomes
+}
+
+// Release the invoices of a group behind one left pending, as pushInOrder
+// does, so none of them reaches the API ahead of it
+func (p *Pipeline) holdGroup(ctx context.Context, rest []int, transactions []source.Transaction, outcomes []string, stats *workerStats) {
+	if len(rest) == 0 {
+		return
+	}
+	slog.InfoContext(ctx, "Holding the rest of the group behind a pending invoice",
+		"group", transactions[rest[0]].Group, "count", len(rest))
+	for _, i := range rest {
+		outcomes[i] = p.release(ctx, transactions[i])
+		stats.count(outcomes[i])
+		p.progress.Done(1)
+	}
+}
+
+// Outcome of an invoice a hook or a quota skipped, left pending without a
+// result
+const outcomeSkipped = "skipped"
+
+// StatusSkipped is the status PushInvoice returns for an invoice a hook or
+// a quota skipped
+const StatusSkipped = outcomeSkipped
+
+// Whether an invoice with outcome o stays pending, to be pushed again: one
+// that failed, was skipped or never dispatched
+func leftPending(o string) bool {
+	return o != results.StatusSuccess && o != results.StatusParked && o != results.StatusReview && o != results.StatusRejected
+}
+
+// Whether every transaction was handled, i.e. none were left out by an
+// interruption
+func completed(outcomes []string) bool {
+	for _, o := range outcomes {
+		if o == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Split n transactions into jobs of size, in selection order
+func bulkJobs(n, size int) [][]int {
+	var jobs [][]int
+	for i := 0; i < n; i++ {
+		if i%size == 0 {
+			jobs = append(jobs, nil)
+		}
+		jobs[len(jobs)-1] = append(jobs[len(jobs)-1], i)
+	}
+	return jobs
+}
+
+// Push the transactions of job with one bulk request and handle each like
+// a single push. Those whose payload failed to load, a hook skipped or
+// past a quota are not sent.
+func (p *Pipeline) pushBulk(ctx context.Context, sink pusher.BulkSink, job []int, transactions []source.Transaction, batch *results.Batch) []string {
+	ctx = correlation.WithRequest(ctx)
+	start := time.Now()
+	statuses := make([]string, len(job))
+	var txns []source.Transaction
+	var sent []int
+	for k, i := range job {
+		txn, err := p.prepare(ctx, transactions[i])
+		if errors.Is(err, hooks.ErrSkip) {
+			statuses[k] = p.skip(ctx, txn)
+			continue
+		}
+		if err != nil {
+			statuses[k] = p.handle(ctx, txn, pusher.Response{}, err, start, batch)
+			continue
+		}
+		if !p.takeQuota(ctx) {
+			statuses[k] = p.release(ctx, txn)
+			continue
+		}
+		txns = append(txns, txn)
+		sent = append(sent, k)
+	}
+	if len(txns) == 0 {
+		return statuses
+	}
+	ctx, span := tracing.Start(ctx, "push bulk", attribute.Int("trx_push.invoices", len(txns)))
+	defer span.End()
+	pushCtx, cancel := p.pushTimeout(ctx)
+	defer cancel()
+	for n, r := range sink.PushBulk(pushCtx, txns) {
+		statuses[sent[n]] = p.handle(ctx, txns[n], r.Response, p.timedOut(ctx, pushCtx, r.Err), start, batch)
+	}
+	return statuses
+}
+
+// Split transactions into per-group jobs, keeping groups in order of first
+// appearance and transactions in selection order within each group
+func groupJobs(transactions []source.Transaction) [][]int {
+	var jobs [][]int
+	index := make(map[string]int)
+	for i, txn := range transactions {
+		j, ok := index[txn.Group]
+		if !ok {
+			j = len(jobs)
+			index[txn.Group] = j
+			jobs = append(jobs, nil)
+		}
+		jobs[j] = append(jobs[j], i)
+	}
+	return jobs
+}
+
+// Log totals, per-worker counts and the failed invoices in selection order
+func logSummary(ctx context.Context, transactions []source.Transaction, outcomes []string, stats []workerStats) {
+	if len(transactions) == 0 {
+		return
+	}
+	var total workerStats
+	for _, s := range outcomes {
+		total.count(s)
+	}
+	slog.InfoContext(ctx, "Push finished", "pushed", total.pushed, "failed", total.failed, "parked", total.parked,
+		"review", total.review, "rejected", total.rejected, "skipped", total.skipped, "total", len(transactions))
+
+	if len(stats) > 1 {
+		for w, s := range stats {
+			slog.InfoContext(ctx, "Worker finished", "worker", w+1, "pushed", s.pushed, "failed", s.failed, "parked", s.parked, "review", s.review)
+		}
+	}
+
+	var failed []string
+	for i, s := range outcomes {
+		if s != results.StatusSuccess {
+			failed = append(failed, transactions[i].InvoiceID)
+		}
+	}
+	if len(failed) > 0 {
+		slog.WarnContext(ctx, "Not pushed", "invoice_ids", strings.Join(failed, ","))
+	}
+}
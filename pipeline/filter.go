@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/purwaren/trx-push/source"
+)
+
+func compileFilter(text string) (*vm.Program, error) {
+	if text == "" {
+		return nil, nil
+	}
+	program, err := expr.Compile(text, expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("invalid query.filter: %v", err)
+	}
+	return program, nil
+}
+
+// Keep the transactions whose payload matches query.filter, loading the
+// payloads for the push on the way. The others are left pending, and so
+// is one the filter fails on. One whose payload fails to load is kept, so
+// its push fails and is counted.
+func (p *Pipeline) filter(ctx context.Context, transactions []source.Transaction) []source.Transaction {
+	if p.filterProgram == nil || len(transactions) == 0 {
+		return transactions
+	}
+	kept := transactions[:0]
+	skipper, _ := p.Source.(source.Skipper)
+	skipped := 0
+	for _, txn := range transactions {
+		log := slog.With("invoice_id", txn.InvoiceID)
+		loaded, err := p.loadPayload(ctx, txn)
+		if err != nil {
+			kept = append(kept, txn)
+			continue
+		}
+		match, err := p.matches(loaded)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to evaluate query.filter", "error", err)
+		}
+		if match {
+			kept = append(kept, loaded)
+			continue
+		}
+		skipped++
+		if skipper != nil {
+			if err := skipper.Skip(context.WithoutCancel(ctx), txn); err != nil {
+				log.ErrorContext(ctx, "Failed to skip transaction", "error", err)
+			}
+		}
+	}
+	if skipped > 0 {
+		slog.InfoContext(ctx, "Left out transactions not matching query.filter", "count", skipped)
+	}
+	return kept
+}
+
+// Whether txn matches query.filter. The payload fields are its variables,
+// with invoice_id for the invoice number.
+func (p *Pipeline) matches(txn source.Transaction) (bool, error) {
+	env := make(map[string]interface{}, len(txn.Payload)+1)
+	for k, v := range txn.Payload {
+		env[k] = v
+	}
+	if _, ok := env["invoice_id"]; !ok {
+		env["invoice_id"] = txn.InvoiceID
+	}
+	out, err := expr.Run(p.filterProgram, env)
+	if err != nil {
+		return false, err
+	}
+	match, _ := out.(bool)
+	return match, nil
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Listen pushes invoices as their numbers arrive on events, after a first
+// full cycle that clears the existing backlog. An empty event (sent after
+// a reconnect) and every schedule.interval (DefaultInterval when serving)
+// trigger a full catch-up cycle so missed notifications are not lost, as
+// does pushing opening again after it was closed and, with
+// grouping.partitioned, every notification. Returns when ctx is cancelled
+// or events is closed; an interrupted catch-up cycle returns
+// ErrInterrupted.
+func (p *Pipeline) Listen(ctx context.Context, events <-chan string) error {
+	if !p.DryRun {
+		go p.refreshToken(ctx)
+	}
+	if _, err := p.run(ctx, TriggerListen); errors.Is(err, ErrInterrupted) {
+		return err
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Run failed", "error", err)
+	}
+
+	var catchUp <-chan time.Time
+	if d := p.interval(); d > 0 {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		catchUp = ticker.C
+	}
+
+	// Fires when pushing opens, armed whenever it is found closed
+	var opens *time.Timer
+	var opened <-chan time.Time
+	defer func() {
+		if opens != nil {
+			opens.Stop()
+		}
+	}()
+
+	slog.InfoContext(ctx, "Waiting for notifications")
+	for {
+		if d, ok := p.untilOpen(time.Now()); ok && opened == nil {
+			opens = time.NewTimer(d)
+			opened = opens.C
+		}
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "Shutting down")
+			return nil
+		case <-opened:
+			opened = nil
+			slog.InfoContext(ctx, "Pushing open, catching up")
+			if _, err := p.run(ctx, TriggerListen); errors.Is(err, ErrInterrupted) {
+				return err
+			} else if err != nil {
+				slog.ErrorContext(ctx, "Run failed", "error", err)
+			}
+		case <-catchUp:
+			if _, err := p.run(ctx, TriggerListen); errors.Is(err, ErrInterrupted) {
+				return err
+			} else if err != nil {
+				slog.ErrorContext(ctx, "Run failed", "error", err)
+			}
+		case invoiceID, ok := <-events:
+			if !ok {
+				return nil
+			}
+			// An invoice of a partitioned group goes in order behind the
+			// pending ones of the group, with a catch-up cycle
+			if invoiceID == "" || p.Config().Grouping.Partitioned {
+				if _, err := p.run(ctx, TriggerListen); errors.Is(err, ErrInterrupted) {
+					return err
+				} else if err != nil {
+					slog.ErrorContext(ctx, "Run failed", "error", err)
+				}
+				continue
+			}
+			p.pushNotified(ctx, invoiceID)
+		}
+	}
+}
+
+// Push one notified invoice, unless it is invalid or pushing is closed (a
+// catch-up cycle picks it up once it opens)
+func (p *Pipeline) pushNotified(ctx context.Context, invoiceID string) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if reason, ok := p.closed(time.Now()); ok {
+		slog.InfoContext(ctx, "Pushing closed, deferring push", "reason", reason, "invoice_id", invoiceID)
+		return
+	}
+	txns := p.skipExhausted(ctx, p.validate(ctx, []source.Transaction{{InvoiceID: invoiceID}}))
+	if len(txns) == 0 {
+		return
+	}
+	// Announced again, or after it was pushed by a run
+	if pc, ok := p.Source.(source.PendingChecker); ok {
+		pending, err := pc.IsPending(ctx, invoiceID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to check whether invoice is pending", "invoice_id", invoiceID, "error", err)
+			return
+		}
+		if !pending {
+			slog.InfoContext(ctx, "Invoice is not pending, not pushing it", "invoice_id", invoiceID)
+			return
+		}
+	}
+	if p.DryRun {
+		p.printDryRun(txns)
+		return
+	}
+	if _, err := p.pushSingle(ctx, txns[0]); err != nil {
+		slog.ErrorContext(ctx, err.Error())
+	}
+}
+
+// Push txn on its own, logging in first when there is no token yet, and
+// return its results status
+func (p *Pipeline) pushSingle(ctx context.Context, txn source.Transaction) (string, error) {
+	if p.Auth.Token() == "" {
+		if err := p.Auth.Login(ctx); err != nil {
+			return "", &LoginError{Err: err}
+		}
+	}
+	p.resetQuota()
+	runID := NewRunID()
+	batch := p.newBatch(runID)
+	status := p.pushOne(correlation.WithRun(ctx, runID), txn, batch)
+	if batch != nil {
+		batch.Flush(context.WithoutCancel(ctx))
+	}
+	return status, nil
+}
+
+// ErrSkipped is returned by PushInvoice for an invoice that failed
+// validation or is past attempts.max
+var ErrSkipped = errors.New("invoice failed validation or is past attempts.max")
+
+// PushInvoice pushes one invoice right away, once a running cycle has
+// finished, and returns its results status. While pushing is closed it
+// is not pushed.
+func (p *Pipeline) PushInvoice(ctx context.Context, invoiceID string) (string, error) {
+	return p.pushInvoice(ctx, invoiceID)
+}
+
+// ForceInvoice pushes one invoice like PushInvoice, but without checking
+// validation, attempts.max or the quotas
+func (p *Pipeline) ForceInvoice(ctx context.Context, invoiceID string) (string, error) {
+	return p.pushInvoice(context.WithValue(ctx, forceKey{}, true), invoiceID)
+}
+
+func (p *Pipeline) pushInvoice(ctx context.Context, invoiceID string) (string, error) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if reason, ok := p.closed(time.Now()); ok {
+		return "", fmt.Errorf("pushing closed: %s", reason)
+	}
+	txns := []source.Transaction{{InvoiceID: invoiceID}}
+	if !forced(ctx) {
+		txns = p.skipExhausted(ctx, p.validate(ctx, txns))
+	}
+	if len(txns) == 0 {
+		return "", ErrSkipped
+	}
+	return p.pushSingle(ctx, txns[0])
+}
+
+// Marks the context of a forced push
+type forceKey struct{}
+
+// Whether ctx is of a push made with ForceInvoice
+func forced(ctx context.Context) bool {
+	f, _ := ctx.Value(forceKey{}).(bool)
+	return f
+}
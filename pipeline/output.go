@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Outcome is the line written to Output for every invoice handled
+type Outcome struct {
+	Type      string `json:"type"`
+	RunID     string `json:"run_id"`
+	Tenant    string `json:"tenant,omitempty"`
+	InvoiceID string `json:"invoice_id"`
+	// One of the results statuses, or "skipped"
+	Status     string `json:"status"`
+	HTTPCode   int    `json:"http_code,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	// The pusher.Class of the error
+	Class string    `json:"class,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// Held while writing a line, as tenants share the output
+var outputMu sync.Mutex
+
+// summaryLine is the line written to Output at the end of a run
+type summaryLine struct {
+	Type string `json:"type"`
+	*Summary
+}
+
+// Write the outcome of txn to Output, when set
+func (p *Pipeline) emitOutcome(ctx context.Context, txn source.Transaction, status string, resp pusher.Response, err error, start time.Time) {
+	if p.Output == nil {
+		return
+	}
+	o := Outcome{Type: "invoice", RunID: correlation.Run(ctx), Tenant: p.cfg.Tenant, InvoiceID: txn.InvoiceID, Status: status,
+		HTTPCode: resp.StatusCode, Attempts: resp.Attempts, At: time.Now()}
+	if !start.IsZero() {
+		o.DurationMS = o.At.Sub(start).Milliseconds()
+	}
+	if err != nil {
+		o.Error, o.Class = err.Error(), string(classify(resp, err))
+	}
+	p.emit(ctx, o)
+}
+
+// Write v to Output as one JSON line
+func (p *Pipeline) emit(ctx context.Context, v interface{}) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode output", "error", err)
+		return
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if _, err := p.Output.Write(append(line, '\n')); err != nil {
+		slog.ErrorContext(ctx, "Failed to write output", "error", err)
+	}
+}
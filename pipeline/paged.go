@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/metrics"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Fetch and push query.page_size transactions at a time, each page starting
+// after the last invoice number of the previous one, so only one page is
+// held in memory. Invoices that fail stay pending for the next run. With
+// checkpoint enabled, a run left unfinished is resumed after the last page
+// it pushed.
+func (p *Pipeline) runPaged(ctx context.Context, pg source.Pager, sum *Summary) error {
+	size := p.cfg.Query.PageSize
+	batch := p.newBatch(sum.RunID)
+	if batch != nil {
+		defer batch.Flush(context.WithoutCancel(ctx))
+	}
+
+	after := p.loadCheckpoint()
+	seen := make(map[string]bool)
+	total := 0
+	warmed := false
+	for page := 1; ; page++ {
+		transactions, err := pg.FetchPage(ctx, after, size)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrInterrupted
+			}
+			return &FetchError{Err: err}
+		}
+		if len(transactions) == 0 {
+			break
+		}
+		after = transactions[len(transactions)-1].InvoiceID
+		fetched := len(transactions)
+		transactions = p.filter(ctx, p.skipExhausted(ctx, p.dedup(ctx, seen, p.validate(ctx, transactions))))
+		total += len(transactions)
+		slog.InfoContext(ctx, "Fetched page", "page", page, "transactions", len(transactions))
+
+		if p.DryRun {
+			p.printDryRun(transactions)
+		} else {
+			if w, ok := p.Sink.(Warmer); ok && p.cfg.Warmup.Enabled && !warmed && len(transactions) > 0 {
+				w.Warmup(ctx)
+				warmed = true
+			}
+			p.progress.Add(len(transactions))
+			if fetched < size {
+				p.progress.Known()
+			}
+			outcomes := p.pushAll(ctx, transactions, batch)
+			sum.add(fetched, transactions, outcomes)
+			if !completed(outcomes) {
+				return ErrInterrupted
+			}
+			p.saveCheckpoint(sum.RunID, after)
+		}
+		if fetched < size {
+			break
+		}
+	}
+	p.clearCheckpoint()
+	metrics.Backlog(ctx, total)
+	return nil
+}
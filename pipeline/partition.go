@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/source"
+)
+
+// The worker of grouping.partitioned that the invoices of group go to
+func partition(group string, workers int) int {
+	if workers <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(group))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// Push all transactions with grouping.parallelism workers, each taking the
+// groups that partition gives it in selection order
+func (p *Pipeline) pushPartitioned(ctx context.Context, transactions []source.Transaction, batch *results.Batch) []string {
+	workers := p.cfg.Grouping.Parallelism
+	partitions := make([][]int, workers)
+	for i, txn := range transactions {
+		w := partition(txn.Group, workers)
+		partitions[w] = append(partitions[w], i)
+	}
+
+	outcomes := make([]string, len(transactions))
+	stats := make([]workerStats, workers)
+	done := make(chan struct{})
+	for w := range partitions {
+		go func(w int) {
+			defer func() { done <- struct{}{} }()
+			for _, i := range partitions[w] {
+				// The rest stays pending for the next run
+				if ctx.Err() != nil {
+					return
+				}
+				outcomes[i] = p.pushInOrder(ctx, transactions[i], batch)
+				stats[w].count(outcomes[i])
+				p.progress.Done(1)
+			}
+		}(w)
+	}
+	for range partitions {
+		<-done
+	}
+	if ctx.Err() != nil && !completed(outcomes) {
+		slog.WarnContext(ctx, "Interrupted, finishing in-flight pushes and skipping the rest")
+	}
+
+	logSummary(ctx, transactions, outcomes, stats)
+	return outcomes
+}
+
+// Forget the groups held by the last run
+func (p *Pipeline) resetHeld() {
+	p.heldMu.Lock()
+	p.held = make(map[string]bool)
+	p.heldMu.Unlock()
+}
+
+// Push txn unless an earlier invoice of its group was left pending in this
+// run, holding the group when txn is
+func (p *Pipeline) pushInOrder(ctx context.Context, txn source.Transaction, batch *results.Batch) string {
+	p.heldMu.Lock()
+	held := p.held[txn.Group]
+	p.heldMu.Unlock()
+	if held {
+		slog.InfoContext(ctx, "Holding invoice behind an earlier one of its group", "invoice_id", txn.InvoiceID, "group", txn.Group)
+		return p.release(ctx, txn)
+	}
+	status := p.pushOne(ctx, txn, batch)
+	if leftPending(status) {
+		p.heldMu.Lock()
+		p.held[txn.Group] = true
+		p.heldMu.Unlock()
+	}
+	return status
+}
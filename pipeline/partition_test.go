@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/purwaren/trx-push/results"
+)
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		group   string
+		workers int
+		want    int
+	}{
+		{"CUST-1", 0, 0},
+		{"CUST-1", 1, 0},
+		// FNV-1a of the group modulo the workers
+		{"", 4, 1},
+		{"CUST-1", 4, 0},
+		{"CUST-2", 4, 1},
+		{"CUST-1", 7, 5},
+	}
+	for _, tt := range tests {
+		if got := partition(tt.group, tt.workers); got != tt.want {
+			t.Errorf("partition(%q, %d) = %d, want %d", tt.group, tt.workers, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionSpread(t *testing.T) {
+	const workers, groups = 4, 1000
+	counts := make([]int, workers)
+	for i := 0; i < groups; i++ {
+		group := fmt.Sprintf("CUST-%d", i)
+		w := partition(group, workers)
+		if w < 0 || w >= workers {
+			t.Fatalf("partition(%q) = %d, out of range", group, w)
+		}
+		// The same group always goes to the same worker
+		if again := partition(group, workers); again != w {
+			t.Fatalf("partition(%q) = %d, then %d", group, w, again)
+		}
+		counts[w]++
+	}
+	for w, n := range counts {
+		if n < groups/workers/2 {
+			t.Errorf("worker %d got %d of %d groups", w, n, groups)
+		}
+	}
+}
+
+func TestLeftPending(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{results.StatusSuccess, false},
+		{results.StatusParked, false},
+		{results.StatusReview, false},
+		{results.StatusRejected, false},
+		{results.StatusFailed, true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := leftPending(tt.status); got != tt.want {
+			t.Errorf("leftPending(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
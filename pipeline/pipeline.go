@@ -0,0 +1,723 @@
+// Package pipeline ties authentication, a transaction source and a sink
+// into the login, fetch and push cycle run by trx-push.
+package pipeline
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/expr-lang/expr/vm"
+	"github.com/purwaren/trx-push/attempts"
+	"github.com/purwaren/trx-push/audit"
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/bucket"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/dlq"
+	"github.com/purwaren/trx-push/hooks"
+	"github.com/purwaren/trx-push/internal/bodyschema"
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/metrics"
+	"github.com/purwaren/trx-push/progress"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/queue"
+	"github.com/purwaren/trx-push/quota"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/runs"
+	"github.com/purwaren/trx-push/source"
+	"github.com/purwaren/trx-push/tracing"
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrInterrupted is returned when ctx was cancelled during a run: in-flight
+// pushes were completed and the remaining transactions skipped
+var ErrInterrupted = errors.New("run interrupted before all transactions were pushed")
+
+// ErrRunTooLong is returned when a run was stopped at max_run_duration the
+// same way as for ErrInterrupted. In daemon mode the next cycle runs as
+// usual.
+var ErrRunTooLong = errors.New("run stopped at max_run_duration before all transactions were pushed")
+
+// LoginError is returned when a run could not log in to the API
+type LoginError struct {
+	Err error
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("failed to login and get JWT token: %v", e.Err)
+}
+
+func (e *LoginError) Unwrap() error { return e.Err }
+
+// FetchError is returned when a run could not read the pending
+// transactions from its source
+type FetchError struct {
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("failed to get transactions from the database: %v", e.Err)
+}
+
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// Warmer is implemented by sinks that can prime their connection before a
+// batch
+type Warmer interface {
+	Warmup(ctx context.Context)
+}
+
+// Describer is implemented by sinks that can show what they would send,
+// used by dry runs
+type Describer interface {
+	Describe(txn source.Transaction) string
+}
+
+type Pipeline struct {
+	Auth   auth.Authenticator
+	Source source.Source
+	Sink   pusher.Sink
+	// Optional; nil disables result persistence
+	Results *results.Store
+	// Optional; nil disables the dead-letter table
+	DeadLetters *dlq.Store
+	// Optional; nil disables attempt tracking across runs
+	Attempts *attempts.Store
+	// Optional; nil disables the run history table
+	Runs *runs.Store
+	// Optional; nil counts no daily quota
+	Quota *quota.Store
+	// Optional; nil leaves the invoices the API did not answer pending
+	Queue *queue.Queue
+	// Optional; nil keeps no copy of the pushed invoices
+	Bucket *bucket.Bucket
+	// Optional; pruned after audit.retention, the sink records into it
+	Audit audit.Log
+	// Called around every push
+	Hooks hooks.Chain
+	// Only fetch and print what would be pushed: no login, no push and no
+	// database writes
+	DryRun bool
+	// Keep polling even without schedule.interval, using DefaultInterval
+	Daemon bool
+	// Sent the summary at the end of every run
+	Notifiers []Notifier
+	// Optional; gets a JSON line with the outcome of every invoice and
+	// one with the summary of every run, in place of summary.print
+	Output io.Writer
+
+	// Held for reading by a running cycle, and for writing by Reload
+	mu             sync.RWMutex
+	cfg            *config.Config
+	invoicePattern *regexp.Regexp
+	rules          []rule
+	filterProgram  *vm.Program
+	blackouts      []dailyWindow
+	windows        []dailyWindow
+	holidays       map[string]bool
+	location       *time.Location
+	cron           []cron.Schedule
+
+	// One run or single push at a time, so runs triggered on demand wait
+	// for the scheduled one instead of pushing the same invoices
+	runMu sync.Mutex
+
+	// The summary of the last run
+	summaryMu sync.Mutex
+	last      *Summary
+	// Pushes that needed more than one request, for the run summaries
+	retried atomic.Int64
+	// Unix nanoseconds of the last successful push
+	lastSuccess atomic.Int64
+	// Pushes of the run in progress, for quota.max_per_run
+	runPushed   atomic.Int64
+	quotaWarned atomic.Bool
+	// The day quota.daily was found reached, so the rest of it is not
+	// counted again
+	quotaFull atomic.Value
+	// Invoices put in the queue, to tell whether the API is still down
+	queued atomic.Int64
+	// Groups of grouping.partitioned with an invoice left pending in the
+	// run in progress
+	heldMu sync.Mutex
+	held   map[string]bool
+	// Reports on the run in progress; nil when there is none
+	progress *progress.Reporter
+	// When the audit log was last pruned
+	auditPruned time.Time
+}
+
+func New(cfg *config.Config, a auth.Authenticator, src source.Source, sink pusher.Sink) (*Pipeline, error) {
+	pl := &Pipeline{Auth: a, Source: src, Sink: sink, cfg: cfg}
+	if err := pl.compile(); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// Prepare the validation pattern, rules, filter and schedule of p.cfg
+func (p *Pipeline) compile() error {
+	p.location = time.Local
+	p.invoicePattern = nil
+	if pattern := p.cfg.Validation.InvoicePattern; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid validation.invoice_pattern: %v", err)
+		}
+		p.invoicePattern = re
+	}
+	rules, err := compileRules(p.cfg.Validation.Rules)
+	if err != nil {
+		return err
+	}
+	p.rules = rules
+	if p.filterProgram, err = compileFilter(p.cfg.Query.Filter); err != nil {
+		return err
+	}
+	return p.parseSchedule()
+}
+
+// DefaultInterval is the polling interval of daemon mode when
+// schedule.interval is not set
+const DefaultInterval = time.Minute
+
+// Run executes a single cycle, or in daemon/interval mode one cycle per
+// schedule.interval (plus up to schedule.jitter) until ctx is cancelled;
+// while pushing is closed it waits for it to open instead.
+// A cancelled batch finishes its in-flight pushes and returns
+// ErrInterrupted.
+func (p *Pipeline) Run(ctx context.Context) error {
+	interval := p.interval()
+	p.mu.RLock()
+	onCron := len(p.cron) > 0
+	p.mu.RUnlock()
+	if p.DryRun {
+		return p.RunOnce(ctx)
+	}
+	if onCron {
+		return p.runCron(ctx)
+	}
+	if interval <= 0 {
+		return p.RunOnce(ctx)
+	}
+
+	// Log failures instead of exiting so the next cycle can recover
+	slog.InfoContext(ctx, "Running on interval", "interval", interval.String())
+	go p.refreshToken(ctx)
+	idle := 0
+	for {
+		sum, err := p.run(ctx, TriggerInterval)
+		if errors.Is(err, ErrInterrupted) {
+			return err
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Run failed", "error", err)
+		}
+		// Re-read after each cycle, a reload may have changed it
+		interval = p.interval()
+		if interval <= 0 {
+			interval = DefaultInterval
+		}
+		if err == nil && sum != nil {
+			idle = p.countIdle(ctx, idle, sum.Fetched == 0, interval)
+		}
+		wait := idleInterval(interval, p.Config().Schedule.IdleBackoff, idle)
+		// What was left pending goes once pushing opens
+		if d, ok := p.untilOpen(time.Now()); ok {
+			slog.InfoContext(ctx, "Waiting for pushing to open", "opens_in", d.Round(time.Second).String())
+			wait = d
+		}
+		if ctx.Err() != nil || !p.waitForNextCycle(ctx, wait+randDuration(p.Config().Schedule.Jitter)) {
+			slog.InfoContext(ctx, "Shutting down")
+			return nil
+		}
+	}
+}
+
+// RunOnce runs a single login, fetch and push pass, skipped while pushing
+// is closed (a blackout, a holiday or outside schedule.windows), and
+// reports its summary. When ctx is cancelled the fetch is aborted, pushes
+// already in flight complete and the rest are skipped.
+func (p *Pipeline) RunOnce(ctx context.Context) error {
+	_, err := p.run(ctx, TriggerOnce)
+	return err
+}
+
+// RunNow runs a cycle on demand like RunOnce, once a running one has
+// finished, and returns its summary; nil when it was skipped because
+// pushing was closed
+func (p *Pipeline) RunNow(ctx context.Context) (*Summary, error) {
+	return p.run(ctx, TriggerAPI)
+}
+
+func (p *Pipeline) run(ctx context.Context, trigger string) (*Summary, error) {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if reason, ok := p.closed(time.Now()); ok {
+		slog.InfoContext(ctx, "Pushing closed, skipping push phase", "reason", reason)
+		return nil, nil
+	}
+
+	p.resetQuota()
+	p.resetHeld()
+	ctx, span := tracing.Start(ctx, "run")
+	sum := &Summary{RunID: NewRunID(), Tenant: p.cfg.Tenant, Trigger: trigger, Started: time.Now()}
+	ctx = correlation.WithRun(ctx, sum.RunID)
+	retried := p.retried.Load()
+	runCtx, cancel := p.limitRun(ctx)
+	err := p.runOnce(runCtx, sum)
+	if err != nil && errors.Is(context.Cause(runCtx), ErrRunTooLong) {
+		slog.WarnContext(ctx, "Run reached max_run_duration, leaving the rest pending", "max_run_duration", p.cfg.MaxRunDuration.String())
+		err = ErrRunTooLong
+	}
+	cancel(nil)
+	span.SetAttributes(attribute.Int("trx_push.fetched", sum.Fetched), attribute.Int("trx_push.pushed", sum.Pushed),
+		attribute.Int("trx_push.failed", sum.Failed))
+	tracing.End(span, err)
+	if !p.DryRun {
+		sum.Retried = int(p.retried.Load() - retried)
+		p.measureAge(ctx, sum)
+		p.report(ctx, sum, err)
+		p.pruneAudit(ctx)
+	}
+	return sum, err
+}
+
+// Look up the age of the oldest invoice the run of sum left pending, with
+// query.created_column set
+func (p *Pipeline) measureAge(ctx context.Context, sum *Summary) {
+	a, ok := p.Source.(source.Ager)
+	if !ok || p.cfg.Query.CreatedColumn == "" {
+		return
+	}
+	oldest, err := a.OldestPending(context.WithoutCancel(ctx))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to look up the oldest pending invoice", "error", err)
+		return
+	}
+	var age time.Duration
+	if !oldest.IsZero() {
+		age = max(time.Since(oldest), 0)
+	}
+	sum.OldestPendingAge = age.Seconds()
+	metrics.OldestPending(ctx, age)
+}
+
+// Cancel ctx once max_run_duration has passed, like a shutdown, with
+// ErrRunTooLong as its cause
+func (p *Pipeline) limitRun(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if d := p.cfg.MaxRunDuration; d > 0 {
+		timer := time.AfterFunc(d, func() { cancel(ErrRunTooLong) })
+		return ctx, func(cause error) {
+			timer.Stop()
+			cancel(cause)
+		}
+	}
+	return ctx, cancel
+}
+
+func (p *Pipeline) runOnce(ctx context.Context, sum *Summary) error {
+	// Step 1: Acquire JWT token
+	if !p.DryRun {
+		if err := p.Auth.Login(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ErrInterrupted
+			}
+			return &LoginError{Err: err}
+		}
+	}
+
+	if !p.DryRun {
+		p.progress = progress.Start(p.cfg.Log.ProgressInterval)
+		defer func() {
+			p.progress.Stop()
+			p.progress = nil
+		}()
+	}
+
+	if p.Queue != nil && !p.DryRun {
+		if err := p.drain(ctx, sum); err != nil {
+			return err
+		}
+	}
+
+	if pg, ok := p.Source.(source.Pager); ok && p.cfg.Query.PageSize > 0 {
+		return p.runPaged(ctx, pg, sum)
+	}
+	if st, ok := p.Source.(source.Streamer); ok && p.cfg.Query.Stream {
+		return p.runStreamed(ctx, st, sum)
+	}
+
+	// Step 2: Retrieve transactions
+	fetched, err := p.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	// The filters compact in place; advance needs the selection as fetched
+	transactions := p.filter(ctx, p.skipExhausted(ctx, p.dedup(ctx, make(map[string]bool), p.validate(ctx, slices.Clone(fetched)))))
+	metrics.Backlog(ctx, len(transactions))
+
+	if p.DryRun {
+		p.printDryRun(transactions)
+		return nil
+	}
+
+	if w, ok := p.Sink.(Warmer); ok && p.cfg.Warmup.Enabled && len(transactions) > 0 {
+		w.Warmup(ctx)
+	}
+
+	// Step 3: Push transactions
+	p.progress.Add(len(transactions))
+	p.progress.Known()
+	batch := p.newBatch(sum.RunID)
+	outcomes := p.pushAll(ctx, transactions, batch)
+	sum.add(len(fetched), transactions, outcomes)
+	if batch != nil {
+		batch.Flush(context.WithoutCancel(ctx))
+	}
+	if a, ok := p.Source.(source.Advancer); ok && p.cfg.Watermark.Enabled {
+		p.advance(context.WithoutCancel(ctx), a, fetched, transactions, outcomes)
+	}
+	if !completed(outcomes) {
+		return ErrInterrupted
+	}
+	return nil
+}
+
+// Pending fetches the transactions waiting to be pushed, without the ones
+// failing validation
+func (p *Pipeline) Pending(ctx context.Context) ([]source.Transaction, error) {
+	transactions, err := p.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transactions = p.filter(ctx, p.skipExhausted(ctx, p.dedup(ctx, make(map[string]bool), p.validate(ctx, transactions))))
+	metrics.Backlog(ctx, len(transactions))
+	return transactions, nil
+}
+
+func (p *Pipeline) fetch(ctx context.Context) ([]source.Transaction, error) {
+	transactions, err := p.Source.Fetch(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrInterrupted
+		}
+		return nil, &FetchError{Err: err}
+	}
+	return transactions, nil
+}
+
+// Start a results batch for run runID, nil when results are disabled
+func (p *Pipeline) newBatch(runID string) *results.Batch {
+	if p.Results == nil {
+		return nil
+	}
+	return p.Results.NewBatch(runID)
+}
+
+// Push one transaction and return its results status
+func (p *Pipeline) pushOne(ctx context.Context, txn source.Transaction, batch *results.Batch) string {
+	ctx = correlation.WithRequest(ctx)
+	ctx, span := tracing.Start(ctx, "push", attribute.String("trx_push.invoice_id", txn.InvoiceID))
+	start := time.Now()
+	pushCtx, cancel := p.pushTimeout(ctx)
+	txn, resp, err := p.push(pushCtx, txn)
+	err = p.timedOut(ctx, pushCtx, err)
+	cancel()
+	if errors.Is(err, hooks.ErrSkip) {
+		tracing.End(span, nil)
+		return p.skip(ctx, txn)
+	}
+	if errors.Is(err, errOverQuota) {
+		tracing.End(span, nil)
+		return p.release(ctx, txn)
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode), attribute.Int("trx_push.attempts", resp.Attempts))
+	status := p.handle(ctx, txn, resp, err, start, batch)
+	tracing.End(span, err)
+	return status
+}
+
+// Bound a push or bulk request by push.timeout
+func (p *Pipeline) pushTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.cfg.Push.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, p.cfg.Push.Timeout)
+}
+
+// Explain err when it is pushCtx reaching push.timeout, rather than ctx
+// being cancelled
+func (p *Pipeline) timedOut(ctx, pushCtx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && errors.Is(pushCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("push timed out after %s: %w", p.cfg.Push.Timeout, err)
+	}
+	return err
+}
+
+// Acknowledge, release or park txn after its push started at start, and
+// return its results status
+func (p *Pipeline) handle(ctx context.Context, txn source.Transaction, resp pusher.Response, err error, start time.Time, batch *results.Batch) string {
+	log := slog.With("invoice_id", txn.InvoiceID, "status_code", resp.StatusCode, "duration_ms", time.Since(start).Milliseconds())
+	if resp.APIVersion != "" {
+		log = log.With("api_version", resp.APIVersion)
+	}
+	if resp.Attempts > 1 {
+		p.retried.Add(1)
+	}
+	// Record the outcome even when shutting down, so a completed push is
+	// never left unacknowledged
+	ctx = context.WithoutCancel(ctx)
+	status := results.StatusSuccess
+	var rejected *RejectedError
+	var invalid *bodyschema.Error
+	if errors.As(err, &rejected) || errors.As(err, &invalid) {
+		// Nothing was sent, pushing it again would fail the same way
+		status = results.StatusRejected
+		log.WarnContext(ctx, "Invoice failed validation, rejecting it", "reason", err)
+		if err := p.reject(ctx, txn); err != nil {
+			log.ErrorContext(ctx, "Failed to reject invoice", "error", err)
+		}
+	} else {
+		if err != nil {
+			class := classify(resp, err)
+			metrics.PushFailure(ctx, string(class))
+			log = log.With("class", class)
+		}
+		status = p.handlePush(ctx, log, txn, resp, err)
+		p.Hooks.AfterResponse(ctx, txn, resp, err)
+	}
+
+	metrics.PushResult(ctx, status)
+	if status == results.StatusSuccess {
+		now := time.Now()
+		p.lastSuccess.Store(now.UnixNano())
+		metrics.LastSuccess(ctx, now)
+	}
+	p.emitOutcome(ctx, txn, status, resp, err, start)
+	if batch != nil {
+		r := results.Result{Invoice: txn.InvoiceID, Status: status, HTTPCode: resp.StatusCode, At: time.Now(), APIVersion: resp.APIVersion}
+		if err != nil {
+			r.Reason = err.Error()
+		} else if o := resp.Outcome; o != nil {
+			r.Reason = "matched outcome " + o.Name
+		}
+		batch.Add(ctx, r)
+	}
+	return status
+}
+
+// Record the outcome of a push that was sent and return its status
+func (p *Pipeline) handlePush(ctx context.Context, log *slog.Logger, txn source.Transaction, resp pusher.Response, err error) string {
+	status := results.StatusSuccess
+	if err != nil {
+		p.deadLetter(ctx, log, txn, resp, err)
+	}
+	p.countAttempts(ctx, log, txn, resp, err)
+	if o := resp.Outcome; o != nil {
+		log = log.With("outcome", o.Name)
+	}
+	if pusher.NeedsReview(err) {
+		status = results.StatusReview
+		log.WarnContext(ctx, "Invoice needs manual review", "error", err)
+		if err := p.settle(ctx, txn, resp, p.review); err != nil {
+			log.ErrorContext(ctx, "Failed to flag invoice for review", "error", err)
+		}
+	} else if o := resp.Outcome; o != nil && o.Outcome == "rejected" {
+		status = results.StatusRejected
+		log.WarnContext(ctx, "Response maps to rejected, rejecting invoice", "error", err)
+		if err := p.settle(ctx, txn, resp, p.reject); err != nil {
+			log.ErrorContext(ctx, "Failed to reject invoice", "error", err)
+		}
+	} else if pusher.IsPermanent(err) {
+		status = results.StatusParked
+		log.WarnContext(ctx, "Permanent failure, parking invoice", "error", err)
+		park := func(ctx context.Context, txn source.Transaction) error { return p.Source.Nack(ctx, txn, false) }
+		if err := p.settle(ctx, txn, resp, park); err != nil {
+			log.ErrorContext(ctx, "Failed to park invoice", "error", err)
+		}
+	} else if err != nil {
+		status = results.StatusFailed
+		if p.enqueue(ctx, log, txn, resp, err) {
+			return status
+		}
+		log.ErrorContext(ctx, "Failed to push transaction", "error", err)
+		if err := p.Source.Nack(ctx, txn, true); err != nil {
+			log.ErrorContext(ctx, "Failed to release invoice", "error", err)
+		}
+	} else {
+		log.InfoContext(ctx, "Successfully pushed transaction")
+		ackErr := p.settle(ctx, txn, resp, p.Source.Ack)
+		if ackErr != nil {
+			log.ErrorContext(ctx, "Failed to update invoice status", "error", ackErr)
+		}
+		p.capture(ctx, log, txn, resp)
+		if ackErr == nil {
+			p.moveToHistory(ctx, log, txn)
+		}
+		p.archive(ctx, log, txn, resp)
+	}
+	return status
+}
+
+// Write the set_status of the push.outcomes rule resp matched to txn, or
+// record the outcome with def when there is none or the source cannot
+func (p *Pipeline) settle(ctx context.Context, txn source.Transaction, resp pusher.Response, def func(context.Context, source.Transaction) error) error {
+	if o := resp.Outcome; o != nil && o.SetStatus != "" {
+		if s, ok := p.Source.(source.StatusSetter); ok {
+			return s.SetStatus(ctx, txn, o.SetStatus)
+		}
+	}
+	return def(ctx, txn)
+}
+
+// Set txn aside for failing validation, or drop it like a parked one when
+// the source cannot
+func (p *Pipeline) reject(ctx context.Context, txn source.Transaction) error {
+	if r, ok := p.Source.(source.Rejecter); ok {
+		return r.Reject(ctx, txn)
+	}
+	return p.Source.Nack(ctx, txn, false)
+}
+
+// Flag txn for review, or drop it like a parked one when the source cannot
+func (p *Pipeline) review(ctx context.Context, txn source.Transaction) error {
+	if r, ok := p.Source.(source.Reviewer); ok {
+		return r.Review(ctx, txn)
+	}
+	return p.Source.Nack(ctx, txn, false)
+}
+
+// Load the payload of txn when payload.query is set and pass it through
+// the hooks, then push it within the quotas. Returns txn as pushed.
+func (p *Pipeline) push(ctx context.Context, txn source.Transaction) (source.Transaction, pusher.Response, error) {
+	txn, err := p.prepare(ctx, txn)
+	if err != nil {
+		return txn, pusher.Response{}, err
+	}
+	if !p.takeQuota(ctx) {
+		return txn, pusher.Response{}, errOverQuota
+	}
+	resp, err := p.Sink.Push(ctx, txn)
+	return txn, resp, err
+}
+
+// Load the payload of txn, then run the before push and transform hooks
+func (p *Pipeline) prepare(ctx context.Context, txn source.Transaction) (source.Transaction, error) {
+	txn, err := p.loadPayload(ctx, txn)
+	if err != nil {
+		return txn, err
+	}
+	if err := p.Hooks.BeforePush(ctx, txn); err != nil {
+		return txn, err
+	}
+	return p.Hooks.TransformPayload(ctx, txn)
+}
+
+// Leave txn pending after a hook skipped it
+func (p *Pipeline) skip(ctx context.Context, txn source.Transaction) string {
+	slog.InfoContext(ctx, "Skipped by a hook", "invoice_id", txn.InvoiceID)
+	return p.release(ctx, txn)
+}
+
+// Leave txn pending without a result, for the next run
+func (p *Pipeline) release(ctx context.Context, txn source.Transaction) string {
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	if skipper, ok := p.Source.(source.Skipper); ok {
+		err = skipper.Skip(ctx, txn)
+	} else {
+		err = p.Source.Nack(ctx, txn, true)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to release invoice", "invoice_id", txn.InvoiceID, "error", err)
+	}
+	p.emitOutcome(ctx, txn, outcomeSkipped, pusher.Response{}, nil, time.Time{})
+	return outcomeSkipped
+}
+
+func (p *Pipeline) loadPayload(ctx context.Context, txn source.Transaction) (source.Transaction, error) {
+	// Already loaded by the filter
+	if pl, ok := p.Source.(source.PayloadLoader); ok && p.cfg.Payload.Query != "" && txn.Payload == nil {
+		payload, err := pl.LoadPayload(ctx, txn.InvoiceID)
+		if err != nil {
+			return txn, &FetchError{Err: fmt.Errorf("failed to load payload: %v", err)}
+		}
+		txn.Payload = payload
+	}
+	if forced(ctx) {
+		return txn, nil
+	}
+	if err := p.checkRules(txn); err != nil {
+		return txn, err
+	}
+	return txn, nil
+}
+
+// The class of err, the failure of a push answered with resp
+func classify(resp pusher.Response, err error) pusher.Class {
+	var fetch *FetchError
+	if errors.As(err, &fetch) {
+		return pusher.ClassDatabase
+	}
+	return pusher.Classify(resp, err)
+}
+
+// Record a failed push in the dead-letter table, unless dead_letter.classes
+// leaves out its class. Pushes interrupted by a shutdown did not fail and
+// are left out.
+func (p *Pipeline) deadLetter(ctx context.Context, log *slog.Logger, txn source.Transaction, resp pusher.Response, err error) {
+	class := classify(resp, err)
+	if p.DeadLetters == nil || class == pusher.ClassCanceled {
+		return
+	}
+	if classes := p.DeadLetters.Config.Classes; len(classes) > 0 && !slices.Contains(classes, string(class)) {
+		return
+	}
+	e := dlq.Entry{Invoice: txn.InvoiceID, Status: results.StatusFailed, HTTPCode: resp.StatusCode, Class: string(class),
+		Error: err.Error(), Response: resp.Body, Attempts: max(resp.Attempts, 1), At: time.Now()}
+	if pusher.NeedsReview(err) {
+		e.Status = results.StatusReview
+	} else if pusher.IsPermanent(err) {
+		e.Status = results.StatusParked
+	}
+	if err := p.DeadLetters.Add(ctx, e); err != nil {
+		log.ErrorContext(ctx, "Failed to write dead letter", "table", p.DeadLetters.Config.Table, "error", err)
+	}
+}
+
+func (p *Pipeline) printDryRun(transactions []source.Transaction) {
+	p.printDryRunLines(transactions)
+	fmt.Printf("[dry-run] %d transaction(s) would be pushed\n", len(transactions))
+}
+
+func (p *Pipeline) printDryRunLines(transactions []source.Transaction) {
+	d, _ := p.Sink.(Describer)
+	for _, txn := range transactions {
+		if d != nil {
+			fmt.Printf("[dry-run] invoice_id %s: %s\n", txn.InvoiceID, d.Describe(txn))
+		} else {
+			fmt.Printf("[dry-run] invoice_id %s\n", txn.InvoiceID)
+		}
+	}
+}
+
+// NewRunID generates an identifier shared by all results of one run
+func NewRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
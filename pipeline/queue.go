@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Queued invoices pushed at a time when draining the queue
+const drainPage = 100
+
+// Whether the push of resp failed because the API could not be reached:
+// requests were sent but none was answered, or only by a gateway. Failures
+// before any request, such as a payload query error, do not count.
+func unreachable(resp pusher.Response, err error) bool {
+	if err == nil || resp.Attempts == 0 || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch resp.StatusCode {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Put txn in the queue when the API could not be reached and take it out
+// of the pending set, instead of releasing it. False when the queue is
+// disabled, the API answered or the queue could not be written, leaving
+// txn to be released.
+func (p *Pipeline) enqueue(ctx context.Context, log *slog.Logger, txn source.Transaction, resp pusher.Response, err error) bool {
+	h, ok := p.Source.(source.Holder)
+	if p.Queue == nil || !ok || !unreachable(resp, err) {
+		return false
+	}
+	if err := p.Queue.Add(ctx, txn); err != nil {
+		log.ErrorContext(ctx, "Failed to queue invoice", "error", err)
+		return false
+	}
+	p.queued.Add(1)
+	log.WarnContext(ctx, "API unreachable, queued invoice", "error", err)
+	if err := h.Hold(ctx, txn); err != nil {
+		// It stays pending too and may be pushed twice
+		log.ErrorContext(ctx, "Failed to set queued invoice aside", "error", err)
+	}
+	return true
+}
+
+// Push the queued invoices, oldest first, before selecting new ones. Those
+// pushed, parked, flagged or rejected leave the queue; failed ones stay in
+// it for the next run. Draining stops at the first page where the API
+// could still not be reached.
+func (p *Pipeline) drain(ctx context.Context, sum *Summary) error {
+	var after int64
+	for {
+		entries, err := p.Queue.Page(ctx, after, drainPage)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrInterrupted
+			}
+			return fmt.Errorf("failed to read the queue: %v", err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		if after == 0 {
+			slog.InfoContext(ctx, "Pushing queued invoices")
+		}
+		transactions := make([]source.Transaction, len(entries))
+		for i, e := range entries {
+			transactions[i] = e.Txn
+		}
+		p.progress.Add(len(transactions))
+		queued := p.queued.Load()
+		batch := p.newBatch(sum.RunID)
+		outcomes := p.pushAll(ctx, transactions, batch)
+		sum.add(len(transactions), transactions, outcomes)
+		if batch != nil {
+			batch.Flush(context.WithoutCancel(ctx))
+		}
+		for i, o := range outcomes {
+			if o == "" || o == outcomeSkipped || o == results.StatusFailed {
+				continue
+			}
+			if err := p.Queue.Remove(context.WithoutCancel(ctx), transactions[i].InvoiceID); err != nil {
+				// Pushed again from the queue on the next run
+				slog.ErrorContext(ctx, "Failed to remove invoice from the queue", "invoice_id", transactions[i].InvoiceID, "error", err)
+			}
+		}
+		if !completed(outcomes) {
+			return ErrInterrupted
+		}
+		if p.queued.Load() > queued {
+			slog.WarnContext(ctx, "API still unreachable, leaving the queue for the next run")
+			return nil
+		}
+		after = entries[len(entries)-1].Seq
+	}
+}
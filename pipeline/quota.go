@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// errOverQuota is returned by push for an invoice past quota.max_per_run
+// or quota.daily; it is left pending without being sent
+var errOverQuota = errors.New("push quota reached")
+
+// Start counting the pushes of a run
+func (p *Pipeline) resetQuota() {
+	p.runPushed.Store(0)
+	p.quotaWarned.Store(false)
+}
+
+// QuotaDay returns the day of schedule.timezone quota.daily counts the
+// pushes at t in
+func (p *Pipeline) QuotaDay(t time.Time) string {
+	return t.In(p.location).Format(time.DateOnly)
+}
+
+// Count one push against the quotas, false when one of them is reached.
+// The run quota is taken first, so a full run does not use up the day.
+func (p *Pipeline) takeQuota(ctx context.Context) bool {
+	q := p.cfg.Quota
+	if forced(ctx) {
+		return true
+	}
+	if n := p.runPushed.Add(1); q.MaxPerRun > 0 && n > int64(q.MaxPerRun) {
+		p.warnQuota(ctx, "max_per_run", q.MaxPerRun)
+		return false
+	}
+	if p.Quota == nil || q.Daily <= 0 {
+		return true
+	}
+	day := p.QuotaDay(time.Now())
+	ok := false
+	if full, _ := p.quotaFull.Load().(string); full != day {
+		var err error
+		ok, err = p.Quota.Take(context.WithoutCancel(ctx), day)
+		if err != nil {
+			// Not knowing the count, push nothing rather than too much
+			slog.ErrorContext(ctx, "Failed to count push against the daily quota", "error", err)
+			ok = false
+		} else if !ok {
+			p.quotaFull.Store(day)
+		}
+	}
+	if !ok {
+		p.runPushed.Add(-1)
+		p.warnQuota(ctx, "daily", q.Daily)
+	}
+	return ok
+}
+
+// Warn once per run that the invoices left are not pushed
+func (p *Pipeline) warnQuota(ctx context.Context, limit string, n int) {
+	if p.quotaWarned.CompareAndSwap(false, true) {
+		slog.WarnContext(ctx, "Push quota reached, leaving the rest pending", "quota", limit, "limit", n)
+	}
+}
@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/purwaren/trx-push/auth"
+)
+
+// How often to look again when the token's expiry is unknown, and the
+// shortest wait between two refreshes
+const (
+	expiryPoll     = time.Minute
+	minRefreshWait = 10 * time.Second
+)
+
+// Log in again api.refresh_before ahead of the token's expiry until ctx is
+// cancelled, so a long batch is not interrupted by a rejected token.
+// Authenticators not reporting an expiry are left alone.
+func (p *Pipeline) refreshToken(ctx context.Context) {
+	e, ok := p.Auth.(auth.Expirer)
+	if !ok {
+		return
+	}
+	wait := expiryPoll
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		expiry := e.Expiry()
+		if expiry.IsZero() {
+			wait = expiryPoll
+			continue
+		}
+		if wait = time.Until(expiry) - p.Config().API.RefreshBefore; wait > 0 {
+			continue
+		}
+		if err := p.Auth.Refresh(ctx, p.Auth.Token()); err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "Failed to refresh token before expiry", "expiry", expiry.Format(time.RFC3339), "error", err)
+		} else if err == nil {
+			slog.InfoContext(ctx, "Refreshed token before expiry", "expiry", e.Expiry().Format(time.RFC3339))
+		}
+		wait = max(time.Until(e.Expiry())-p.Config().API.RefreshBefore, minRefreshWait)
+	}
+}
@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Reloader is implemented by components that can switch to a new config
+// without being rebuilt
+type Reloader interface {
+	Reload(cfg *config.Config)
+}
+
+// Reload switches to cfg from the next cycle on, waiting for a running
+// cycle to finish first. The auth, source and sink pick up their settings
+// when they implement Reloader, as do the results, dead-letter, attempts,
+// runs, quota and audit stores.
+// Whether the pipeline runs on an interval, on cron or from notifications
+// is decided at start and kept.
+func (p *Pipeline) Reload(cfg *config.Config) error {
+	next := &Pipeline{cfg: cfg}
+	if err := next.compile(); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cfg = cfg
+	p.invoicePattern = next.invoicePattern
+	p.rules = next.rules
+	p.filterProgram = next.filterProgram
+	p.blackouts = next.blackouts
+	p.windows = next.windows
+	p.holidays = next.holidays
+	p.location = next.location
+	if len(p.cron) > 0 && len(next.cron) > 0 {
+		p.cron = next.cron
+	}
+	for _, c := range []interface{}{p.Auth, p.Source, p.Sink} {
+		if r, ok := c.(Reloader); ok {
+			r.Reload(cfg)
+		}
+	}
+	if p.DeadLetters != nil {
+		p.DeadLetters.Reload(cfg)
+	}
+	if p.Attempts != nil {
+		p.Attempts.Reload(cfg)
+	}
+	if p.Results != nil {
+		p.Results.Reload(cfg)
+	}
+	if p.Runs != nil {
+		p.Runs.Reload(cfg)
+	}
+	if p.Quota != nil {
+		p.Quota.Reload(cfg)
+	}
+	p.quotaFull.Store("")
+	if p.Audit != nil {
+		p.Audit.Reload(cfg)
+	}
+	for _, n := range p.Notifiers {
+		if r, ok := n.(Reloader); ok {
+			r.Reload(cfg)
+		}
+	}
+	return nil
+}
+
+// Config returns the config currently in use
+func (p *Pipeline) Config() *config.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg
+}
+
+// Polling interval of the current config, DefaultInterval in daemon mode
+// when unset
+func (p *Pipeline) interval() time.Duration {
+	d := p.Config().Schedule.Interval
+	if d <= 0 && p.Daemon {
+		d = DefaultInterval
+	}
+	return d
+}
@@ -0,0 +1,263 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/robfig/cron/v3"
+)
+
+// dailyWindow is a daily time range, in minutes since midnight, of
+// schedule.blackouts or schedule.windows. A window whose end is before its
+// start wraps past midnight (e.g. 22:00-02:00).
+type dailyWindow struct {
+	start, end int
+}
+
+func (w dailyWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+func (w dailyWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func (p *Pipeline) parseSchedule() error {
+	s := p.cfg.Schedule
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid schedule.timezone: %v", err)
+		}
+		p.location = loc
+	}
+
+	var err error
+	if p.blackouts, err = parseWindows("blackout", s.Blackouts); err != nil {
+		return err
+	}
+	if p.windows, err = parseWindows("window", s.Windows); err != nil {
+		return err
+	}
+	for _, w := range p.windows {
+		if w.start == w.end {
+			return fmt.Errorf("schedule.windows %s is empty", w)
+		}
+	}
+	p.holidays = nil
+	if s.HolidaysFile != "" {
+		if p.holidays, err = loadHolidays(s.HolidaysFile); err != nil {
+			return fmt.Errorf("invalid schedule.holidays_file: %v", err)
+		}
+	}
+
+	p.cron = nil
+	for _, expr := range s.Cron {
+		sched, err := cron.ParseStandard(expr)
+		if err != nil {
+			return fmt.Errorf("invalid schedule.cron %q: %v", expr, err)
+		}
+		p.cron = append(p.cron, sched)
+	}
+	return nil
+}
+
+// Run a cycle each time one of the schedule.cron expressions fires, in
+// schedule.timezone, until ctx is cancelled. A run skipped while pushing
+// was closed is made up for once it opens.
+func (p *Pipeline) runCron(ctx context.Context) error {
+	slog.InfoContext(ctx, "Running on schedule", "cron", strings.Join(p.Config().Schedule.Cron, " | "))
+	go p.refreshToken(ctx)
+	skipped := false
+	for {
+		now := time.Now()
+		p.mu.RLock()
+		next := p.nextCronRun(now)
+		p.mu.RUnlock()
+		if d, ok := p.untilOpen(now); skipped && ok && now.Add(d).Before(next) {
+			next = now.Add(d)
+		}
+		slog.InfoContext(ctx, "Next run scheduled", "at", next.Format(time.RFC3339))
+		if !p.waitForNextCycle(ctx, time.Until(next)) {
+			slog.InfoContext(ctx, "Shutting down")
+			return nil
+		}
+		sum, err := p.run(ctx, TriggerCron)
+		if errors.Is(err, ErrInterrupted) {
+			return err
+		} else if err != nil {
+			slog.ErrorContext(ctx, "Run failed", "error", err)
+		}
+		skipped = sum == nil && err == nil
+	}
+}
+
+// Earliest activation of any cron expression after now
+func (p *Pipeline) nextCronRun(now time.Time) time.Time {
+	now = now.In(p.location)
+	var next time.Time
+	for _, s := range p.cron {
+		if t := s.Next(now); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+func parseWindows(kind string, ranges []config.BlackoutConfig) ([]dailyWindow, error) {
+	var windows []dailyWindow
+	for _, r := range ranges {
+		start, err := parseClock(r.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s start %q: %v", kind, r.Start, err)
+		}
+		end, err := parseClock(r.End)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s end %q: %v", kind, r.End, err)
+		}
+		windows = append(windows, dailyWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+// Parse an HH:MM clock time into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Why nothing may be pushed at now: a holiday, a blackout or being outside
+// every schedule.windows; false when pushing is open
+func (p *Pipeline) closed(now time.Time) (string, bool) {
+	now = now.In(p.location)
+	if day := now.Format(time.DateOnly); p.holidays[day] {
+		return "holiday " + day, true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range p.blackouts {
+		if w.contains(minute) {
+			return "blackout " + w.String(), true
+		}
+	}
+	if len(p.windows) == 0 {
+		return "", false
+	}
+	names := make([]string, len(p.windows))
+	for i, w := range p.windows {
+		if w.contains(minute) {
+			return "", false
+		}
+		names[i] = w.String()
+	}
+	return "outside push windows " + strings.Join(names, ", "), true
+}
+
+// How far pushing closes are looked ahead
+const maxClosed = 400 * 24 * time.Hour
+
+// When pushing opens next after now, closed; false when it stays closed
+// for over maxClosed
+func (p *Pipeline) nextOpen(now time.Time) (time.Time, bool) {
+	t := now.In(p.location).Truncate(time.Minute).Add(time.Minute)
+	for limit := now.Add(maxClosed); t.Before(limit); {
+		if p.holidays[t.Format(time.DateOnly)] {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, p.location)
+			continue
+		}
+		if _, ok := p.closed(t); !ok {
+			return t, true
+		}
+		t = t.Add(time.Minute)
+	}
+	return time.Time{}, false
+}
+
+// How long until pushing opens, when it is closed at now
+func (p *Pipeline) untilOpen(now time.Time) (time.Duration, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if _, ok := p.closed(now); !ok {
+		return 0, false
+	}
+	next, ok := p.nextOpen(now)
+	if !ok {
+		return 0, false
+	}
+	return next.Sub(now), true
+}
+
+// Sleep until the next cycle, logging a heartbeat every schedule.heartbeat
+// so liveness monitoring can tell an idle process from a hung one. Returns
+// false when ctx is cancelled first.
+func (p *Pipeline) waitForNextCycle(ctx context.Context, d time.Duration) bool {
+	next := time.Now().Add(d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	var heartbeat <-chan time.Time
+	if hb := p.Config().Schedule.Heartbeat; hb > 0 && hb < d {
+		ticker := time.NewTicker(hb)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-heartbeat:
+			slog.InfoContext(ctx, "Idle", "next_run_in", time.Until(next).Round(time.Second).String())
+		}
+	}
+}
+
+// Random duration in [0, n], so instances started together drift apart
+func randDuration(n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(n) + 1))
+}
+
+// The number of cycles in a row that fetched nothing after one that was
+// empty or not, logging when schedule.idle_backoff starts and stops
+func (p *Pipeline) countIdle(ctx context.Context, idle int, empty bool, interval time.Duration) int {
+	b := p.Config().Schedule.IdleBackoff
+	if !empty {
+		if idleInterval(interval, b, idle) > interval {
+			slog.InfoContext(ctx, "Invoices found, polling every interval again", "interval", interval.String())
+		}
+		return 0
+	}
+	idle++
+	if wait := idleInterval(interval, b, idle); wait > interval && idleInterval(interval, b, idle-1) == interval {
+		slog.InfoContext(ctx, "Nothing to push for a while, polling less often", "empty_cycles", idle, "next_run_in", wait.String())
+	}
+	return idle
+}
+
+// The wait before the next cycle after idle empty ones: interval, grown by
+// schedule.idle_backoff once there were more than its after
+func idleInterval(interval time.Duration, b config.IdleBackoffConfig, idle int) time.Duration {
+	if b.MaxInterval <= interval || idle < b.After {
+		return interval
+	}
+	wait := float64(interval)
+	for i := b.After; i <= idle && wait < float64(b.MaxInterval); i++ {
+		wait *= b.Factor
+	}
+	return min(time.Duration(wait), b.MaxInterval)
+}
@@ -0,0 +1,198 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"00:00", 0, true},
+		{"08:30", 510, true},
+		{"23:59", 1439, true},
+		{"24:00", 0, false},
+		{"8:30", 510, true},
+		{"08:60", 0, false},
+		{"noon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseClock(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseClock(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDailyWindowContains(t *testing.T) {
+	day := dailyWindow{start: 8 * 60, end: 17 * 60}
+	night := dailyWindow{start: 22 * 60, end: 2 * 60}
+	tests := []struct {
+		w      dailyWindow
+		minute int
+		want   bool
+	}{
+		{day, 7*60 + 59, false},
+		{day, 8 * 60, true},
+		{day, 12 * 60, true},
+		{day, 17 * 60, false},
+		{night, 21*60 + 59, false},
+		{night, 22 * 60, true},
+		{night, 0, true},
+		{night, 1*60 + 59, true},
+		{night, 2 * 60, false},
+		{night, 12 * 60, false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.contains(tt.minute); got != tt.want {
+			t.Errorf("%s contains %02d:%02d = %v, want %v", tt.w, tt.minute/60, tt.minute%60, got, tt.want)
+		}
+	}
+}
+
+func TestParseWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []config.BlackoutConfig
+		want   []dailyWindow
+		ok     bool
+	}{
+		{"none", nil, nil, true},
+		{"day", []config.BlackoutConfig{{Start: "08:00", End: "17:30"}}, []dailyWindow{{480, 1050}}, true},
+		{"wrapping", []config.BlackoutConfig{{Start: "22:00", End: "02:00"}}, []dailyWindow{{1320, 120}}, true},
+		{"bad start", []config.BlackoutConfig{{Start: "8am", End: "17:00"}}, nil, false},
+		{"bad end", []config.BlackoutConfig{{Start: "08:00", End: "25:00"}}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWindows("window", tt.ranges)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("window %d = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	p := &Pipeline{location: time.Local, cfg: &config.Config{}}
+	p.cfg.Schedule.Timezone = "Asia/Jakarta"
+	p.cfg.Schedule.Blackouts = []config.BlackoutConfig{{Start: "23:00", End: "01:00"}}
+	if err := p.parseSchedule(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		// 23:30 in Jakarta
+		{time.Date(2026, 3, 1, 16, 30, 0, 0, time.UTC), true},
+		// 00:59 the next day
+		{time.Date(2026, 3, 1, 17, 59, 0, 0, time.UTC), true},
+		// 01:00
+		{time.Date(2026, 3, 1, 18, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if _, got := p.closed(tt.now); got != tt.want {
+			t.Errorf("closed(%s) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+
+	p.cfg.Schedule.Blackouts[0].Start = "11pm"
+	if err := p.parseSchedule(); err == nil {
+		t.Error("parsed an invalid blackout start")
+	}
+}
+
+func TestClosedAndNextOpen(t *testing.T) {
+	loc := time.FixedZone("WIB", 7*3600)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, loc)
+	}
+	p := &Pipeline{
+		location:  loc,
+		windows:   []dailyWindow{{start: 8 * 60, end: 17 * 60}},
+		blackouts: []dailyWindow{{start: 12 * 60, end: 13 * 60}},
+		holidays:  map[string]bool{"2026-03-03": true, "2026-03-04": true},
+	}
+	tests := []struct {
+		name   string
+		now    time.Time
+		reason string
+		next   time.Time
+	}{
+		{"open", at(2, 9, 0), "", time.Time{}},
+		{"before window", at(2, 7, 30), "outside push windows 08:00-17:00", at(2, 8, 0)},
+		{"blackout", at(2, 12, 15), "blackout 12:00-13:00", at(2, 13, 0)},
+		{"after window", at(2, 17, 0), "outside push windows 08:00-17:00", at(5, 8, 0)},
+		{"holiday", at(3, 10, 0), "holiday 2026-03-03", at(5, 8, 0)},
+		// Another zone is read in schedule.timezone: 01:00 UTC is 08:00 WIB
+		{"utc", time.Date(2026, 3, 2, 1, 0, 0, 0, time.UTC), "", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, closed := p.closed(tt.now)
+			if reason != tt.reason || closed != (tt.reason != "") {
+				t.Fatalf("closed = %q, %v; want %q", reason, closed, tt.reason)
+			}
+			if !closed {
+				return
+			}
+			next, ok := p.nextOpen(tt.now)
+			if !ok || !next.Equal(tt.next) {
+				t.Fatalf("nextOpen = %s, %v; want %s", next, ok, tt.next)
+			}
+		})
+	}
+}
+
+func TestNextOpenNever(t *testing.T) {
+	// Every day a holiday
+	holidays := make(map[string]bool)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for t := start; t.Before(start.Add(maxClosed + 48*time.Hour)); t = t.AddDate(0, 0, 1) {
+		holidays[t.Format(time.DateOnly)] = true
+	}
+	p := &Pipeline{location: time.UTC, holidays: holidays}
+	if next, ok := p.nextOpen(start); ok {
+		t.Fatalf("nextOpen = %s, want none", next)
+	}
+}
+
+func TestIdleInterval(t *testing.T) {
+	b := config.IdleBackoffConfig{MaxInterval: time.Minute, After: 2, Factor: 2}
+	tests := []struct {
+		name string
+		b    config.IdleBackoffConfig
+		idle int
+		want time.Duration
+	}{
+		{"off", config.IdleBackoffConfig{}, 10, 10 * time.Second},
+		{"max below interval", config.IdleBackoffConfig{MaxInterval: 5 * time.Second, After: 1, Factor: 2}, 10, 10 * time.Second},
+		{"busy", b, 0, 10 * time.Second},
+		{"not yet", b, 1, 10 * time.Second},
+		{"first", b, 2, 20 * time.Second},
+		{"second", b, 3, 40 * time.Second},
+		{"capped", b, 4, time.Minute},
+		{"long idle", b, 1000, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := idleInterval(10*time.Second, tt.b, tt.idle); got != tt.want {
+			t.Errorf("%s: idleInterval = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/purwaren/trx-push/metrics"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Transactions read ahead of the push workers in stream mode, and the most
+// checked at once before being pushed
+const streamBuffer = 100
+
+// Push the transactions while the source is still reading them: what is
+// read goes through the checks in chunks of what has arrived and on to the
+// push workers, so only streamBuffer or so are held at a time besides the
+// numbers already seen.
+func (p *Pipeline) runStreamed(ctx context.Context, st source.Streamer, sum *Summary) error {
+	batch := p.newBatch(sum.RunID)
+	if batch != nil {
+		defer batch.Flush(context.WithoutCancel(ctx))
+	}
+
+	rows := make(chan source.Transaction, streamBuffer)
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	var readErr error
+	go func() {
+		defer close(rows)
+		readErr = st.Stream(readCtx, rows)
+	}()
+
+	var mu sync.Mutex
+	total := 0
+	interrupted := false
+	// One queue the concurrency workers share, or with grouping.partitioned
+	// one per worker
+	queues := []chan source.Transaction{make(chan source.Transaction)}
+	workers := p.cfg.Concurrency
+	if p.cfg.Grouping.Partitioned {
+		queues = make([]chan source.Transaction, p.cfg.Grouping.Parallelism)
+		for i := range queues {
+			queues[i] = make(chan source.Transaction, streamBuffer)
+		}
+		workers = 1
+	}
+	go func() {
+		defer func() {
+			for _, q := range queues {
+				close(q)
+			}
+		}()
+		seen := make(map[string]bool)
+		warmed := false
+		for {
+			chunk := receive(rows, streamBuffer)
+			if len(chunk) == 0 {
+				p.progress.Known()
+				return
+			}
+			transactions := p.filter(ctx, p.skipExhausted(ctx, p.dedup(ctx, seen, p.validate(ctx, chunk))))
+			mu.Lock()
+			sum.add(len(chunk), transactions, nil)
+			total += len(transactions)
+			mu.Unlock()
+			p.progress.Add(len(transactions))
+			if p.DryRun {
+				p.printDryRunLines(transactions)
+				continue
+			}
+			if w, ok := p.Sink.(Warmer); ok && p.cfg.Warmup.Enabled && !warmed && len(transactions) > 0 {
+				w.Warmup(ctx)
+				warmed = true
+			}
+			for i, txn := range transactions {
+				select {
+				case queues[partition(txn.Group, len(queues))] <- txn:
+				case <-ctx.Done():
+					slog.WarnContext(ctx, "Interrupted, finishing in-flight pushes and skipping the rest")
+					mu.Lock()
+					sum.Skipped += len(transactions) - i
+					interrupted = true
+					mu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(q <-chan source.Transaction) {
+				defer wg.Done()
+				for txn := range q {
+					var status string
+					if p.cfg.Grouping.Partitioned {
+						status = p.pushInOrder(ctx, txn, batch)
+					} else {
+						status = p.pushOne(ctx, txn, batch)
+					}
+					mu.Lock()
+					sum.count(txn, status)
+					mu.Unlock()
+					p.progress.Done(1)
+				}
+			}(q)
+		}
+	}
+	wg.Wait()
+	stopReading()
+	for range rows {
+		// Wait for the reader to stop
+	}
+
+	metrics.Backlog(ctx, total)
+	if p.DryRun {
+		fmt.Printf("[dry-run] %d transaction(s) would be pushed\n", total)
+	} else if total > 0 {
+		slog.InfoContext(ctx, "Push finished", "pushed", sum.Pushed, "failed", sum.Failed, "parked", sum.Parked,
+			"review", sum.Review, "rejected", sum.Rejected, "skipped", sum.Skipped, "total", sum.Fetched)
+	}
+	switch {
+	case interrupted || ctx.Err() != nil:
+		return ErrInterrupted
+	case readErr != nil:
+		return &FetchError{Err: readErr}
+	}
+	return nil
+}
+
+// Wait for the next transaction, then take the ones already waiting up to
+// limit in all; empty once ch is closed
+func receive(ch <-chan source.Transaction, limit int) []source.Transaction {
+	txn, ok := <-ch
+	if !ok {
+		return nil
+	}
+	chunk := []source.Transaction{txn}
+	for len(chunk) < limit {
+		select {
+		case txn, ok := <-ch:
+			if !ok {
+				return chunk
+			}
+			chunk = append(chunk, txn)
+		default:
+			return chunk
+		}
+	}
+	return chunk
+}
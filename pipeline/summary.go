@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/results"
+	"github.com/purwaren/trx-push/runs"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Summary is the report of one run, printed with summary.print and written
+// to summary.file
+type Summary struct {
+	// Also the run_id of its results
+	RunID string `json:"run_id"`
+	// The tenant pushed for, empty without tenants
+	Tenant string `json:"tenant,omitempty"`
+	// What started the run, one of the Trigger constants
+	Trigger  string    `json:"trigger"`
+	Started  time.Time `json:"started_at"`
+	Finished time.Time `json:"finished_at"`
+	Duration float64   `json:"duration_seconds"`
+	Fetched  int       `json:"fetched"`
+	Pushed   int       `json:"pushed"`
+	Failed   int       `json:"failed"`
+	Parked   int       `json:"parked"`
+	Review   int       `json:"review"`
+	// Failed validation.rules
+	Rejected int `json:"rejected"`
+	// Rejected by validation, past attempts.max or left by an interruption
+	Skipped int `json:"skipped"`
+	// Invoices that needed more than one request
+	Retried        int      `json:"retried"`
+	FailedInvoices []string `json:"failed_invoices"`
+	// Age of the oldest invoice still pending when the run ended, with
+	// query.created_column set
+	OldestPendingAge float64 `json:"oldest_pending_age_seconds,omitempty"`
+	// When an invoice was last pushed by this process
+	LastSuccess *time.Time `json:"last_success_at,omitempty"`
+	// Why the run stopped early, if it did
+	Error string `json:"error,omitempty"`
+	// Cut short by a signal
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// What started a run
+const (
+	// A one-off run
+	TriggerOnce = "once"
+	// schedule.interval while serving
+	TriggerInterval = "interval"
+	// schedule.cron
+	TriggerCron = "cron"
+	// A catch-up cycle in listen mode
+	TriggerListen = "listen"
+	// RunNow, e.g. from the admin API
+	TriggerAPI = "api"
+)
+
+// Count a fetched batch, of which transactions were pushed with outcomes
+func (s *Summary) add(fetched int, transactions []source.Transaction, outcomes []string) {
+	s.Fetched += fetched
+	s.Skipped += fetched - len(transactions)
+	for i, o := range outcomes {
+		s.count(transactions[i], o)
+	}
+}
+
+// Count the outcome of txn
+func (s *Summary) count(txn source.Transaction, outcome string) {
+	switch outcome {
+	case results.StatusSuccess:
+		s.Pushed++
+	case results.StatusParked:
+		s.Parked++
+	case results.StatusReview:
+		s.Review++
+	case results.StatusRejected:
+		s.Rejected++
+	case "", outcomeSkipped:
+		s.Skipped++
+	default:
+		s.Failed++
+		s.FailedInvoices = append(s.FailedInvoices, txn.InvoiceID)
+	}
+}
+
+// Notifier passes the summary of a run on, e.g. by email. It decides
+// itself whether the run is worth a message.
+type Notifier interface {
+	Notify(ctx context.Context, s *Summary) error
+}
+
+// NotPushed is the number of invoices that failed, were parked, flagged
+// for review or rejected
+func (s *Summary) NotPushed() int {
+	return s.Failed + s.Parked + s.Review + s.Rejected
+}
+
+// HasFailures tells whether the run left invoices unpushed or stopped early
+func (s *Summary) HasFailures() bool {
+	return s.NotPushed() > 0 || s.Error != ""
+}
+
+// Finish the summary of a run that returned err, then print, write and
+// send it as configured
+func (p *Pipeline) report(ctx context.Context, s *Summary, err error) {
+	s.Finished = time.Now()
+	s.Duration = s.Finished.Sub(s.Started).Seconds()
+	if err != nil {
+		s.Error = err.Error()
+		s.Interrupted = errors.Is(err, ErrInterrupted)
+	}
+	if s.FailedInvoices == nil {
+		s.FailedInvoices = []string{}
+	}
+	if ns := p.lastSuccess.Load(); ns != 0 {
+		t := time.Unix(0, ns)
+		s.LastSuccess = &t
+	}
+	p.summaryMu.Lock()
+	p.last = s
+	p.summaryMu.Unlock()
+	if p.Runs != nil {
+		r := runs.Run{ID: s.RunID, Started: s.Started, Finished: s.Finished, TriggeredBy: s.Trigger,
+			Fetched: s.Fetched, Pushed: s.Pushed, Failed: s.Failed, Parked: s.Parked, Review: s.Review,
+			Skipped: s.Skipped, Retried: s.Retried, Error: s.Error}
+		if err := p.Runs.Record(context.WithoutCancel(ctx), r); err != nil {
+			slog.ErrorContext(ctx, "Failed to record run", "error", err)
+		}
+	}
+	if p.Output != nil {
+		p.emit(ctx, summaryLine{Type: "summary", Summary: s})
+	} else if p.cfg.Summary.Print {
+		fmt.Print(s.String())
+	}
+	if f := p.cfg.Summary.File; f != "" {
+		if err := writeSummary(f, s); err != nil {
+			slog.ErrorContext(ctx, "Failed to write run summary", "file", f, "error", err)
+		}
+	}
+	// Also sent for a run cut short by a signal
+	ctx = context.WithoutCancel(ctx)
+	for _, n := range p.Notifiers {
+		if err := n.Notify(ctx, s); err != nil {
+			slog.ErrorContext(ctx, "Failed to send run summary", "notifier", fmt.Sprintf("%T", n), "error", err)
+		}
+	}
+}
+
+// LastSummary returns the summary of the last run, nil before the first
+// one ends
+func (p *Pipeline) LastSummary() *Summary {
+	p.summaryMu.Lock()
+	defer p.summaryMu.Unlock()
+	return p.last
+}
+
+func (s *Summary) String() string {
+	var b strings.Builder
+	if s.Tenant != "" {
+		fmt.Fprintf(&b, "Tenant %s: ", s.Tenant)
+	}
+	fmt.Fprintf(&b, "Run finished in %s: %d fetched, %d pushed, %d failed, %d parked, %d for review, %d rejected, %d skipped, %d retried\n",
+		time.Duration(s.Duration*float64(time.Second)).Round(time.Millisecond), s.Fetched, s.Pushed, s.Failed, s.Parked, s.Review, s.Rejected, s.Skipped, s.Retried)
+	if len(s.FailedInvoices) > 0 {
+		fmt.Fprintf(&b, "Failed invoices: %s\n", strings.Join(s.FailedInvoices, ", "))
+	}
+	if s.OldestPendingAge > 0 {
+		fmt.Fprintf(&b, "Oldest pending invoice: %s old\n", time.Duration(s.OldestPendingAge*float64(time.Second)).Round(time.Second))
+	}
+	if s.Error != "" {
+		fmt.Fprintf(&b, "Run error: %s\n", s.Error)
+	}
+	return b.String()
+}
+
+// Replace path with the JSON of s in one step, so readers never see half
+// a file
+func writeSummary(path string, s *Summary) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
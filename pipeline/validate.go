@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Drop transactions whose invoice number is empty, blank or does not match
+// the configured pattern, so they never turn into a malformed push
+func (p *Pipeline) validate(ctx context.Context, transactions []source.Transaction) []source.Transaction {
+	valid := transactions[:0]
+	skipper, _ := p.Source.(source.Skipper)
+	skipped := 0
+	for _, txn := range transactions {
+		switch {
+		case strings.TrimSpace(txn.InvoiceID) == "":
+			slog.WarnContext(ctx, "Skipping transaction with empty invoice number")
+		case p.invoicePattern != nil && !p.invoicePattern.MatchString(txn.InvoiceID):
+			slog.WarnContext(ctx, "Skipping transaction with invalid invoice number", "invoice_id", txn.InvoiceID)
+		default:
+			valid = append(valid, txn)
+			continue
+		}
+		skipped++
+		if skipper != nil {
+			if err := skipper.Skip(context.WithoutCancel(ctx), txn); err != nil {
+				slog.ErrorContext(ctx, "Failed to skip transaction", "invoice_id", txn.InvoiceID, "error", err)
+			}
+		}
+	}
+	if skipped > 0 {
+		slog.WarnContext(ctx, "Skipped transactions with invalid invoice numbers", "count", skipped)
+	}
+	return valid
+}
+
+// RejectedError is returned for a transaction whose payload fails one of
+// validation.rules. It is never sent.
+type RejectedError struct {
+	Field  string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s %s", e.Field, e.Reason)
+}
+
+// A validation rule with its pattern compiled
+type rule struct {
+	config.ValidationRule
+	pattern *regexp.Regexp
+}
+
+func compileRules(rules []config.ValidationRule) ([]rule, error) {
+	compiled := make([]rule, len(rules))
+	for i, r := range rules {
+		compiled[i].ValidationRule = r
+		if r.Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validation.rules[%d].pattern: %v", i, err)
+		}
+		compiled[i].pattern = re
+	}
+	return compiled, nil
+}
+
+// Check the payload of txn against validation.rules
+func (p *Pipeline) checkRules(txn source.Transaction) error {
+	for _, r := range p.rules {
+		v, ok := field(txn.Payload, r.Field)
+		if !ok || v == nil || v == "" {
+			if r.Required {
+				return &RejectedError{Field: r.Field, Reason: "is required"}
+			}
+			continue
+		}
+		s := fmt.Sprint(v)
+		if r.GreaterThan != nil {
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return &RejectedError{Field: r.Field, Reason: fmt.Sprintf("is not a number: %q", s)}
+			}
+			if n <= *r.GreaterThan {
+				return &RejectedError{Field: r.Field, Reason: fmt.Sprintf("must be greater than %g, is %s", *r.GreaterThan, s)}
+			}
+		}
+		if len(r.OneOf) > 0 && !slices.Contains(r.OneOf, s) {
+			return &RejectedError{Field: r.Field, Reason: fmt.Sprintf("must be one of %s, is %q", strings.Join(r.OneOf, ", "), s)}
+		}
+		if r.pattern != nil && !r.pattern.MatchString(s) {
+			return &RejectedError{Field: r.Field, Reason: fmt.Sprintf("does not match %s: %q", r.Pattern, s)}
+		}
+	}
+	return nil
+}
+
+// The value at a dotted path of a payload
+func field(payload map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = payload
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/purwaren/trx-push/source"
+)
+
+// Move the source's watermark past the longest run of handled transactions
+// at the start of the selection, that of each shard with shards. A failed
+// or skipped invoice stops it, so the invoice is selected again next time;
+// invoices rejected by validation and parked or reviewed ones do not.
+func (p *Pipeline) advance(ctx context.Context, a source.Advancer, fetched, pushed []source.Transaction, outcomes []string) {
+	pending := make(map[string]bool)
+	for i, txn := range pushed {
+		if leftPending(outcomes[i]) {
+			pending[txn.InvoiceID] = true
+		}
+	}
+
+	// The last handled transaction of each shard, none once one is pending
+	var shards []string
+	last := make(map[string]*source.Transaction)
+	stopped := make(map[string]bool)
+	for i, txn := range fetched {
+		if _, ok := last[txn.Shard]; !ok {
+			shards = append(shards, txn.Shard)
+			last[txn.Shard] = nil
+		}
+		if stopped[txn.Shard] {
+			continue
+		}
+		if pending[txn.InvoiceID] {
+			stopped[txn.Shard] = true
+			continue
+		}
+		last[txn.Shard] = &fetched[i]
+	}
+	for _, shard := range shards {
+		txn := last[shard]
+		if txn == nil {
+			continue
+		}
+		log := slog.Default()
+		if shard != "" {
+			log = log.With("shard", shard)
+		}
+		if err := a.Advance(ctx, *txn); err != nil {
+			log.ErrorContext(ctx, "Failed to store the watermark", "error", err)
+			continue
+		}
+		log.InfoContext(ctx, "Watermark advanced", "cursor", txn.Cursor, "invoice_id", txn.InvoiceID)
+	}
+}
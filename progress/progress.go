@@ -0,0 +1,188 @@
+// Package progress reports how far a run got: as a bar redrawn below the
+// log lines when standard error is a terminal, or as a periodic log line
+// otherwise.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+// How often the bar is redrawn
+const redraw = 200 * time.Millisecond
+
+const barWidth = 30
+
+// Standard error, erasing the bar before each write and drawing it again
+// after, so log lines scroll above it
+type terminal struct {
+	mu sync.Mutex
+	w  io.Writer
+	// Whether w is a terminal the bar can be drawn on
+	tty  bool
+	line string
+}
+
+var stderr = &terminal{w: os.Stderr, tty: isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())}
+
+// Stderr is where log lines should be written for the bar to stay below
+// them
+func Stderr() io.Writer {
+	return stderr
+}
+
+func (t *terminal) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.line == "" {
+		return t.w.Write(b)
+	}
+	fmt.Fprint(t.w, "\r\033[K")
+	n, err := t.w.Write(b)
+	fmt.Fprint(t.w, t.line)
+	return n, err
+}
+
+// Replace the bar with line, or erase it when line is empty
+func (t *terminal) draw(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.line = line
+	fmt.Fprint(t.w, "\r\033[K"+line)
+}
+
+// Reporter follows the transactions of one run. A nil Reporter reports
+// nothing.
+type Reporter struct {
+	mu    sync.Mutex
+	start time.Time
+	total int
+	done  int
+	// The total will not grow any more, so an ETA can be given
+	known bool
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Start reporting on a run: every interval in the log, or as a bar when
+// standard error is a terminal. A negative interval reports nothing and
+// returns nil.
+func Start(interval time.Duration) *Reporter {
+	if interval < 0 {
+		return nil
+	}
+	r := &Reporter{start: time.Now(), stop: make(chan struct{})}
+	tick, show := interval, r.log
+	if stderr.tty {
+		tick, show = redraw, r.draw
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		t := time.NewTicker(tick)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				show()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Add n transactions to push
+func (r *Reporter) Add(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.total += n
+	r.mu.Unlock()
+}
+
+// Known tells that the total will not grow any more
+func (r *Reporter) Known() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.known = true
+	r.mu.Unlock()
+}
+
+// Done counts n transactions as handled, whatever their outcome
+func (r *Reporter) Done(n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.done += n
+	r.mu.Unlock()
+}
+
+// Stop reporting and erase the bar
+func (r *Reporter) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+	if stderr.tty {
+		stderr.draw("")
+	}
+}
+
+// Handled and total transactions, per second rate and time left; the time
+// left is negative when it cannot be told yet
+func (r *Reporter) state() (done, total int, rate float64, eta time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	done, total = r.done, r.total
+	if elapsed := time.Since(r.start).Seconds(); elapsed > 0 {
+		rate = float64(done) / elapsed
+	}
+	eta = -1
+	if r.known && rate > 0 {
+		eta = time.Duration(float64(total-done) / rate * float64(time.Second)).Round(time.Second)
+	}
+	return done, total, rate, eta
+}
+
+func (r *Reporter) draw() {
+	done, total, rate, eta := r.state()
+	if total == 0 {
+		return
+	}
+	filled := barWidth * done / total
+	line := fmt.Sprintf("[%s%s] %d/%d", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), done, total)
+	if !r.known {
+		line += "+"
+	}
+	line += fmt.Sprintf(" %d%% %.1f/s", 100*done/total, rate)
+	if eta >= 0 {
+		line += " ETA " + eta.String()
+	}
+	stderr.draw(line)
+}
+
+func (r *Reporter) log() {
+	done, total, rate, eta := r.state()
+	if total == 0 {
+		return
+	}
+	args := []interface{}{"done", done, "total", total, "rate_per_second", fmt.Sprintf("%.1f", rate)}
+	if eta >= 0 {
+		args = append(args, "eta", eta.String())
+	}
+	slog.Info("Progress", args...)
+}
@@ -0,0 +1,130 @@
+// Package pull fetches the status of pushed invoices back from the API and
+// stores it with the invoice, for partners settling them asynchronously.
+package pull
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"text/template"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/internal/tmpl"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Summary counts the outcome of one poll
+type Summary struct {
+	Polled  int
+	Updated int
+	Failed  int
+}
+
+// Puller polls pull.status_url for the invoices of pull.query
+type Puller struct {
+	HTTP   *pusher.HTTP
+	DB     *source.Database
+	Config config.PullConfig
+}
+
+// Status is the response of pull.status_url for one invoice
+type Status struct {
+	InvoiceID string
+	Body      []byte
+	// The pull.store.fields of Body, nil when missing
+	Values []*string
+}
+
+// Pending returns the invoice numbers selected by pull.query
+func (p *Puller) Pending(ctx context.Context) ([]string, error) {
+	rows, err := p.DB.Read.QueryContext(ctx, p.Config.Query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Fetch gets the status of one invoice
+func (p *Puller) Fetch(ctx context.Context, t *template.Template, invoiceID string) (Status, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, map[string]string{"InvoiceID": invoiceID}); err != nil {
+		return Status{}, fmt.Errorf("failed to render pull.status_url: %v", err)
+	}
+	resp, err := p.HTTP.Get(ctx, b.String())
+	if err != nil {
+		return Status{}, err
+	}
+	s := Status{InvoiceID: invoiceID, Body: resp.Body, Values: make([]*string, len(p.Config.Store.Fields))}
+	for i, f := range p.Config.Store.Fields {
+		if v, ok := jsonutil.Lookup(resp.Body, f.Path); ok {
+			s.Values[i] = &v
+		}
+	}
+	return s, nil
+}
+
+// Run polls every invoice of pull.query once and stores the fields of its
+// status. An invoice that fails is counted and left for the next poll.
+func (p *Puller) Run(ctx context.Context) (Summary, error) {
+	var sum Summary
+	t, err := tmpl.Parse("status_url", p.Config.StatusURL)
+	if err != nil {
+		return sum, err
+	}
+	ids, err := p.Pending(ctx)
+	if err != nil {
+		return sum, fmt.Errorf("failed to select invoices to poll: %v", err)
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return sum, ctx.Err()
+		}
+		sum.Polled++
+		log := slog.With("invoice_id", id)
+		s, err := p.Fetch(ctx, t, id)
+		if err != nil {
+			log.Error("Failed to fetch invoice status", "error", err)
+			sum.Failed++
+			continue
+		}
+		if err := p.Store(ctx, s); err != nil {
+			if errors.Is(err, errNoFields) {
+				log.Warn("Status response has none of the stored fields")
+				continue
+			}
+			log.Error("Failed to store invoice status", "error", err)
+			sum.Failed++
+			continue
+		}
+		log.Info("Stored invoice status")
+		sum.Updated++
+	}
+	return sum, nil
+}
+
+var errNoFields = errors.New("no stored fields in the response")
+
+// Store writes the values of s into pull.store
+func (p *Puller) Store(ctx context.Context, s Status) error {
+	found := false
+	for _, v := range s.Values {
+		found = found || v != nil
+	}
+	if !found {
+		return errNoFields
+	}
+	return p.DB.StoreFields(ctx, p.Config.Store, s.InvoiceID, s.Values)
+}
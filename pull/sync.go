@@ -0,0 +1,200 @@
+package pull
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/internal/tmpl"
+)
+
+// SyncSummary counts the outcome of the pull half of a sync
+type SyncSummary struct {
+	Summary
+	// Already holding the pulled values
+	Unchanged int
+	// Conflicts won by the local side
+	Repushed int
+}
+
+// Syncer pulls like Puller.Run, resolving the invoices whose stored
+// columns disagree with the pulled values by sync.conflict
+type Syncer struct {
+	*Puller
+	Rules config.SyncConfig
+	// Pushes an invoice again when the local side wins
+	Repush func(ctx context.Context, invoiceID string) error
+}
+
+// Run pulls the status of every invoice of pull.query once
+func (s *Syncer) Run(ctx context.Context) (SyncSummary, error) {
+	var sum SyncSummary
+	t, err := tmpl.Parse("status_url", s.Config.StatusURL)
+	if err != nil {
+		return sum, err
+	}
+	ids, err := s.Pending(ctx)
+	if err != nil {
+		return sum, fmt.Errorf("failed to select invoices to poll: %v", err)
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return sum, ctx.Err()
+		}
+		sum.Polled++
+		log := slog.With("invoice_id", id)
+		st, err := s.Fetch(ctx, t, id)
+		if err != nil {
+			log.Error("Failed to fetch invoice status", "error", err)
+			sum.Failed++
+			continue
+		}
+		localWins, err := s.resolve(ctx, st)
+		switch {
+		case errors.Is(err, errUnchanged):
+			sum.Unchanged++
+		case err != nil:
+			log.Error("Failed to resolve invoice status", "error", err)
+			sum.Failed++
+		case localWins:
+			log.Info("Local invoice wins the conflict, pushing it again", "conflict", s.Rules.Conflict)
+			if err := s.Repush(ctx, id); err != nil {
+				log.Error("Failed to push invoice again", "error", err)
+				sum.Failed++
+				continue
+			}
+			sum.Repushed++
+		default:
+			if err := s.Store(ctx, st); errors.Is(err, errNoFields) {
+				log.Warn("Status response has none of the stored fields")
+				continue
+			} else if err != nil {
+				log.Error("Failed to store invoice status", "error", err)
+				sum.Failed++
+				continue
+			}
+			log.Info("Stored invoice status")
+			sum.Updated++
+		}
+	}
+	return sum, nil
+}
+
+var errUnchanged = errors.New("stored values are the pulled ones")
+
+// Whether the local side of st wins. errUnchanged when both agree.
+func (s *Syncer) resolve(ctx context.Context, st Status) (bool, error) {
+	if s.Rules.Conflict == "remote_wins" {
+		return false, nil
+	}
+	local, updated, err := s.local(ctx, st.InvoiceID)
+	if err != nil {
+		return false, err
+	}
+	stored, same := false, true
+	for i, v := range local {
+		stored = stored || v != nil
+		same = same && equal(v, st.Values[i])
+	}
+	if same {
+		return false, errUnchanged
+	}
+	if !stored {
+		// Never pulled before, so there is nothing to conflict with
+		return false, nil
+	}
+	if s.Rules.Conflict == "local_wins" {
+		return true, nil
+	}
+
+	v, ok := jsonutil.Lookup(st.Body, s.Rules.UpdatedField)
+	if !ok {
+		return false, fmt.Errorf("status response has no %s field", s.Rules.UpdatedField)
+	}
+	remoteAt, err := parseTime(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid remote update time: %v", err)
+	}
+	if updated == nil {
+		return false, nil
+	}
+	localAt, err := parseTime(*updated)
+	if err != nil {
+		return false, fmt.Errorf("invalid local update time: %v", err)
+	}
+	return localAt.After(remoteAt), nil
+}
+
+// The pull.store.fields columns of an invoice, then sync.updated_column
+func (s *Syncer) local(ctx context.Context, invoiceID string) ([]*string, *string, error) {
+	d := s.DB.Dialect
+	var cols []string
+	for _, f := range s.Config.Store.Fields {
+		cols = append(cols, d.Quote(f.Column))
+	}
+	if s.Rules.UpdatedColumn != "" {
+		cols = append(cols, d.Quote(s.Rules.UpdatedColumn))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s", strings.Join(cols, ", "),
+		d.QuoteQualified(s.DB.Query.Table), d.Quote(s.DB.Query.IDColumn), d.Param(1))
+	raw := make([]interface{}, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err := s.DB.Read.QueryRowContext(ctx, query, invoiceID).Scan(dest...); errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("invoice %s not found", invoiceID)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	values := make([]*string, len(raw))
+	for i, v := range raw {
+		values[i] = text(v)
+	}
+	n := len(s.Config.Store.Fields)
+	if s.Rules.UpdatedColumn == "" {
+		return values, nil, nil
+	}
+	return values[:n], values[n], nil
+}
+
+// A scanned column as text, nil for NULL
+func text(v interface{}) *string {
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		s = string(t)
+	case time.Time:
+		s = t.Format(time.RFC3339Nano)
+	default:
+		s = fmt.Sprint(t)
+	}
+	return &s
+}
+
+func equal(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Layouts of the update times, as sent by APIs and stored by the drivers
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999"}
+
+func parseTime(v string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format %q", v)
+}
@@ -0,0 +1,107 @@
+package pusher
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// backoff computes retry delays using the configured jitter strategy:
+// full (random in [0, exp]), equal (exp/2 plus random in [0, exp/2]) or
+// decorrelated (random in [base, prev*3], capped).
+type backoff struct {
+	cfg     config.RetryConfig
+	attempt int
+	prev    time.Duration
+}
+
+func newBackoff(cfg config.RetryConfig) *backoff {
+	return &backoff{cfg: cfg}
+}
+
+func (b *backoff) next() time.Duration {
+	base, maxDelay := b.cfg.BaseDelay, b.cfg.MaxDelay
+	switch b.cfg.Jitter {
+	case "equal":
+		d := expDelay(base, maxDelay, b.attempt)
+		b.attempt++
+		return d/2 + randDuration(d/2)
+	case "decorrelated":
+		if b.prev < base {
+			b.prev = base
+		}
+		d := base + randDuration(b.prev*3-base)
+		if d > maxDelay {
+			d = maxDelay
+		}
+		b.prev = d
+		return d
+	default:
+		d := expDelay(base, maxDelay, b.attempt)
+		b.attempt++
+		return randDuration(d)
+	}
+}
+
+func expDelay(base, maxDelay time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	return d
+}
+
+// Delay asked for by a Retry-After header, in seconds or as an HTTP date;
+// 0 when absent or invalid
+func retryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// throttle holds the requests of all workers while the API asked to back
+// off with Retry-After
+type throttle struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+func (t *throttle) extend(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+}
+
+// Wait until the pause is over, returning false if ctx is cancelled first
+func (t *throttle) wait(ctx context.Context) bool {
+	t.mu.Lock()
+	d := time.Until(t.until)
+	t.mu.Unlock()
+	return d <= 0 || sleep(ctx, d)
+}
+
+func randDuration(n time.Duration) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(n) + 1))
+}
@@ -0,0 +1,156 @@
+package pusher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func TestExpDelay(t *testing.T) {
+	base, maxDelay := 100*time.Millisecond, time.Second
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{50, time.Second},
+	}
+	for _, tt := range tests {
+		if got := expDelay(base, maxDelay, tt.attempt); got != tt.want {
+			t.Errorf("expDelay(attempt %d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	base, maxDelay := 100*time.Millisecond, time.Second
+	tests := []struct {
+		jitter string
+		// Bounds of the delay of each attempt
+		min, max []time.Duration
+	}{
+		{
+			jitter: "full",
+			min:    []time.Duration{0, 0, 0, 0, 0},
+			max:    []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second},
+		},
+		{
+			jitter: "equal",
+			min:    []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond},
+			max:    []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second},
+		},
+		{
+			jitter: "decorrelated",
+			min:    []time.Duration{base, base, base, base, base},
+			max:    []time.Duration{300 * time.Millisecond, time.Second, time.Second, time.Second, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.jitter, func(t *testing.T) {
+			for run := 0; run < 100; run++ {
+				b := newBackoff(config.RetryConfig{BaseDelay: base, MaxDelay: maxDelay, Jitter: tt.jitter})
+				for i := range tt.min {
+					if d := b.next(); d < tt.min[i] || d > tt.max[i] {
+						t.Fatalf("delay %d = %s, want between %s and %s", i+1, d, tt.min[i], tt.max[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"  ", 0},
+		{"0", 0},
+		{"7", 7 * time.Second},
+		{" 120 ", 2 * time.Minute},
+		{"-5", 0},
+		{"soon", 0},
+		{"Sun, 01 Mar 2026 12:00:30 GMT", 30 * time.Second},
+		{"Sun, 01 Mar 2026 11:59:00 GMT", 0},
+		{"1.5", 0},
+	}
+	for _, tt := range tests {
+		if got := retryAfter(tt.header, now); got != tt.want {
+			t.Errorf("retryAfter(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestThrottleExtend(t *testing.T) {
+	var th throttle
+	th.extend(time.Hour)
+	until := th.until
+	// A shorter pause does not cut the longer one short
+	th.extend(time.Second)
+	if !th.until.Equal(until) {
+		t.Fatalf("until moved from %s to %s", until, th.until)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if th.wait(ctx) {
+		t.Fatal("wait returned true with a cancelled context")
+	}
+	var open throttle
+	if !open.wait(ctx) {
+		t.Fatal("wait returned false without a pause")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyTransient(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name      string
+		status    int
+		err       error
+		class     Class
+		transient bool
+	}{
+		{"success", 200, nil, "", false},
+		{"no response", 0, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, ClassNetwork, true},
+		{"timeout", 0, timeoutError{}, ClassTimeout, true},
+		{"deadline", 0, context.DeadlineExceeded, ClassTimeout, true},
+		{"dns", 0, &net.DNSError{Err: "no such host", Name: "api.invalid"}, ClassDNS, true},
+		{"canceled", 0, context.Canceled, ClassCanceled, false},
+		{"request", 0, &RequestError{Err: failed}, ClassRequest, false},
+		{"bad request", 400, failed, ClassClient, false},
+		{"unauthorized", 401, failed, ClassAuth, false},
+		{"forbidden", 403, failed, ClassAuth, false},
+		{"throttled", 429, failed, ClassThrottled, true},
+		{"server", 500, failed, ClassServer, true},
+		{"unavailable", 503, failed, ClassServer, true},
+		{"unmet success", 200, failed, ClassResponse, false},
+		{"other", 0, failed, ClassOther, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Classify(Response{StatusCode: tt.status}, tt.err)
+			if c != tt.class {
+				t.Fatalf("Classify = %q, want %q", c, tt.class)
+			}
+			if c.Transient() != tt.transient {
+				t.Fatalf("%q.Transient() = %v, want %v", c, c.Transient(), tt.transient)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package pusher
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/metrics"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// Breaker stops requests to the push API after circuit_breaker.failures
+// consecutive requests failed without a response or with a 5xx. While
+// open, requests wait for the cool-down to pass; then a single probe is
+// let through, closing the circuit when it succeeds and opening it again
+// when it fails.
+type Breaker struct {
+	mu       sync.Mutex
+	cfg      config.CircuitBreakerConfig
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	// Closed and replaced on every state change, to wake waiting requests
+	changed chan struct{}
+}
+
+// NewBreaker returns a closed breaker; ctx labels its metrics
+func NewBreaker(ctx context.Context, cfg config.CircuitBreakerConfig) *Breaker {
+	metrics.CircuitState(ctx, circuitClosed)
+	return &Breaker{cfg: cfg, state: circuitClosed, changed: make(chan struct{})}
+}
+
+// SetConfig changes the failure threshold and cool-down; the current state
+// is kept
+func (b *Breaker) SetConfig(cfg config.CircuitBreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg
+}
+
+// Allow blocks until a request may be sent or ctx is cancelled. Every nil
+// return must be followed by a call to Record, or to Cancel when the
+// request is not sent after all.
+func (b *Breaker) Allow(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		var timer *time.Timer
+		var wait <-chan time.Time
+		switch b.state {
+		case circuitClosed:
+			b.mu.Unlock()
+			return nil
+		case circuitOpen:
+			remaining := time.Until(b.openedAt.Add(b.cfg.Cooldown))
+			if remaining <= 0 {
+				b.setState(ctx, circuitHalfOpen)
+				b.probing = true
+				b.mu.Unlock()
+				return nil
+			}
+			timer = time.NewTimer(remaining)
+			wait = timer.C
+		case circuitHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return nil
+			}
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-wait:
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Record the outcome of a request let through by Allow; ok is false when
+// it got no response or a 5xx
+func (b *Breaker) Record(ctx context.Context, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.probing = false
+	}
+	if ok {
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.setState(ctx, circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.cfg.Failures) {
+		b.openedAt = time.Now()
+		b.setState(ctx, circuitOpen)
+	}
+}
+
+// Cancel gives up a request let through by Allow without sending it,
+// leaving the state as it was; a probe of the half-open circuit is let
+// through again
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen && b.probing {
+		b.probing = false
+		close(b.changed)
+		b.changed = make(chan struct{})
+	}
+}
+
+// Must be called with b.mu held
+func (b *Breaker) setState(ctx context.Context, state string) {
+	switch state {
+	case circuitOpen:
+		slog.WarnContext(ctx, "Push API is failing, circuit opened", "failures", b.failures, "cooldown", b.cfg.Cooldown.String())
+	case circuitHalfOpen:
+		slog.InfoContext(ctx, "Circuit half-open, probing the push API")
+	case circuitClosed:
+		slog.InfoContext(ctx, "Push API recovered, circuit closed")
+	}
+	b.state = state
+	metrics.CircuitState(ctx, state)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
@@ -0,0 +1,82 @@
+package pusher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+		// Outcomes in order: "ok", "fail" or "cancel", each after an Allow
+		steps []string
+		want  string
+	}{
+		{"closed", []string{"fail", "ok", "fail"}, circuitClosed},
+		{"opens", []string{"fail", "fail"}, circuitOpen},
+		{"probe succeeds", []string{"fail", "fail", "ok"}, circuitClosed},
+		{"probe fails", []string{"fail", "fail", "fail"}, circuitOpen},
+		{"probe cancelled", []string{"fail", "fail", "cancel"}, circuitHalfOpen},
+		{"probe after cancel", []string{"fail", "fail", "cancel", "ok"}, circuitClosed},
+		{"cancel while closed", []string{"fail", "cancel", "fail"}, circuitOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			b := NewBreaker(ctx, config.CircuitBreakerConfig{Failures: 2, Cooldown: time.Millisecond})
+			for i, step := range tt.steps {
+				allowCtx, cancel := context.WithTimeout(ctx, time.Second)
+				err := b.Allow(allowCtx)
+				cancel()
+				if err != nil {
+					t.Fatalf("step %d: Allow: %v", i+1, err)
+				}
+				switch step {
+				case "ok":
+					b.Record(ctx, true)
+				case "fail":
+					b.Record(ctx, false)
+				case "cancel":
+					b.Cancel()
+				}
+			}
+			if b.state != tt.want {
+				t.Fatalf("state = %s, want %s", b.state, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerProbeWaits(t *testing.T) {
+	ctx := context.Background()
+	b := NewBreaker(ctx, config.CircuitBreakerConfig{Failures: 1, Cooldown: time.Millisecond})
+	if err := b.Allow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b.Record(ctx, false)
+	time.Sleep(2 * time.Millisecond)
+	if err := b.Allow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// A second request waits for the probe
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := b.Allow(short); err == nil {
+		t.Fatal("second request let through while probing")
+	}
+	// and is let through once the probe gives up
+	allowed := make(chan error, 1)
+	go func() { allowed <- b.Allow(ctx) }()
+	b.Cancel()
+	select {
+	case err := <-allowed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request still waiting after the probe was cancelled")
+	}
+}
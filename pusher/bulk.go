@@ -0,0 +1,158 @@
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/source"
+)
+
+// BulkSink is implemented by sinks that can push several invoices with
+// one request, used with bulk.enabled
+type BulkSink interface {
+	// PushBulk returns the outcome of each of txns, in the same order
+	PushBulk(ctx context.Context, txns []source.Transaction) []ItemResult
+}
+
+// ItemResult is the outcome of one invoice of a bulk push. Its response
+// has the status of the request and the body of the invoice's result.
+type ItemResult struct {
+	Response Response
+	Err      error
+}
+
+// PushBulk sends the documents of txns to bulk.url in one request, retried
+// as a whole like a single push, then reads the result of each invoice
+// from the response
+func (p *HTTP) PushBulk(ctx context.Context, txns []source.Transaction) []ItemResult {
+	results := make([]ItemResult, len(txns))
+	enc := Encoder{InvoiceField: p.InvoiceField, Template: p.Template}
+	var docs []json.RawMessage
+	var sent []int
+	for i, txn := range txns {
+		doc, err := enc.Encode(txn)
+		if err == nil && p.Schema != nil {
+			err = p.Schema.Check(doc)
+		}
+		if err != nil {
+			results[i].Err = &RequestError{Err: err}
+			continue
+		}
+		docs = append(docs, doc)
+		sent = append(sent, i)
+	}
+	if len(docs) == 0 {
+		return results
+	}
+
+	ids := make([]string, len(sent))
+	for k, i := range sent {
+		ids[k] = txns[i].InvoiceID
+	}
+	log := slog.With("invoice_ids", strings.Join(ids, ","))
+	resp, err := p.withRetry(ctx, log, func(token string) (Response, error) {
+		return p.bulkOnce(ctx, docs, ids, token, log)
+	})
+	if err != nil {
+		for _, i := range sent {
+			results[i] = ItemResult{Response: resp, Err: err}
+		}
+		return results
+	}
+	for k, item := range p.itemResults(resp, ids) {
+		results[sent[k]] = item
+	}
+	return results
+}
+
+// Send one bulk request; only a response that is not 2xx fails it as a
+// whole
+func (p *HTTP) bulkOnce(ctx context.Context, docs []json.RawMessage, ids []string, token string, log *slog.Logger) (Response, error) {
+	var v interface{} = docs
+	if p.Bulk.ItemsField != "" {
+		v = map[string]interface{}{p.Bulk.ItemsField: docs}
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return Response{}, &RequestError{Err: err}
+	}
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "POST", p.Bulk.URL, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	p.setHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+	if p.Idempotency.Enabled {
+		req.Header.Set(p.Idempotency.Header, idempotencyKey(p.Idempotency.Salt, strings.Join(ids, "\x00")))
+	}
+	r, err := p.send(ctx, req, token, ids, log)
+	if err != nil {
+		return r, err
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		err := fmt.Errorf("failed to push bulk request of %d invoices, status: %d", len(ids), r.StatusCode)
+		return r, classify(p.Rules, r, err)
+	}
+	return r, nil
+}
+
+// Match the results in resp to the invoices ids by bulk.id_field or by
+// position. An invoice without a result failed.
+func (p *HTTP) itemResults(resp Response, ids []string) []ItemResult {
+	results := make([]ItemResult, len(ids))
+	list := resp.Body
+	if f := p.Bulk.ResultsField; f != "" {
+		s, _ := jsonutil.Lookup(resp.Body, f)
+		list = []byte(s)
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(list, &items); err != nil {
+		for i := range results {
+			results[i] = ItemResult{Response: resp, Err: fmt.Errorf("bulk response has no list of results: %s", jsonutil.Redact(resp.Body))}
+		}
+		return results
+	}
+
+	byID := make(map[string]json.RawMessage)
+	if p.Bulk.IDField != "" {
+		for _, item := range items {
+			if id, ok := jsonutil.Lookup(item, p.Bulk.IDField); ok {
+				byID[id] = item
+			}
+		}
+	}
+	for i, id := range ids {
+		var item json.RawMessage
+		if p.Bulk.IDField != "" {
+			item = byID[id]
+		} else if i < len(items) {
+			item = items[i]
+		}
+		r := Response{StatusCode: resp.StatusCode, Body: item, Attempts: resp.Attempts}
+		err := p.itemError(id, &r)
+		results[i] = ItemResult{Response: r, Err: err}
+	}
+	return results
+}
+
+func (p *HTTP) itemError(id string, r *Response) error {
+	if r.Body == nil {
+		return fmt.Errorf("bulk response has no result for invoice_id %s", id)
+	}
+	if ok, err := mapOutcome(p.Rules, r, "invoice_id "+id); ok {
+		return err
+	}
+	if evalSuccess(p.Bulk.Success, r.StatusCode, r.Body) {
+		return nil
+	}
+	err := fmt.Errorf("bulk push of invoice_id %s failed, result: %s", id, jsonutil.Redact(r.Body))
+	return classify(p.Rules, *r, err)
+}
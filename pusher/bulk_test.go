@@ -0,0 +1,89 @@
+package pusher
+
+import (
+	"testing"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func TestItemResults(t *testing.T) {
+	ok := "ok"
+	success := &config.SuccessRule{Field: "status", Equals: &ok}
+	tests := []struct {
+		name string
+		bulk config.BulkConfig
+		push config.PushConfig
+		body string
+		ids  []string
+		// Per id: "" pushed, "failed" failed, "permanent" a PermanentError
+		want []string
+	}{
+		{
+			name: "by position",
+			bulk: config.BulkConfig{Success: success},
+			body: `[{"status":"ok"},{"status":"error"}]`,
+			ids:  []string{"INV-1", "INV-2"},
+			want: []string{"", "failed"},
+		},
+		{
+			name: "fewer results than invoices",
+			bulk: config.BulkConfig{Success: success},
+			body: `[{"status":"ok"}]`,
+			ids:  []string{"INV-1", "INV-2"},
+			want: []string{"", "failed"},
+		},
+		{
+			name: "by id field",
+			bulk: config.BulkConfig{IDField: "invoice", Success: success},
+			body: `[{"invoice":"INV-2","status":"ok"},{"invoice":"INV-1","status":"error"}]`,
+			ids:  []string{"INV-1", "INV-2", "INV-3"},
+			want: []string{"failed", "", "failed"},
+		},
+		{
+			name: "results field",
+			bulk: config.BulkConfig{ResultsField: "data.results", IDField: "id", Success: success},
+			body: `{"data":{"results":[{"id":"INV-1","status":"ok"}]}}`,
+			ids:  []string{"INV-1"},
+			want: []string{""},
+		},
+		{
+			name: "no list",
+			bulk: config.BulkConfig{Success: success},
+			body: `{"error":"busy"}`,
+			ids:  []string{"INV-1", "INV-2"},
+			want: []string{"failed", "failed"},
+		},
+		{
+			name: "permanent error",
+			bulk: config.BulkConfig{Success: success},
+			push: config.PushConfig{PermanentErrors: []config.ResponseRule{{Field: "status", Value: "duplicate"}}},
+			body: `[{"status":"duplicate"},{"status":"ok"}]`,
+			ids:  []string{"INV-1", "INV-2"},
+			want: []string{"permanent", ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &HTTP{Bulk: tt.bulk, Rules: tt.push}
+			results := p.itemResults(Response{StatusCode: 200, Body: []byte(tt.body), Attempts: 2}, tt.ids)
+			if len(results) != len(tt.ids) {
+				t.Fatalf("got %d results for %d invoices", len(results), len(tt.ids))
+			}
+			for i, r := range results {
+				got := ""
+				switch {
+				case IsPermanent(r.Err):
+					got = "permanent"
+				case r.Err != nil:
+					got = "failed"
+				}
+				if got != tt.want[i] {
+					t.Errorf("%s: got %q (%v), want %q", tt.ids[i], got, r.Err, tt.want[i])
+				}
+				if r.Response.Attempts != 2 {
+					t.Errorf("%s: attempts = %d, want 2", tt.ids[i], r.Response.Attempts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package pusher
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Class is the kind of a failed push. Retries, dead letters, metrics and
+// exit codes tell failures apart by it rather than by their messages.
+type Class string
+
+const (
+	// No response in time
+	ClassTimeout Class = "timeout"
+	// The API host name did not resolve
+	ClassDNS Class = "dns"
+	// The connection was refused or dropped, or TLS failed
+	ClassNetwork Class = "network"
+	// 401 or 403, even after logging in again
+	ClassAuth Class = "auth"
+	// 429
+	ClassThrottled Class = "throttled"
+	// Any other 4xx
+	ClassClient Class = "client"
+	// 5xx
+	ClassServer Class = "server"
+	// A 2xx reporting a failure, such as GraphQL errors or an unmet
+	// push.success
+	ClassResponse Class = "response"
+	// The request could not be built, see RequestError
+	ClassRequest Class = "request"
+	// The source database failed, e.g. loading the payload
+	ClassDatabase Class = "database"
+	// Stopped by a shutdown
+	ClassCanceled Class = "canceled"
+	ClassOther    Class = "other"
+)
+
+// Transient reports whether failures of class c typically resolve on their
+// own
+func (c Class) Transient() bool {
+	switch c {
+	case ClassTimeout, ClassDNS, ClassNetwork, ClassThrottled, ClassServer:
+		return true
+	}
+	return false
+}
+
+// RequestError is a push that could not be built, e.g. because the
+// template fails on its payload. Sending it again would fail the same way.
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string { return e.Err.Error() }
+
+func (e *RequestError) Unwrap() error { return e.Err }
+
+// Classify returns the class of err, the failure of a push answered with
+// resp, or "" when err is nil
+func Classify(resp Response, err error) Class {
+	if err == nil {
+		return ""
+	}
+	var reqErr *RequestError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	code := resp.StatusCode
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.As(err, &reqErr):
+		return ClassRequest
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ClassAuth
+	case code == http.StatusTooManyRequests:
+		return ClassThrottled
+	case code >= 500:
+		return ClassServer
+	case code >= 400:
+		return ClassClient
+	case code >= 200:
+		return ClassResponse
+	case errors.As(err, &dnsErr):
+		return ClassDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ClassTimeout
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return ClassNetwork
+	}
+	return ClassOther
+}
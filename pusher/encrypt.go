@@ -0,0 +1,214 @@
+package pusher
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/purwaren/trx-push/config"
+)
+
+// Encrypter encrypts push bodies for api.encryption
+type Encrypter interface {
+	// Ciphertext of a whole body and its content type
+	EncryptBody(plaintext []byte) ([]byte, string, error)
+	// Ciphertext of a field value, as a string
+	EncryptField(plaintext []byte) (string, error)
+}
+
+// NewEncrypter returns the Encrypter of cfg, nil when cfg.Format is empty
+func NewEncrypter(cfg config.EncryptionConfig) (Encrypter, error) {
+	if cfg.Format == "" {
+		return nil, nil
+	}
+	key := []byte(cfg.Key)
+	if cfg.KeyFile != "" {
+		var err error
+		if key, err = os.ReadFile(cfg.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(bytes.TrimSpace(key)) == 0 {
+		return nil, errors.New("no key or key_file")
+	}
+	if cfg.Format == "age" {
+		recipients, err := age.ParseRecipients(bytes.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipients: %v", err)
+		}
+		return ageEncrypter{recipients: recipients}, nil
+	}
+	return newJWE(cfg, key)
+}
+
+// ageEncrypter encrypts to age recipients, binary bodies and base64 fields
+type ageEncrypter struct {
+	recipients []age.Recipient
+}
+
+func (e ageEncrypter) EncryptBody(plaintext []byte) ([]byte, string, error) {
+	var b bytes.Buffer
+	w, err := age.Encrypt(&b, e.recipients...)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), "application/octet-stream", nil
+}
+
+func (e ageEncrypter) EncryptField(plaintext []byte) (string, error) {
+	b, _, err := e.EncryptBody(plaintext)
+	return base64.StdEncoding.EncodeToString(b), err
+}
+
+// jweEncrypter encrypts to a public key in JWE compact serialization
+type jweEncrypter struct {
+	recipient jose.Recipient
+	enc       jose.ContentEncryption
+}
+
+func newJWE(cfg config.EncryptionConfig, key []byte) (Encrypter, error) {
+	pub, err := publicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	alg := jose.KeyAlgorithm(cfg.Algorithm)
+	if alg == "" {
+		alg = jose.RSA_OAEP_256
+		if _, ok := pub.(*ecdsa.PublicKey); ok {
+			alg = jose.ECDH_ES_A256KW
+		}
+	}
+	enc := jose.ContentEncryption(cfg.ContentEncryption)
+	if enc == "" {
+		enc = jose.A256GCM
+	}
+	e := jweEncrypter{recipient: jose.Recipient{Algorithm: alg, Key: pub, KeyID: cfg.KeyID}, enc: enc}
+	// Fail now on a key that does not fit the algorithm
+	if _, err := e.EncryptField([]byte("{}")); err != nil {
+		return nil, fmt.Errorf("%s with this key: %v", alg, err)
+	}
+	return e, nil
+}
+
+// The RSA or EC public key of a PEM public key, certificate or JWK
+func publicKey(key []byte) (interface{}, error) {
+	if block, _ := pem.Decode(key); block != nil {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return checkPublicKey(cert.PublicKey)
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return checkPublicKey(pub)
+		}
+	}
+	var jwk jose.JSONWebKey
+	if err := json.Unmarshal(key, &jwk); err != nil {
+		return nil, errors.New("the key is neither PEM nor a JWK")
+	}
+	if !jwk.IsPublic() {
+		jwk = jwk.Public()
+	}
+	return checkPublicKey(jwk.Key)
+}
+
+func checkPublicKey(pub interface{}) (interface{}, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T (expected RSA or EC)", pub)
+}
+
+func (e jweEncrypter) EncryptBody(plaintext []byte) ([]byte, string, error) {
+	s, err := e.EncryptField(plaintext)
+	return []byte(s), "application/jose", err
+}
+
+func (e jweEncrypter) EncryptField(plaintext []byte) (string, error) {
+	enc, err := jose.NewEncrypter(e.enc, e.recipient, nil)
+	if err != nil {
+		return "", err
+	}
+	obj, err := enc.Encrypt(plaintext)
+	if err != nil {
+		return "", err
+	}
+	return obj.CompactSerialize()
+}
+
+// Encrypt the JSON body, or the fields listed, with enc; returns the body
+// and its content type
+func encryptBody(enc Encrypter, fields []string, body []byte) ([]byte, string, error) {
+	if len(fields) == 0 {
+		return enc.EncryptBody(body)
+	}
+	d := json.NewDecoder(bytes.NewReader(body))
+	// Numbers are encrypted as they were written
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, "", fmt.Errorf("failed to parse the body to encrypt fields of it: %v", err)
+	}
+	for _, f := range fields {
+		var err error
+		if doc, err = encryptField(enc, doc, strings.Split(f, ".")); err != nil {
+			return nil, "", fmt.Errorf("failed to encrypt %s: %v", f, err)
+		}
+	}
+	out, err := json.Marshal(doc)
+	return out, "application/json", err
+}
+
+// Replace the value at path in v with the ciphertext of its JSON, in each
+// element of the arrays on the way; a missing field is left alone
+func encryptField(enc Encrypter, v interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		plaintext, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncryptField(plaintext)
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if child, ok := v[path[0]]; ok {
+			var err error
+			if v[path[0]], err = encryptField(enc, child, path[1:]); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			var err error
+			if v[i], err = encryptField(enc, v[i], path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,121 @@
+package pusher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"golang.org/x/time/rate"
+)
+
+// FairShare caps the push requests of all tenants together, at once and
+// per second. When they are all taken, the next free one goes to the
+// tenant after the last one served that is waiting, so a tenant with a
+// large backlog cannot starve the others.
+type FairShare struct {
+	mu       sync.Mutex
+	max      int
+	limiter  *rate.Limiter
+	inFlight int
+	// Waiting requests by tenant, and the tenants in the order served
+	waiting map[string][]chan struct{}
+	order   []string
+	next    int
+	// Set while a timer waits for the rate limit to allow the next request
+	timer *time.Timer
+}
+
+// NewFairShare returns the share of cfg, nil when it sets no limit
+func NewFairShare(cfg config.FairShareConfig) *FairShare {
+	if cfg.MaxInFlight <= 0 && cfg.RateLimit == "" {
+		return nil
+	}
+	f := &FairShare{max: cfg.MaxInFlight, waiting: make(map[string][]chan struct{})}
+	if r := limit(cfg.RateLimit); r != rate.Inf {
+		f.limiter = rate.NewLimiter(r, 1)
+	}
+	return f
+}
+
+// Acquire blocks until tenant may send a request or ctx is cancelled.
+// Every nil return must be followed by a call to Release.
+func (f *FairShare) Acquire(ctx context.Context, tenant string) error {
+	ch := make(chan struct{})
+	f.mu.Lock()
+	if _, ok := f.waiting[tenant]; !ok {
+		f.order = append(f.order, tenant)
+	}
+	f.waiting[tenant] = append(f.waiting[tenant], ch)
+	f.grant()
+	f.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	queue := f.waiting[tenant]
+	for i, c := range queue {
+		if c == ch {
+			f.waiting[tenant] = append(queue[:i], queue[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	// Granted meanwhile, pass it on
+	f.inFlight--
+	f.grant()
+	return ctx.Err()
+}
+
+// Release ends a request let through by Acquire
+func (f *FairShare) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inFlight--
+	f.grant()
+}
+
+// Let waiting requests through in turn while the limits allow. Must be
+// called with f.mu held.
+func (f *FairShare) grant() {
+	for f.timer == nil && (f.max <= 0 || f.inFlight < f.max) {
+		tenant := f.nextWaiting()
+		if tenant == "" {
+			return
+		}
+		if f.limiter != nil {
+			r := f.limiter.Reserve()
+			if d := r.Delay(); d > 0 {
+				r.Cancel()
+				f.timer = time.AfterFunc(d, func() {
+					f.mu.Lock()
+					defer f.mu.Unlock()
+					f.timer = nil
+					f.grant()
+				})
+				return
+			}
+		}
+		queue := f.waiting[tenant]
+		close(queue[0])
+		f.waiting[tenant] = queue[1:]
+		f.inFlight++
+		f.next = (f.next + 1) % len(f.order)
+	}
+}
+
+// The first tenant with a waiting request from f.next on, moving f.next
+// to it; empty when none is waiting
+func (f *FairShare) nextWaiting() string {
+	for i := range f.order {
+		j := (f.next + i) % len(f.order)
+		if len(f.waiting[f.order[j]]) > 0 {
+			f.next = j
+			return f.order[j]
+		}
+	}
+	return ""
+}
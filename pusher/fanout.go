@@ -0,0 +1,192 @@
+package pusher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/deliveries"
+	"github.com/purwaren/trx-push/source"
+)
+
+// FanOut pushes every invoice to each of fanout.targets in parallel. The
+// push succeeds once all targets took the invoice; the targets that did
+// are recorded in Deliveries, so the next attempt only pushes to the ones
+// that failed.
+type FanOut struct {
+	Targets []*Target
+	// Optional; nil pushes to every target again
+	Deliveries *deliveries.Store
+}
+
+// Target is one push API of a fan-out, with its own login
+type Target struct {
+	Name string
+	HTTP *HTTP
+
+	// Held for the first login, so workers do not all log in at once
+	loginMu sync.Mutex
+}
+
+func NewFanOut(cfg *config.Config, client *http.Client) (*FanOut, error) {
+	f := &FanOut{}
+	for _, t := range cfg.Fanout.Targets {
+		tc := cfg.ForTarget(t)
+		a, err := auth.New(tc.API, client)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", t.Name, err)
+		}
+		f.Targets = append(f.Targets, &Target{Name: t.Name, HTTP: NewHTTP(tc, client, a)})
+	}
+	return f, nil
+}
+
+// Push txn to the targets that did not take it yet
+func (f *FanOut) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	delivered := map[string]bool{}
+	if f.Deliveries != nil {
+		var err error
+		if delivered, err = f.Deliveries.Delivered(ctx, txn.InvoiceID); err != nil {
+			return Response{}, fmt.Errorf("failed to read the targets invoice_id %s was pushed to: %v", txn.InvoiceID, err)
+		}
+	}
+
+	type outcome struct {
+		resp Response
+		err  error
+	}
+	outcomes := make([]*outcome, len(f.Targets))
+	var wg sync.WaitGroup
+	for i, t := range f.Targets {
+		if delivered[t.Name] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, t *Target) {
+			defer wg.Done()
+			resp, err := t.push(ctx, txn)
+			outcomes[i] = &outcome{resp, err}
+			if err != nil || f.Deliveries == nil {
+				return
+			}
+			// Recorded even on shutdown, the push itself was completed
+			if err := f.Deliveries.Mark(context.WithoutCancel(ctx), txn.InvoiceID, t.Name); err != nil {
+				slog.ErrorContext(ctx, "Failed to record delivery", "invoice_id", txn.InvoiceID, "target", t.Name, "error", err)
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	// The response of the first target that failed, or else of the first
+	// one pushed to
+	var resp Response
+	var failed []string
+	var rule *config.ResponseRule
+	var review *ReviewError
+	permanent := true
+	attempts := 0
+	for i, o := range outcomes {
+		if o == nil {
+			continue
+		}
+		attempts = max(attempts, o.resp.Attempts)
+		if o.err == nil {
+			if resp.Attempts == 0 && len(failed) == 0 {
+				resp = o.resp
+			}
+			continue
+		}
+		if len(failed) == 0 {
+			resp = o.resp
+		}
+		failed = append(failed, fmt.Sprintf("target %s: %v", f.Targets[i].Name, o.err))
+		var perr *PermanentError
+		var rerr *ReviewError
+		switch {
+		case errors.As(o.err, &rerr):
+			if review == nil {
+				review = rerr
+			}
+		case errors.As(o.err, &perr):
+			if rule == nil {
+				rule = &perr.Rule
+			}
+		default:
+			permanent = false
+		}
+	}
+	resp.Attempts = attempts
+	if len(failed) > 0 {
+		// Not retried only when retrying cannot help any of the targets;
+		// one that needs review flags the invoice
+		err := errors.New(strings.Join(failed, "; "))
+		switch {
+		case !permanent:
+			return resp, err
+		case review != nil:
+			return resp, &ReviewError{Status: review.Status, Err: err}
+		}
+		return resp, &PermanentError{Rule: *rule, Err: err}
+	}
+	if f.Deliveries != nil {
+		if err := f.Deliveries.Clear(context.WithoutCancel(ctx), txn.InvoiceID); err != nil {
+			slog.WarnContext(ctx, "Failed to clear deliveries", "invoice_id", txn.InvoiceID, "error", err)
+		}
+	}
+	return resp, nil
+}
+
+// Log in on the first push, then push like a single HTTP sink
+func (t *Target) push(ctx context.Context, txn source.Transaction) (Response, error) {
+	t.loginMu.Lock()
+	if t.HTTP.Auth.Token() == "" {
+		if err := t.HTTP.Auth.Login(ctx); err != nil {
+			t.loginMu.Unlock()
+			return Response{}, fmt.Errorf("login failed: %v", err)
+		}
+	}
+	t.loginMu.Unlock()
+	return t.HTTP.Push(ctx, txn)
+}
+
+// Describe joins the requests that would be sent to each target
+func (f *FanOut) Describe(txn source.Transaction) string {
+	parts := make([]string, len(f.Targets))
+	for i, t := range f.Targets {
+		parts[i] = t.Name + ": " + t.HTTP.Describe(txn)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Warmup sends the warmup request once, it does not depend on the target
+func (f *FanOut) Warmup(ctx context.Context) {
+	if len(f.Targets) > 0 {
+		f.Targets[0].HTTP.Warmup(ctx)
+	}
+}
+
+// Reload picks up the settings of each target in cfg by name. Adding,
+// removing or renaming targets needs a restart.
+func (f *FanOut) Reload(cfg *config.Config) {
+	for _, t := range f.Targets {
+		for _, tc := range cfg.Fanout.Targets {
+			if tc.Name != t.Name {
+				continue
+			}
+			c := cfg.ForTarget(tc)
+			t.HTTP.Reload(c)
+			if r, ok := t.HTTP.Auth.(reloader); ok {
+				r.Reload(c)
+			}
+		}
+	}
+	if f.Deliveries != nil {
+		f.Deliveries.Reload(cfg)
+	}
+}
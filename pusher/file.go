@@ -0,0 +1,81 @@
+package pusher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/source"
+)
+
+// File appends the document of every pushed invoice to a file, one JSON
+// document per line, for exports picked up by another system and for
+// trying a config without the API. A push fails only when the write does.
+type File struct {
+	Path    string
+	Encoder Encoder
+
+	mu  sync.Mutex
+	out *os.File
+}
+
+func NewFile(cfg *config.Config) *File {
+	return &File{Path: cfg.Sink.File.Path, Encoder: NewEncoder(cfg)}
+}
+
+// Push appends the document of txn, opening the file on first use
+func (f *File) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	doc, err := f.Encoder.Encode(txn)
+	if err != nil {
+		return Response{}, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.out == nil {
+		if f.out, err = os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+			return Response{}, err
+		}
+	}
+	if _, err := f.out.Write(append(doc, '\n')); err != nil {
+		return Response{}, fmt.Errorf("failed to write to %s: %v", f.Path, err)
+	}
+	return Response{Attempts: 1}, nil
+}
+
+// Describe returns the line that would be appended for txn
+func (f *File) Describe(txn source.Transaction) string {
+	doc, err := f.Encoder.Encode(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid document: %v", err)
+	}
+	return fmt.Sprintf("append to %s: %s", f.Path, doc)
+}
+
+// Reload picks up the document settings of cfg and switches to its path
+// from the next push on
+func (f *File) Reload(cfg *config.Config) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Encoder = NewEncoder(cfg)
+	if cfg.Sink.File.Path != f.Path {
+		f.close()
+		f.Path = cfg.Sink.File.Path
+	}
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.close()
+}
+
+func (f *File) close() error {
+	if f.out == nil {
+		return nil
+	}
+	err := f.out.Close()
+	f.out = nil
+	return err
+}
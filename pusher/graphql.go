@@ -0,0 +1,138 @@
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/source"
+)
+
+// GraphQL sends a mutation for every invoice, with the invoice document as
+// one of its variables. Requests go through HTTP, so they are
+// authenticated, rate limited, retried and audited like pushes. A response
+// listing errors fails the push even with status 200.
+type GraphQL struct {
+	HTTP   *HTTP
+	Config config.GraphQLSinkConfig
+}
+
+func NewGraphQL(cfg *config.Config, client *http.Client, a auth.Authenticator) *GraphQL {
+	return &GraphQL{HTTP: NewHTTP(cfg, client, a), Config: cfg.Sink.GraphQL}
+}
+
+type graphQLRequest struct {
+	Query         string                     `json:"query"`
+	OperationName string                     `json:"operationName,omitempty"`
+	Variables     map[string]json.RawMessage `json:"variables"`
+}
+
+type graphQLResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (g *GraphQL) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	log := slog.With("invoice_id", txn.InvoiceID)
+	return g.HTTP.withRetry(ctx, log, func(token string) (Response, error) {
+		return g.pushOnce(ctx, txn, token, log)
+	})
+}
+
+func (g *GraphQL) pushOnce(ctx context.Context, txn source.Transaction, token string, log *slog.Logger) (Response, error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+	req, err := g.newRequest(reqCtx, txn)
+	if err != nil {
+		return Response{}, &RequestError{Err: err}
+	}
+	r, err := g.HTTP.send(ctx, req, token, []string{txn.InvoiceID}, log)
+	if err != nil {
+		return r, err
+	}
+	if ok, err := mapOutcome(g.HTTP.Rules, &r, "invoice_id "+txn.InvoiceID); ok {
+		return r, err
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		err := fmt.Errorf("failed to push transaction with invoice_id %s, status: %d", txn.InvoiceID, r.StatusCode)
+		return r, classify(g.HTTP.Rules, r, err)
+	}
+	var resp graphQLResponse
+	if err := json.Unmarshal(r.Body, &resp); err != nil {
+		return r, fmt.Errorf("GraphQL response for invoice_id %s is not JSON: %s", txn.InvoiceID, jsonutil.Redact(r.Body))
+	}
+	if len(resp.Errors) > 0 {
+		messages := make([]string, len(resp.Errors))
+		for i, e := range resp.Errors {
+			messages[i] = e.Message
+		}
+		err := fmt.Errorf("GraphQL errors pushing invoice_id %s: %s", txn.InvoiceID, strings.Join(messages, "; "))
+		return r, classify(g.HTTP.Rules, r, err)
+	}
+	if g.HTTP.Rules.Success != nil && !isSuccess(g.HTTP.Rules.Success, r.StatusCode, r.Body) {
+		err := fmt.Errorf("push of invoice_id %s did not meet the success criteria, status: %d, response: %s", txn.InvoiceID, r.StatusCode, jsonutil.Redact(r.Body))
+		return r, classify(g.HTTP.Rules, r, err)
+	}
+	return r, nil
+}
+
+func (g *GraphQL) newRequest(ctx context.Context, txn source.Transaction) (*http.Request, error) {
+	body, err := g.body(txn)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	g.HTTP.setHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if i := g.HTTP.Idempotency; i.Enabled {
+		req.Header.Set(i.Header, idempotencyKey(i.Salt, txn.InvoiceID))
+	}
+	return req, nil
+}
+
+// The request body for txn: the query, with the document of txn as its
+// variable
+func (g *GraphQL) body(txn source.Transaction) ([]byte, error) {
+	doc, err := Encoder{InvoiceField: g.HTTP.InvoiceField, Template: g.HTTP.Template}.Encode(txn)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(graphQLRequest{
+		Query:         g.Config.Query,
+		OperationName: g.Config.OperationName,
+		Variables:     map[string]json.RawMessage{g.Config.Variable: doc},
+	})
+}
+
+// Describe returns the request that would be sent for txn, for dry runs
+func (g *GraphQL) Describe(txn source.Transaction) string {
+	body, err := g.body(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid request: %v", err)
+	}
+	return fmt.Sprintf("POST %s %s", g.Config.URL, body)
+}
+
+// Warmup primes the connection to the API like the http sink
+func (g *GraphQL) Warmup(ctx context.Context) {
+	g.HTTP.Warmup(ctx)
+}
+
+// Reload picks up the sink.graphql settings of cfg along with the api ones
+// the http sink reloads
+func (g *GraphQL) Reload(cfg *config.Config) {
+	g.HTTP.Reload(cfg)
+	g.Config = cfg.Sink.GraphQL
+}
@@ -0,0 +1,237 @@
+package pusher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/httpclient"
+	"github.com/purwaren/trx-push/metrics"
+	"github.com/purwaren/trx-push/source"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// GRPC calls a unary method of a service described by a descriptor set,
+// with the invoice document as the request message. Calls go through the
+// retries, rate limit and circuit breaker of HTTP, which sees the gRPC
+// status as the HTTP status it stands for, and carry its token and
+// headers as metadata.
+type GRPC struct {
+	HTTP   *HTTP
+	Config config.GRPCSinkConfig
+
+	conn *grpc.ClientConn
+	// "/<service>/<method>", as on the wire
+	method string
+	input  protoreflect.MessageDescriptor
+	output protoreflect.MessageDescriptor
+}
+
+func NewGRPC(cfg *config.Config, client *http.Client, a auth.Authenticator) (*GRPC, error) {
+	g := &GRPC{HTTP: NewHTTP(cfg, client, a), Config: cfg.Sink.GRPC}
+	md, err := findMethod(g.Config.DescriptorSetFile, g.Config.Method)
+	if err != nil {
+		return nil, err
+	}
+	g.method = "/" + g.Config.Method
+	g.input, g.output = md.Input(), md.Output()
+
+	creds := insecure.NewCredentials()
+	if g.Config.TLS {
+		t, err := httpclient.NewTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		t.ServerName = g.Config.ServerName
+		creds = credentials.NewTLS(t)
+	}
+	g.conn, err = grpc.NewClient(g.Config.Address, grpc.WithTransportCredentials(creds), grpc.WithUserAgent(httpclient.UserAgent))
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// The method named "<package>.<Service>/<Method>" in the descriptor set
+// file
+func findMethod(file, name string) (protoreflect.MethodDescriptor, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to read descriptor set %s: %v", file, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %v", file, err)
+	}
+	service, method, _ := strings.Cut(name, "/")
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("service %s not found in %s", service, file)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s in %s is not a service", service, file)
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", service, method)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is streaming, only unary methods can be called", name)
+	}
+	return md, nil
+}
+
+func (g *GRPC) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	in, err := g.request(txn)
+	if err != nil {
+		return Response{}, &RequestError{Err: err}
+	}
+	return g.HTTP.withRetry(ctx, slog.With("invoice_id", txn.InvoiceID), func(token string) (Response, error) {
+		return g.call(ctx, txn.InvoiceID, in, token)
+	})
+}
+
+// The request message for txn, from its document
+func (g *GRPC) request(txn source.Transaction) (*dynamicpb.Message, error) {
+	doc, err := Encoder{InvoiceField: g.HTTP.InvoiceField, Template: g.HTTP.Template}.Encode(txn)
+	if err != nil {
+		return nil, err
+	}
+	in := dynamicpb.NewMessage(g.input)
+	opts := protojson.UnmarshalOptions{DiscardUnknown: g.Config.DiscardUnknown}
+	if err := opts.Unmarshal(doc, in); err != nil {
+		return nil, fmt.Errorf("document of invoice_id %s does not fit %s: %v", txn.InvoiceID, g.input.FullName(), err)
+	}
+	return in, nil
+}
+
+func (g *GRPC) call(ctx context.Context, invoiceID string, in *dynamicpb.Message, token string) (Response, error) {
+	release, err := g.HTTP.admit(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	defer release()
+
+	out := dynamicpb.NewMessage(g.output)
+	start := time.Now()
+	callCtx, cancel := requestContext(ctx)
+	err = g.conn.Invoke(metadata.NewOutgoingContext(callCtx, g.metadata(token)), g.method, in, out)
+	cancel()
+	metrics.PushAttempt(ctx, time.Since(start))
+	st := status.Convert(err)
+	r := Response{StatusCode: httpStatus(st.Code())}
+	if g.HTTP.Breaker != nil {
+		g.HTTP.Breaker.Record(ctx, r.StatusCode < 500)
+	}
+	if err != nil {
+		r.Body, _ = json.Marshal(map[string]string{"code": st.Code().String(), "message": st.Message()})
+	} else {
+		r.Body, _ = protojson.Marshal(out)
+	}
+	if ok, err := mapOutcome(g.HTTP.Rules, &r, "invoice_id "+invoiceID); ok {
+		return r, err
+	}
+	if err != nil {
+		err := fmt.Errorf("failed to push transaction with invoice_id %s, status: %s: %s", invoiceID, st.Code(), st.Message())
+		return r, classify(g.HTTP.Rules, r, err)
+	}
+	return r, nil
+}
+
+// The api headers, metadata and token of a call, with the Authorization
+// set the way the authenticator does it for HTTP requests
+func (g *GRPC) metadata(token string) metadata.MD {
+	req := &http.Request{Header: http.Header{}}
+	for name, value := range g.HTTP.Headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range g.Config.Metadata {
+		req.Header.Set(name, value)
+	}
+	if token != "" {
+		if a, ok := g.HTTP.Auth.(auth.Authorizer); ok {
+			a.Authorize(req, token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	md := metadata.MD{}
+	for name, values := range req.Header {
+		md.Set(strings.ToLower(name), values...)
+	}
+	return md
+}
+
+// The HTTP status standing for code, as gRPC gateways map them
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Describe returns the call that would be made for txn, for dry runs
+func (g *GRPC) Describe(txn source.Transaction) string {
+	in, err := g.request(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid request: %v", err)
+	}
+	body, _ := protojson.Marshal(in)
+	return fmt.Sprintf("call %s%s %s", g.Config.Address, g.method, body)
+}
+
+// Reload picks up the api settings the http sink reloads and the metadata
+// of cfg. The address, method and TLS settings need a restart.
+func (g *GRPC) Reload(cfg *config.Config) {
+	g.HTTP.Reload(cfg)
+	g.Config.Metadata, g.Config.DiscardUnknown = cfg.Sink.GRPC.Metadata, cfg.Sink.GRPC.DiscardUnknown
+}
+
+func (g *GRPC) Close() error {
+	return g.conn.Close()
+}
@@ -0,0 +1,115 @@
+package pusher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/kafkaclient"
+	"github.com/purwaren/trx-push/source"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Kafka publishes the document of every invoice to a topic, keyed by the
+// invoice number. A push succeeds once all in-sync replicas have the
+// message; with a transactional ID it is also committed in a transaction
+// of its own.
+type Kafka struct {
+	Config  config.KafkaSinkConfig
+	Encoder Encoder
+	client  *kgo.Client
+
+	// A client runs one transaction at a time
+	txnMu sync.Mutex
+}
+
+func NewKafka(cfg *config.Config) (*Kafka, error) {
+	k := cfg.Sink.Kafka
+	opts, err := kafkaclient.Options(k.KafkaClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, kgo.DefaultProduceTopic(k.Topic), kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordDeliveryTimeout(k.Timeout))
+	if !k.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if k.TransactionalID != "" {
+		opts = append(opts, kgo.TransactionalID(k.TransactionalID))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Kafka{Config: k, Encoder: NewEncoder(cfg), client: client}, nil
+}
+
+// Push publishes the document of txn and waits for it to be acknowledged
+func (k *Kafka) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	rec, err := k.record(txn)
+	if err != nil {
+		return Response{}, err
+	}
+	// Like an HTTP request on the wire, a send in progress is completed
+	// on shutdown
+	ctx = context.WithoutCancel(ctx)
+	if k.Config.TransactionalID == "" {
+		err = k.client.ProduceSync(ctx, rec).FirstErr()
+	} else {
+		err = k.produceInTransaction(ctx, rec)
+	}
+	if err != nil {
+		return Response{Attempts: 1}, fmt.Errorf("failed to publish invoice_id %s to Kafka topic %s: %v", txn.InvoiceID, k.Config.Topic, err)
+	}
+	return Response{Attempts: 1}, nil
+}
+
+func (k *Kafka) produceInTransaction(ctx context.Context, rec *kgo.Record) error {
+	k.txnMu.Lock()
+	defer k.txnMu.Unlock()
+	if err := k.client.BeginTransaction(); err != nil {
+		return err
+	}
+	err := k.client.ProduceSync(ctx, rec).FirstErr()
+	end := kgo.TryCommit
+	if err != nil {
+		end = kgo.TryAbort
+	}
+	if eerr := k.client.EndTransaction(ctx, end); err == nil {
+		err = eerr
+	}
+	return err
+}
+
+func (k *Kafka) record(txn source.Transaction) (*kgo.Record, error) {
+	doc, err := k.Encoder.Encode(txn)
+	if err != nil {
+		return nil, err
+	}
+	rec := &kgo.Record{Key: []byte(txn.InvoiceID), Value: doc}
+	for name, value := range k.Config.Headers {
+		rec.Headers = append(rec.Headers, kgo.RecordHeader{Key: name, Value: []byte(value)})
+	}
+	return rec, nil
+}
+
+// Describe returns the message that would be published for txn
+func (k *Kafka) Describe(txn source.Transaction) string {
+	rec, err := k.record(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid message: %v", err)
+	}
+	return fmt.Sprintf("publish to %s key %s: %s", k.Config.Topic, rec.Key, rec.Value)
+}
+
+// Reload picks up the document settings of cfg. The connection settings
+// need a restart.
+func (k *Kafka) Reload(cfg *config.Config) {
+	k.Encoder = NewEncoder(cfg)
+}
+
+func (k *Kafka) Close() error {
+	k.client.Close()
+	return nil
+}
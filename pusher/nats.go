@@ -0,0 +1,92 @@
+package pusher
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/natsclient"
+	"github.com/purwaren/trx-push/source"
+)
+
+// NATS publishes the document of every invoice to a JetStream subject. The
+// invoice number is the message ID, so within the duplicate window of the
+// stream a retried publish is dropped instead of stored twice. A push
+// succeeds once the stream acknowledged the message.
+type NATS struct {
+	Config  config.NATSSinkConfig
+	Encoder Encoder
+	conn    *nats.Conn
+	js      jetstream.JetStream
+}
+
+func NewNATS(cfg *config.Config) (*NATS, error) {
+	n := cfg.Sink.NATS
+	conn, err := natsclient.Connect(n.NATSClientConfig, "trx-push")
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATS{Config: n, Encoder: NewEncoder(cfg), conn: conn, js: js}, nil
+}
+
+// Push publishes the document of txn and waits for the stream to
+// acknowledge it
+func (n *NATS) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	msg, err := n.message(txn)
+	if err != nil {
+		return Response{}, err
+	}
+	// Like an HTTP request on the wire, a publish in progress is completed
+	// on shutdown
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), n.Config.Timeout)
+	defer cancel()
+	ack, err := n.js.PublishMsg(ctx, msg, jetstream.WithMsgID(txn.InvoiceID))
+	if err != nil {
+		return Response{Attempts: 1}, fmt.Errorf("failed to publish invoice_id %s to NATS subject %s: %v", txn.InvoiceID, n.Config.Subject, err)
+	}
+	if ack.Duplicate {
+		slog.InfoContext(ctx, "NATS stream already had the invoice", "invoice_id", txn.InvoiceID, "stream", ack.Stream)
+	}
+	return Response{Attempts: 1}, nil
+}
+
+func (n *NATS) message(txn source.Transaction) (*nats.Msg, error) {
+	doc, err := n.Encoder.Encode(txn)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(n.Config.Subject)
+	msg.Data = doc
+	for name, value := range n.Config.Headers {
+		msg.Header.Set(name, value)
+	}
+	return msg, nil
+}
+
+// Describe returns the message that would be published for txn
+func (n *NATS) Describe(txn source.Transaction) string {
+	msg, err := n.message(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid message: %v", err)
+	}
+	return fmt.Sprintf("publish to %s msg id %s: %s", n.Config.Subject, txn.InvoiceID, msg.Data)
+}
+
+// Reload picks up the document settings of cfg. The connection settings
+// need a restart.
+func (n *NATS) Reload(cfg *config.Config) {
+	n.Encoder = NewEncoder(cfg)
+}
+
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
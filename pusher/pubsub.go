@@ -0,0 +1,90 @@
+package pusher
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/pubsubclient"
+	"github.com/purwaren/trx-push/source"
+)
+
+// PubSub publishes the document of every invoice to a Google Cloud Pub/Sub
+// topic, with the invoice number as the invoice_id attribute and, with
+// ordering, as the ordering key. A push succeeds once Pub/Sub stored the
+// message.
+type PubSub struct {
+	Config  config.PubSubSinkConfig
+	Encoder Encoder
+	client  *pubsub.Client
+	topic   *pubsub.Topic
+}
+
+func NewPubSub(cfg *config.Config) (*PubSub, error) {
+	ps := cfg.Sink.PubSub
+	client, err := pubsubclient.New(context.Background(), ps.PubSubClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	topic := client.Topic(ps.Topic)
+	topic.EnableMessageOrdering = ps.Ordering
+	topic.PublishSettings.Timeout = ps.Timeout
+	// Published one at a time, so a push waits for nothing but its message
+	topic.PublishSettings.CountThreshold = 1
+	return &PubSub{Config: ps, Encoder: NewEncoder(cfg), client: client, topic: topic}, nil
+}
+
+// Push publishes the document of txn and waits for Pub/Sub to store it
+func (p *PubSub) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	msg, err := p.message(txn)
+	if err != nil {
+		return Response{}, err
+	}
+	// Like an HTTP request on the wire, a publish in progress is completed
+	// on shutdown
+	ctx = context.WithoutCancel(ctx)
+	if _, err := p.topic.Publish(ctx, msg).Get(ctx); err != nil {
+		if msg.OrderingKey != "" {
+			// A failure pauses the key until resumed
+			p.topic.ResumePublish(msg.OrderingKey)
+		}
+		return Response{Attempts: 1}, fmt.Errorf("failed to publish invoice_id %s to Pub/Sub topic %s: %v", txn.InvoiceID, p.Config.Topic, err)
+	}
+	return Response{Attempts: 1}, nil
+}
+
+func (p *PubSub) message(txn source.Transaction) (*pubsub.Message, error) {
+	doc, err := p.Encoder.Encode(txn)
+	if err != nil {
+		return nil, err
+	}
+	msg := &pubsub.Message{Data: doc, Attributes: map[string]string{"invoice_id": txn.InvoiceID}}
+	for name, value := range p.Config.Attributes {
+		msg.Attributes[name] = value
+	}
+	if p.Config.Ordering {
+		msg.OrderingKey = txn.InvoiceID
+	}
+	return msg, nil
+}
+
+// Describe returns the message that would be published for txn
+func (p *PubSub) Describe(txn source.Transaction) string {
+	msg, err := p.message(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid message: %v", err)
+	}
+	return fmt.Sprintf("publish to %s invoice_id %s: %s", p.Config.Topic, txn.InvoiceID, msg.Data)
+}
+
+// Reload picks up the document settings of cfg. The connection settings
+// need a restart.
+func (p *PubSub) Reload(cfg *config.Config) {
+	p.Encoder = NewEncoder(cfg)
+}
+
+func (p *PubSub) Close() error {
+	p.topic.Stop()
+	return p.client.Close()
+}
@@ -0,0 +1,841 @@
+// Package pusher delivers transactions to their destination: the push API
+// or another sink selected by sink.type.
+package pusher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/purwaren/trx-push/audit"
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/bodyschema"
+	"github.com/purwaren/trx-push/internal/correlation"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/internal/tmpl"
+	"github.com/purwaren/trx-push/metrics"
+	"github.com/purwaren/trx-push/source"
+	"golang.org/x/time/rate"
+)
+
+// Sink delivers a single invoice to the destination. The pipeline only
+// talks to the destination through this interface and the optional ones
+// it defines, so an HTTP endpoint, a file or a broker can take the pushes
+// alike.
+type Sink interface {
+	// Push returns the response of the last attempt and a non-nil error
+	// when the push failed
+	Push(ctx context.Context, txn source.Transaction) (Response, error)
+}
+
+// HTTP pushes invoices to the push endpoint with a bearer token, retrying
+// failed attempts with jittered exponential backoff
+type HTTP struct {
+	URL          string
+	Headers      map[string]string
+	Format       string
+	InvoiceField string
+	// "gzip" or empty
+	Compression string
+	// POST when empty
+	Method string
+	// Optional; renders the body instead of the invoice field or payload
+	Template *template.Template
+	// Optional; a JSON body not matching it is rejected unsent
+	Schema *bodyschema.Schema
+	// Optional; encrypts the JSON body, or its EncryptFields. Should its key
+	// fail to load, no push is sent unencrypted.
+	Encrypter     Encrypter
+	EncryptFields []string
+	encryptErr    error
+	// Name of the version of URL, and the other versions invoices may be
+	// routed to
+	Version       string
+	Versions      []Version
+	Idempotency   config.IdempotencyConfig
+	Client        *http.Client
+	Auth          auth.Authenticator
+	Retry         config.RetryConfig
+	Rules         config.PushConfig
+	WarmupRequest config.WarmupConfig
+	// Shared by all workers; every request, retries included, waits for a
+	// token
+	Limiter *rate.Limiter
+	// Optional; the rate limit shared with other instances, waited for
+	// after Limiter
+	Shared *SharedLimit
+	// Optional; nil sends requests even while the API keeps failing
+	Breaker *Breaker
+	// Optional; the limits shared with other tenants, taken as Tenant
+	Share  *FairShare
+	Tenant string
+	// Optional; nil sends unsigned requests
+	Signer *Signer
+	// Where and how PushBulk sends its requests
+	Bulk config.BulkConfig
+	// Optional; nil keeps no record of the requests
+	Audit audit.Log
+	// Carry the request and run IDs; empty sends neither
+	RequestIDHeader, CorrelationIDHeader string
+
+	throttle throttle
+}
+
+func NewHTTP(cfg *config.Config, client *http.Client, a auth.Authenticator) *HTTP {
+	p := &HTTP{
+		URL:           cfg.API.PushURL,
+		Method:        cfg.API.PushMethod,
+		Headers:       cfg.API.Headers,
+		Format:        cfg.API.PushFormat,
+		InvoiceField:  cfg.API.InvoiceField,
+		Compression:   cfg.API.Compression,
+		Template:      bodyTemplate(cfg.Payload),
+		Schema:        bodySchema(cfg.Validation.Schema),
+		Version:       cfg.API.Version,
+		Idempotency:   cfg.Idempotency,
+		Client:        client,
+		Auth:          a,
+		Retry:         cfg.Retry,
+		Rules:         cfg.Push,
+		WarmupRequest: cfg.Warmup,
+		Limiter:       rate.NewLimiter(limit(cfg.RateLimit), 1),
+		Breaker:       newBreaker(cfg),
+		Tenant:        cfg.Tenant,
+		Signer:        newSigner(cfg.Signing),
+		Bulk:          cfg.Bulk,
+
+		RequestIDHeader:     idHeader(cfg.API.RequestIDHeader),
+		CorrelationIDHeader: idHeader(cfg.API.CorrelationIDHeader),
+	}
+	p.Versions = newVersions(cfg.API, p.Template, p.Schema)
+	p.setEncryption(cfg.API.Encryption)
+	return p
+}
+
+func (p *HTTP) setEncryption(cfg config.EncryptionConfig) {
+	p.Encrypter, p.encryptErr = NewEncrypter(cfg)
+	p.EncryptFields = cfg.Fields
+	if p.encryptErr != nil {
+		slog.Error("Failed to load the api.encryption key, pushes will fail", "error", p.encryptErr)
+	}
+}
+
+// The ID header named name, empty for "none"
+func idHeader(name string) string {
+	if name == "none" {
+		return ""
+	}
+	return name
+}
+
+func newBreaker(cfg *config.Config) *Breaker {
+	if !cfg.Circuit.Enabled {
+		return nil
+	}
+	return NewBreaker(metrics.WithTenant(context.Background(), cfg.Tenant), cfg.Circuit)
+}
+
+// Body template of cfg, already checked by Validate
+func bodyTemplate(cfg config.PayloadConfig) *template.Template {
+	if cfg.Template == "" {
+		return nil
+	}
+	t, _ := tmpl.Parse("payload", cfg.Template)
+	return t
+}
+
+// Schema of cfg, already checked by Validate; should the file have become
+// unreadable since, bodies go out unchecked rather than not at all
+func bodySchema(cfg config.SchemaConfig) *bodyschema.Schema {
+	if cfg.File == "" {
+		return nil
+	}
+	s, err := bodyschema.Load(cfg.File, cfg.Pointer)
+	if err != nil {
+		slog.Error("Failed to load body schema, pushing unchecked bodies", "file", cfg.File, "error", err)
+	}
+	return s
+}
+
+// Rate limit of s, already checked by Validate
+func limit(s string) rate.Limit {
+	perSecond, _ := config.ParseRate(s)
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
+
+// Reload picks up the push URL and method, format, compression, body
+// template, versions, encryption, headers, idempotency key, retry, response
+// rules, warmup, request ID and bulk settings of cfg, with its rate limits
+// and the circuit breaker and signing settings. The HTTP client with its
+// TLS and timeouts, the authenticator, the audit log and tenant shares are
+// not reloaded, and enabling or disabling the shared rate limit, circuit
+// breaker or signing needs a restart.
+func (p *HTTP) Reload(cfg *config.Config) {
+	p.URL, p.Method = cfg.API.PushURL, cfg.API.PushMethod
+	p.Headers = cfg.API.Headers
+	p.Format, p.InvoiceField = cfg.API.PushFormat, cfg.API.InvoiceField
+	p.Compression = cfg.API.Compression
+	p.Template = bodyTemplate(cfg.Payload)
+	p.Schema = bodySchema(cfg.Validation.Schema)
+	p.Version, p.Versions = cfg.API.Version, newVersions(cfg.API, p.Template, p.Schema)
+	p.setEncryption(cfg.API.Encryption)
+	p.Idempotency = cfg.Idempotency
+	p.Retry = cfg.Retry
+	p.Rules = cfg.Push
+	p.WarmupRequest = cfg.Warmup
+	p.Bulk = cfg.Bulk
+	p.RequestIDHeader = idHeader(cfg.API.RequestIDHeader)
+	p.CorrelationIDHeader = idHeader(cfg.API.CorrelationIDHeader)
+	p.Limiter.SetLimit(limit(cfg.RateLimit))
+	if p.Shared != nil {
+		p.Shared.SetRate(cfg.Redis.RateLimit)
+	}
+	if p.Breaker != nil {
+		p.Breaker.SetConfig(cfg.Circuit)
+	}
+	if p.Signer != nil {
+		p.Signer.SetConfig(cfg.Signing)
+	}
+}
+
+// Response is the outcome of a push: the status code (0 when no response
+// was received) and body of the last request, and how many were sent
+// including retries
+type Response struct {
+	StatusCode int
+	Body       []byte
+	Attempts   int
+	// From the Retry-After header of a 429 or 503 response
+	RetryAfter time.Duration
+	// The push.outcomes rule the response matched, if any
+	Outcome *config.OutcomeRule
+	// Name of the API version the invoice was pushed to, if any
+	APIVersion string
+}
+
+// Push a transaction, retrying transient failures with jittered
+// exponential backoff up to retry.max_attempts. A 429 is retried after its
+// Retry-After for up to retry.throttle_wait without using up an attempt.
+func (p *HTTP) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	v := p.version(txn)
+	resp, err := p.withRetry(ctx, slog.With("invoice_id", txn.InvoiceID), func(token string) (Response, error) {
+		return p.pushOnce(ctx, txn, v, token)
+	})
+	resp.APIVersion = v.Name
+	return resp, err
+}
+
+// Send a request with once, retrying it like Push; log carries the
+// invoices it is about
+func (p *HTTP) withRetry(ctx context.Context, log *slog.Logger, once func(token string) (Response, error)) (Response, error) {
+	b := newBackoff(p.Retry)
+	var resp Response
+	var err error
+	var throttled time.Duration
+	sent := 0
+	for attempt := 1; attempt <= p.Retry.MaxAttempts; attempt++ {
+		resp, err = p.authenticated(ctx, log, once)
+		sent++
+		resp.Attempts = sent
+		if err == nil {
+			if sent > 1 {
+				log.InfoContext(ctx, "Push succeeded after retry", "attempt", sent)
+			}
+			return resp, nil
+		}
+		final := IsPermanent(err) || NeedsReview(err)
+		if resp.StatusCode == http.StatusTooManyRequests && !final {
+			delay := resp.RetryAfter
+			if delay <= 0 {
+				delay = b.next()
+			}
+			if throttled+delay > p.Retry.ThrottleWait {
+				// Left pending for the next run
+				log.WarnContext(ctx, "Push still throttled after retry.throttle_wait", "waited", throttled.String())
+				break
+			}
+			throttled += delay
+			attempt--
+			log.WarnContext(ctx, "Push throttled, waiting", "retry_in", delay.String(), "waited", throttled.String())
+			if !sleep(ctx, delay) {
+				return resp, ctx.Err()
+			}
+			continue
+		}
+		if final || !(p.retryable(resp, err) || IsRetryable(err)) || attempt == p.Retry.MaxAttempts {
+			break
+		}
+		delay := max(b.next(), min(resp.RetryAfter, p.Retry.MaxDelay))
+		log.WarnContext(ctx, "Push failed, retrying", "status_code", resp.StatusCode,
+			"attempt", attempt, "max_attempts", p.Retry.MaxAttempts, "retry_in", delay.String(), "error", err)
+		if !sleep(ctx, delay) {
+			return resp, ctx.Err()
+		}
+	}
+	return resp, err
+}
+
+// Failures without a response (timeouts, connection errors) and the
+// responses of retry.retryable_codes, which typically resolve on their own,
+// are worth another attempt; others, like requests that could not be
+// built, will fail the same way again
+func (p *HTTP) retryable(resp Response, err error) bool {
+	if resp.StatusCode != 0 {
+		return config.MatchStatus(p.Retry.RetryableCodes, resp.StatusCode)
+	}
+	c := Classify(resp, err)
+	return c != ClassRequest && c != ClassCanceled
+}
+
+// Sleep for d, returning false if ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// Send once; when the token is rejected with 401/403 (e.g. it expired
+// mid-run) log in again and repeat the request one time
+func (p *HTTP) authenticated(ctx context.Context, log *slog.Logger, once func(token string) (Response, error)) (Response, error) {
+	token := p.Auth.Token()
+	resp, err := once(token)
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+
+	log.WarnContext(ctx, "Push rejected, logging in again", "status_code", resp.StatusCode)
+	if rerr := p.Auth.Refresh(ctx, token); rerr != nil {
+		return resp, fmt.Errorf("%v (re-login failed: %v)", err, rerr)
+	}
+	return once(p.Auth.Token())
+}
+
+// Push a transaction by invoice_id to version v, returning the HTTP status
+// code (0 when no response was received) and the response body
+func (p *HTTP) pushOnce(ctx context.Context, txn source.Transaction, v Version, token string) (Response, error) {
+	invoiceID := txn.InvoiceID
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+	req, err := p.newRequest(reqCtx, txn, v)
+	if err != nil {
+		return Response{}, &RequestError{Err: err}
+	}
+	r, err := p.send(ctx, req, token, []string{invoiceID}, slog.With("invoice_id", invoiceID))
+	if err != nil {
+		return r, err
+	}
+	if ok, err := mapOutcome(p.Rules, &r, "invoice_id "+invoiceID); ok {
+		return r, err
+	}
+
+	if !isSuccess(p.Rules.Success, r.StatusCode, r.Body) {
+		err := fmt.Errorf("failed to push transaction with invoice_id %s, status: %d", invoiceID, r.StatusCode)
+		if p.Rules.Success != nil {
+			err = fmt.Errorf("push of invoice_id %s did not meet the success criteria, status: %d, response: %s", invoiceID, r.StatusCode, jsonutil.Redact(r.Body))
+		}
+		return r, classify(p.Rules, r, err)
+	}
+	return r, nil
+}
+
+// Authorize, sign and send req for invoices once the rate limit and
+// circuit breaker let it through, returning the status and body of the
+// response
+func (p *HTTP) send(ctx context.Context, req *http.Request, token string, invoices []string, log *slog.Logger) (Response, error) {
+	if a, ok := p.Auth.(auth.Authorizer); ok {
+		a.Authorize(req, token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	release, err := p.admit(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	defer release()
+	body, err := p.prepare(req)
+	if err != nil {
+		// Nothing was sent, so there is no outcome for the breaker
+		if p.Breaker != nil {
+			p.Breaker.Cancel()
+		}
+		return Response{}, err
+	}
+	start := time.Now()
+	resp, err := p.Client.Do(req)
+	elapsed := time.Since(start)
+	metrics.PushAttempt(ctx, elapsed)
+	if p.Breaker != nil {
+		p.Breaker.Record(ctx, err == nil && resp.StatusCode < 500)
+	}
+	if p.Signer != nil && err == nil {
+		p.Signer.Observe(resp)
+	}
+	if err != nil {
+		log.DebugContext(ctx, "Push request failed", "url", req.URL.String(),
+			"duration_ms", elapsed.Milliseconds(), "error", err)
+		p.audit(ctx, invoices, req, body, start, nil, nil, err)
+		return Response{}, err
+	}
+	log.DebugContext(ctx, "Push request sent", "url", req.URL.String(),
+		"status_code", resp.StatusCode, "duration_ms", elapsed.Milliseconds())
+
+	defer resp.Body.Close()
+
+	r := Response{StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		r.RetryAfter = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	// The other workers hold off as well instead of collecting 429s
+	if resp.StatusCode == http.StatusTooManyRequests && r.RetryAfter > 0 {
+		p.throttle.extend(r.RetryAfter)
+	}
+	r.Body, err = io.ReadAll(resp.Body)
+	p.audit(ctx, invoices, req, body, start, resp, r.Body, err)
+	if err != nil {
+		return Response{StatusCode: resp.StatusCode}, err
+	}
+	return r, nil
+}
+
+// Compress and sign req, returning its body as built for the audit log
+func (p *HTTP) prepare(req *http.Request) ([]byte, error) {
+	var body []byte
+	if p.Audit != nil && req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, _ = io.ReadAll(r)
+	}
+	if err := p.compress(req); err != nil {
+		return nil, err
+	}
+	// Signed last, so the timestamp does not age in the waits of admit
+	if p.Signer != nil {
+		if err := p.Signer.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// Wait until the throttle, rate limit, fair share and circuit breaker let
+// a request through; release gives back the fair share once it is done
+func (p *HTTP) admit(ctx context.Context) (release func(), err error) {
+	if !p.throttle.wait(ctx) {
+		return nil, ctx.Err()
+	}
+	if err := p.Limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	if p.Shared != nil {
+		if err := p.Shared.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+	release = func() {}
+	if p.Share != nil {
+		if err := p.Share.Acquire(ctx, p.Tenant); err != nil {
+			return nil, err
+		}
+		release = p.Share.Release
+	}
+	if p.Breaker != nil {
+		if err := p.Breaker.Allow(ctx); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// The context of a request: not cancelled with ctx, so a push in flight
+// completes on shutdown, but ending at its deadline such as push.timeout.
+// cancel releases it once the response body is closed.
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithoutCancel(ctx), func() {}
+	}
+	return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+}
+
+// Resend the recorded request e, to target instead of its URL when set,
+// with a fresh token and signature and retried like Push. Any 2xx
+// response counts as success.
+func (p *HTTP) Resend(ctx context.Context, e audit.Entry, target string) (Response, error) {
+	u, err := replayURL(e.URL, target)
+	if err != nil {
+		return Response{}, err
+	}
+	ids := strings.Join(e.Invoices, ",")
+	return p.withRetry(ctx, slog.With("invoice_ids", ids), func(token string) (Response, error) {
+		reqCtx, cancel := requestContext(ctx)
+		defer cancel()
+		req, err := http.NewRequestWithContext(reqCtx, e.Method, u, strings.NewReader(e.RequestBody))
+		if err != nil {
+			return Response{}, err
+		}
+		for name, values := range e.RequestHeaders {
+			// Set again by send
+			if name == "Authorization" || name == "Content-Encoding" || len(values) == 0 || values[0] == audit.Redacted {
+				continue
+			}
+			req.Header[name] = values
+		}
+		r, err := p.send(ctx, req, token, e.Invoices, slog.With("invoice_ids", ids))
+		if err != nil {
+			return r, err
+		}
+		if r.StatusCode < 200 || r.StatusCode > 299 {
+			return r, classify(p.Rules, r, fmt.Errorf("failed to resend invoice_ids %s, status: %d", ids, r.StatusCode))
+		}
+		return r, nil
+	})
+}
+
+// Get sends a GET to u with the token and headers of the pushes, retried
+// like Push. A response that is not 2xx fails it.
+func (p *HTTP) Get(ctx context.Context, u string) (Response, error) {
+	log := slog.With("url", u)
+	return p.withRetry(ctx, log, func(token string) (Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return Response{}, err
+		}
+		p.setHeaders(req)
+		req.Header.Set("Accept", "application/json")
+		r, err := p.send(ctx, req, token, nil, log)
+		if err != nil {
+			return r, err
+		}
+		if r.StatusCode < 200 || r.StatusCode > 299 {
+			return r, fmt.Errorf("GET %s failed, status: %d", req.URL.Redacted(), r.StatusCode)
+		}
+		return r, nil
+	})
+}
+
+// The recorded URL with the scheme, host and path of target, keeping its
+// query unless target has one
+func replayURL(recorded, target string) (string, error) {
+	if target == "" {
+		return recorded, nil
+	}
+	t, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(recorded)
+	if err != nil {
+		return "", err
+	}
+	if t.RawQuery == "" {
+		t.RawQuery = r.RawQuery
+	}
+	return t.String(), nil
+}
+
+// Record a request sent at start and its response, nil when none was
+// received. A failure to record does not fail the push, which was sent.
+func (p *HTTP) audit(ctx context.Context, invoices []string, req *http.Request, reqBody []byte, start time.Time, resp *http.Response, respBody []byte, err error) {
+	if p.Audit == nil {
+		return
+	}
+	e := audit.Entry{At: start, RunID: correlation.Run(ctx), Invoices: invoices, Method: req.Method, URL: req.URL.Redacted(),
+		RequestHeaders: req.Header, RequestBody: string(reqBody), DurationMS: time.Since(start).Milliseconds()}
+	if resp != nil {
+		e.StatusCode, e.ResponseHeaders, e.ResponseBody = resp.StatusCode, resp.Header, string(respBody)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if aerr := p.Audit.Record(context.WithoutCancel(ctx), e); aerr != nil {
+		slog.ErrorContext(ctx, "Failed to write audit entry", "invoice_ids", strings.Join(invoices, ","), "error", aerr)
+	}
+}
+
+// The request is made with ctx, which pushOnce takes from requestContext:
+// a push that is already on the wire is completed on shutdown instead of
+// leaving its outcome unknown. Cancellation still stops further retries.
+func (p *HTTP) newRequest(ctx context.Context, txn source.Transaction, v Version) (*http.Request, error) {
+	invoiceID := txn.InvoiceID
+	raw, err := expandURL(v.URL, v.InvoiceField, txn)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	contentType := ""
+	switch {
+	case v.Template != nil:
+		if body, err = render(v.Template, txn, v.Format == "json"); err != nil {
+			return nil, err
+		}
+		contentType = "application/x-www-form-urlencoded"
+		if v.Format == "json" {
+			contentType = "application/json"
+		}
+	case v.Format == "json":
+		if body, err = document(txn, v.InvoiceField); err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	case v.Format == "form":
+		body = []byte(url.Values{v.InvoiceField: {invoiceID}}.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case !strings.Contains(v.URL, "{"+v.InvoiceField+"}"):
+		// Unless the URL carries it already
+		q := u.Query()
+		q.Set(v.InvoiceField, invoiceID)
+		u.RawQuery = q.Encode()
+	}
+	if v.Schema != nil && contentType == "application/json" {
+		if err := v.Schema.Check(body); err != nil {
+			return nil, err
+		}
+	}
+	if p.encryptErr != nil {
+		return nil, fmt.Errorf("api.encryption: %v", p.encryptErr)
+	}
+	if p.Encrypter != nil && body != nil {
+		if body, contentType, err = encryptBody(p.Encrypter, p.EncryptFields, body); err != nil {
+			return nil, err
+		}
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	method := v.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	p.setHeaders(req)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if p.Idempotency.Enabled {
+		req.Header.Set(p.Idempotency.Header, idempotencyKey(p.Idempotency.Salt, invoiceID))
+	}
+	return req, nil
+}
+
+// Replace the body of req with its gzip when compression is on. The
+// signature covers the compressed body, as sent.
+func (p *HTTP) compress(req *http.Request) error {
+	if p.Compression != "gzip" || req.GetBody == nil {
+		return nil
+	}
+	r, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	body := buf.Bytes()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Encoding", "gzip")
+	return nil
+}
+
+// Fill the {name} placeholders of the push URL raw: invoiceField with the
+// invoice number, the others with the payload columns of txn. Values are
+// escaped for the path, or for the query after a ?.
+func expandURL(raw, invoiceField string, txn source.Transaction) (string, error) {
+	if !strings.Contains(raw, "{") {
+		return raw, nil
+	}
+	var b strings.Builder
+	inQuery := false
+	for {
+		i := strings.IndexByte(raw, '{')
+		if i < 0 {
+			b.WriteString(raw)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(raw[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("push_url has an unclosed {")
+		}
+		b.WriteString(raw[:i])
+		inQuery = inQuery || strings.Contains(raw[:i], "?")
+		name := raw[i+1 : i+end]
+		var value string
+		if name == invoiceField {
+			value = txn.InvoiceID
+		} else if v, ok := txn.Payload[name]; ok && v != nil {
+			value = fmt.Sprint(v)
+		} else {
+			return "", fmt.Errorf("push_url placeholder {%s} has no value for invoice %s", name, txn.InvoiceID)
+		}
+		if inQuery {
+			b.WriteString(url.QueryEscape(value))
+		} else {
+			b.WriteString(url.PathEscape(value))
+		}
+		raw = raw[i+end+1:]
+	}
+}
+
+// Same invoice and salt, same key
+func idempotencyKey(salt, invoiceID string) string {
+	sum := sha256.Sum256([]byte(salt + "\x00" + invoiceID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Render t for txn, checking the result is JSON when asJSON is set
+func render(t *template.Template, txn source.Transaction, asJSON bool) ([]byte, error) {
+	row := txn.Payload
+	if row == nil {
+		row = map[string]interface{}{}
+	}
+	data := struct {
+		InvoiceID string
+		Row       map[string]interface{}
+	}{txn.InvoiceID, row}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render payload template: %v", err)
+	}
+	if asJSON && !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("payload template did not render valid JSON: %s", buf.Bytes())
+	}
+	return buf.Bytes(), nil
+}
+
+// The JSON document of txn without a template: its payload, or the invoice
+// number under invoiceField
+func document(txn source.Transaction, invoiceField string) ([]byte, error) {
+	var v interface{} = map[string]string{invoiceField: txn.InvoiceID}
+	if txn.Payload != nil {
+		v = txn.Payload
+	}
+	return json.Marshal(v)
+}
+
+// Encoder builds the JSON document of a transaction for the sinks that do
+// not send HTTP requests: payload.template when set, which must render
+// JSON, otherwise the same body as api.push_format json
+type Encoder struct {
+	InvoiceField string
+	Template     *template.Template
+}
+
+func NewEncoder(cfg *config.Config) Encoder {
+	return Encoder{InvoiceField: cfg.API.InvoiceField, Template: bodyTemplate(cfg.Payload)}
+}
+
+func (e Encoder) Encode(txn source.Transaction) ([]byte, error) {
+	if e.Template != nil {
+		return render(e.Template, txn, true)
+	}
+	return document(txn, e.InvoiceField)
+}
+
+func (p *HTTP) setHeaders(req *http.Request) {
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+	ctx := req.Context()
+	if id := correlation.Request(ctx); id != "" && p.RequestIDHeader != "" {
+		req.Header.Set(p.RequestIDHeader, id)
+	}
+	if id := correlation.Run(ctx); id != "" && p.CorrelationIDHeader != "" {
+		req.Header.Set(p.CorrelationIDHeader, id)
+	}
+}
+
+// Describe returns the request that would be sent for txn, for dry
+// runs
+func (p *HTTP) Describe(txn source.Transaction) string {
+	v := p.version(txn)
+	req, err := p.newRequest(context.Background(), txn, v)
+	if err != nil {
+		return fmt.Sprintf("invalid request: %v", err)
+	}
+	line := fmt.Sprintf("%s %s", req.Method, req.URL)
+	if v.Name != "" {
+		line = fmt.Sprintf("[%s] %s", v.Name, line)
+	}
+	if req.Body == nil {
+		return line + " (no body)"
+	}
+	body, _ := io.ReadAll(req.Body)
+	return fmt.Sprintf("%s %s", line, body)
+}
+
+// Warmup sends a lightweight request to the push host so DNS and the
+// connection pool are primed before the batch. Failures are logged, never
+// fatal.
+func (p *HTTP) Warmup(ctx context.Context) {
+	method := p.WarmupRequest.Method
+	if method == "" {
+		method = "GET"
+	}
+	expected := p.WarmupRequest.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.WarmupRequest.URL, nil)
+	if err != nil {
+		slog.WarnContext(ctx, "Warmup request failed", "error", err)
+		return
+	}
+	p.setHeaders(req)
+	start := time.Now()
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		slog.WarnContext(ctx, "Warmup request failed", "url", p.WarmupRequest.URL, "error", err)
+		return
+	}
+	// Drain the body so the connection goes back to the pool
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		slog.WarnContext(ctx, "Warmup returned unexpected status", "status_code", resp.StatusCode, "expected", expected)
+		return
+	}
+	slog.InfoContext(ctx, "Warmup completed", "duration_ms", time.Since(start).Milliseconds())
+}
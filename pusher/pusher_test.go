@@ -0,0 +1,87 @@
+package pusher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/source"
+)
+
+func TestRetryable(t *testing.T) {
+	p := &HTTP{Retry: config.RetryConfig{RetryableCodes: []string{"408", "425", "429", "5xx"}}}
+	failed := errors.New("failed")
+	tests := []struct {
+		code int
+		err  error
+		want bool
+	}{
+		{0, failed, true},
+		{0, &RequestError{Err: failed}, false},
+		{0, context.Canceled, false},
+		{400, failed, false},
+		{401, failed, false},
+		{404, failed, false},
+		{408, failed, true},
+		{422, failed, false},
+		{425, failed, true},
+		{429, failed, true},
+		{500, failed, true},
+		{502, failed, true},
+		{503, failed, true},
+	}
+	for _, tt := range tests {
+		if got := p.retryable(Response{StatusCode: tt.code}, tt.err); got != tt.want {
+			t.Errorf("retryable(%d, %v) = %v, want %v", tt.code, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if sleep(ctx, time.Minute) {
+		t.Fatal("sleep returned true with a cancelled context")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("sleep took %s after cancel", d)
+	}
+	if !sleep(context.Background(), time.Millisecond) {
+		t.Fatal("sleep returned false without cancel")
+	}
+}
+
+func TestExpandURL(t *testing.T) {
+	txn := source.Transaction{InvoiceID: "INV/1", Payload: map[string]interface{}{"store": "Jakarta Pusat", "branch": 7, "missing": nil}}
+	tests := []struct {
+		raw  string
+		want string
+		err  string
+	}{
+		{"https://api.example.com/invoices", "https://api.example.com/invoices", ""},
+		{"https://api.example.com/stores/{store}/invoices/{number}", "https://api.example.com/stores/Jakarta%20Pusat/invoices/INV%2F1", ""},
+		{"https://api.example.com/invoices?store={store}&branch={branch}", "https://api.example.com/invoices?store=Jakarta+Pusat&branch=7", ""},
+		{"https://api.example.com/{branch}/push?id={number}", "https://api.example.com/7/push?id=INV%2F1", ""},
+		{"https://api.example.com/{missing}", "", "placeholder {missing} has no value for invoice INV/1"},
+		{"https://api.example.com/{unknown}", "", "placeholder {unknown} has no value"},
+		{"https://api.example.com/{store", "", "unclosed {"},
+	}
+	for _, tt := range tests {
+		got, err := expandURL(tt.raw, "number", txn)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expandURL(%q) error = %v, want %q", tt.raw, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandURL(%q): %v", tt.raw, err)
+		} else if got != tt.want {
+			t.Errorf("expandURL(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pusher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+)
+
+// PermanentError is a push failure that retrying cannot fix
+type PermanentError struct {
+	Rule config.ResponseRule
+	Err  error
+}
+
+func (e *PermanentError) Error() string {
+	return fmt.Sprintf("%v (matched permanent error rule %s)", e.Err, e.Rule)
+}
+
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// IsPermanent reports whether err matched one of push.permanent_errors or
+// push.permanent_codes
+func IsPermanent(err error) bool {
+	var perr *PermanentError
+	return errors.As(err, &perr)
+}
+
+// ReviewError is a push failure with one of push.review_codes, left to a
+// person to look into
+type ReviewError struct {
+	Status int
+	Err    error
+}
+
+func (e *ReviewError) Error() string {
+	return fmt.Sprintf("%v (status %d needs manual review)", e.Err, e.Status)
+}
+
+func (e *ReviewError) Unwrap() error { return e.Err }
+
+// NeedsReview reports whether err is a ReviewError
+func NeedsReview(err error) bool {
+	var rerr *ReviewError
+	return errors.As(err, &rerr)
+}
+
+// RetryableError is a push failure worth another attempt whatever the
+// status of its response, such as a SOAP server fault
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// IsRetryable reports whether err is a RetryableError
+func IsRetryable(err error) bool {
+	var rerr *RetryableError
+	return errors.As(err, &rerr)
+}
+
+// Turn the error of a failed response into a ReviewError or PermanentError
+// when the rules say so
+func classify(rules config.PushConfig, r Response, err error) error {
+	if config.MatchStatus(rules.ReviewCodes, r.StatusCode) {
+		return &ReviewError{Status: r.StatusCode, Err: err}
+	}
+	if rule, ok := matchResponseRules(rules.PermanentErrors, r.StatusCode, r.Body); ok {
+		return &PermanentError{Rule: rule, Err: err}
+	}
+	if config.MatchStatus(rules.PermanentCodes, r.StatusCode) {
+		return &PermanentError{Rule: config.ResponseRule{Status: r.StatusCode}, Err: err}
+	}
+	return err
+}
+
+// Find the first of push.outcomes matching r and record it in r. Its
+// outcome comes back as the error the push would have failed with.
+func mapOutcome(rules config.PushConfig, r *Response, what string) (bool, error) {
+	for i := range rules.Outcomes {
+		o := &rules.Outcomes[i]
+		v, ok := matchOutcome(o, r.StatusCode, r.Body)
+		if !ok {
+			continue
+		}
+		r.Outcome = o
+		err := fmt.Errorf("push of %s matched outcome %s, status: %d, response: %s", what, o.Name, r.StatusCode, jsonutil.Redact(r.Body))
+		switch o.Outcome {
+		case "parked", "rejected":
+			return true, &PermanentError{Rule: config.ResponseRule{Status: r.StatusCode, Field: o.Field, Value: v}, Err: err}
+		case "review":
+			return true, &ReviewError{Status: r.StatusCode, Err: err}
+		case "retry":
+			return true, &RetryableError{Err: err}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Whether o matches a response, and the value of its field
+func matchOutcome(o *config.OutcomeRule, status int, body []byte) (string, bool) {
+	if len(o.Codes) > 0 && !config.MatchStatus(o.Codes, status) {
+		return "", false
+	}
+	text := string(body)
+	if o.Field != "" {
+		v, ok := jsonutil.Lookup(body, o.Field)
+		if !ok || len(o.Values) > 0 && !containsString(o.Values, v) {
+			return "", false
+		}
+		text = v
+	}
+	if o.Contains != "" && !strings.Contains(strings.ToLower(text), strings.ToLower(o.Contains)) {
+		return "", false
+	}
+	if o.Field == "" {
+		text = ""
+	}
+	return text, true
+}
+
+func isSuccess(rule *config.SuccessRule, status int, body []byte) bool {
+	if rule == nil {
+		return status == http.StatusOK
+	}
+	return evalSuccess(rule, status, body)
+}
+
+func evalSuccess(r *config.SuccessRule, status int, body []byte) bool {
+	if len(r.Status) > 0 && !containsInt(r.Status, status) {
+		return false
+	}
+	if r.Field != "" {
+		v, ok := jsonutil.Lookup(body, r.Field)
+		if !ok {
+			return false
+		}
+		if r.Equals != nil && v != *r.Equals {
+			return false
+		}
+		if len(r.In) > 0 && !containsString(r.In, v) {
+			return false
+		}
+	}
+	for i := range r.All {
+		if !evalSuccess(&r.All[i], status, body) {
+			return false
+		}
+	}
+	if len(r.Any) > 0 {
+		matched := false
+		for i := range r.Any {
+			if evalSuccess(&r.Any[i], status, body) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.Not != nil && evalSuccess(r.Not, status, body) {
+		return false
+	}
+	return true
+}
+
+func matchResponseRules(rules []config.ResponseRule, status int, body []byte) (config.ResponseRule, bool) {
+	for _, r := range rules {
+		if matchesRule(r, status, body) {
+			return r, true
+		}
+	}
+	return config.ResponseRule{}, false
+}
+
+func matchesRule(r config.ResponseRule, status int, body []byte) bool {
+	if r.Status != 0 && r.Status != status {
+		return false
+	}
+	if r.Field != "" {
+		v, ok := jsonutil.Lookup(body, r.Field)
+		if !ok || v != r.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package pusher
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func TestMatchOutcome(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   config.OutcomeRule
+		status int
+		body   string
+		value  string
+		ok     bool
+	}{
+		{"code", config.OutcomeRule{Codes: []string{"409"}}, 409, `{}`, "", true},
+		{"code class", config.OutcomeRule{Codes: []string{"4xx"}}, 422, `{}`, "", true},
+		{"other code", config.OutcomeRule{Codes: []string{"4xx"}}, 500, `{}`, "", false},
+		{"field exists", config.OutcomeRule{Field: "error.code"}, 200, `{"error":{"code":"E12"}}`, "E12", true},
+		{"field missing", config.OutcomeRule{Field: "error.code"}, 200, `{"status":"ok"}`, "", false},
+		{"field value", config.OutcomeRule{Field: "status", Values: []string{"duplicate", "exists"}}, 200, `{"status":"exists"}`, "exists", true},
+		{"other value", config.OutcomeRule{Field: "status", Values: []string{"duplicate"}}, 200, `{"status":"ok"}`, "", false},
+		{"contains body", config.OutcomeRule{Codes: []string{"400"}, Contains: "already exists"}, 400, `{"message":"Invoice Already Exists"}`, "", true},
+		{"contains field", config.OutcomeRule{Field: "message", Contains: "closed"}, 200, `{"message":"Period CLOSED","note":"x"}`, "Period CLOSED", true},
+		{"contains other field", config.OutcomeRule{Field: "note", Contains: "closed"}, 200, `{"message":"Period closed","note":"x"}`, "", false},
+		{"all parts", config.OutcomeRule{Codes: []string{"200"}, Field: "status", Values: []string{"held"}}, 202, `{"status":"held"}`, "", false},
+	}
+	for _, tt := range tests {
+		v, ok := matchOutcome(&tt.rule, tt.status, []byte(tt.body))
+		if ok != tt.ok || v != tt.value {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, v, ok, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestMapOutcome(t *testing.T) {
+	rules := config.PushConfig{Outcomes: []config.OutcomeRule{
+		{Name: "already_pushed", Field: "status", Values: []string{"duplicate"}, Outcome: "pushed"},
+		{Name: "closed", Field: "status", Values: []string{"closed"}, Outcome: "parked"},
+		{Name: "invalid", Field: "status", Values: []string{"invalid"}, Outcome: "rejected"},
+		{Name: "held", Field: "status", Values: []string{"held"}, Outcome: "review"},
+		{Name: "busy", Codes: []string{"503"}, Outcome: "retry"},
+	}}
+	tests := []struct {
+		status int
+		body   string
+		// "" no rule matched, else the name of the rule
+		rule string
+		// "nil", "permanent", "review" or "retry"
+		err string
+	}{
+		{200, `{"status":"ok"}`, "", "nil"},
+		{200, `{"status":"duplicate"}`, "already_pushed", "nil"},
+		{422, `{"status":"closed"}`, "closed", "permanent"},
+		{400, `{"status":"invalid"}`, "invalid", "permanent"},
+		{200, `{"status":"held"}`, "held", "review"},
+		{503, `busy`, "busy", "retry"},
+	}
+	for _, tt := range tests {
+		r := Response{StatusCode: tt.status, Body: []byte(tt.body)}
+		matched, err := mapOutcome(rules, &r, "invoice_id INV-1")
+		if matched != (tt.rule != "") {
+			t.Errorf("%s: matched = %v", tt.body, matched)
+			continue
+		}
+		if tt.rule != "" && (r.Outcome == nil || r.Outcome.Name != tt.rule) {
+			t.Errorf("%s: outcome = %v, want %s", tt.body, r.Outcome, tt.rule)
+		}
+		var retry *RetryableError
+		got := "nil"
+		switch {
+		case IsPermanent(err):
+			got = "permanent"
+		case NeedsReview(err):
+			got = "review"
+		case errors.As(err, &retry):
+			got = "retry"
+		case err != nil:
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: error %v, want %s", tt.body, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/source"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP uploads the documents of invoices as files to an SFTP server, one
+// file per PushBulk call. Each file is written under a temporary name and
+// renamed once complete, so the partner never picks up half a file; its
+// manifest, when enabled, is uploaded after it the same way. A push fails
+// when the upload does.
+type SFTP struct {
+	Config  config.SFTPSinkConfig
+	Encoder Encoder
+
+	// Uploads use one connection, one at a time
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func NewSFTP(cfg *config.Config) *SFTP {
+	return &SFTP{Config: cfg.Sink.SFTP, Encoder: NewEncoder(cfg)}
+}
+
+type manifest struct {
+	File      string    `json:"file"`
+	Count     int       `json:"count"`
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Invoices  []string  `json:"invoices"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Push uploads a file holding txn alone
+func (s *SFTP) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	r := s.PushBulk(ctx, []source.Transaction{txn})[0]
+	return r.Response, r.Err
+}
+
+// PushBulk uploads one file with the documents of txns. The invoices whose
+// document cannot be built fail on their own, the others with the upload.
+func (s *SFTP) PushBulk(ctx context.Context, txns []source.Transaction) []ItemResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]ItemResult, len(txns))
+	var docs []json.RawMessage
+	var ids []string
+	var sent []int
+	for i, txn := range txns {
+		doc, err := s.Encoder.Encode(txn)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		docs = append(docs, doc)
+		ids = append(ids, txn.InvoiceID)
+		sent = append(sent, i)
+	}
+	if len(docs) == 0 {
+		return results
+	}
+
+	now := time.Now().UTC()
+	name := s.fileName(now, ids[0])
+	data, err := s.encode(docs)
+	if err == nil {
+		err = s.upload(ctx, name, data)
+	}
+	if err == nil && s.Config.Manifest {
+		sum := sha256.Sum256(data)
+		m, _ := json.Marshal(manifest{File: name, Count: len(docs), Size: len(data), SHA256: hex.EncodeToString(sum[:]), Invoices: ids, CreatedAt: now})
+		err = s.upload(ctx, name+".manifest.json", m)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to upload %s to %s: %v", name, s.Config.Address, err)
+	}
+	for _, i := range sent {
+		results[i] = ItemResult{Response: Response{Attempts: 1}, Err: err}
+	}
+	return results
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func (s *SFTP) fileName(now time.Time, first string) string {
+	return fmt.Sprintf("%s-%s-%s.%s", s.Config.Prefix, now.Format("20060102T150405.000Z"), unsafeName.ReplaceAllString(first, "_"), s.Config.Format)
+}
+
+// The content of a file with docs, in sink.sftp.format
+func (s *SFTP) encode(docs []json.RawMessage) ([]byte, error) {
+	if s.Config.Format != "csv" {
+		return json.Marshal(docs)
+	}
+	rows := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		d := json.NewDecoder(bytes.NewReader(doc))
+		d.UseNumber()
+		if err := d.Decode(&rows[i]); err != nil {
+			return nil, fmt.Errorf("document is not a JSON object: %v", err)
+		}
+	}
+	columns := s.Config.Columns
+	if len(columns) == 0 {
+		for k := range rows[0] {
+			columns = append(columns, k)
+		}
+		sort.Strings(columns)
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, c := range columns {
+			record[i] = csvValue(row[c])
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// Write data to a temporary file in the directory and rename it to name,
+// connecting first when needed. A failed upload drops the connection, so
+// the next one starts afresh. Takes at most sink.sftp.timeout.
+func (s *SFTP) upload(ctx context.Context, name string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.Config.Timeout)
+	defer cancel()
+	if s.client == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	client := s.client
+	done := make(chan error, 1)
+	go func() {
+		done <- s.write(client, name, data)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			s.disconnect()
+		}
+		return err
+	case <-ctx.Done():
+		// Closing the connection ends the write
+		s.disconnect()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *SFTP) write(client *sftp.Client, name string, data []byte) error {
+	final := path.Join(s.Config.Directory, name)
+	tmp := path.Join(s.Config.Directory, "."+name+".tmp")
+	f, err := client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = client.Rename(tmp, final)
+	}
+	if err != nil {
+		client.Remove(tmp)
+	}
+	return err
+}
+
+func (s *SFTP) connect() error {
+	key, err := os.ReadFile(s.Config.PrivateKeyFile)
+	if err != nil {
+		return err
+	}
+	var signer ssh.Signer
+	if s.Config.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(s.Config.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read private key %s: %v", s.Config.PrivateKeyFile, err)
+	}
+	hostKeys, err := knownhosts.New(s.Config.KnownHostsFile)
+	if err != nil {
+		return err
+	}
+	conn, err := ssh.Dial("tcp", s.Config.Address, &ssh.ClientConfig{
+		User:            s.Config.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         s.Config.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.client = conn, client
+	return nil
+}
+
+func (s *SFTP) disconnect() {
+	if s.client != nil {
+		s.client.Close()
+		s.conn.Close()
+		s.conn, s.client = nil, nil
+	}
+}
+
+// Describe returns the file that would be uploaded for txn alone
+func (s *SFTP) Describe(txn source.Transaction) string {
+	doc, err := s.Encoder.Encode(txn)
+	if err != nil {
+		return fmt.Sprintf("invalid document: %v", err)
+	}
+	data, err := s.encode([]json.RawMessage{doc})
+	if err != nil {
+		return fmt.Sprintf("invalid document: %v", err)
+	}
+	name := path.Join(s.Config.Directory, s.fileName(time.Now().UTC(), txn.InvoiceID))
+	return fmt.Sprintf("upload to %s:%s: %s", s.Config.Address, name, data)
+}
+
+// Reload picks up the document and file settings of cfg. The connection
+// settings need a restart.
+func (s *SFTP) Reload(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := cfg.Sink.SFTP
+	s.Encoder = NewEncoder(cfg)
+	s.Config.Directory, s.Config.Format, s.Config.Columns = c.Directory, c.Format, c.Columns
+	s.Config.Prefix, s.Config.Manifest, s.Config.Timeout = c.Prefix, c.Manifest, c.Timeout
+}
+
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnect()
+	return nil
+}
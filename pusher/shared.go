@@ -0,0 +1,81 @@
+package pusher
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/redisclient"
+	"github.com/redis/go-redis/v9"
+)
+
+// Reserve the next free slot of a rate limit kept in one key, an evenly
+// spaced schedule of requests (GCRA), returning how long to wait for it in
+// milliseconds
+var reserveScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + tonumber(t[2]) / 1000
+local interval = tonumber(ARGV[1])
+local next = tonumber(redis.call('GET', KEYS[1]) or now)
+if next < now then next = now end
+redis.call('SET', KEYS[1], next + interval, 'PX', math.ceil(next - now + interval))
+return math.ceil(next - now)`)
+
+// SharedLimit is the rate limit of redis.rate_limit, shared by all the
+// instances using the same Redis keys. Every request takes the next free
+// slot of the schedule and waits for it.
+type SharedLimit struct {
+	client *redis.Client
+	key    string
+	// Milliseconds between two requests, as float64 bits
+	interval atomic.Uint64
+}
+
+func NewSharedLimit(cfg *config.Config) *SharedLimit {
+	l := &SharedLimit{client: redisclient.New(cfg), key: redisclient.Prefix(cfg) + ":rate"}
+	l.SetRate(cfg.Redis.RateLimit)
+	return l
+}
+
+// SetRate changes the limit to rate, already checked by Validate
+func (l *SharedLimit) SetRate(rate string) {
+	perSecond, _ := config.ParseRate(rate)
+	interval := 0.0
+	if perSecond > 0 {
+		interval = 1000 / perSecond
+	}
+	l.interval.Store(math.Float64bits(interval))
+}
+
+// Wait blocks until the request may be sent or ctx is done. While Redis
+// cannot be reached requests are only held to the rate_limit of this
+// instance.
+func (l *SharedLimit) Wait(ctx context.Context) error {
+	interval := math.Float64frombits(l.interval.Load())
+	if interval == 0 {
+		return nil
+	}
+	wait, err := reserveScript.Run(ctx, l.client, []string{l.key}, interval).Int64()
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to reach the Redis rate limit, sending anyway", "error", err)
+		return nil
+	}
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(wait) * time.Millisecond)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (l *SharedLimit) Close() error {
+	return l.client.Close()
+}
@@ -0,0 +1,125 @@
+package pusher
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Signer adds an HMAC signature of the request body followed by the
+// timestamp, and the timestamp itself, to push requests. When the push
+// server's clock is further off than signing.drift_tolerance, timestamps
+// follow the server clock as reported in its Date header.
+type Signer struct {
+	cfg config.SigningConfig
+
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func NewSigner(cfg config.SigningConfig) *Signer {
+	return &Signer{cfg: cfg}
+}
+
+func newSigner(cfg config.SigningConfig) *Signer {
+	if !cfg.Enabled {
+		return nil
+	}
+	return NewSigner(cfg)
+}
+
+// SetConfig changes the signing settings for the next request
+func (s *Signer) SetConfig(cfg config.SigningConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+}
+
+// Sign sets the timestamp and signature headers of req
+func (s *Signer) Sign(req *http.Request) error {
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	cfg, offset := s.cfg, s.offset
+	s.mu.Unlock()
+
+	ts := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+	sum := MAC(cfg.Algorithm, cfg.Secret, body, ts)
+
+	sig := hex.EncodeToString(sum)
+	if cfg.Encoding == "base64" {
+		sig = base64.StdEncoding.EncodeToString(sum)
+	}
+	req.Header.Set(cfg.TimestampHeader, ts)
+	req.Header.Set(cfg.SignatureHeader, sig)
+	return nil
+}
+
+// Observe the server clock from the Date header of resp
+func (s *Signer) Observe(resp *http.Response) {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// Date has a one second resolution
+	drift := time.Until(date).Round(time.Second)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tolerance := s.cfg.DriftTolerance
+	abs := drift
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs > tolerance && s.offset == 0:
+		slog.Warn("Push server clock differs from ours, signing with its time", "drift", drift.String())
+		s.offset = drift
+	case abs > tolerance:
+		s.offset = drift
+	case s.offset != 0:
+		slog.Info("Push server clock is back in sync")
+		s.offset = 0
+	}
+}
+
+// MAC returns the HMAC with algorithm and secret of body followed by the
+// timestamp ts, as sent by Sign and expected from webhooks
+func MAC(algorithm, secret string, body []byte, ts string) []byte {
+	mac := hmac.New(hashFunc(algorithm), []byte(secret))
+	mac.Write(body)
+	mac.Write([]byte(ts))
+	return mac.Sum(nil)
+}
+
+// Validate accepts sha1, sha256 and sha512
+func hashFunc(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New
+	case "sha512":
+		return sha512.New
+	}
+	return sha256.New
+}
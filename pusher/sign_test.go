@@ -0,0 +1,98 @@
+package pusher
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		encoding  string
+		body      string
+		hash      func() hash.Hash
+		decode    func(string) ([]byte, error)
+	}{
+		{"sha256 hex", "sha256", "hex", `{"invoice_id":"INV-1"}`, sha256.New, hex.DecodeString},
+		{"default", "", "", `{"invoice_id":"INV-1"}`, sha256.New, hex.DecodeString},
+		{"sha512 base64", "sha512", "base64", `{"invoice_id":"INV-1"}`, sha512.New, base64.StdEncoding.DecodeString},
+		{"sha1", "sha1", "hex", "invoice_id=INV-1", sha1.New, hex.DecodeString},
+		{"no body", "sha256", "hex", "", sha256.New, hex.DecodeString},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSigner(config.SigningConfig{
+				Algorithm: tt.algorithm, Encoding: tt.encoding, Secret: "s3cret",
+				SignatureHeader: "X-Signature", TimestampHeader: "X-Timestamp",
+			})
+			var req *http.Request
+			if tt.body == "" {
+				req, _ = http.NewRequest("GET", "http://api.test/push", nil)
+			} else {
+				req, _ = http.NewRequest("POST", "http://api.test/push", strings.NewReader(tt.body))
+			}
+			if err := s.Sign(req); err != nil {
+				t.Fatal(err)
+			}
+
+			ts := req.Header.Get("X-Timestamp")
+			unix, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil || time.Since(time.Unix(unix, 0)).Abs() > 5*time.Second {
+				t.Fatalf("timestamp %q is not the current time", ts)
+			}
+			got, err := tt.decode(req.Header.Get("X-Signature"))
+			if err != nil {
+				t.Fatalf("signature %q: %v", req.Header.Get("X-Signature"), err)
+			}
+			mac := hmac.New(tt.hash, []byte("s3cret"))
+			mac.Write([]byte(tt.body + ts))
+			if !hmac.Equal(got, mac.Sum(nil)) {
+				t.Fatalf("signature does not match the HMAC of the body and timestamp")
+			}
+		})
+	}
+}
+
+func TestSignerObserve(t *testing.T) {
+	s := NewSigner(config.SigningConfig{SignatureHeader: "X-Signature", TimestampHeader: "X-Timestamp", DriftTolerance: 30 * time.Second})
+	observe := func(d time.Duration) {
+		resp := &http.Response{Header: http.Header{"Date": {time.Now().Add(d).UTC().Format(http.TimeFormat)}}}
+		s.Observe(resp)
+	}
+	tests := []struct {
+		name  string
+		drift time.Duration
+		// Expected offset of the timestamps
+		want time.Duration
+	}{
+		{"in sync", 0, 0},
+		{"within tolerance", 20 * time.Second, 0},
+		{"server ahead", time.Hour, time.Hour},
+		{"server behind", -10 * time.Minute, -10 * time.Minute},
+		{"back in sync", 5 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		observe(tt.drift)
+		req, _ := http.NewRequest("POST", "http://api.test/push", strings.NewReader("{}"))
+		if err := s.Sign(req); err != nil {
+			t.Fatal(err)
+		}
+		unix, _ := strconv.ParseInt(req.Header.Get("X-Timestamp"), 10, 64)
+		if off := time.Unix(unix, 0).Sub(time.Now().Add(tt.want)); off.Abs() > 3*time.Second {
+			t.Errorf("%s: timestamp off by %s from the expected %s offset", tt.name, off, tt.want)
+		}
+	}
+}
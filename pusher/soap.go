@@ -0,0 +1,178 @@
+package pusher
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/purwaren/trx-push/auth"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/tmpl"
+	"github.com/purwaren/trx-push/source"
+)
+
+// SOAP posts an envelope rendered for every invoice. Requests go through
+// HTTP, so they are authenticated, rate limited, retried and audited like
+// pushes. A fault in the response fails the push, for good when its code
+// is one of sink.soap.permanent_faults and worth a retry otherwise.
+type SOAP struct {
+	HTTP     *HTTP
+	Config   config.SOAPSinkConfig
+	Envelope *template.Template
+}
+
+func NewSOAP(cfg *config.Config, client *http.Client, a auth.Authenticator) *SOAP {
+	s := &SOAP{HTTP: NewHTTP(cfg, client, a)}
+	s.configure(cfg.Sink.SOAP)
+	return s
+}
+
+// Envelope already checked by Validate
+func (s *SOAP) configure(cfg config.SOAPSinkConfig) {
+	s.Config = cfg
+	s.Envelope, _ = tmpl.Parse("envelope", cfg.Envelope)
+}
+
+// The parts of a SOAP 1.1 or 1.2 fault that are read
+type soapFault struct {
+	Code   string `xml:"faultcode"`
+	String string `xml:"faultstring"`
+	Code12 string `xml:"Code>Value"`
+	Reason string `xml:"Reason>Text"`
+}
+
+func (s *SOAP) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	log := slog.With("invoice_id", txn.InvoiceID)
+	return s.HTTP.withRetry(ctx, log, func(token string) (Response, error) {
+		return s.pushOnce(ctx, txn, token, log)
+	})
+}
+
+func (s *SOAP) pushOnce(ctx context.Context, txn source.Transaction, token string, log *slog.Logger) (Response, error) {
+	reqCtx, cancel := requestContext(ctx)
+	defer cancel()
+	req, err := s.newRequest(reqCtx, txn)
+	if err != nil {
+		return Response{}, &RequestError{Err: err}
+	}
+	r, err := s.HTTP.send(ctx, req, token, []string{txn.InvoiceID}, log)
+	if err != nil {
+		return r, err
+	}
+	if ok, err := mapOutcome(s.HTTP.Rules, &r, "invoice_id "+txn.InvoiceID); ok {
+		return r, err
+	}
+	fault, err := findFault(r.Body)
+	if err != nil && (r.StatusCode >= 200 && r.StatusCode <= 299) {
+		return r, fmt.Errorf("SOAP response for invoice_id %s is not XML: %v", txn.InvoiceID, err)
+	}
+	if fault != nil {
+		code, reason := fault.Code, fault.String
+		if fault.Code12 != "" {
+			code, reason = fault.Code12, fault.Reason
+		}
+		ferr := fmt.Errorf("SOAP fault pushing invoice_id %s, status: %d, code: %s: %s", txn.InvoiceID, r.StatusCode, code, reason)
+		if s.permanent(code) {
+			return r, &PermanentError{Rule: config.ResponseRule{Field: "faultcode", Value: code}, Err: ferr}
+		}
+		// push.review_codes and permanent_errors still apply
+		if err := classify(s.HTTP.Rules, r, ferr); err != ferr {
+			return r, err
+		}
+		return r, &RetryableError{Err: ferr}
+	}
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		err := fmt.Errorf("failed to push transaction with invoice_id %s, status: %d", txn.InvoiceID, r.StatusCode)
+		return r, classify(s.HTTP.Rules, r, err)
+	}
+	return r, nil
+}
+
+// Whether the fault code, namespace prefix and all, is one of
+// permanent_faults or a subcode of one
+func (s *SOAP) permanent(code string) bool {
+	if i := strings.LastIndexByte(code, ':'); i >= 0 {
+		code = code[i+1:]
+	}
+	for _, f := range s.Config.PermanentFaults {
+		if code == f || strings.HasPrefix(code, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// The Fault element anywhere in body, nil when there is none
+func findFault(body []byte) (*soapFault, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "Fault" {
+			var f soapFault
+			if err := d.DecodeElement(&f, &start); err != nil {
+				return nil, err
+			}
+			return &f, nil
+		}
+	}
+}
+
+func (s *SOAP) newRequest(ctx context.Context, txn source.Transaction) (*http.Request, error) {
+	body, err := render(s.Envelope, txn, false)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.HTTP.setHeaders(req)
+	if s.Config.Version == "1.2" {
+		contentType := "application/soap+xml; charset=utf-8"
+		if s.Config.Action != "" {
+			contentType += fmt.Sprintf("; action=%q", s.Config.Action)
+		}
+		req.Header.Set("Content-Type", contentType)
+	} else {
+		req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+		req.Header.Set("SOAPAction", fmt.Sprintf("%q", s.Config.Action))
+	}
+	if i := s.HTTP.Idempotency; i.Enabled {
+		req.Header.Set(i.Header, idempotencyKey(i.Salt, txn.InvoiceID))
+	}
+	return req, nil
+}
+
+// Describe returns the envelope that would be posted for txn, for dry runs
+func (s *SOAP) Describe(txn source.Transaction) string {
+	body, err := render(s.Envelope, txn, false)
+	if err != nil {
+		return fmt.Sprintf("invalid request: %v", err)
+	}
+	return fmt.Sprintf("POST %s SOAPAction %q %s", s.Config.URL, s.Config.Action, body)
+}
+
+// Warmup primes the connection to the API like the http sink
+func (s *SOAP) Warmup(ctx context.Context) {
+	s.HTTP.Warmup(ctx)
+}
+
+// Reload picks up the sink.soap settings of cfg along with the api ones
+// the http sink reloads
+func (s *SOAP) Reload(cfg *config.Config) {
+	s.HTTP.Reload(cfg)
+	s.configure(cfg.Sink.SOAP)
+}
@@ -0,0 +1,87 @@
+package pusher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Tee pushes every invoice to several sinks in turn, for sink.also. The
+// first failure stops the push and is returned, so the invoice stays
+// pending and is pushed to all sinks again. The response is the one of
+// the first sink.
+type Tee struct {
+	Sinks []Sink
+}
+
+// The optional sink methods of the pipeline, passed on to each sink
+type (
+	describer interface {
+		Describe(txn source.Transaction) string
+	}
+	warmer interface {
+		Warmup(ctx context.Context)
+	}
+	reloader interface {
+		Reload(cfg *config.Config)
+	}
+)
+
+func (t *Tee) Push(ctx context.Context, txn source.Transaction) (Response, error) {
+	var first Response
+	for i, s := range t.Sinks {
+		resp, err := s.Push(ctx, txn)
+		if i == 0 {
+			first = resp
+		}
+		if err != nil {
+			return resp, err
+		}
+	}
+	return first, nil
+}
+
+// Describe joins what each sink would send
+func (t *Tee) Describe(txn source.Transaction) string {
+	var parts []string
+	for _, s := range t.Sinks {
+		if d, ok := s.(describer); ok {
+			parts = append(parts, d.Describe(txn))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Warmup primes the sinks that support it
+func (t *Tee) Warmup(ctx context.Context) {
+	for _, s := range t.Sinks {
+		if w, ok := s.(warmer); ok {
+			w.Warmup(ctx)
+		}
+	}
+}
+
+func (t *Tee) Reload(cfg *config.Config) {
+	for _, s := range t.Sinks {
+		if r, ok := s.(reloader); ok {
+			r.Reload(cfg)
+		}
+	}
+}
+
+func (t *Tee) Close() error {
+	var errs []error
+	for _, s := range t.Sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%T: %v", s, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
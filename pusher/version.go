@@ -0,0 +1,101 @@
+package pusher
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"text/template"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/bodyschema"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Hash buckets the invoices are spread over for the percents of the
+// versions, 0.01% each
+const versionBuckets = 10000
+
+// Version is where and how the HTTP sink sends the push of an invoice:
+// push_url or one of api.versions
+type Version struct {
+	// Empty for push_url without api.version
+	Name         string
+	URL          string
+	Method       string
+	Format       string
+	InvoiceField string
+	// Optional; nil sends the invoice field or payload
+	Template *template.Template
+	// Optional; the JSON body must match it
+	Schema *bodyschema.Schema
+	Match  *config.VersionMatch
+	// The hash buckets of the percent, [from, to); none without one
+	from, to int
+}
+
+// The versions of api.versions, their templates and schemas already
+// checked by Validate and falling back to those of push_url
+func newVersions(api config.APIConfig, fallback *template.Template, schema *bodyschema.Schema) []Version {
+	var versions []Version
+	start := 0
+	for _, v := range api.Versions {
+		n := int(math.Round(v.Percent * versionBuckets / 100))
+		t, s := fallback, schema
+		if v.Template != "" {
+			t = bodyTemplate(config.PayloadConfig{Template: v.Template})
+		}
+		if v.Schema.File != "" {
+			s = bodySchema(v.Schema)
+		}
+		versions = append(versions, Version{
+			Name:         v.Name,
+			URL:          v.PushURL,
+			Method:       v.PushMethod,
+			Format:       v.PushFormat,
+			InvoiceField: v.InvoiceField,
+			Template:     t,
+			Schema:       s,
+			Match:        v.Match,
+			from:         start,
+			to:           start + n,
+		})
+		start += n
+	}
+	return versions
+}
+
+// The version txn is pushed to: the first of Versions that matches its
+// payload and has its hash bucket, or else push_url
+func (p *HTTP) version(txn source.Transaction) Version {
+	if len(p.Versions) > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(txn.InvoiceID))
+		bucket := int(h.Sum32() % versionBuckets)
+		var doc []byte
+		for _, v := range p.Versions {
+			if v.Match != nil {
+				if doc == nil {
+					doc, _ = json.Marshal(txn.Payload)
+				}
+				value, ok := jsonutil.Lookup(doc, v.Match.Field)
+				if !ok || !containsString(v.Match.Values, value) {
+					continue
+				}
+			}
+			if v.to > v.from && (bucket < v.from || bucket >= v.to) {
+				continue
+			}
+			return v
+		}
+	}
+	return Version{
+		Name:         p.Version,
+		URL:          p.URL,
+		Method:       p.Method,
+		Format:       p.Format,
+		InvoiceField: p.InvoiceField,
+		Template:     p.Template,
+		Schema:       p.Schema,
+	}
+}
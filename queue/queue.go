@@ -0,0 +1,98 @@
+// Package queue buffers the invoices that could not reach the push API in
+// a local SQLite file, so they can be pushed once it is back without being
+// selected from the invoice table again.
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/purwaren/trx-push/source"
+	_ "modernc.org/sqlite"
+)
+
+// Entry is one queued invoice
+type Entry struct {
+	// Order in which it was first queued
+	Seq int64
+	Txn source.Transaction
+	// Times it was queued, the first one included
+	Attempts int
+	QueuedAt time.Time
+}
+
+// Queue is the SQLite file of queue.file. It is safe for concurrent use.
+type Queue struct {
+	db *sql.DB
+}
+
+// Open opens the queue file, creating it and its table when missing
+func Open(path string) (*Queue, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite writes one at a time anyway
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS queue (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	invoice_number TEXT NOT NULL UNIQUE,
+	grp TEXT NOT NULL DEFAULT '',
+	shard TEXT NOT NULL DEFAULT '',
+	attempts INTEGER NOT NULL,
+	queued_at TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open queue %s: %v", path, err)
+	}
+	return &Queue{db: db}, nil
+}
+
+// Add queues txn. An invoice already queued keeps its place and has its
+// attempts increased.
+func (q *Queue) Add(ctx context.Context, txn source.Transaction) error {
+	_, err := q.db.ExecContext(ctx, `INSERT INTO queue AS q (invoice_number, grp, shard, attempts, queued_at)
+VALUES ($1, $2, $3, 1, $4)
+ON CONFLICT (invoice_number) DO UPDATE SET attempts = q.attempts + 1`,
+		txn.InvoiceID, txn.Group, txn.Shard, time.Now())
+	return err
+}
+
+// Page returns up to limit entries queued after seq, oldest first
+func (q *Queue) Page(ctx context.Context, after int64, limit int) ([]Entry, error) {
+	rows, err := q.db.QueryContext(ctx, `SELECT seq, invoice_number, grp, shard, attempts, queued_at
+FROM queue WHERE seq > $1 ORDER BY seq LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.Seq, &e.Txn.InvoiceID, &e.Txn.Group, &e.Txn.Shard, &e.Attempts, &e.QueuedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Remove takes the invoice out of the queue
+func (q *Queue) Remove(ctx context.Context, invoiceID string) error {
+	_, err := q.db.ExecContext(ctx, "DELETE FROM queue WHERE invoice_number = $1", invoiceID)
+	return err
+}
+
+// Len is the number of queued invoices
+func (q *Queue) Len(ctx context.Context) (int, error) {
+	var n int
+	err := q.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM queue").Scan(&n)
+	return n, err
+}
+
+func (q *Queue) Close() error {
+	return q.db.Close()
+}
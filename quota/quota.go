@@ -0,0 +1,153 @@
+// Package quota counts the invoices pushed each day in a table or a file,
+// so no more than quota.daily are pushed however many are pending and
+// however many instances share the count.
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Store keeps the daily counts of quota.name
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.QuotaConfig
+
+	// Serializes the updates of the file store
+	mu sync.Mutex
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.QuotaConfig) *Store {
+	return &Store{DB: db, Dialect: dialect, Config: cfg}
+}
+
+// Reload picks up the limits and store of cfg.Quota
+func (s *Store) Reload(cfg *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Config = cfg.Quota
+}
+
+// The count of one day in the file store
+type fileCount struct {
+	Day    string `json:"day"`
+	Pushed int    `json:"pushed"`
+}
+
+// Take counts one push on day, a date such as 2026-01-31, returning false
+// when quota.daily pushes were counted on it already
+func (s *Store) Take(ctx context.Context, day string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit := s.Config.Daily
+	if s.Config.Store == "file" {
+		c, err := s.readFile()
+		if err != nil {
+			return false, err
+		}
+		if c.Day != day {
+			c = fileCount{Day: day}
+		}
+		if c.Pushed >= limit {
+			return false, nil
+		}
+		c.Pushed++
+		return true, s.writeFile(c)
+	}
+
+	// The update only counts below the limit, so instances racing for the
+	// last pushes cannot both get them
+	d := s.Dialect
+	table := d.QuoteQualified(s.Config.Table)
+	update := fmt.Sprintf("UPDATE %s SET pushed = pushed + 1, updated_at = %s WHERE name = %s AND quota_day = %s AND pushed < %s",
+		table, d.Now(), d.Param(1), d.Param(2), d.Param(3))
+	for i := 0; i < 2; i++ {
+		res, err := s.DB.ExecContext(ctx, update, s.Config.Name, day, limit)
+		if err != nil {
+			return false, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 1 {
+			return n == 1, err
+		}
+		// A row left untouched is a full day
+		if _, found, err := s.used(ctx, day); err != nil || found {
+			return false, err
+		}
+		insert := fmt.Sprintf("INSERT INTO %s (name, quota_day, pushed, updated_at) VALUES (%s, %s, 1, %s)",
+			table, d.Param(1), d.Param(2), d.Now())
+		if _, err := s.DB.ExecContext(ctx, insert, s.Config.Name, day); err == nil {
+			return true, nil
+		}
+		// Another instance inserted the day first; count on its row
+	}
+	return false, nil
+}
+
+// Used returns the pushes counted on day
+func (s *Store) Used(ctx context.Context, day string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Config.Store == "file" {
+		c, err := s.readFile()
+		if err != nil || c.Day != day {
+			return 0, err
+		}
+		return c.Pushed, nil
+	}
+	n, _, err := s.used(ctx, day)
+	return n, err
+}
+
+func (s *Store) used(ctx context.Context, day string) (int, bool, error) {
+	query := fmt.Sprintf("SELECT pushed FROM %s WHERE name = %s AND quota_day = %s",
+		s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1), s.Dialect.Param(2))
+	var n int
+	err := s.DB.QueryRowContext(ctx, query, s.Config.Name, day).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return n, err == nil, err
+}
+
+// Nothing was counted yet when the file does not exist
+func (s *Store) readFile() (fileCount, error) {
+	var c fileCount
+	data, err := os.ReadFile(s.Config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(data, &c)
+}
+
+func (s *Store) writeFile(c fileCount) error {
+	data, _ := json.Marshal(c)
+	tmp := s.Config.File + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Config.File)
+}
+
+// Migrate creates the quota table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	d := s.Dialect
+	_, err := s.DB.ExecContext(ctx, d.CreateTable(d.QuoteQualified(s.Config.Table),
+		"name "+d.Type(sqlutil.String),
+		"quota_day "+d.Type(sqlutil.String),
+		"pushed "+d.Type(sqlutil.Integer),
+		"updated_at "+d.Type(sqlutil.Timestamp),
+		"PRIMARY KEY (name, quota_day)"))
+	return err
+}
@@ -0,0 +1,190 @@
+// Package reconcile compares the invoices marked pushed in the database
+// with the ones the API lists, finding the pushes that were lost on either
+// side.
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+	"github.com/purwaren/trx-push/internal/tmpl"
+	"github.com/purwaren/trx-push/pusher"
+	"github.com/purwaren/trx-push/source"
+)
+
+// Layout of the dates of a range
+const DateLayout = "2006-01-02"
+
+// Range is the dates compared, From through To inclusive
+type Range struct {
+	From time.Time
+	To   time.Time
+}
+
+// Report is the outcome of a comparison
+type Report struct {
+	// Pushed according to the database but not listed by the API
+	MissingRemote []string
+	// Listed by the API but not marked pushed in the database
+	MissingLocal []string
+	Matched      int
+}
+
+// Clean reports whether both sides agree
+func (r Report) Clean() bool {
+	return len(r.MissingRemote) == 0 && len(r.MissingLocal) == 0
+}
+
+// Compare matches the pushed invoice numbers with the remote ones
+func Compare(pushed, remote []string) Report {
+	inRemote := make(map[string]bool, len(remote))
+	for _, id := range remote {
+		inRemote[id] = true
+	}
+	inLocal := make(map[string]bool, len(pushed))
+	r := Report{MissingRemote: []string{}, MissingLocal: []string{}}
+	for _, id := range pushed {
+		if inLocal[id] {
+			continue
+		}
+		inLocal[id] = true
+		if inRemote[id] {
+			r.Matched++
+		} else {
+			r.MissingRemote = append(r.MissingRemote, id)
+		}
+	}
+	for id := range inRemote {
+		if !inLocal[id] {
+			r.MissingLocal = append(r.MissingLocal, id)
+		}
+	}
+	sort.Strings(r.MissingRemote)
+	sort.Strings(r.MissingLocal)
+	return r
+}
+
+// Pushed returns the invoices of the range in reconcile.pushed_status
+func Pushed(ctx context.Context, db *source.Database, cfg config.ReconcileConfig, rng Range) ([]string, error) {
+	d := db.Dialect
+	date := d.Quote(cfg.DateColumn)
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s AND %s >= %s AND %s < %s",
+		d.Quote(db.Query.IDColumn), d.QuoteQualified(db.Query.Table), d.Quote(db.Query.StatusColumn), d.Param(1),
+		date, d.Param(2), date, d.Param(3))
+	rows, err := db.Read.QueryContext(ctx, query, cfg.PushedStatus,
+		rng.From.Format(DateLayout), rng.To.AddDate(0, 0, 1).Format(DateLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Remote lists the invoices of a range from reconcile.list_url
+type Remote struct {
+	HTTP   *pusher.HTTP
+	Config config.ReconcileConfig
+}
+
+// List fetches every page of the listing for rng
+func (r *Remote) List(ctx context.Context, rng Range) ([]string, error) {
+	t, err := tmpl.Parse("list_url", r.Config.ListURL)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, map[string]string{"From": rng.From.Format(DateLayout), "To": rng.To.Format(DateLayout)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render reconcile.list_url: %v", err)
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	for next := b.String(); next != "" && !seen[next]; {
+		seen[next] = true
+		resp, err := r.HTTP.Get(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		page, err := r.items(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, page...)
+		if next, err = r.nextPage(next, resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// Invoice numbers of one page
+func (r *Remote) items(body []byte) ([]string, error) {
+	if r.Config.ItemsField != "" {
+		v, ok := jsonutil.Lookup(body, r.Config.ItemsField)
+		if !ok {
+			return nil, fmt.Errorf("response has no %s field", r.Config.ItemsField)
+		}
+		body = []byte(v)
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, fmt.Errorf("response items are not an array: %v", err)
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		var id string
+		if r.Config.InvoiceField == "" {
+			dec := json.NewDecoder(bytes.NewReader(item))
+			dec.UseNumber()
+			var v interface{}
+			if err := dec.Decode(&v); err != nil {
+				return nil, err
+			}
+			id = fmt.Sprint(v)
+		} else {
+			var ok bool
+			if id, ok = jsonutil.Lookup(item, r.Config.InvoiceField); !ok {
+				return nil, fmt.Errorf("response item has no %s field: %s", r.Config.InvoiceField, item)
+			}
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// URL of the page after current, resolved against it; empty at the end
+func (r *Remote) nextPage(current string, body []byte) (string, error) {
+	if r.Config.NextField == "" {
+		return "", nil
+	}
+	next, _ := jsonutil.Lookup(body, r.Config.NextField)
+	if next == "" {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	u, err := base.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page URL %q: %v", next, err)
+	}
+	return u.String(), nil
+}
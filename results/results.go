@@ -0,0 +1,305 @@
+// Package results persists per-invoice push outcomes to a database table
+// that reporting tools can query.
+package results
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Outcome values stored in the status column
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	StatusParked  = "parked"
+	StatusReview  = "review"
+	// Failed validation.rules, never sent
+	StatusRejected = "rejected"
+)
+
+// Result is one row of the results table
+type Result struct {
+	Invoice  string
+	Status   string
+	HTTPCode int
+	Reason   string
+	At       time.Time
+	// The API version pushed to, when api.versions route the invoices
+	APIVersion string
+}
+
+// Store writes results into the configured table
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.ResultsConfig
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.ResultsConfig) *Store {
+	return &Store{DB: db, Dialect: dialect, Config: cfg}
+}
+
+// Reload picks up the table, columns and batch size of cfg.Results for the
+// next batch
+func (s *Store) Reload(cfg *config.Config) {
+	s.Config = cfg.Results
+}
+
+// Batch buffers the results of one run and inserts them in batches of
+// results.batch_size rows. It is safe for concurrent use.
+type Batch struct {
+	store   *Store
+	runID   string
+	mu      sync.Mutex
+	pending []Result
+}
+
+func (s *Store) NewBatch(runID string) *Batch {
+	return &Batch{store: s, runID: runID}
+}
+
+func (b *Batch) Add(ctx context.Context, r Result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, r)
+	if len(b.pending) >= b.store.Config.BatchSize {
+		b.flushLocked(ctx)
+	}
+}
+
+// Flush inserts the buffered results. Failures are logged; the pushes
+// themselves already happened and must not be reported as failed.
+func (b *Batch) Flush(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked(ctx)
+}
+
+func (b *Batch) flushLocked(ctx context.Context) {
+	if len(b.pending) == 0 {
+		return
+	}
+	if err := b.store.insert(ctx, b.runID, b.pending); err != nil {
+		slog.Error("Failed to write push results", "count", len(b.pending), "table", b.store.Config.Table, "error", err)
+	}
+	b.pending = b.pending[:0]
+}
+
+func (s *Store) insert(ctx context.Context, runID string, results []Result) error {
+	c := s.Config.Columns
+	columns := []string{c.Invoice, c.Status, c.HTTPCode, c.Reason, c.Timestamp, c.RunID}
+	// Tables from before api.versions lack the column until -migrate
+	versioned := false
+	for _, r := range results {
+		versioned = versioned || r.APIVersion != ""
+	}
+	if versioned {
+		columns = append(columns, c.APIVersion)
+	}
+	var values []string
+	var args []interface{}
+	for _, r := range results {
+		params := make([]string, len(columns))
+		for i := range params {
+			params[i] = s.Dialect.Param(len(args) + i + 1)
+		}
+		values = append(values, "("+strings.Join(params, ", ")+")")
+		args = append(args, r.Invoice, r.Status, r.HTTPCode, r.Reason, r.At, runID)
+		if versioned {
+			args = append(args, r.APIVersion)
+		}
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s",
+		s.Dialect.QuoteQualified(s.Config.Table),
+		s.quoteColumns(columns...),
+		strings.Join(values, ", "))
+	_, err := s.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Counts is the number of results per status
+type Counts struct {
+	Success  int `json:"success"`
+	Failed   int `json:"failed"`
+	Parked   int `json:"parked"`
+	Review   int `json:"review"`
+	Rejected int `json:"rejected"`
+}
+
+func (c Counts) Total() int { return c.Success + c.Failed + c.Parked + c.Review + c.Rejected }
+
+// SuccessRate is the share of successful pushes, 0 without results
+func (c Counts) SuccessRate() float64 {
+	if c.Total() == 0 {
+		return 0
+	}
+	return float64(c.Success) / float64(c.Total())
+}
+
+// Run summarizes the results of one run
+type Run struct {
+	ID       string
+	Started  time.Time
+	Finished time.Time
+	Counts
+}
+
+// Counts returns the results recorded at or after since
+func (s *Store) Counts(ctx context.Context, since time.Time) (Counts, error) {
+	c := s.Config.Columns
+	query := fmt.Sprintf("SELECT %[1]s, count(*) FROM %[2]s WHERE %[3]s >= %[4]s GROUP BY %[1]s",
+		s.Dialect.Quote(c.Status), s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Quote(c.Timestamp), s.Dialect.Param(1))
+	return s.counts(ctx, query, since)
+}
+
+// LastRun returns the most recent run with results, false when there is none
+func (s *Store) LastRun(ctx context.Context) (Run, bool, error) {
+	c := s.Config.Columns
+	table := s.Dialect.QuoteQualified(s.Config.Table)
+	ts, runID := s.Dialect.Quote(c.Timestamp), s.Dialect.Quote(c.RunID)
+	query := fmt.Sprintf(`SELECT %[2]s, min(%[3]s), max(%[3]s) FROM %[1]s
+WHERE %[2]s = (SELECT %[2]s FROM %[1]s ORDER BY %[3]s DESC%[4]s) GROUP BY %[2]s`, table, runID, ts, s.Dialect.Limit(1))
+	var r Run
+	var started, finished sqlutil.Time
+	err := s.DB.QueryRowContext(ctx, query).Scan(&r.ID, &started, &finished)
+	r.Started, r.Finished = started.Time, finished.Time
+	if err == sql.ErrNoRows {
+		return Run{}, false, nil
+	}
+	if err != nil {
+		return Run{}, false, err
+	}
+	query = fmt.Sprintf("SELECT %[1]s, count(*) FROM %[2]s WHERE %[3]s = %[4]s GROUP BY %[1]s",
+		s.Dialect.Quote(c.Status), table, runID, s.Dialect.Param(1))
+	r.Counts, err = s.counts(ctx, query, r.ID)
+	return r, true, err
+}
+
+// LastSuccess returns when an invoice was last pushed, the zero time when
+// none was
+func (s *Store) LastSuccess(ctx context.Context) (time.Time, error) {
+	c := s.Config.Columns
+	query := fmt.Sprintf("SELECT max(%s) FROM %s WHERE %s = %s", s.Dialect.Quote(c.Timestamp),
+		s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Quote(c.Status), s.Dialect.Param(1))
+	var last sqlutil.Time
+	err := s.DB.QueryRowContext(ctx, query, StatusSuccess).Scan(&last)
+	return last.Time, err
+}
+
+// History returns the last limit results of invoice, newest first
+func (s *Store) History(ctx context.Context, invoice string, limit int) ([]Result, error) {
+	c := s.Config.Columns
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s ORDER BY %s DESC%s",
+		s.quoteColumns(c.Invoice, c.Status, c.HTTPCode, c.Reason, c.Timestamp), s.Dialect.QuoteQualified(s.Config.Table),
+		s.Dialect.Quote(c.Invoice), s.Dialect.Param(1), s.Dialect.Quote(c.Timestamp), s.Dialect.Limit(limit))
+	rows, err := s.DB.QueryContext(ctx, query, invoice)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []Result
+	for rows.Next() {
+		var r Result
+		var code sql.NullInt64
+		var reason sql.NullString
+		var at sqlutil.Time
+		if err := rows.Scan(&r.Invoice, &r.Status, &code, &reason, &at); err != nil {
+			return nil, err
+		}
+		r.HTTPCode, r.Reason, r.At = int(code.Int64), reason.String, at.Time
+		history = append(history, r)
+	}
+	return history, rows.Err()
+}
+
+// Pushed returns which of invoices have a success result
+func (s *Store) Pushed(ctx context.Context, invoices []string) (map[string]bool, error) {
+	pushed := make(map[string]bool)
+	for _, chunk := range sqlutil.Chunks(invoices) {
+		if err := s.pushed(ctx, chunk, pushed); err != nil {
+			return nil, err
+		}
+	}
+	return pushed, nil
+}
+
+// Add those of invoices with a success result to pushed
+func (s *Store) pushed(ctx context.Context, invoices []string, pushed map[string]bool) error {
+	c := s.Config.Columns
+	in, args := s.Dialect.In(s.Dialect.Quote(c.Invoice), 2, invoices)
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM %s WHERE %s = %s AND %s", s.Dialect.Quote(c.Invoice),
+		s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Quote(c.Status), s.Dialect.Param(1), in)
+	rows, err := s.DB.QueryContext(ctx, query, append([]interface{}{StatusSuccess}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var invoice string
+		if err := rows.Scan(&invoice); err != nil {
+			return err
+		}
+		pushed[invoice] = true
+	}
+	return rows.Err()
+}
+
+func (s *Store) counts(ctx context.Context, query string, arg interface{}) (Counts, error) {
+	var counts Counts
+	rows, err := s.DB.QueryContext(ctx, query, arg)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return counts, err
+		}
+		switch status {
+		case StatusSuccess:
+			counts.Success = n
+		case StatusFailed:
+			counts.Failed = n
+		case StatusParked:
+			counts.Parked = n
+		case StatusReview:
+			counts.Review = n
+		case StatusRejected:
+			counts.Rejected = n
+		}
+	}
+	return counts, rows.Err()
+}
+
+// Migrate creates the results table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	c, d := s.Config.Columns, s.Dialect
+	query := d.CreateTable(d.QuoteQualified(s.Config.Table),
+		"id "+d.Type(sqlutil.Serial),
+		d.Quote(c.Invoice)+" "+d.Type(sqlutil.String),
+		d.Quote(c.Status)+" "+d.Type(sqlutil.String),
+		d.Quote(c.HTTPCode)+" "+d.Type(sqlutil.Integer),
+		d.Quote(c.Reason)+" "+d.Type(sqlutil.Text),
+		d.Quote(c.Timestamp)+" "+d.Type(sqlutil.Timestamp),
+		d.Quote(c.RunID)+" "+d.Type(sqlutil.String),
+		d.Quote(c.APIVersion)+" "+d.Type(sqlutil.String))
+	_, err := s.DB.ExecContext(ctx, query)
+	return err
+}
+
+func (s *Store) quoteColumns(names ...string) string {
+	for i, n := range names {
+		names[i] = s.Dialect.Quote(n)
+	}
+	return strings.Join(names, ", ")
+}
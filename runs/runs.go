@@ -0,0 +1,97 @@
+// Package runs records every run in a table, an auditable history of the
+// synchronization that can be queried with SQL.
+package runs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Run is one row of the runs table
+type Run struct {
+	ID          string
+	Started     time.Time
+	Finished    time.Time
+	TriggeredBy string
+	Fetched     int
+	Pushed      int
+	Failed      int
+	Parked      int
+	Review      int
+	Skipped     int
+	Retried     int
+	Error       string
+}
+
+// Store writes runs into the runs table
+type Store struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Config  config.RunsConfig
+	// The trx-push version and host recorded with every run
+	Version string
+	Host    string
+}
+
+func NewStore(db *sql.DB, dialect sqlutil.Dialect, cfg config.RunsConfig, version string) *Store {
+	host, _ := os.Hostname()
+	return &Store{DB: db, Dialect: dialect, Config: cfg, Version: version, Host: host}
+}
+
+// Reload picks up the table of cfg.Runs for the next run
+func (s *Store) Reload(cfg *config.Config) {
+	s.Config = cfg.Runs
+}
+
+var columns = []string{"run_id", "started_at", "finished_at", "triggered_by", "version", "host",
+	"fetched", "pushed", "failed", "parked", "review", "skipped", "retried", "error_message"}
+
+// Record adds r to the table
+func (s *Store) Record(ctx context.Context, r Run) error {
+	params := make([]string, len(columns))
+	for i := range params {
+		params[i] = s.Dialect.Param(i + 1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", s.Dialect.QuoteQualified(s.Config.Table),
+		strings.Join(columns, ", "), strings.Join(params, ", "))
+	_, err := s.DB.ExecContext(ctx, query, r.ID, r.Started, r.Finished, r.TriggeredBy, s.Version, s.Host,
+		r.Fetched, r.Pushed, r.Failed, r.Parked, r.Review, r.Skipped, r.Retried, r.Error)
+	return err
+}
+
+// Prune deletes the runs started before cutoff and returns how many
+func (s *Store) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE started_at < %s", s.Dialect.QuoteQualified(s.Config.Table), s.Dialect.Param(1))
+	res, err := s.DB.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Migrate creates the runs table if it does not exist yet
+func (s *Store) Migrate(ctx context.Context) error {
+	d := s.Dialect
+	cols := []string{
+		"run_id " + d.Type(sqlutil.String) + " PRIMARY KEY",
+		"started_at " + d.Type(sqlutil.Timestamp),
+		"finished_at " + d.Type(sqlutil.Timestamp),
+		"triggered_by " + d.Type(sqlutil.String),
+		"version " + d.Type(sqlutil.String),
+		"host " + d.Type(sqlutil.String),
+	}
+	for _, c := range columns[6:13] {
+		cols = append(cols, c+" "+d.Type(sqlutil.Integer))
+	}
+	cols = append(cols, "error_message "+d.Type(sqlutil.Text))
+	_, err := s.DB.ExecContext(ctx, d.CreateTable(d.QuoteQualified(s.Config.Table), cols...))
+	return err
+}
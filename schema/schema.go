@@ -0,0 +1,160 @@
+// Package schema creates and upgrades the tables trx-push keeps its own
+// records in. Every table has numbered migrations, applied in order and
+// recorded in a migrations table, so running them again only applies the
+// new ones.
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Migration is one step in the history of a table
+type Migration struct {
+	// As configured, e.g. trx_push_runs
+	Table string
+	// From 1, in the order the steps are applied
+	Version     int
+	Description string
+	Up          func(ctx context.Context) error
+}
+
+// Applied is a migration recorded in the migrations table
+type Applied struct {
+	Table       string
+	Version     int
+	Description string
+	At          time.Time
+}
+
+// Migrator applies migrations and records them in Table
+type Migrator struct {
+	DB      *sql.DB
+	Dialect sqlutil.Dialect
+	Table   string
+}
+
+func NewMigrator(db *sql.DB, dialect sqlutil.Dialect, table string) *Migrator {
+	return &Migrator{DB: db, Dialect: dialect, Table: table}
+}
+
+// Init creates the migrations table if it does not exist yet
+func (m *Migrator) Init(ctx context.Context) error {
+	d := m.Dialect
+	_, err := m.DB.ExecContext(ctx, d.CreateTable(d.QuoteQualified(m.Table),
+		"table_name "+d.Type(sqlutil.String),
+		"version "+d.Type(sqlutil.Integer),
+		"description "+d.Type(sqlutil.Text),
+		"applied_at "+d.Type(sqlutil.Timestamp),
+		"PRIMARY KEY (table_name, version)"))
+	return err
+}
+
+// Applied returns the recorded migrations, by table and version
+func (m *Migrator) Applied(ctx context.Context) ([]Applied, error) {
+	rows, err := m.DB.QueryContext(ctx, fmt.Sprintf("SELECT table_name, version, description, applied_at FROM %s ORDER BY table_name, version",
+		m.Dialect.QuoteQualified(m.Table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var applied []Applied
+	for rows.Next() {
+		var a Applied
+		// Oracle returns empty text as NULL
+		var description sql.NullString
+		var at sqlutil.Time
+		if err := rows.Scan(&a.Table, &a.Version, &description, &at); err != nil {
+			return nil, err
+		}
+		a.Description, a.At = description.String, at.Time
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// Pending returns the migrations not applied yet, in the order of
+// migrations
+func (m *Migrator) Pending(ctx context.Context, migrations []Migration) ([]Migration, error) {
+	applied, err := m.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int)
+	for _, a := range applied {
+		latest[a.Table] = max(latest[a.Table], a.Version)
+	}
+	var pending []Migration
+	for _, mg := range migrations {
+		if mg.Version > latest[mg.Table] {
+			pending = append(pending, mg)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations, recording each once it succeeds,
+// and returns the ones applied. It stops at the first failing one.
+func (m *Migrator) Migrate(ctx context.Context, migrations []Migration) ([]Migration, error) {
+	if err := m.Init(ctx); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", m.Table, err)
+	}
+	pending, err := m.Pending(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+	d := m.Dialect
+	insert := fmt.Sprintf("INSERT INTO %s (table_name, version, description, applied_at) VALUES (%s, %s, %s, %s)",
+		d.QuoteQualified(m.Table), d.Param(1), d.Param(2), d.Param(3), d.Param(4))
+	for i, mg := range pending {
+		if err := mg.Up(ctx); err != nil {
+			return pending[:i], fmt.Errorf("migration %d of %s (%s) failed: %v", mg.Version, mg.Table, mg.Description, err)
+		}
+		if _, err := m.DB.ExecContext(ctx, insert, mg.Table, mg.Version, mg.Description, time.Now()); err != nil {
+			return pending[:i], fmt.Errorf("failed to record migration %d of %s: %v", mg.Version, mg.Table, err)
+		}
+	}
+	return pending, nil
+}
+
+// Columns returns the names of the columns of table, as the database
+// reports them; Oracle upper-cases them
+func Columns(ctx context.Context, db *sql.DB, d sqlutil.Dialect, table string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", d.QuoteQualified(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// HasColumn tells whether table has column, for migrations adding columns
+// to tables that may have been created with them. Selecting the column
+// itself would not do, as SQLite takes an unknown quoted name for a string.
+func HasColumn(ctx context.Context, db *sql.DB, d sqlutil.Dialect, table, column string) (bool, error) {
+	columns, err := Columns(ctx, db, d, table)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c, column) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddColumn adds column with the definition def to table, unless it is
+// there already
+func AddColumn(ctx context.Context, db *sql.DB, d sqlutil.Dialect, table, column, def string) error {
+	if ok, err := HasColumn(ctx, db, d, table, column); ok || err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD %s %s", d.QuoteQualified(table), d.Quote(column), def))
+	return err
+}
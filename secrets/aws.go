@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/purwaren/trx-push/config"
+)
+
+// Config values referencing AWS secrets:
+//
+//	aws-sm:<secret name or ARN>[#<json key>]
+//	aws-ssm:<parameter name>
+//	aws-kms:<key ID, ARN or alias>, the PEM public key of an asymmetric key
+const (
+	awsSecretPrefix = "aws-sm:"
+	awsParamPrefix  = "aws-ssm:"
+	awsKMSPrefix    = "aws-kms:"
+)
+
+func isAWSRef(s string) bool {
+	return strings.HasPrefix(s, awsSecretPrefix) || strings.HasPrefix(s, awsParamPrefix) || strings.HasPrefix(s, awsKMSPrefix)
+}
+
+// ResolveAWS replaces aws-sm:, aws-ssm: and aws-kms: references in config
+// values with the secret from Secrets Manager, the decrypted SSM parameter
+// or the public key of the KMS key. Nothing is loaded when the config has
+// no such references.
+func ResolveAWS(ctx context.Context, cfg *config.Config) error {
+	found := false
+	cfg.RewriteStrings(func(_, s string) (string, error) {
+		found = found || isAWSRef(s)
+		return s, nil
+	})
+	if !found {
+		return nil
+	}
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Secrets.AWSRegion != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Secrets.AWSRegion))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	r := &awsResolver{
+		sm:    secretsmanager.NewFromConfig(awsCfg),
+		ssm:   ssm.NewFromConfig(awsCfg),
+		kms:   kms.NewFromConfig(awsCfg),
+		cache: make(map[string]string),
+	}
+	return cfg.RewriteStrings(func(_, s string) (string, error) {
+		if !isAWSRef(s) {
+			return s, nil
+		}
+		return r.resolve(ctx, s)
+	})
+}
+
+type awsResolver struct {
+	sm  *secretsmanager.Client
+	ssm *ssm.Client
+	kms *kms.Client
+	// Secret strings by ID, so one JSON secret serves several keys
+	cache map[string]string
+}
+
+func (r *awsResolver) resolve(ctx context.Context, ref string) (string, error) {
+	if id, ok := strings.CutPrefix(ref, awsKMSPrefix); ok {
+		out, err := r.kms.GetPublicKey(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(id)})
+		if err != nil {
+			return "", fmt.Errorf("failed to read the public key of KMS key %s: %v", id, err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: out.PublicKey})), nil
+	}
+	if name, ok := strings.CutPrefix(ref, awsParamPrefix); ok {
+		out, err := r.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to read SSM parameter %s: %v", name, err)
+		}
+		return aws.ToString(out.Parameter.Value), nil
+	}
+
+	id, key, _ := strings.Cut(strings.TrimPrefix(ref, awsSecretPrefix), "#")
+	secret, ok := r.cache[id]
+	if !ok {
+		out, err := r.sm.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret %s: %v", id, err)
+		}
+		secret = aws.ToString(out.SecretString)
+		r.cache[id] = secret
+	}
+	if key == "" {
+		return secret, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, cannot select %q", id, key)
+	}
+	v, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", id, key)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/zalando/go-keyring"
+)
+
+// Config values referencing the OS keyring (Keychain on macOS, the
+// Credential Manager on Windows, the Secret Service on Linux):
+//
+//	keyring:<name>
+const keyringPrefix = "keyring:"
+
+func isKeyringRef(s string) bool {
+	return strings.HasPrefix(s, keyringPrefix)
+}
+
+// ResolveKeyring replaces keyring: references in config values with the
+// secrets stored under secrets.keyring_service, as by trx-push secret set
+func ResolveKeyring(cfg *config.Config) error {
+	return cfg.RewriteStrings(func(_, s string) (string, error) {
+		name, ok := strings.CutPrefix(s, keyringPrefix)
+		if !ok {
+			return s, nil
+		}
+		return GetKeyring(cfg.Secrets.KeyringService, name)
+	})
+}
+
+// GetKeyring reads the secret stored as name for service
+func GetKeyring(service, name string) (string, error) {
+	v, err := keyring.Get(service, name)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return "", fmt.Errorf("keyring has no secret %q for service %q, store it with trx-push secret set", name, service)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %q from the keyring: %v%s", name, err, keyringHint())
+	}
+	return v, nil
+}
+
+// SetKeyring stores value as name for service, replacing any stored before
+func SetKeyring(service, name, value string) error {
+	if err := keyring.Set(service, name, value); err != nil {
+		return fmt.Errorf("failed to store secret %q in the keyring: %v%s", name, err, keyringHint())
+	}
+	return nil
+}
+
+// DeleteKeyring removes the secret stored as name for service
+func DeleteKeyring(service, name string) error {
+	err := keyring.Delete(service, name)
+	if errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("keyring has no secret %q for service %q", name, service)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete secret %q from the keyring: %v%s", name, err, keyringHint())
+	}
+	return nil
+}
+
+// Linux servers often run without the session bus the Secret Service is on
+func keyringHint() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	return " (the keyring needs a Secret Service such as gnome-keyring on the session D-Bus)"
+}
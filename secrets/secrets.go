@@ -0,0 +1,44 @@
+// Package secrets loads credentials from an external secret store into the
+// config.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Provider reads the key/value pairs of the configured secret
+type Provider interface {
+	// Fetch returns the secret and how long it stays valid (0 when the
+	// store does not say)
+	Fetch(ctx context.Context) (map[string]string, time.Duration, error)
+}
+
+// New returns the provider for secrets.backend, nil when none is set
+func New(cfg config.SecretsConfig, client *http.Client) (Provider, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "vault":
+		return NewVault(cfg.Vault, client), nil
+	}
+	return nil, fmt.Errorf("unknown secrets backend %q", cfg.Backend)
+}
+
+// Apply sets each config key in keys to the secret value it maps to
+func Apply(cfg *config.Config, keys, values map[string]string) error {
+	for key, name := range keys {
+		v, ok := values[name]
+		if !ok {
+			return fmt.Errorf("secret has no %q for %s", name, key)
+		}
+		if err := cfg.Set(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Vault reads a KV secret over the Vault HTTP API, authenticating with a
+// static token or an AppRole
+type Vault struct {
+	Config config.VaultConfig
+	Client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	tokenTTL time.Duration
+	loggedIn time.Time
+}
+
+func NewVault(cfg config.VaultConfig, client *http.Client) *Vault {
+	return &Vault{Config: cfg, Client: client, token: cfg.Token}
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	Data          json.RawMessage `json:"data"`
+	LeaseDuration int             `json:"lease_duration"`
+	Auth          *vaultAuth      `json:"auth"`
+	Errors        []string        `json:"errors"`
+}
+
+// Fetch the secret, logging in or renewing the token first when needed.
+// The returned lifetime is the secret's lease, or the token's when the
+// secret has none (KV v2 secrets never do).
+func (v *Vault) Fetch(ctx context.Context) (map[string]string, time.Duration, error) {
+	if err := v.authenticate(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	path := fmt.Sprintf("%s/%s", v.Config.Mount, strings.TrimPrefix(v.Config.Path, "/"))
+	if v.Config.KVVersion == 2 {
+		path = fmt.Sprintf("%s/data/%s", v.Config.Mount, strings.TrimPrefix(v.Config.Path, "/"))
+	}
+	resp, err := v.do(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read vault secret %s: %v", path, err)
+	}
+
+	data := resp.Data
+	if v.Config.KVVersion == 2 {
+		var kv struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(resp.Data, &kv); err != nil {
+			return nil, 0, err
+		}
+		data = kv.Data
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, fmt.Errorf("unexpected vault secret format: %v", err)
+	}
+	values := make(map[string]string, len(raw))
+	for k, val := range raw {
+		values[k] = fmt.Sprint(val)
+	}
+
+	ttl := time.Duration(resp.LeaseDuration) * time.Second
+	if ttl == 0 {
+		v.mu.Lock()
+		ttl = v.tokenTTL
+		v.mu.Unlock()
+	}
+	return values, ttl, nil
+}
+
+// Log in with the AppRole when there is no token yet, or renew the token
+// once two thirds of its TTL have passed
+func (v *Vault) authenticate(ctx context.Context) error {
+	v.mu.Lock()
+	token, ttl, since := v.token, v.tokenTTL, time.Since(v.loggedIn)
+	v.mu.Unlock()
+
+	switch {
+	case v.Config.Auth == "approle" && (token == "" || (ttl > 0 && since > ttl*2/3)):
+		body, _ := json.Marshal(map[string]string{"role_id": v.Config.RoleID, "secret_id": v.Config.SecretID})
+		resp, err := v.do(ctx, "POST", "auth/approle/login", body)
+		if err != nil {
+			return fmt.Errorf("vault approle login failed: %v", err)
+		}
+		return v.setAuth(resp.Auth)
+	case token == "":
+		return fmt.Errorf("no vault token configured")
+	case ttl > 0 && since > ttl*2/3:
+		resp, err := v.do(ctx, "POST", "auth/token/renew-self", nil)
+		if err != nil {
+			return fmt.Errorf("vault token renewal failed: %v", err)
+		}
+		return v.setAuth(resp.Auth)
+	case v.loggedIn.IsZero():
+		// Learn the TTL of a static token so it is renewed in time
+		resp, err := v.do(ctx, "GET", "auth/token/lookup-self", nil)
+		if err != nil {
+			return fmt.Errorf("vault token lookup failed: %v", err)
+		}
+		var data struct {
+			TTL int `json:"ttl"`
+		}
+		json.Unmarshal(resp.Data, &data)
+		v.mu.Lock()
+		v.tokenTTL = time.Duration(data.TTL) * time.Second
+		v.loggedIn = time.Now()
+		v.mu.Unlock()
+	}
+	return nil
+}
+
+func (v *Vault) setAuth(a *vaultAuth) error {
+	if a == nil || a.ClientToken == "" {
+		return fmt.Errorf("vault returned no client token")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.token = a.ClientToken
+	v.tokenTTL = time.Duration(a.LeaseDuration) * time.Second
+	v.loggedIn = time.Now()
+	return nil
+}
+
+func (v *Vault) do(ctx context.Context, method, path string, body []byte) (*vaultResponse, error) {
+	url := strings.TrimSuffix(v.Config.Address, "/") + "/v1/" + path
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	v.mu.Unlock()
+	if v.Config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Config.Namespace)
+	}
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var out vaultResponse
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &out); err != nil {
+			return nil, fmt.Errorf("status %d: %v", resp.StatusCode, err)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(out.Errors) > 0 {
+			return nil, fmt.Errorf("status %d: %s", resp.StatusCode, strings.Join(out.Errors, "; "))
+		}
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return &out, nil
+}
@@ -0,0 +1,55 @@
+package secrets
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// Minimum wait between re-reads, so a very short lease cannot cause a busy
+// loop
+const minRefresh = 10 * time.Second
+
+// Watch re-reads the secret at two thirds of its lifetime (or every
+// interval when it has none) and calls update with the new values whenever
+// they change, until ctx is cancelled. Failed reads are retried after
+// minRefresh.
+func Watch(ctx context.Context, p Provider, current map[string]string, ttl, interval time.Duration, update func(map[string]string)) {
+	failed := false
+	for {
+		wait := interval
+		switch {
+		case failed:
+			wait = minRefresh
+		case ttl > 0:
+			wait = ttl * 2 / 3
+		}
+		if wait <= 0 {
+			return
+		}
+		if wait < minRefresh {
+			wait = minRefresh
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		values, newTTL, err := p.Fetch(ctx)
+		if failed = err != nil; failed {
+			slog.Warn("Failed to refresh secrets", "error", err)
+			continue
+		}
+		ttl = newTTL
+		if !reflect.DeepEqual(values, current) {
+			slog.Info("Secrets changed, updating credentials")
+			current = values
+			update(values)
+		}
+	}
+}
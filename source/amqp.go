@@ -0,0 +1,139 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AMQP consumes pending invoices from a queue, such as a RabbitMQ one. A
+// message is acked once its invoice was pushed; on failure it is nacked
+// and either requeued or, per on_failure, rejected to the queue's
+// dead-letter exchange, so redelivery is left to the broker. The
+// connection is opened on the first fetch and again after it was lost.
+type AMQP struct {
+	Config config.AMQPSourceConfig
+
+	mu         sync.Mutex
+	conn       *amqp.Connection
+	deliveries <-chan amqp.Delivery
+}
+
+func NewAMQP(cfg config.AMQPSourceConfig) *AMQP {
+	return &AMQP{Config: cfg}
+}
+
+// Fetch returns up to batch_size messages, waiting at most max_wait for them
+func (a *AMQP) Fetch(ctx context.Context) ([]Transaction, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect to the AMQP broker: %v", err)
+	}
+
+	wait := time.NewTimer(a.Config.MaxWait)
+	defer wait.Stop()
+	var batch []Transaction
+	for len(batch) < a.Config.BatchSize {
+		select {
+		case <-ctx.Done():
+			// Unacked messages go back to the queue with the channel
+			return nil, ctx.Err()
+		case <-wait.C:
+			return batch, nil
+		case d, ok := <-a.deliveries:
+			if !ok {
+				a.close()
+				return nil, errors.New("AMQP channel closed, reconnecting on the next fetch")
+			}
+			txn, err := decodeMessage(d.Body, a.Config.Message)
+			if err != nil {
+				slog.Warn("Rejecting AMQP message", "delivery_tag", d.DeliveryTag, "error", err)
+				if err := d.Nack(false, false); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			txn.handle = d
+			batch = append(batch, txn)
+		}
+	}
+	return batch, nil
+}
+
+// Ack acks the message of txn
+func (a *AMQP) Ack(ctx context.Context, txn Transaction) error {
+	d, ok := txn.handle.(amqp.Delivery)
+	if !ok {
+		return nil
+	}
+	return d.Ack(false)
+}
+
+// Nack nacks the message of txn, requeueing it when the failure was not
+// permanent and on_failure is requeue
+func (a *AMQP) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	d, ok := txn.handle.(amqp.Delivery)
+	if !ok {
+		return nil
+	}
+	return d.Nack(false, requeue && a.Config.OnFailure == "requeue")
+}
+
+// Skip rejects the message of a transaction that will not be pushed
+func (a *AMQP) Skip(ctx context.Context, txn Transaction) error {
+	return a.Nack(ctx, txn, false)
+}
+
+func (a *AMQP) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.close()
+}
+
+// Open the connection and start consuming, unless already consuming
+func (a *AMQP) connect() error {
+	if a.conn != nil && !a.conn.IsClosed() {
+		return nil
+	}
+	conn, err := amqp.DialConfig(a.Config.URL, amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Dial:      amqp.DefaultDial(a.Config.DialTimeout),
+	})
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Qos(a.Config.Prefetch, 0, false)
+	}
+	var deliveries <-chan amqp.Delivery
+	if err == nil {
+		deliveries, err = ch.Consume(a.Config.Queue, a.Config.ConsumerTag, false, false, false, false, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	a.conn, a.deliveries = conn, deliveries
+	slog.Info("Consuming from AMQP queue", "queue", a.Config.Queue)
+	return nil
+}
+
+func (a *AMQP) close() error {
+	if a.conn == nil {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn, a.deliveries = nil, nil
+	if errors.Is(err, amqp.ErrClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Turn a page selection into a statement claiming the page: rows locked by
+// another instance's claim are skipped, rows claimed longer than claim.ttl
+// ago are taken over. The claimed rows are returned ordered like the page.
+// Postgres only, see claimLocked for the other drivers.
+func (db *Database) claimQuery(s selection) (string, []interface{}) {
+	c := db.Claim
+	id := db.Dialect.Quote(db.Query.IDColumn)
+	by, at := db.Dialect.Quote(c.ClaimedByColumn), db.Dialect.Quote(c.ClaimedAtColumn)
+
+	returning := s.columns
+	s.columns = id
+	s.and(fmt.Sprintf("(%s IS NULL OR %s < now() - $?::interval)", at, at), fmt.Sprintf("%d milliseconds", c.TTL.Milliseconds()))
+	s.args = append(s.args, db.instance())
+
+	query := fmt.Sprintf(`WITH claimed AS (
+	UPDATE %s SET %s = $%d, %s = now()
+	WHERE %s IN (%s FOR UPDATE SKIP LOCKED)
+	RETURNING %s
+) SELECT * FROM claimed ORDER BY %s`, s.table, by, len(s.args), at, id, s.sql(), returning, id)
+	return query, s.args
+}
+
+// Claim a page on MySQL and SQL Server, which cannot update and return the
+// locked rows in one statement: the page is locked skipping rows locked by
+// other instances (FOR UPDATE SKIP LOCKED, or READPAST), claimed and read
+// back in one transaction. Config validation rejects claim mode on the
+// other drivers.
+func (db *Database) claimLocked(ctx context.Context, s selection) ([]Transaction, error) {
+	c, d := db.Claim, db.Dialect
+	id, table := d.Quote(db.Query.IDColumn), s.table
+	by, at := d.Quote(c.ClaimedByColumn), d.Quote(c.ClaimedAtColumn)
+
+	columns := s.columns
+	s.columns = id
+	if d == sqlutil.SQLServer {
+		s.table += " WITH (UPDLOCK, ROWLOCK, READPAST)"
+		s.and(fmt.Sprintf("(%s IS NULL OR %s < DATEADD(millisecond, -$?, %s))", at, at, d.Now()), c.TTL.Milliseconds())
+	} else {
+		s.and(fmt.Sprintf("(%s IS NULL OR %s < %s - INTERVAL $? MICROSECOND)", at, at, d.Now()), c.TTL.Microseconds())
+	}
+	lock := s.sql()
+	if d == sqlutil.MySQL {
+		lock += " FOR UPDATE SKIP LOCKED"
+	}
+
+	tx, err := db.Write.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, lock, s.args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, number)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, tx.Commit()
+	}
+
+	in, args := d.In(id, 2, ids)
+	update := fmt.Sprintf("UPDATE %s SET %s = %s, %s = %s WHERE %s", table, by, d.Param(1), at, d.Now(), in)
+	if _, err := tx.ExecContext(ctx, update, append([]interface{}{db.instance()}, args...)...); err != nil {
+		return nil, err
+	}
+	in, args = d.In(id, 1, ids)
+	rows, err = tx.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s", columns, table, in, id), args...)
+	if err != nil {
+		return nil, err
+	}
+	transactions, err := db.scan(rows)
+	if err != nil {
+		return nil, err
+	}
+	return transactions, tx.Commit()
+}
+
+// Release clears this instance's claim on an invoice that was not pushed,
+// so the next cycle (or another instance) picks it up without waiting for
+// claim.ttl
+func (db *Database) Release(ctx context.Context, invoiceID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if !db.Claim.Enabled {
+		return nil
+	}
+	by := db.Dialect.Quote(db.Claim.ClaimedByColumn)
+	query := fmt.Sprintf("UPDATE %s SET %s = NULL, %s = NULL WHERE %s = %s AND %s = %s",
+		db.Dialect.QuoteQualified(db.Query.Table), by, db.Dialect.Quote(db.Claim.ClaimedAtColumn),
+		db.Dialect.Quote(db.Query.IDColumn), db.Dialect.Param(1), by, db.Dialect.Param(2))
+	_, err := db.Write.ExecContext(ctx, query, invoiceID, db.instance())
+	return err
+}
+
+func (db *Database) instance() string {
+	if db.Claim.Instance != "" {
+		return db.Claim.Instance
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,59 @@
+package source
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+func TestClaimQuery(t *testing.T) {
+	claim := config.ClaimConfig{ClaimedByColumn: "claimed_by", ClaimedAtColumn: "claimed_at", TTL: 5 * time.Minute, Instance: "pos-1"}
+	tests := []struct {
+		name  string
+		query config.QueryConfig
+		group string
+		after string
+		limit int
+		want  string
+		args  []interface{}
+	}{
+		{
+			name:  "status",
+			query: config.QueryConfig{Table: "pos.invoice", IDColumn: "number", StatusColumn: "status", PendingStatus: "1"},
+			want: `WITH claimed AS (
+	UPDATE "pos"."invoice" SET "claimed_by" = $3, "claimed_at" = now()
+	WHERE "number" IN (SELECT "number" FROM "pos"."invoice" WHERE "status" = $1 AND ("claimed_at" IS NULL OR "claimed_at" < now() - $2::interval) FOR UPDATE SKIP LOCKED)
+	RETURNING "number"
+) SELECT * FROM claimed ORDER BY "number"`,
+			args: []interface{}{"1", "300000 milliseconds", "pos-1"},
+		},
+		{
+			name:  "page with group",
+			query: config.QueryConfig{Table: "invoice", IDColumn: "number", Where: "status = 1"},
+			group: "customer",
+			after: "INV-9",
+			limit: 50,
+			want: `WITH claimed AS (
+	UPDATE "invoice" SET "claimed_by" = $3, "claimed_at" = now()
+	WHERE "number" IN (SELECT "number" FROM "invoice" WHERE (status = 1) AND "number" IS NOT NULL AND "number" > $1 AND ("claimed_at" IS NULL OR "claimed_at" < now() - $2::interval) ORDER BY "number" LIMIT 50 FOR UPDATE SKIP LOCKED)
+	RETURNING "number", "customer"
+) SELECT * FROM claimed ORDER BY "number"`,
+			args: []interface{}{"INV-9", "300000 milliseconds", "pos-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &Database{Dialect: sqlutil.Postgres, Query: tt.query, Claim: claim, GroupColumn: tt.group}
+			query, args := db.claimQuery(db.selectQuery(tt.after, tt.limit))
+			if query != tt.want {
+				t.Errorf("query:\n%s\nwant:\n%s", query, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package source
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/purwaren/trx-push/config"
+	go_ora "github.com/sijms/go-ora/v2"
+	"modernc.org/sqlite"
+)
+
+// connector builds the DSN for every new connection, so rotated
+// credentials take effect without reopening the pool. Open connections
+// keep working until they are recycled. Postgres connections come from a
+// pgxpool, which holds them while database/sql keeps none idle.
+type connector struct {
+	mu   sync.Mutex
+	db   config.DatabaseConfig
+	pool *pgxpool.Pool
+	pg   driver.Connector
+}
+
+func newConnector(db config.DatabaseConfig) (*connector, error) {
+	c := &connector{db: db}
+	if db.Driver != "postgres" {
+		return c, nil
+	}
+	pc, err := pgxpool.ParseConfig(DSN(db))
+	if err != nil {
+		return nil, err
+	}
+	if db.MaxConns > 0 {
+		pc.MaxConns = int32(db.MaxConns)
+	}
+	if db.MaxConnLifetime > 0 {
+		pc.MaxConnLifetime = db.MaxConnLifetime
+	}
+	if db.MaxConnIdleTime > 0 {
+		pc.MaxConnIdleTime = db.MaxConnIdleTime
+	}
+	setExecMode(pc.ConnConfig, db)
+	pc.BeforeConnect = c.beforeConnect
+	// No connection is made until the first one is needed
+	if c.pool, err = pgxpool.NewWithConfig(context.Background(), pc); err != nil {
+		return nil, err
+	}
+	c.pg = stdlib.GetPoolConnector(c.pool)
+	return c, nil
+}
+
+// Have the pool connect with the current settings
+func (c *connector) beforeConnect(_ context.Context, cc *pgx.ConnConfig) error {
+	c.mu.Lock()
+	db := c.db
+	c.mu.Unlock()
+	fresh, err := pgx.ParseConfig(DSN(db))
+	if err != nil {
+		return err
+	}
+	setExecMode(fresh, db)
+	*cc = *fresh
+	return nil
+}
+
+// setExecMode applies query_exec_mode and statement_cache_capacity
+func setExecMode(cc *pgx.ConnConfig, db config.DatabaseConfig) {
+	switch db.QueryExecMode {
+	case "cache_describe":
+		cc.DefaultQueryExecMode = pgx.QueryExecModeCacheDescribe
+	case "describe_exec":
+		cc.DefaultQueryExecMode = pgx.QueryExecModeDescribeExec
+	case "exec":
+		cc.DefaultQueryExecMode = pgx.QueryExecModeExec
+	case "simple_protocol":
+		cc.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	default:
+		cc.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+	}
+	if db.StatementCacheCapacity > 0 {
+		cc.StatementCacheCapacity = db.StatementCacheCapacity
+		cc.DescriptionCacheCapacity = db.StatementCacheCapacity
+	}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	db := c.db
+	c.mu.Unlock()
+	switch db.Driver {
+	case "mysql":
+		mc, err := mysql.NewConnector(mysqlConfig(db))
+		if err != nil {
+			return nil, err
+		}
+		return mc.Connect(ctx)
+	case "sqlite":
+		return (&sqlite.Driver{}).Open(sqliteDSN(db))
+	case "mssql":
+		mc, err := mssql.NewConnector(sqlServerDSN(db))
+		if err != nil {
+			return nil, err
+		}
+		return mc.Connect(ctx)
+	case "oracle":
+		return go_ora.NewConnector(oracleDSN(db)).Connect(ctx)
+	}
+	return c.pg.Connect(ctx)
+}
+
+func (c *connector) Driver() driver.Driver {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.db.Driver {
+	case "mysql":
+		return &mysql.MySQLDriver{}
+	case "sqlite":
+		return &sqlite.Driver{}
+	case "mssql":
+		return &mssql.Driver{}
+	case "oracle":
+		return &go_ora.OracleDriver{}
+	}
+	return stdlib.GetDefaultDriver()
+}
+
+func (c *connector) set(db config.DatabaseConfig) {
+	c.mu.Lock()
+	c.db = db
+	c.mu.Unlock()
+}
+
+// Close the connections of the pgxpool, after those of database/sql
+func (c *connector) close() {
+	if c.pool != nil {
+		c.pool.Close()
+	}
+}
+
+// mysqlConfig maps the database settings onto go-sql-driver/mysql.
+// sslmode disable turns TLS off, require encrypts without verifying the
+// server certificate and verify-ca/verify-full verify it, as on Postgres.
+// statement_timeout becomes max_execution_time, which MySQL applies to
+// SELECT statements only.
+func mysqlConfig(db config.DatabaseConfig) *mysql.Config {
+	mc := mysql.NewConfig()
+	mc.Net = "tcp"
+	mc.Addr = net.JoinHostPort(db.Host, strconv.Itoa(db.Port))
+	mc.User, mc.Passwd, mc.DBName = db.User, db.Password, db.DBName
+	mc.ParseTime = true
+	switch db.SSLMode {
+	case "", "disable":
+	case "allow", "prefer":
+		mc.TLSConfig = "preferred"
+	case "verify-ca", "verify-full":
+		mc.TLSConfig = "true"
+	default:
+		mc.TLSConfig = "skip-verify"
+	}
+	if db.StatementTimeout > 0 {
+		mc.Params = map[string]string{"max_execution_time": fmt.Sprint(db.StatementTimeout.Milliseconds())}
+	}
+	return mc
+}
+
+// sqliteDSN opens database.file. Writers wait up to 5s for the POS
+// application's locks instead of failing right away, and times are stored
+// in a format SQLite's date functions and lexical comparison understand.
+// statement_timeout has no SQLite equivalent and is ignored.
+func sqliteDSN(db config.DatabaseConfig) string {
+	return "file:" + db.File + "?_pragma=busy_timeout(5000)&_time_format=sqlite"
+}
+
+// sqlServerDSN connects to the database named dbname. sslmode maps as for
+// MySQL: require encrypts and trusts any server certificate, verify-ca and
+// verify-full verify it. statement_timeout is not supported.
+func sqlServerDSN(db config.DatabaseConfig) string {
+	q := url.Values{"database": {db.DBName}}
+	switch db.SSLMode {
+	case "", "disable":
+		q.Set("encrypt", "disable")
+	case "verify-ca", "verify-full":
+		q.Set("encrypt", "true")
+	default:
+		q.Set("encrypt", "true")
+		q.Set("TrustServerCertificate", "true")
+	}
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(db.User, db.Password),
+		Host:     net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// oracleDSN connects to the service named dbname, over TLS unless sslmode
+// is disable or empty. statement_timeout is not supported.
+func oracleDSN(db config.DatabaseConfig) string {
+	options := map[string]string{}
+	switch db.SSLMode {
+	case "", "disable":
+	case "verify-ca", "verify-full":
+		options["SSL"] = "enable"
+	default:
+		options["SSL"] = "enable"
+		options["SSL Verify"] = "false"
+	}
+	return go_ora.BuildUrl(db.Host, db.Port, db.DBName, db.User, db.Password, options)
+}
@@ -0,0 +1,655 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+	"github.com/purwaren/trx-push/tracing"
+)
+
+// Database reads pending invoices from the invoice table, or the one
+// described by the query config. Reads go to the Read pool and writes to
+// the Write pool, which may be the same pool.
+type Database struct {
+	Read  *sql.DB
+	Write *sql.DB
+	// database.driver, which the generated statements are written for
+	Dialect sqlutil.Dialect
+	Query   config.QueryConfig
+	// Claim pages for this instance instead of only reading them
+	Claim config.ClaimConfig
+	// Select after the stored watermark
+	Watermark config.WatermarkConfig
+	// Optional column selected as Transaction.Group
+	GroupColumn  string
+	ParkedStatus int
+	ReviewStatus int
+	// validation.rejected_status
+	RejectedStatus int
+	// queue.status
+	QueuedStatus int
+	StatusUpdate config.StatusUpdateConfig
+	// Queries building the push payload of an invoice
+	Payload config.PayloadConfig
+	// Columns receiving fields of the push response
+	ResponseCapture config.CaptureConfig
+	// Table the rows of pushed invoices are moved to
+	History config.HistoryConfig
+	// Name of the shard this is, set on the transactions read
+	Shard string
+	// database.query_timeout
+	QueryTimeout time.Duration
+
+	writeConn, readConn *connector
+	successes           successes
+}
+
+// Open opens the primary pool and, when read_database is configured, a
+// separate read pool on the same driver. Connections are established
+// lazily on first use.
+func Open(cfg *config.Config) (*Database, error) {
+	db := &Database{
+		Dialect:         sqlutil.Dialect(cfg.Database.Driver),
+		Query:           cfg.Query,
+		Claim:           cfg.Claim,
+		Watermark:       cfg.Watermark,
+		GroupColumn:     cfg.Grouping.Column,
+		ParkedStatus:    cfg.Push.ParkedStatus,
+		ReviewStatus:    cfg.Push.ReviewStatus,
+		RejectedStatus:  cfg.Validation.RejectedStatus,
+		QueuedStatus:    cfg.Queue.Status,
+		StatusUpdate:    cfg.StatusUpdate,
+		Payload:         cfg.Payload,
+		ResponseCapture: cfg.Capture,
+		History:         cfg.History,
+		QueryTimeout:    cfg.Database.QueryTimeout,
+	}
+	var err error
+	if db.writeConn, err = newConnector(cfg.Database); err != nil {
+		return nil, err
+	}
+	db.Write = openDB(db.writeConn, cfg)
+	db.Read, db.readConn = db.Write, db.writeConn
+	if cfg.ReadDatabase.Configured() {
+		if db.readConn, err = newConnector(cfg.ReadDatabase); err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.Read = openDB(db.readConn, cfg)
+	}
+	return db, nil
+}
+
+func openDB(c *connector, cfg *config.Config) *sql.DB {
+	var db *sql.DB
+	if cfg.Tracing.Enabled {
+		db = tracing.OpenDB(c, c.db.Driver)
+	} else {
+		db = sql.OpenDB(c)
+	}
+	if c.pool != nil {
+		// The pgxpool keeps the idle connections and applies the limits
+		db.SetMaxIdleConns(0)
+		return db
+	}
+	if n := c.db.MaxConns; n > 0 {
+		db.SetMaxOpenConns(n)
+		db.SetMaxIdleConns(n)
+	}
+	db.SetConnMaxLifetime(c.db.MaxConnLifetime)
+	db.SetConnMaxIdleTime(c.db.MaxConnIdleTime)
+	return db
+}
+
+// Reload picks up the selection, claim, watermark, grouping column,
+// statuses, status updates, payload queries, captured fields, history and
+// query timeout of cfg, and its database credentials for new connections.
+func (db *Database) Reload(cfg *config.Config) {
+	db.Query = cfg.Query
+	db.Claim = cfg.Claim
+	db.Watermark = cfg.Watermark
+	db.GroupColumn = cfg.Grouping.Column
+	db.ParkedStatus = cfg.Push.ParkedStatus
+	db.ReviewStatus = cfg.Push.ReviewStatus
+	db.RejectedStatus = cfg.Validation.RejectedStatus
+	db.QueuedStatus = cfg.Queue.Status
+	db.StatusUpdate = cfg.StatusUpdate
+	db.Payload = cfg.Payload
+	db.ResponseCapture = cfg.Capture
+	db.History = cfg.History
+	db.QueryTimeout = cfg.Database.QueryTimeout
+	db.SetCredentials(cfg)
+}
+
+// Bound ctx by database.query_timeout
+func (db *Database) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.QueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
+// SetCredentials makes new connections use the database settings of cfg,
+// e.g. after a password rotation
+func (db *Database) SetCredentials(cfg *config.Config) {
+	db.writeConn.set(cfg.Database)
+	if db.readConn != db.writeConn {
+		db.readConn.set(cfg.ReadDatabase)
+	}
+}
+
+func (db *Database) Close() error {
+	db.FlushSuccesses(context.Background())
+	if db.Read != db.Write {
+		db.Read.Close()
+		db.readConn.close()
+	}
+	err := db.Write.Close()
+	db.writeConn.close()
+	return err
+}
+
+// DSN builds a pgx connection URL; see mysqlConfig for MySQL
+func DSN(db config.DatabaseConfig) string {
+	q := url.Values{}
+	if db.SSLMode != "" {
+		q.Set("sslmode", db.SSLMode)
+	}
+	// pgx sends unknown parameters as startup parameters, which is the same
+	// as running SET statement_timeout right after each connection is made
+	if db.StatementTimeout > 0 {
+		q.Set("statement_timeout", fmt.Sprint(db.StatementTimeout.Milliseconds()))
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(db.User, db.Password),
+		Host:     net.JoinHostPort(db.Host, strconv.Itoa(db.Port)),
+		Path:     "/" + db.DBName,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// Fetch pending transactions (status = 1 by default) from the read pool
+func (db *Database) Fetch(ctx context.Context) ([]Transaction, error) {
+	// Those waiting would be selected again
+	db.FlushSuccesses(ctx)
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.Query.SQL != "" {
+		return db.queryPending(ctx, db.Query.SQL, nil)
+	}
+	s := db.selectQuery("", 0)
+	if db.Watermark.Enabled {
+		if err := db.afterWatermark(ctx, &s); err != nil {
+			return nil, err
+		}
+	}
+	return db.queryPending(ctx, s.sql(), s.args)
+}
+
+// FetchPage returns the next page of pending transactions ordered by
+// query.id_column, for keyset pagination. In claim mode the page is claimed
+// for this instance first.
+func (db *Database) FetchPage(ctx context.Context, after string, limit int) ([]Transaction, error) {
+	db.FlushSuccesses(ctx)
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	s := db.selectQuery(after, limit)
+	if db.Claim.Enabled && db.Dialect == sqlutil.Postgres {
+		// Claiming writes, it cannot run on read_database
+		query, args := db.claimQuery(s)
+		rows, err := db.Write.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		return db.scan(rows)
+	}
+	if db.Claim.Enabled {
+		return db.claimLocked(ctx, s)
+	}
+	// A short page ends the run, so the page is filled up again past the
+	// invoices the recheck drops
+	var page []Transaction
+	for {
+		rows, err := db.query(ctx, s.sql(), s.args)
+		if err != nil {
+			return nil, err
+		}
+		pending, err := db.stillPending(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		page = append(page, pending...)
+		if len(rows) < s.limit || len(page) == limit {
+			return page, nil
+		}
+		s = db.selectQuery(rows[len(rows)-1].InvoiceID, limit-len(page))
+	}
+}
+
+// Stream reads the pending transactions like Fetch, sending each to out
+// as soon as it is scanned. query_timeout does not apply, the query stays
+// open while they are pushed.
+func (db *Database) Stream(ctx context.Context, out chan<- Transaction) error {
+	db.FlushSuccesses(ctx)
+	query, args := db.Query.SQL, []interface{}(nil)
+	if query == "" {
+		s := db.selectQuery("", 0)
+		query, args = s.sql(), s.args
+	}
+	rows, err := db.Read.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		txn, err := db.scanRow(rows)
+		if err != nil {
+			return err
+		}
+		kept, err := db.stillPending(ctx, []Transaction{txn})
+		if err != nil {
+			return err
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		select {
+		case out <- txn:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return rows.Err()
+}
+
+// Keep those of transactions database still has pending. read_database
+// lags behind it, and may list invoices whose push was acknowledged a
+// moment ago; they would be pushed twice.
+func (db *Database) stillPending(ctx context.Context, transactions []Transaction) ([]Transaction, error) {
+	if db.Read == db.Write || len(transactions) == 0 {
+		return transactions, nil
+	}
+	ids := make([]string, len(transactions))
+	for i, txn := range transactions {
+		ids[i] = txn.InvoiceID
+	}
+	pending := make(map[string]bool, len(transactions))
+	for _, chunk := range sqlutil.Chunks(ids) {
+		if err := db.recheck(ctx, chunk, pending); err != nil {
+			return nil, fmt.Errorf("failed to recheck the invoices of read_database on database: %v", err)
+		}
+	}
+	kept := transactions[:0]
+	for _, txn := range transactions {
+		if pending[txn.InvoiceID] {
+			kept = append(kept, txn)
+		}
+	}
+	if n := len(transactions) - len(kept); n > 0 {
+		slog.DebugContext(ctx, "Dropped invoices read_database still lists as pending", "count", n)
+	}
+	return kept, nil
+}
+
+// Add those of ids database has pending to pending
+func (db *Database) recheck(ctx context.Context, ids []string, pending map[string]bool) error {
+	s := db.selectQuery("", 0)
+	in, args := db.Dialect.In(db.Dialect.Quote(db.Query.IDColumn), len(s.args)+1, ids)
+	s.where = "(" + s.where + ") AND " + in
+	s.args = append(s.args, args...)
+	s.columns, s.order = db.Dialect.Quote(db.Query.IDColumn), ""
+	rows, err := db.Write.QueryContext(ctx, s.sql(), s.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			return err
+		}
+		pending[number] = true
+	}
+	return rows.Err()
+}
+
+// Run query on read_database and recheck what it returns on database
+func (db *Database) queryPending(ctx context.Context, query string, args []interface{}) ([]Transaction, error) {
+	transactions, err := db.query(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return db.stillPending(ctx, transactions)
+}
+
+func (db *Database) query(ctx context.Context, query string, args []interface{}) ([]Transaction, error) {
+	rows, err := db.Read.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return db.scan(rows)
+}
+
+func (db *Database) scan(rows *sql.Rows) ([]Transaction, error) {
+	defer rows.Close()
+	var transactions []Transaction
+	for rows.Next() {
+		txn, err := db.scanRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, txn)
+	}
+	return transactions, rows.Err()
+}
+
+// Read the selected invoice number, and the group and cursor columns when
+// selected
+func (db *Database) scanRow(rows *sql.Rows) (Transaction, error) {
+	var number, group, cursor sql.NullString
+	dest := []interface{}{&number}
+	if db.GroupColumn != "" {
+		dest = append(dest, &group)
+	}
+	if db.Watermark.Enabled {
+		dest = append(dest, &cursor)
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return Transaction{}, err
+	}
+	// NULL numbers are kept as empty IDs and rejected by validation
+	return Transaction{InvoiceID: number.String, Group: group.String, Cursor: cursor.String, Shard: db.Shard}, nil
+}
+
+// A pending selection, kept in parts so claim mode can extend it
+type selection struct {
+	columns string
+	table   string
+	where   string
+	order   string
+	limit   int
+	args    []interface{}
+	dialect sqlutil.Dialect
+}
+
+func (s selection) sql() string {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", s.columns, s.table, s.where)
+	if s.order != "" {
+		query += " ORDER BY " + s.order
+	}
+	if s.limit > 0 {
+		query += s.dialect.Limit(s.limit)
+	}
+	return query
+}
+
+// Add a condition with one parameter, written as $? in cond
+func (s *selection) and(cond string, arg interface{}) {
+	s.args = append(s.args, arg)
+	s.where += " AND " + strings.Replace(cond, "$?", s.dialect.Param(len(s.args)), 1)
+}
+
+// Build the pending selection from the query config. With a limit the
+// rows are ordered by id_column and start after the given invoice number.
+func (db *Database) selectQuery(after string, limit int) selection {
+	q := db.Query
+	id := db.Dialect.Quote(q.IDColumn)
+	s := selection{columns: id, table: db.Dialect.QuoteQualified(q.Table), where: q.Where, order: q.OrderBy, dialect: db.Dialect}
+	if q.PriorityColumn != "" {
+		// NULLs sort first in descending order on some databases
+		p := db.Dialect.Quote(q.PriorityColumn)
+		s.order = fmt.Sprintf("CASE WHEN %s IS NULL THEN 1 ELSE 0 END, %s DESC", p, p)
+		if q.OrderBy != "" {
+			s.order += ", " + q.OrderBy
+		}
+	}
+	if db.GroupColumn != "" {
+		s.columns += ", " + db.Dialect.Quote(db.GroupColumn)
+	}
+	switch {
+	case s.where != "":
+	case db.Watermark.Enabled:
+		// The watermark replaces the status flag unless where adds it
+		s.where = "1 = 1"
+	default:
+		s.where = db.Dialect.Quote(q.StatusColumn) + " = " + db.Dialect.Param(1)
+		s.args = append(s.args, q.PendingStatus)
+	}
+	if q.PushAfterColumn != "" {
+		after := db.Dialect.Quote(q.PushAfterColumn)
+		s.where = fmt.Sprintf("(%s) AND (%s IS NULL OR %s <= %s)", s.where, after, after, db.Dialect.Now())
+	}
+	if limit > 0 {
+		// NULL numbers cannot be paged past, so they are left out
+		s.where = fmt.Sprintf("(%s) AND %s IS NOT NULL", s.where, id)
+		if after != "" {
+			s.and(id+" > $?", after)
+		}
+		s.order, s.limit = id, limit
+	}
+	return s
+}
+
+// IsPending tells whether invoiceID is among the invoices the pending
+// selection would return
+func (db *Database) IsPending(ctx context.Context, invoiceID string) (bool, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	s := db.selectQuery("", 0)
+	s.where = "(" + s.where + ")"
+	s.and(db.Dialect.Quote(db.Query.IDColumn)+" = $?", invoiceID)
+	s.columns, s.order = "COUNT(*)", ""
+	var n int
+	// On database, read_database may not have caught up with it yet
+	err := db.Write.QueryRowContext(ctx, s.sql(), s.args...).Scan(&n)
+	return n > 0, err
+}
+
+// OldestPending returns the earliest query.created_column of the pending
+// invoices
+func (db *Database) OldestPending(ctx context.Context) (time.Time, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	s := db.selectQuery("", 0)
+	s.columns, s.order = "MIN("+db.Dialect.Quote(db.Query.CreatedColumn)+")", ""
+	var oldest sqlutil.Time
+	if err := db.Read.QueryRowContext(ctx, s.sql(), s.args...).Scan(&oldest); err != nil {
+		return time.Time{}, err
+	}
+	return oldest.Time, nil
+}
+
+// Ack marks the invoice of txn as pushed
+func (db *Database) Ack(ctx context.Context, txn Transaction) error {
+	if db.StatusUpdate.OnSuccessBatch != "" {
+		return db.addSuccess(ctx, txn.InvoiceID)
+	}
+	return db.MarkPushed(ctx, txn.InvoiceID)
+}
+
+// Nack releases the claim on the invoice of txn so it is selected again,
+// or parks it when the failure was permanent
+func (db *Database) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	if requeue {
+		return db.Release(ctx, txn.InvoiceID)
+	}
+	return db.Park(ctx, txn.InvoiceID)
+}
+
+// MarkPushed runs status_update.on_success, if configured
+func (db *Database) MarkPushed(ctx context.Context, invoiceID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.StatusUpdate.OnSuccess == "" {
+		return nil
+	}
+	_, err := db.Write.ExecContext(ctx, db.StatusUpdate.OnSuccess, invoiceID)
+	return err
+}
+
+// Park moves an invoice out of the pending set so future runs skip it
+func (db *Database) Park(ctx context.Context, invoiceID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.StatusUpdate.OnPermanentFailure != "" {
+		_, err := db.Write.ExecContext(ctx, db.StatusUpdate.OnPermanentFailure, invoiceID)
+		return err
+	}
+	return db.setStatus(ctx, invoiceID, db.ParkedStatus)
+}
+
+// Review flags the invoice of txn for manual review so future runs skip it
+func (db *Database) Review(ctx context.Context, txn Transaction) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.StatusUpdate.OnReview != "" {
+		_, err := db.Write.ExecContext(ctx, db.StatusUpdate.OnReview, txn.InvoiceID)
+		return err
+	}
+	return db.setStatus(ctx, txn.InvoiceID, db.ReviewStatus)
+}
+
+// Reject sets an invoice failing validation aside
+func (db *Database) Reject(ctx context.Context, txn Transaction) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.StatusUpdate.OnRejected != "" {
+		_, err := db.Write.ExecContext(ctx, db.StatusUpdate.OnRejected, txn.InvoiceID)
+		return err
+	}
+	return db.setStatus(ctx, txn.InvoiceID, db.RejectedStatus)
+}
+
+// Hold sets the invoice of txn aside while it waits in the local queue
+func (db *Database) Hold(ctx context.Context, txn Transaction) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.StatusUpdate.OnQueued != "" {
+		_, err := db.Write.ExecContext(ctx, db.StatusUpdate.OnQueued, txn.InvoiceID)
+		return err
+	}
+	return db.setStatus(ctx, txn.InvoiceID, db.QueuedStatus)
+}
+
+// SetStatus writes status to the status column of the invoice of txn
+func (db *Database) SetStatus(ctx context.Context, txn Transaction, status string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	return db.setStatus(ctx, txn.InvoiceID, status)
+}
+
+func (db *Database) setStatus(ctx context.Context, invoiceID string, status interface{}) error {
+	query := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s",
+		db.Dialect.QuoteQualified(db.Query.Table), db.Dialect.Quote(db.Query.StatusColumn), db.Dialect.Param(1),
+		db.Dialect.Quote(db.Query.IDColumn), db.Dialect.Param(2))
+	_, err := db.Write.ExecContext(ctx, query, status, invoiceID)
+	return err
+}
+
+// Capture writes the captured response fields into their columns of the
+// invoice row, or runs capture.update
+func (db *Database) Capture(ctx context.Context, invoiceID string, values []*string) error {
+	return db.StoreFields(ctx, db.ResponseCapture, invoiceID, values)
+}
+
+// StoreFields writes values into the columns of c.Fields of the invoice
+// row, or runs c.Update
+func (db *Database) StoreFields(ctx context.Context, c config.CaptureConfig, invoiceID string, values []*string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	args := []interface{}{invoiceID}
+	for _, v := range values {
+		args = append(args, v)
+	}
+	if c.Update != "" {
+		_, err := db.Write.ExecContext(ctx, c.Update, args...)
+		return err
+	}
+	var set []string
+	for i, f := range c.Fields {
+		set = append(set, fmt.Sprintf("%s = %s", db.Dialect.Quote(f.Column), db.Dialect.Param(i+1)))
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = %s", db.Dialect.QuoteQualified(db.Query.Table),
+		strings.Join(set, ", "), db.Dialect.Quote(db.Query.IDColumn), db.Dialect.Param(len(args)))
+	// The invoice number goes last, after the values being set
+	_, err := db.Write.ExecContext(ctx, query, append(args[1:], invoiceID)...)
+	return err
+}
+
+// MoveToHistory copies the invoice row into history.table and, in move
+// mode, deletes it from the invoice table, in one transaction
+func (db *Database) MoveToHistory(ctx context.Context, invoiceID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	table := db.Dialect.QuoteQualified(db.Query.Table)
+	where := fmt.Sprintf("%s = %s", db.Dialect.Quote(db.Query.IDColumn), db.Dialect.Param(1))
+	columns, into := "*", ""
+	if len(db.History.Columns) > 0 {
+		quoted := make([]string, len(db.History.Columns))
+		for i, c := range db.History.Columns {
+			quoted[i] = db.Dialect.Quote(c)
+		}
+		columns = strings.Join(quoted, ", ")
+		into = " (" + columns + ")"
+	}
+	tx, err := db.Write.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert := fmt.Sprintf("INSERT INTO %s%s SELECT %s FROM %s WHERE %s",
+		db.Dialect.QuoteQualified(db.History.Table), into, columns, table, where)
+	res, err := tx.ExecContext(ctx, insert, invoiceID)
+	if err != nil {
+		return fmt.Errorf("failed to copy invoice %s to %s: %v", invoiceID, db.History.Table, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("invoice %s is not in %s", invoiceID, db.Query.Table)
+	}
+	if db.History.Mode == "move" {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s", table, where), invoiceID); err != nil {
+			return fmt.Errorf("failed to delete invoice %s from %s: %v", invoiceID, db.Query.Table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Has tells whether the invoice table holds invoiceID, in any status
+func (db *Database) Has(ctx context.Context, invoiceID string) (bool, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = %s", db.Dialect.QuoteQualified(db.Query.Table),
+		db.Dialect.Quote(db.Query.IDColumn), db.Dialect.Param(1))
+	var n int
+	err := db.Write.QueryRowContext(ctx, query, invoiceID).Scan(&n)
+	return n > 0, err
+}
+
+// Requeue sets a parked or reviewed invoice back to query.pending_status.
+// Invoices in any other status are left alone, so one pushed since it was
+// dead-lettered is not pushed twice.
+func (db *Database) Requeue(ctx context.Context, invoiceID string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	if db.StatusUpdate.OnRequeue != "" {
+		_, err := db.Write.ExecContext(ctx, db.StatusUpdate.OnRequeue, invoiceID)
+		return err
+	}
+	status := db.Dialect.Quote(db.Query.StatusColumn)
+	query := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s = %s AND %s IN (%s, %s)",
+		db.Dialect.QuoteQualified(db.Query.Table), status, db.Dialect.Param(1),
+		db.Dialect.Quote(db.Query.IDColumn), db.Dialect.Param(2), status, db.Dialect.Param(3), db.Dialect.Param(4))
+	_, err := db.Write.ExecContext(ctx, query, db.Query.PendingStatus, invoiceID, db.ParkedStatus, db.ReviewStatus)
+	return err
+}
@@ -0,0 +1,209 @@
+package source
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/xuri/excelize/v2"
+)
+
+// File reads the invoices to push from a CSV or XLSX file with a header
+// row, for one-off migrations and re-pushes handed over as a spreadsheet.
+// The file is read again on every fetch. Invoices pushed or parked are not
+// handed out again by the same process; with done_file the pushed ones are
+// skipped by later runs as well.
+type File struct {
+	Config config.FileSourceConfig
+
+	mu sync.Mutex
+	// Invoices acked or parked, including the ones read from done_file
+	handled map[string]bool
+	loaded  bool
+}
+
+func NewFile(cfg config.FileSourceConfig) *File {
+	return &File{Config: cfg, handled: make(map[string]bool)}
+}
+
+// Fetch returns one transaction per row not handled yet, in file order.
+// Rows without an invoice number and repeated invoice numbers are skipped.
+func (f *File) Fetch(ctx context.Context) ([]Transaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s is empty, expected a header row", f.Config.Path)
+	}
+	header := rows[0]
+	id := column(header, f.Config.IDColumn)
+	if id < 0 {
+		return nil, fmt.Errorf("%s has no %q column", f.Config.Path, f.Config.IDColumn)
+	}
+	payload := make([]int, len(f.Config.PayloadColumns))
+	for i, name := range f.Config.PayloadColumns {
+		if payload[i] = column(header, name); payload[i] < 0 {
+			return nil, fmt.Errorf("%s has no %q column", f.Config.Path, name)
+		}
+	}
+
+	if err := f.loadDone(); err != nil {
+		return nil, err
+	}
+	var transactions []Transaction
+	seen := make(map[string]bool)
+	for _, row := range rows[1:] {
+		invoice := strings.TrimSpace(cell(row, id))
+		if invoice == "" || seen[invoice] || f.handled[invoice] {
+			continue
+		}
+		seen[invoice] = true
+		txn := Transaction{InvoiceID: invoice}
+		if len(payload) > 0 {
+			txn.Payload = make(map[string]interface{}, len(payload))
+			for i, c := range payload {
+				txn.Payload[f.Config.PayloadColumns[i]] = cell(row, c)
+			}
+		}
+		transactions = append(transactions, txn)
+	}
+	return transactions, nil
+}
+
+// Ack remembers the invoice of txn as pushed and appends it to done_file
+func (f *File) Ack(ctx context.Context, txn Transaction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handled[txn.InvoiceID] = true
+	if f.Config.DoneFile == "" {
+		return nil
+	}
+	out, err := os.OpenFile(f.Config.DoneFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(out, txn.InvoiceID); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Nack leaves the invoice of txn to be fetched again, or sets it aside for
+// the rest of the process when the failure was permanent
+func (f *File) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	if !requeue {
+		f.mu.Lock()
+		f.handled[txn.InvoiceID] = true
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// Reload switches to the new file settings. Invoices handled so far stay
+// handled, done_file is read again on the next fetch.
+func (f *File) Reload(cfg *config.Config) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Config = cfg.Source.File
+	f.loaded = false
+}
+
+// Read the invoice numbers in done_file into handled, once
+func (f *File) loadDone() error {
+	if f.loaded || f.Config.DoneFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.Config.DoneFile)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read done file: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			f.handled[line] = true
+		}
+	}
+	f.loaded = true
+	return nil
+}
+
+// Read all rows of the file, the header first
+func (f *File) read() ([][]string, error) {
+	format := f.Config.Format
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(f.Config.Path)), ".")
+	}
+	switch format {
+	case "xlsx":
+		return f.readXLSX()
+	case "csv":
+		return f.readCSV()
+	default:
+		return nil, fmt.Errorf("cannot tell the format of %s, set source.file.format to csv or xlsx", f.Config.Path)
+	}
+}
+
+func (f *File) readCSV() ([][]string, error) {
+	in, err := os.Open(f.Config.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	r := csv.NewReader(in)
+	if d := []rune(f.Config.Delimiter); len(d) > 0 {
+		r.Comma = d[0]
+	}
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", f.Config.Path, err)
+	}
+	// Excel saves CSV files with a byte order mark
+	if len(rows) > 0 && len(rows[0]) > 0 {
+		rows[0][0] = strings.TrimPrefix(rows[0][0], "\ufeff")
+	}
+	return rows, nil
+}
+
+func (f *File) readXLSX() ([][]string, error) {
+	book, err := excelize.OpenFile(f.Config.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer book.Close()
+	sheet := f.Config.Sheet
+	if sheet == "" {
+		sheet = book.GetSheetName(0)
+	}
+	rows, err := book.GetRows(sheet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sheet %q of %s: %v", sheet, f.Config.Path, err)
+	}
+	return rows, nil
+}
+
+// Index of the header named name, ignoring case and surrounding spaces
+func column(header []string, name string) int {
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Cell i of row, empty for the cells missing from short rows
+func cell(row []string, i int) string {
+	if i < len(row) {
+		return row[i]
+	}
+	return ""
+}
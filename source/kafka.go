@@ -0,0 +1,206 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/kafkaclient"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Kafka consumes invoice events from a topic as a member of a consumer
+// group. An offset is committed once the message and every one before it
+// on the partition were pushed, parked or skipped, so a restart resumes
+// with the first invoice not handled yet. Invoices that failed are handed
+// out again by the next fetch.
+type Kafka struct {
+	Config config.KafkaSourceConfig
+	client *kgo.Client
+
+	commitMu sync.Mutex
+	mu       sync.Mutex
+	// Messages fetched and not committed yet, per partition in offset order
+	pending map[int32][]*kafkaMessage
+	// Transactions nacked with requeue, returned by the next fetch
+	retry []Transaction
+}
+
+type kafkaMessage struct {
+	record *kgo.Record
+	done   bool
+}
+
+func NewKafka(cfg config.KafkaSourceConfig) (*Kafka, error) {
+	k := &Kafka{Config: cfg, pending: make(map[int32][]*kafkaMessage)}
+	opts, err := kafkaclient.Options(cfg.KafkaClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	start := kgo.NewOffset().AtStart()
+	if cfg.StartOffset == "last" {
+		start = kgo.NewOffset().AtEnd()
+	}
+	opts = append(opts,
+		kgo.ConsumerGroup(cfg.GroupID),
+		kgo.ConsumeTopics(cfg.Topic),
+		kgo.ConsumeResetOffset(start),
+		// Committed from Ack instead of in the background
+		kgo.DisableAutoCommit(),
+		kgo.OnPartitionsRevoked(k.forget),
+		kgo.OnPartitionsLost(k.forget),
+	)
+	if k.client, err = kgo.NewClient(opts...); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Fetch returns the invoices that failed last time or, when there are
+// none, up to batch_size new messages, waiting at most max_wait for them
+func (k *Kafka) Fetch(ctx context.Context) ([]Transaction, error) {
+	k.mu.Lock()
+	if len(k.retry) > 0 {
+		batch := k.retry
+		k.retry = nil
+		k.mu.Unlock()
+		return batch, nil
+	}
+	k.mu.Unlock()
+
+	// Not holding mu, a rebalance during the poll calls forget
+	wait, cancel := context.WithTimeout(ctx, k.Config.MaxWait)
+	defer cancel()
+	fetches := k.client.PollRecords(wait, k.Config.BatchSize)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, e := range fetches.Errors() {
+		if !errors.Is(e.Err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("failed to fetch from Kafka topic %s partition %d: %v", e.Topic, e.Partition, e.Err)
+		}
+	}
+
+	k.mu.Lock()
+	var batch []Transaction
+	for _, r := range fetches.Records() {
+		m := &kafkaMessage{record: r}
+		k.pending[r.Partition] = append(k.pending[r.Partition], m)
+		txn, err := decodeMessage(r.Value, k.Config.Message)
+		if err != nil {
+			slog.Warn("Skipping Kafka message", "partition", r.Partition, "offset", r.Offset, "error", err)
+			m.done = true
+			continue
+		}
+		txn.handle = m
+		batch = append(batch, txn)
+	}
+	k.mu.Unlock()
+	return batch, k.commit(ctx)
+}
+
+// Ack commits the message of txn, once the ones before it are handled
+func (k *Kafka) Ack(ctx context.Context, txn Transaction) error {
+	return k.Skip(ctx, txn)
+}
+
+// Nack hands txn out again on the next fetch, or with a permanent failure
+// commits it like a pushed one
+func (k *Kafka) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	if !requeue {
+		return k.Skip(ctx, txn)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.retry = append(k.retry, txn)
+	return nil
+}
+
+// Skip commits the message of a transaction that will not be pushed
+func (k *Kafka) Skip(ctx context.Context, txn Transaction) error {
+	m, ok := txn.handle.(*kafkaMessage)
+	if !ok {
+		return nil
+	}
+	k.mu.Lock()
+	m.done = true
+	k.mu.Unlock()
+	return k.commit(ctx)
+}
+
+// The last message of each partition that is preceded only by handled
+// ones, to be committed
+func (k *Kafka) ready() []*kgo.Record {
+	var records []*kgo.Record
+	for _, queue := range k.pending {
+		n := 0
+		for n < len(queue) && queue[n].done {
+			n++
+		}
+		if n > 0 {
+			records = append(records, queue[n-1].record)
+		}
+	}
+	return records
+}
+
+// Stop tracking the messages up to the committed records
+func (k *Kafka) committed(records []*kgo.Record) {
+	for _, r := range records {
+		queue := k.pending[r.Partition]
+		n := 0
+		for n < len(queue) && queue[n].record.Offset <= r.Offset {
+			n++
+		}
+		k.pending[r.Partition] = queue[n:]
+	}
+}
+
+// Commit the ready offsets. Commits are serialized so an older offset never
+// overwrites a newer one, and made without holding mu as a rebalance waits
+// for commits in progress.
+func (k *Kafka) commit(ctx context.Context) error {
+	k.commitMu.Lock()
+	defer k.commitMu.Unlock()
+	k.mu.Lock()
+	records := k.ready()
+	k.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+	// Kept pending until committed, so a failed commit is tried again
+	if err := k.client.CommitRecords(ctx, records...); err != nil {
+		return fmt.Errorf("failed to commit Kafka offsets: %v", err)
+	}
+	k.mu.Lock()
+	k.committed(records)
+	k.mu.Unlock()
+	return nil
+}
+
+// Drop what is tracked for partitions assigned to another member, which
+// consumes them again from the last commit
+func (k *Kafka) forget(_ context.Context, _ *kgo.Client, revoked map[string][]int32) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	gone := make(map[int32]bool)
+	for _, partition := range revoked[k.Config.Topic] {
+		gone[partition] = true
+		delete(k.pending, partition)
+	}
+	retry := k.retry[:0]
+	for _, txn := range k.retry {
+		if m, ok := txn.handle.(*kafkaMessage); !ok || !gone[m.record.Partition] {
+			retry = append(retry, txn)
+		}
+	}
+	k.retry = retry
+}
+
+func (k *Kafka) Close() error {
+	k.client.Close()
+	return nil
+}
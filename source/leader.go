@@ -0,0 +1,93 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// AdvisoryLock is a session-level pg_advisory_lock held on a dedicated
+// connection, used to elect a single active instance. Postgres releases it
+// when the session ends, so a standby can take over from a leader that
+// died.
+type AdvisoryLock struct {
+	db   *sql.DB
+	key  int64
+	conn *sql.Conn
+}
+
+func NewAdvisoryLock(db *sql.DB, key int64) *AdvisoryLock {
+	return &AdvisoryLock{db: db, key: key}
+}
+
+// Acquire blocks until the lock is taken, trying again every retry.
+// Returns ctx.Err() when cancelled first.
+func (l *AdvisoryLock) Acquire(ctx context.Context, retry time.Duration) error {
+	for {
+		ok, err := l.try(ctx)
+		if ok {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("Failed to try the leader lock", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (l *AdvisoryLock) try(ctx context.Context) (bool, error) {
+	if l.conn == nil {
+		conn, err := l.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		l.conn = conn
+	}
+	var ok bool
+	if err := l.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&ok); err != nil {
+		// Start over on a fresh connection next time
+		l.conn.Close()
+		l.conn = nil
+		return false, err
+	}
+	return ok, nil
+}
+
+// Hold returns a context derived from ctx that is cancelled as soon as the
+// lock's connection stops answering, checked every interval: at that point
+// another instance may already hold the lock.
+func (l *AdvisoryLock) Hold(ctx context.Context, interval time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := l.conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("Lost the leader lock connection", "error", err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+// Release unlocks and returns the dedicated connection to the pool
+func (l *AdvisoryLock) Release() {
+	if l.conn == nil {
+		return
+	}
+	l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", l.key)
+	l.conn.Close()
+	l.conn = nil
+}
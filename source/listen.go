@@ -0,0 +1,130 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/purwaren/trx-push/config"
+)
+
+// Listener receives invoice numbers sent with NOTIFY <channel>, '<number>'
+// by a trigger on the invoice table
+type Listener struct {
+	db      config.DatabaseConfig
+	channel string
+	conn    *pgx.Conn
+	// Stop Events and wait for it to let go of conn
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// NewListener starts listening on channel using a dedicated connection to
+// the primary database
+func NewListener(db config.DatabaseConfig, channel string) (*Listener, error) {
+	if db.Driver != "postgres" {
+		return nil, errors.New("listen mode requires database.driver postgres")
+	}
+	l := &Listener{db: db, channel: channel}
+	if err := l.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Open the connection and LISTEN on it
+func (l *Listener) connect(ctx context.Context) error {
+	cc, err := pgx.ParseConfig(DSN(l.db))
+	if err != nil {
+		return err
+	}
+	conn, err := pgx.ConnectConfig(ctx, cc)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{l.channel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return err
+	}
+	l.conn = conn
+	return nil
+}
+
+// Reconnect after a lost connection, waiting from a second up to a minute
+// between attempts. False when ctx was cancelled first.
+func (l *Listener) reconnect(ctx context.Context) bool {
+	l.conn.Close(context.Background())
+	delay := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		err := l.connect(ctx)
+		if err == nil {
+			slog.Info("LISTEN connection re-established")
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		slog.Warn("Failed to connect for LISTEN", "error", err)
+		delay = min(2*delay, time.Minute)
+	}
+}
+
+// Events delivers notification payloads until ctx is cancelled. An empty
+// string is sent after a reconnect, when notifications may have been
+// missed and the backlog should be re-read.
+func (l *Listener) Events(ctx context.Context) <-chan string {
+	events := make(chan string)
+	ctx, l.stop = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		defer close(events)
+		for {
+			// Detect dead connections that never reported an error
+			wait, cancel := context.WithTimeout(ctx, 90*time.Second)
+			n, err := l.conn.WaitForNotification(wait)
+			cancel()
+			var payload string
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err == nil:
+				payload = n.Payload
+			case errors.Is(err, context.DeadlineExceeded):
+				if err = l.conn.Ping(ctx); err == nil {
+					continue
+				}
+				fallthrough
+			default:
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("Lost LISTEN connection", "error", err)
+				if !l.reconnect(ctx) {
+					return
+				}
+			}
+			select {
+			case events <- payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+func (l *Listener) Close() error {
+	if l.stop != nil {
+		l.stop()
+		<-l.done
+	}
+	return l.conn.Close(context.Background())
+}
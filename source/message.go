@@ -0,0 +1,38 @@
+package source
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/jsonutil"
+)
+
+// Build the transaction announced by a queue message: the body is the
+// invoice number, or a JSON event holding it at invoice_field
+func decodeMessage(body []byte, cfg config.MessageConfig) (Transaction, error) {
+	if cfg.InvoiceField == "" {
+		invoice := strings.TrimSpace(string(body))
+		if invoice == "" {
+			return Transaction{}, errors.New("empty message")
+		}
+		return Transaction{InvoiceID: invoice}, nil
+	}
+
+	invoice, ok := jsonutil.Lookup(body, cfg.InvoiceField)
+	if !ok || invoice == "" {
+		return Transaction{}, fmt.Errorf("message has no %s", cfg.InvoiceField)
+	}
+	txn := Transaction{InvoiceID: invoice}
+	if cfg.Payload {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&txn.Payload); err != nil {
+			return Transaction{}, fmt.Errorf("message is not a JSON object: %v", err)
+		}
+	}
+	return txn, nil
+}
@@ -0,0 +1,189 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/natsclient"
+)
+
+// NATS consumes pending invoices from a JetStream stream with a durable
+// pull consumer and explicit acks. A message is acked once its invoice was
+// pushed and marked in progress every half ack_wait until then; a failed
+// one is nacked for redelivery, up to max_deliver times, and a permanent
+// failure or skipped message is terminated so it is not delivered again.
+// The consumer is created, or updated to the configured settings, on the
+// first fetch.
+type NATS struct {
+	Config config.NATSSourceConfig
+	conn   *nats.Conn
+	js     jetstream.JetStream
+
+	mu       sync.Mutex
+	consumer jetstream.Consumer
+	// Messages fetched and not handled yet
+	inFlight map[jetstream.Msg]bool
+	stop     context.CancelFunc
+}
+
+func NewNATS(cfg config.NATSSourceConfig) (*NATS, error) {
+	conn, err := natsclient.Connect(cfg.NATSClientConfig, "trx-push")
+	if err != nil {
+		return nil, err
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	n := &NATS{Config: cfg, conn: conn, js: js, inFlight: make(map[jetstream.Msg]bool)}
+	ctx, stop := context.WithCancel(context.Background())
+	n.stop = stop
+	go n.extend(ctx)
+	return n, nil
+}
+
+// Fetch returns up to batch_size messages, waiting at most max_wait for them
+func (n *NATS) Fetch(ctx context.Context) ([]Transaction, error) {
+	consumer, err := n.bind(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up NATS consumer %s on stream %s: %v", n.Config.Consumer, n.Config.Stream, err)
+	}
+	msgs, err := consumer.Fetch(n.Config.BatchSize, jetstream.FetchMaxWait(n.Config.MaxWait))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from NATS stream %s: %v", n.Config.Stream, err)
+	}
+
+	var batch []Transaction
+	for {
+		select {
+		case <-ctx.Done():
+			// Unacked messages are redelivered once ack_wait passes
+			return nil, ctx.Err()
+		case m, ok := <-msgs.Messages():
+			if !ok {
+				if err := msgs.Error(); err != nil && len(batch) == 0 {
+					return nil, fmt.Errorf("failed to fetch from NATS stream %s: %v", n.Config.Stream, err)
+				}
+				return batch, nil
+			}
+			txn, err := decodeMessage(m.Data(), n.Config.Message)
+			if err != nil {
+				slog.WarnContext(ctx, "Terminating NATS message", "subject", m.Subject(), "error", err)
+				if err := m.Term(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			txn.handle = m
+			n.mu.Lock()
+			n.inFlight[m] = true
+			n.mu.Unlock()
+			batch = append(batch, txn)
+		}
+	}
+}
+
+// Ack acks the message of txn
+func (n *NATS) Ack(ctx context.Context, txn Transaction) error {
+	m, ok := n.done(txn)
+	if !ok {
+		return nil
+	}
+	return m.DoubleAck(ctx)
+}
+
+// Nack has the message of txn redelivered, or terminates it when the
+// failure was permanent
+func (n *NATS) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	if !requeue {
+		return n.Skip(ctx, txn)
+	}
+	m, ok := n.done(txn)
+	if !ok {
+		return nil
+	}
+	return m.Nak()
+}
+
+// Skip terminates the message of a transaction that will not be pushed
+func (n *NATS) Skip(ctx context.Context, txn Transaction) error {
+	m, ok := n.done(txn)
+	if !ok {
+		return nil
+	}
+	return m.Term()
+}
+
+// Close stops marking unhandled messages in progress, which are
+// redelivered once ack_wait passes, and closes the connection
+func (n *NATS) Close() error {
+	n.stop()
+	n.conn.Close()
+	return nil
+}
+
+// Create or update the durable consumer, unless done already
+func (n *NATS) bind(ctx context.Context) (jetstream.Consumer, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.consumer != nil {
+		return n.consumer, nil
+	}
+	consumer, err := n.js.CreateOrUpdateConsumer(ctx, n.Config.Stream, jetstream.ConsumerConfig{
+		Durable:       n.Config.Consumer,
+		FilterSubject: n.Config.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       n.Config.AckWait,
+		MaxDeliver:    n.Config.MaxDeliver,
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.consumer = consumer
+	slog.InfoContext(ctx, "Consuming from NATS stream", "stream", n.Config.Stream, "consumer", n.Config.Consumer)
+	return consumer, nil
+}
+
+// Stop marking the message of txn in progress and return it
+func (n *NATS) done(txn Transaction) (jetstream.Msg, bool) {
+	m, ok := txn.handle.(jetstream.Msg)
+	if !ok {
+		return nil, false
+	}
+	n.mu.Lock()
+	delete(n.inFlight, m)
+	n.mu.Unlock()
+	return m, true
+}
+
+// Mark the messages in flight in progress every half ack_wait, until ctx
+// is cancelled
+func (n *NATS) extend(ctx context.Context) {
+	t := time.NewTicker(n.Config.AckWait / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		msgs := make([]jetstream.Msg, 0, len(n.inFlight))
+		for m := range n.inFlight {
+			msgs = append(msgs, m)
+		}
+		n.mu.Unlock()
+		for _, m := range msgs {
+			if err := m.InProgress(); err != nil && ctx.Err() == nil {
+				slog.Warn("Failed to mark NATS message in progress", "subject", m.Subject(), "error", err)
+			}
+		}
+	}
+}
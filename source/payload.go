@@ -0,0 +1,107 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// LoadPayload builds the JSON payload of invoiceID from payload.query and
+// the payload.items queries, each run with $1 = invoice number. A column
+// alias such as "customer.name" nests the value under "customer".
+func (db *Database) LoadPayload(ctx context.Context, invoiceID string) (map[string]interface{}, error) {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	rows, err := db.selectRows(ctx, db.Payload.Query, invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("payload query: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("payload query returned no row for invoice_id %s", invoiceID)
+	}
+	payload := rows[0]
+
+	for _, item := range db.Payload.Items {
+		list, err := db.selectRows(ctx, item.Query, invoiceID)
+		if err != nil {
+			return nil, fmt.Errorf("payload items %s: %v", item.Field, err)
+		}
+		values := make([]interface{}, len(list))
+		for i, row := range list {
+			values[i] = row
+		}
+		setPath(payload, item.Field, values)
+	}
+	return payload, nil
+}
+
+// Run query and return every row as a nested map keyed by column name
+func (db *Database) selectRows(ctx context.Context, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.Read.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(types))
+		dest := make([]interface{}, len(types))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{})
+		for i, t := range types {
+			setPath(row, t.Name(), jsonValue(t, values[i]))
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// Drivers return numeric and text columns as bytes, pgx numeric ones as
+// strings; keep numbers as numbers in the payload so amounts are not turned
+// into strings
+func jsonValue(t *sql.ColumnType, v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		if name := t.DatabaseTypeName(); name == "NUMERIC" || name == "DECIMAL" {
+			return json.Number(s)
+		}
+		return s
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	switch t.DatabaseTypeName() {
+	case "NUMERIC", "DECIMAL":
+		return json.Number(b)
+	case "JSON", "JSONB":
+		return json.RawMessage(b)
+	}
+	return string(b)
+}
+
+// Set m[a][b][c] = v for the dotted path "a.b.c", creating the maps in
+// between
+func setPath(m map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = v
+}
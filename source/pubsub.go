@@ -0,0 +1,160 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/pubsubclient"
+)
+
+// PubSub receives pending invoices from a Google Cloud Pub/Sub pull
+// subscription. Messages are received in the background from the first
+// fetch on, at most batch_size of them unacked at a time, and the client
+// keeps extending their ack deadline until they are handled or
+// max_extension passes. A pushed message is acked; a failed one is nacked
+// for redelivery, leaving the move to a dead-letter topic to the
+// subscription's policy. Permanent failures and skipped messages are
+// acked, the dead_letter table keeps those.
+type PubSub struct {
+	Config config.PubSubSourceConfig
+	client *pubsub.Client
+	sub    *pubsub.Subscription
+
+	messages chan *pubsub.Message
+	ctx      context.Context
+	stop     context.CancelFunc
+
+	mu        sync.Mutex
+	receiving bool
+	// Why receiving stopped, reported by the next fetch
+	err  error
+	done chan struct{}
+}
+
+func NewPubSub(ctx context.Context, cfg config.PubSubSourceConfig) (*PubSub, error) {
+	client, err := pubsubclient.New(ctx, cfg.PubSubClientConfig)
+	if err != nil {
+		return nil, err
+	}
+	sub := client.Subscription(cfg.Subscription)
+	sub.ReceiveSettings.MaxExtension = cfg.MaxExtension
+	sub.ReceiveSettings.MaxOutstandingMessages = cfg.BatchSize
+	p := &PubSub{Config: cfg, client: client, sub: sub, messages: make(chan *pubsub.Message)}
+	p.ctx, p.stop = context.WithCancel(context.Background())
+	return p, nil
+}
+
+// Fetch returns up to batch_size messages, waiting at most max_wait for them
+func (p *PubSub) Fetch(ctx context.Context) ([]Transaction, error) {
+	if err := p.receive(ctx); err != nil {
+		return nil, fmt.Errorf("failed to receive from Pub/Sub subscription %s: %v", p.Config.Subscription, err)
+	}
+
+	wait := time.NewTimer(p.Config.MaxWait)
+	defer wait.Stop()
+	var batch []Transaction
+	for len(batch) < p.Config.BatchSize {
+		select {
+		case <-ctx.Done():
+			// Unacked messages are redelivered once their deadline passes
+			return nil, ctx.Err()
+		case <-wait.C:
+			return batch, nil
+		case m := <-p.messages:
+			txn, err := decodeMessage(m.Data, p.Config.Message)
+			if err != nil {
+				slog.WarnContext(ctx, "Dropping Pub/Sub message", "message_id", m.ID, "error", err)
+				m.Ack()
+				continue
+			}
+			txn.handle = m
+			batch = append(batch, txn)
+		}
+	}
+	return batch, nil
+}
+
+// Ack acks the message of txn
+func (p *PubSub) Ack(ctx context.Context, txn Transaction) error {
+	if m, ok := txn.handle.(*pubsub.Message); ok {
+		m.Ack()
+	}
+	return nil
+}
+
+// Nack has the message of txn redelivered, or acks it when the failure
+// was permanent
+func (p *PubSub) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	m, ok := txn.handle.(*pubsub.Message)
+	if !ok {
+		return nil
+	}
+	if requeue {
+		m.Nack()
+	} else {
+		m.Ack()
+	}
+	return nil
+}
+
+// Skip acks the message of a transaction that will not be pushed
+func (p *PubSub) Skip(ctx context.Context, txn Transaction) error {
+	return p.Ack(ctx, txn)
+}
+
+// Close stops receiving, nacking the messages not fetched yet, and closes
+// the client
+func (p *PubSub) Close() error {
+	p.stop()
+	p.mu.Lock()
+	done := p.done
+	p.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	return p.client.Close()
+}
+
+// Start receiving in the background unless already receiving, returning
+// why the last receive stopped
+func (p *PubSub) receive(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.receiving {
+		return nil
+	}
+	if err := p.err; err != nil {
+		// Retried by the next fetch
+		p.err = nil
+		return err
+	}
+	p.receiving = true
+	p.done = make(chan struct{})
+	slog.InfoContext(ctx, "Receiving from Pub/Sub subscription", "subscription", p.Config.Subscription)
+	go func() {
+		defer close(p.done)
+		err := p.sub.Receive(p.ctx, func(ctx context.Context, m *pubsub.Message) {
+			select {
+			case p.messages <- m:
+			case <-ctx.Done():
+				m.Nack()
+			}
+		})
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.receiving = false
+		if p.ctx.Err() == nil {
+			if err == nil {
+				err = errors.New("receiving stopped")
+			}
+			p.err = err
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,276 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/redisclient"
+	"github.com/redis/go-redis/v9"
+)
+
+// Queue an invoice unless it is queued or being pushed already
+var enqueueScript = redis.NewScript(`
+if redis.call('SADD', KEYS[1], ARGV[1]) == 1 then
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+	return 1
+end
+return 0`)
+
+// RedisQueue hands out the pending invoices of a Database through a Redis
+// list shared by all instances, with the reliable queue pattern: a fetch
+// moves invoices from the list to one of this instance, where they stay
+// until they are answered. The instance renews a lease while it runs; the
+// invoices of an instance whose lease ran out are queued again by the
+// next refill. Once every refill_interval one of the instances reads the
+// pending invoices from the database and queues those that are not queued
+// or being pushed already. Answers are recorded in the database as without
+// the queue.
+type RedisQueue struct {
+	*Database
+	Config   config.RedisQueueConfig
+	client   *redis.Client
+	prefix   string
+	instance string
+	stop     context.CancelFunc
+}
+
+// A queued invoice, with what the database read for it
+type redisEntry struct {
+	ID      string                 `json:"id"`
+	Group   string                 `json:"group,omitempty"`
+	Payload map[string]interface{} `json:"payload,omitempty"`
+}
+
+func NewRedisQueue(db *Database, cfg *config.Config) *RedisQueue {
+	q := &RedisQueue{
+		Database: db,
+		Config:   cfg.Redis.Queue,
+		client:   redisclient.New(cfg),
+		prefix:   redisclient.Prefix(cfg),
+		instance: db.instance(),
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	q.stop = stop
+	go q.renew(ctx)
+	return q
+}
+
+func (q *RedisQueue) key(name string) string {
+	return q.prefix + ":" + name
+}
+
+// List of the invoices taken by instance and not answered yet
+func (q *RedisQueue) processing(instance string) string {
+	return q.key("processing:" + instance)
+}
+
+// Fetch takes up to redis.queue.batch_size queued invoices, first queueing
+// the pending ones when it is this instance's turn to
+func (q *RedisQueue) Fetch(ctx context.Context) ([]Transaction, error) {
+	if err := q.lease(ctx); err != nil {
+		return nil, fmt.Errorf("failed to renew Redis lease: %v", err)
+	}
+	turn, err := q.client.SetNX(ctx, q.key("refill"), q.instance, q.Config.RefillInterval).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Redis: %v", err)
+	}
+	if turn {
+		err := q.recover(ctx)
+		if err != nil {
+			err = fmt.Errorf("failed to requeue the invoices of gone instances: %v", err)
+		} else {
+			err = q.refill(ctx)
+		}
+		if err != nil {
+			// Let the next fetch of any instance try again
+			q.client.Del(ctx, q.key("refill"))
+			return nil, err
+		}
+	}
+
+	pipe := q.client.Pipeline()
+	moves := make([]*redis.StringCmd, q.Config.BatchSize)
+	for i := range moves {
+		moves[i] = pipe.LMove(ctx, q.key("pending"), q.processing(q.instance), "LEFT", "RIGHT")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to take invoices from Redis: %v", err)
+	}
+	var batch []Transaction
+	for _, m := range moves {
+		raw, err := m.Result()
+		if err != nil {
+			break
+		}
+		var e redisEntry
+		if err := json.Unmarshal([]byte(raw), &e); err != nil {
+			slog.WarnContext(ctx, "Dropping invalid Redis queue entry", "entry", raw, "error", err)
+			q.client.LRem(ctx, q.processing(q.instance), 1, raw)
+			continue
+		}
+		batch = append(batch, Transaction{InvoiceID: e.ID, Group: e.Group, Payload: e.Payload, Shard: q.Shard, handle: raw})
+	}
+	return batch, nil
+}
+
+// Queue the pending invoices of the database that are not queued yet
+func (q *RedisQueue) refill(ctx context.Context) error {
+	pending, err := q.Database.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	// A pipeline does not load the script on its own
+	if err := enqueueScript.Load(ctx, q.client).Err(); err != nil {
+		return fmt.Errorf("failed to queue invoices in Redis: %v", err)
+	}
+	pipe := q.client.Pipeline()
+	results := make([]*redis.Cmd, len(pending))
+	for i, txn := range pending {
+		raw, err := json.Marshal(redisEntry{ID: txn.InvoiceID, Group: txn.Group, Payload: txn.Payload})
+		if err != nil {
+			return fmt.Errorf("failed to encode invoice_id %s for Redis: %v", txn.InvoiceID, err)
+		}
+		results[i] = enqueueScript.EvalSha(ctx, pipe, []string{q.key("queued"), q.key("pending")}, txn.InvoiceID, raw)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to queue invoices in Redis: %v", err)
+	}
+	queued := 0
+	for _, r := range results {
+		if n, _ := r.Int(); n == 1 {
+			queued++
+		}
+	}
+	if queued > 0 {
+		slog.InfoContext(ctx, "Queued pending invoices in Redis", "queued", queued, "pending", len(pending))
+	}
+	return nil
+}
+
+// Queue again, ahead of the others, the invoices taken by instances whose
+// lease ran out
+func (q *RedisQueue) recover(ctx context.Context) error {
+	workers, err := q.client.SMembers(ctx, q.key("workers")).Result()
+	if err != nil {
+		return err
+	}
+	for _, w := range workers {
+		if w == q.instance {
+			continue
+		}
+		alive, err := q.client.Exists(ctx, q.key("lease:"+w)).Result()
+		if err != nil {
+			return err
+		}
+		if alive > 0 {
+			continue
+		}
+		n := 0
+		for {
+			err := q.client.LMove(ctx, q.processing(w), q.key("pending"), "RIGHT", "LEFT").Err()
+			if errors.Is(err, redis.Nil) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		if err := q.client.SRem(ctx, q.key("workers"), w).Err(); err != nil {
+			return err
+		}
+		if n > 0 {
+			slog.WarnContext(ctx, "Queued the invoices of a gone instance again", "instance", w, "invoices", n)
+		}
+	}
+	return nil
+}
+
+// Ack records the push in the database and removes the invoice from Redis
+func (q *RedisQueue) Ack(ctx context.Context, txn Transaction) error {
+	if err := q.Database.Ack(ctx, txn); err != nil {
+		return err
+	}
+	return q.done(ctx, txn, false)
+}
+
+// Nack records the failure in the database and queues the invoice again
+// with requeue, removing it from Redis otherwise
+func (q *RedisQueue) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	if err := q.Database.Nack(ctx, txn, requeue); err != nil {
+		return err
+	}
+	return q.done(ctx, txn, requeue)
+}
+
+// Skip removes a transaction that will not be pushed from Redis, so the
+// next refill queues it again if it is still pending
+func (q *RedisQueue) Skip(ctx context.Context, txn Transaction) error {
+	return q.done(ctx, txn, false)
+}
+
+// Take txn off this instance's list, putting it back at the end of the
+// queue with requeue
+func (q *RedisQueue) done(ctx context.Context, txn Transaction, requeue bool) error {
+	raw, ok := txn.handle.(string)
+	if !ok {
+		return nil
+	}
+	pipe := q.client.TxPipeline()
+	pipe.LRem(ctx, q.processing(q.instance), 1, raw)
+	if requeue {
+		pipe.RPush(ctx, q.key("pending"), raw)
+	} else {
+		pipe.SRem(ctx, q.key("queued"), txn.InvoiceID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to update invoice_id %s in Redis: %v", txn.InvoiceID, err)
+	}
+	return nil
+}
+
+// Renew the lease of this instance
+func (q *RedisQueue) lease(ctx context.Context) error {
+	pipe := q.client.Pipeline()
+	pipe.Set(ctx, q.key("lease:"+q.instance), time.Now().UTC().Format(time.RFC3339), q.Config.LeaseTTL)
+	pipe.SAdd(ctx, q.key("workers"), q.instance)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Renew the lease every third of lease_ttl, until ctx is cancelled
+func (q *RedisQueue) renew(ctx context.Context) {
+	t := time.NewTicker(q.Config.LeaseTTL / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if err := q.lease(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Failed to renew Redis lease", "error", err)
+		}
+	}
+}
+
+// Close queues the invoices still taken by this instance again, ends its
+// lease and closes the Redis client. The database is closed on its own.
+func (q *RedisQueue) Close() error {
+	q.stop()
+	ctx := context.Background()
+	for {
+		err := q.client.LMove(ctx, q.processing(q.instance), q.key("pending"), "RIGHT", "LEFT").Err()
+		if err != nil {
+			break
+		}
+	}
+	q.client.Del(ctx, q.key("lease:"+q.instance))
+	q.client.SRem(ctx, q.key("workers"), q.instance)
+	return q.client.Close()
+}
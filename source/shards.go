@@ -0,0 +1,297 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+)
+
+// Sharded reads the pending invoices from all the shards of the invoice
+// table at once, merged in the order of the shards. Every transaction is
+// answered on the shard it came from, and each shard keeps its own
+// watermark.
+type Sharded struct {
+	Shards []*Database
+
+	mu sync.Mutex
+	// Shard of each invoice fetched by the current run, for the calls made
+	// with the invoice number only
+	of map[string]*Database
+	// Paging position of each shard, and whether it has no more pages
+	after []string
+	done  []bool
+}
+
+// OpenShards opens a Database for each of cfg.Shards
+func OpenShards(cfg *config.Config) (*Sharded, error) {
+	s := &Sharded{of: make(map[string]*Database)}
+	for _, shard := range cfg.Shards {
+		db, err := Open(shardConfig(cfg, shard))
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("shard %s: %v", shard.Name, err)
+		}
+		db.Shard = shard.Name
+		s.Shards = append(s.Shards, db)
+	}
+	return s, nil
+}
+
+// cfg as seen by the Database of shard
+func shardConfig(cfg *config.Config, shard config.ShardConfig) *config.Config {
+	sc := *cfg
+	sc.Database = shard.Database
+	sc.ReadDatabase = config.DatabaseConfig{}
+	sc.Watermark.Name += "-" + shard.Name
+	if sc.Watermark.File != "" {
+		sc.Watermark.File += "." + shard.Name
+	}
+	return &sc
+}
+
+// Reload passes cfg on to the shards. Adding or removing shards needs a
+// restart.
+func (s *Sharded) Reload(cfg *config.Config) {
+	for i, db := range s.Shards {
+		if i < len(cfg.Shards) && cfg.Shards[i].Name == db.Shard {
+			db.Reload(shardConfig(cfg, cfg.Shards[i]))
+		}
+	}
+}
+
+func (s *Sharded) Close() error {
+	var errs []error
+	for _, db := range s.Shards {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Call fetch on every shard at once, returning their transactions in the
+// order of the shards
+func (s *Sharded) fetchAll(ctx context.Context, fetch func(i int, db *Database) ([]Transaction, error)) ([][]Transaction, error) {
+	results := make([][]Transaction, len(s.Shards))
+	errs := make([]error, len(s.Shards))
+	var wg sync.WaitGroup
+	for i, db := range s.Shards {
+		wg.Add(1)
+		go func(i int, db *Database) {
+			defer wg.Done()
+			results[i], errs[i] = fetch(i, db)
+		}(i, db)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %v", s.Shards[i].Shard, err)
+		}
+	}
+	s.mu.Lock()
+	for i, transactions := range results {
+		for _, txn := range transactions {
+			s.of[txn.InvoiceID] = s.Shards[i]
+		}
+	}
+	s.mu.Unlock()
+	return results, nil
+}
+
+func (s *Sharded) Fetch(ctx context.Context) ([]Transaction, error) {
+	s.mu.Lock()
+	s.of = make(map[string]*Database)
+	s.mu.Unlock()
+	results, err := s.fetchAll(ctx, func(_ int, db *Database) ([]Transaction, error) {
+		return db.Fetch(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var transactions []Transaction
+	for _, r := range results {
+		transactions = append(transactions, r...)
+	}
+	return transactions, nil
+}
+
+// FetchPage returns the next page of every shard that has one, so up to
+// limit transactions per shard. Each shard pages on from its own last
+// invoice; an empty after starts them all over.
+func (s *Sharded) FetchPage(ctx context.Context, after string, limit int) ([]Transaction, error) {
+	s.mu.Lock()
+	if after == "" {
+		s.of = make(map[string]*Database)
+		s.after = make([]string, len(s.Shards))
+		s.done = make([]bool, len(s.Shards))
+	}
+	positions, done := append([]string(nil), s.after...), append([]bool(nil), s.done...)
+	s.mu.Unlock()
+
+	results, err := s.fetchAll(ctx, func(i int, db *Database) ([]Transaction, error) {
+		if done[i] {
+			return nil, nil
+		}
+		return db.FetchPage(ctx, positions[i], limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var transactions []Transaction
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range results {
+		if len(r) < limit {
+			s.done[i] = true
+		}
+		if len(r) > 0 {
+			s.after[i] = r[len(r)-1].InvoiceID
+		}
+		transactions = append(transactions, r...)
+	}
+	return transactions, nil
+}
+
+// The shard txn came from: the one it names, else the one its invoice
+// was fetched from or is found on, e.g. for an invoice pushed on demand
+func (s *Sharded) shard(ctx context.Context, txn Transaction) (*Database, error) {
+	for _, db := range s.Shards {
+		if txn.Shard != "" && db.Shard == txn.Shard {
+			return db, nil
+		}
+	}
+	if txn.Shard != "" {
+		return nil, fmt.Errorf("invoice %s is from unknown shard %q", txn.InvoiceID, txn.Shard)
+	}
+	s.mu.Lock()
+	db := s.of[txn.InvoiceID]
+	s.mu.Unlock()
+	if db != nil {
+		return db, nil
+	}
+	for _, db := range s.Shards {
+		found, err := db.Has(ctx, txn.InvoiceID)
+		if err != nil {
+			return nil, fmt.Errorf("shard %s: %v", db.Shard, err)
+		}
+		if found {
+			s.mu.Lock()
+			s.of[txn.InvoiceID] = db
+			s.mu.Unlock()
+			return db, nil
+		}
+	}
+	return nil, fmt.Errorf("invoice %s is on no shard", txn.InvoiceID)
+}
+
+func (s *Sharded) Ack(ctx context.Context, txn Transaction) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.Ack(ctx, txn)
+}
+
+func (s *Sharded) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.Nack(ctx, txn, requeue)
+}
+
+func (s *Sharded) Review(ctx context.Context, txn Transaction) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.Review(ctx, txn)
+}
+
+func (s *Sharded) Reject(ctx context.Context, txn Transaction) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.Reject(ctx, txn)
+}
+
+// OldestPending returns the oldest pending invoice of all shards
+func (s *Sharded) OldestPending(ctx context.Context) (time.Time, error) {
+	var oldest time.Time
+	for _, db := range s.Shards {
+		t, err := db.OldestPending(ctx)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("shard %s: %v", db.Shard, err)
+		}
+		if !t.IsZero() && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	return oldest, nil
+}
+
+func (s *Sharded) SetStatus(ctx context.Context, txn Transaction, status string) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.SetStatus(ctx, txn, status)
+}
+
+func (s *Sharded) Hold(ctx context.Context, txn Transaction) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.Hold(ctx, txn)
+}
+
+// Advance stores txn as the watermark of its shard
+func (s *Sharded) Advance(ctx context.Context, txn Transaction) error {
+	db, err := s.shard(ctx, txn)
+	if err != nil {
+		return err
+	}
+	return db.Advance(ctx, txn)
+}
+
+// LoadPayload loads the payload from the shard of the invoice
+func (s *Sharded) LoadPayload(ctx context.Context, invoiceID string) (map[string]interface{}, error) {
+	db, err := s.shard(ctx, Transaction{InvoiceID: invoiceID})
+	if err != nil {
+		return nil, err
+	}
+	return db.LoadPayload(ctx, invoiceID)
+}
+
+// Capture stores the fields on the shard of the invoice
+func (s *Sharded) Capture(ctx context.Context, invoiceID string, values []*string) error {
+	db, err := s.shard(ctx, Transaction{InvoiceID: invoiceID})
+	if err != nil {
+		return err
+	}
+	return db.Capture(ctx, invoiceID, values)
+}
+
+// MoveToHistory moves the row into the history table of its shard
+func (s *Sharded) MoveToHistory(ctx context.Context, invoiceID string) error {
+	db, err := s.shard(ctx, Transaction{InvoiceID: invoiceID})
+	if err != nil {
+		return err
+	}
+	return db.MoveToHistory(ctx, invoiceID)
+}
+
+// Requeue requeues the invoice on every shard, being left alone on the
+// ones that do not hold it
+func (s *Sharded) Requeue(ctx context.Context, invoiceID string) error {
+	for _, db := range s.Shards {
+		if err := db.Requeue(ctx, invoiceID); err != nil {
+			return fmt.Errorf("shard %s: %v", db.Shard, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package source provides the pending transactions to push.
+package source
+
+import (
+	"context"
+	"time"
+)
+
+type Transaction struct {
+	InvoiceID string `json:"invoice_id"`
+	// Value of grouping.column; invoices sharing it are pushed in order
+	Group string `json:"-"`
+	// Value of watermark.column, for sources selecting by watermark
+	Cursor string `json:"-"`
+	// Name of the shard it was read from, empty without shards
+	Shard string `json:"-"`
+	// Fields pushed as the JSON body when payload.query is set
+	Payload map[string]interface{} `json:"-"`
+
+	// Set by queue sources to find the message again on Ack and Nack
+	handle interface{}
+}
+
+// Source provides the transactions that still need to be pushed and is
+// told what became of each one. The pipeline only talks to a source
+// through this interface and the optional ones below, so a database, a
+// file or a queue can feed it alike.
+type Source interface {
+	Fetch(ctx context.Context) ([]Transaction, error)
+	// Ack records that txn was pushed, so it is not fetched again
+	Ack(ctx context.Context, txn Transaction) error
+	// Nack records that txn was not pushed. With requeue it is handed out
+	// again as soon as possible, without it the failure was permanent and
+	// txn is set aside.
+	Nack(ctx context.Context, txn Transaction, requeue bool) error
+}
+
+// Pager is implemented by sources that can return the pending transactions
+// a page at a time, ordered by invoice number
+type Pager interface {
+	// FetchPage returns up to limit transactions with an invoice number
+	// greater than after (all of them when after is empty)
+	FetchPage(ctx context.Context, after string, limit int) ([]Transaction, error)
+}
+
+// Streamer is implemented by sources that can hand out the pending
+// transactions while they are being read
+type Streamer interface {
+	// Stream sends the pending transactions to out in selection order and
+	// returns once they are all sent, ctx is done or reading fails
+	Stream(ctx context.Context, out chan<- Transaction) error
+}
+
+// Reviewer is implemented by sources that can flag an invoice for manual
+// review. Other sources drop such invoices like parked ones.
+type Reviewer interface {
+	Review(ctx context.Context, txn Transaction) error
+}
+
+// Rejecter is implemented by sources that can set an invoice failing
+// validation aside. Other sources drop such invoices like parked ones.
+type Rejecter interface {
+	Reject(ctx context.Context, txn Transaction) error
+}
+
+// StatusSetter is implemented by sources that can write any status to an
+// invoice, such as the set_status of push.outcomes. Other sources handle
+// the outcome as if it had none.
+type StatusSetter interface {
+	SetStatus(ctx context.Context, txn Transaction, status string) error
+}
+
+// Ager is implemented by sources that can tell when their oldest pending
+// invoice was created
+type Ager interface {
+	// OldestPending returns the zero time when nothing is pending
+	OldestPending(ctx context.Context) (time.Time, error)
+}
+
+// PendingChecker is implemented by sources that can tell whether one
+// invoice is still waiting to be pushed
+type PendingChecker interface {
+	IsPending(ctx context.Context, invoiceID string) (bool, error)
+}
+
+// Holder is implemented by sources that can take an invoice out of the
+// pending set while it waits in the local queue
+type Holder interface {
+	Hold(ctx context.Context, txn Transaction) error
+}
+
+// Skipper is implemented by sources that must hear about every transaction
+// they hand out, such as queues that cannot move past an unanswered
+// message. Skip is called for the transactions dropped before pushing.
+type Skipper interface {
+	Skip(ctx context.Context, txn Transaction) error
+}
+
+// Advancer is implemented by sources that select the transactions after a
+// stored watermark rather than by status
+type Advancer interface {
+	// Advance moves the watermark to txn, which was handled along with
+	// everything selected before it
+	Advance(ctx context.Context, txn Transaction) error
+}
+
+// PayloadLoader is implemented by sources that can build the full payload
+// pushed for an invoice
+type PayloadLoader interface {
+	LoadPayload(ctx context.Context, invoiceID string) (map[string]interface{}, error)
+}
+
+// Capturer is implemented by sources that can store fields of the push
+// response alongside the invoice
+type Capturer interface {
+	// Capture stores values, in the order of capture.fields; a nil value
+	// is a field missing from the response
+	Capture(ctx context.Context, invoiceID string, values []*string) error
+}
+
+// Historian is implemented by sources that can set the rows of pushed
+// invoices aside in a history table
+type Historian interface {
+	MoveToHistory(ctx context.Context, invoiceID string) error
+}
+
+// Requeuer is implemented by sources that can move a parked invoice back
+// into the pending set
+type Requeuer interface {
+	Requeue(ctx context.Context, invoiceID string) error
+}
@@ -0,0 +1,211 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/purwaren/trx-push/config"
+)
+
+// SQS receives pending invoices from an SQS queue with long polling. The
+// messages of a fetch stay invisible to other consumers while they are
+// pushed, their visibility timeout being extended until they are handled.
+// A pushed message is deleted; a failed one is made visible again right
+// away, leaving redelivery and the move to a dead-letter queue to the
+// queue's redrive policy. Permanent failures and skipped messages are
+// deleted, the dead_letter table keeps those.
+type SQS struct {
+	Config config.SQSSourceConfig
+	client *sqs.Client
+
+	mu sync.Mutex
+	// Receipt handles of the messages fetched and not handled yet
+	inFlight map[string]bool
+	stop     context.CancelFunc
+}
+
+func NewSQS(ctx context.Context, cfg config.SQSSourceConfig) (*SQS, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	client := sqs.NewFromConfig(awsCfg, func(o *sqs.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+	s := &SQS{Config: cfg, client: client, inFlight: make(map[string]bool)}
+	extendCtx, stop := context.WithCancel(context.Background())
+	s.stop = stop
+	go s.extend(extendCtx)
+	return s, nil
+}
+
+// Fetch returns up to batch_size messages, waiting at most wait_time for
+// the first ones
+func (s *SQS) Fetch(ctx context.Context) ([]Transaction, error) {
+	var batch []Transaction
+	var handles []string
+	for len(batch) < s.Config.BatchSize {
+		wait := int32(0)
+		if len(handles) == 0 {
+			wait = int32(s.Config.WaitTime / time.Second)
+		}
+		out, err := s.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl: aws.String(s.Config.QueueURL),
+			// SQS returns at most 10 messages per call
+			MaxNumberOfMessages: int32(min(10, s.Config.BatchSize-len(batch))),
+			WaitTimeSeconds:     wait,
+			VisibilityTimeout:   s.visibility(),
+		})
+		if err != nil {
+			// Messages received so far become visible again on their own
+			return nil, fmt.Errorf("failed to receive SQS messages: %v", err)
+		}
+		if len(out.Messages) == 0 {
+			break
+		}
+		for _, m := range out.Messages {
+			handle := aws.ToString(m.ReceiptHandle)
+			txn, err := decodeMessage([]byte(aws.ToString(m.Body)), s.Config.Message)
+			if err != nil {
+				slog.Warn("Deleting SQS message", "message_id", aws.ToString(m.MessageId), "error", err)
+				if err := s.delete(ctx, handle); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			txn.handle = handle
+			batch = append(batch, txn)
+			handles = append(handles, handle)
+		}
+	}
+
+	s.mu.Lock()
+	for _, h := range handles {
+		s.inFlight[h] = true
+	}
+	s.mu.Unlock()
+	return batch, nil
+}
+
+// Ack deletes the message of txn
+func (s *SQS) Ack(ctx context.Context, txn Transaction) error {
+	return s.Skip(ctx, txn)
+}
+
+// Nack makes the message of txn visible again for redelivery, or deletes
+// it when the failure was permanent
+func (s *SQS) Nack(ctx context.Context, txn Transaction, requeue bool) error {
+	if !requeue {
+		return s.Skip(ctx, txn)
+	}
+	handle, ok := s.done(txn)
+	if !ok {
+		return nil
+	}
+	_, err := s.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.Config.QueueURL),
+		ReceiptHandle:     aws.String(handle),
+		VisibilityTimeout: 0,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release SQS message: %v", err)
+	}
+	return nil
+}
+
+// Skip deletes the message of a transaction that will not be pushed
+func (s *SQS) Skip(ctx context.Context, txn Transaction) error {
+	handle, ok := s.done(txn)
+	if !ok {
+		return nil
+	}
+	return s.delete(ctx, handle)
+}
+
+// Close stops extending the visibility of unhandled messages, which become
+// visible again once their timeout passes
+func (s *SQS) Close() error {
+	s.stop()
+	return nil
+}
+
+// Stop extending the message of txn and return its receipt handle
+func (s *SQS) done(txn Transaction) (string, bool) {
+	handle, ok := txn.handle.(string)
+	if !ok {
+		return "", false
+	}
+	s.mu.Lock()
+	delete(s.inFlight, handle)
+	s.mu.Unlock()
+	return handle, true
+}
+
+func (s *SQS) delete(ctx context.Context, handle string) error {
+	_, err := s.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.Config.QueueURL),
+		ReceiptHandle: aws.String(handle),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete SQS message: %v", err)
+	}
+	return nil
+}
+
+// Reset the visibility timeout of the messages in flight every half
+// timeout, until ctx is cancelled
+func (s *SQS) extend(ctx context.Context) {
+	t := time.NewTicker(s.Config.VisibilityTimeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		handles := make([]string, 0, len(s.inFlight))
+		for h := range s.inFlight {
+			handles = append(handles, h)
+		}
+		s.mu.Unlock()
+
+		for len(handles) > 0 {
+			n := min(10, len(handles))
+			entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, n)
+			for i, h := range handles[:n] {
+				entries[i] = types.ChangeMessageVisibilityBatchRequestEntry{
+					Id:                aws.String(strconv.Itoa(i)),
+					ReceiptHandle:     aws.String(h),
+					VisibilityTimeout: s.visibility(),
+				}
+			}
+			handles = handles[n:]
+			_, err := s.client.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+				QueueUrl: aws.String(s.Config.QueueURL),
+				Entries:  entries,
+			})
+			if err != nil && ctx.Err() == nil {
+				slog.Warn("Failed to extend the visibility of SQS messages", "error", err)
+			}
+		}
+	}
+}
+
+func (s *SQS) visibility() int32 {
+	return int32(s.Config.VisibilityTimeout / time.Second)
+}
@@ -0,0 +1,88 @@
+package source
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// successes holds the pushed invoices waiting for
+// status_update.on_success_batch
+type successes struct {
+	mu      sync.Mutex
+	pending []string
+	timer   *time.Timer
+}
+
+// Add invoiceID to the batch, writing it once batch_size invoices are in
+// it or flush_interval has passed
+func (db *Database) addSuccess(ctx context.Context, invoiceID string) error {
+	s := &db.successes
+	s.mu.Lock()
+	s.pending = append(s.pending, invoiceID)
+	if len(s.pending) < db.StatusUpdate.BatchSize {
+		if s.timer == nil {
+			s.timer = time.AfterFunc(db.StatusUpdate.FlushInterval, func() { db.FlushSuccesses(context.Background()) })
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	batch := s.take()
+	s.mu.Unlock()
+	return db.writeSuccesses(ctx, batch)
+}
+
+// FlushSuccesses writes the status of the pushed invoices still waiting
+// for their batch to fill. Failures are logged; the invoices stay pending
+// and are pushed again.
+func (db *Database) FlushSuccesses(ctx context.Context) {
+	s := &db.successes
+	s.mu.Lock()
+	batch := s.take()
+	s.mu.Unlock()
+	if len(batch) > 0 {
+		// Also when shutting down, these were pushed
+		db.writeSuccesses(context.WithoutCancel(ctx), batch)
+	}
+}
+
+// The pending invoices, leaving none; s.mu is held
+func (s *successes) take() []string {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	batch := s.pending
+	s.pending = nil
+	return batch
+}
+
+func (db *Database) writeSuccesses(ctx context.Context, batch []string) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	args := make([]interface{}, len(batch))
+	for i, invoiceID := range batch {
+		args[i] = invoiceID
+	}
+	start := time.Now()
+	_, err := db.Write.ExecContext(ctx, db.successBatch(len(batch)), args...)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to write the status of pushed invoices, they will be pushed again",
+			"count", len(batch), "first_invoice_id", batch[0], "error", err)
+		return err
+	}
+	slog.DebugContext(ctx, "Wrote the status of pushed invoices", "count", len(batch), "duration_ms", time.Since(start).Milliseconds())
+	return nil
+}
+
+// status_update.on_success_batch for n invoices, $invoices replaced by
+// their placeholders
+func (db *Database) successBatch(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = db.Dialect.Param(i + 1)
+	}
+	return strings.Replace(db.StatusUpdate.OnSuccessBatch, "$invoices", strings.Join(params, ", "), 1)
+}
@@ -0,0 +1,99 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/purwaren/trx-push/config"
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+func TestSuccessBatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		pushed    int
+		// Invoices written before and after FlushSuccesses
+		written, flushed int
+	}{
+		{"single", 1, 3, 3, 3},
+		{"full batches", 2, 4, 4, 4},
+		{"partial batch", 3, 7, 6, 7},
+		{"below batch size", 10, 4, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := sql.Open("sqlite", ":memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// Every connection would get its own in-memory database
+			conn.SetMaxOpenConns(1)
+			if _, err := conn.Exec("CREATE TABLE invoice (number TEXT PRIMARY KEY, status INTEGER NOT NULL)"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= tt.pushed; i++ {
+				if _, err := conn.Exec("INSERT INTO invoice VALUES ($1, 1)", fmt.Sprintf("INV-%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db := &Database{Write: conn, Dialect: sqlutil.SQLite, StatusUpdate: config.StatusUpdateConfig{
+				OnSuccessBatch: "UPDATE invoice SET status = 2 WHERE number IN ($invoices)",
+				BatchSize:      tt.batchSize,
+				FlushInterval:  time.Hour,
+			}}
+			ctx := context.Background()
+			for i := 1; i <= tt.pushed; i++ {
+				if err := db.addSuccess(ctx, fmt.Sprintf("INV-%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := countStatus(t, conn, 2); n != tt.written {
+				t.Errorf("written before flush = %d, want %d", n, tt.written)
+			}
+			db.FlushSuccesses(ctx)
+			if n := countStatus(t, conn, 2); n != tt.flushed {
+				t.Errorf("written after flush = %d, want %d", n, tt.flushed)
+			}
+			if db.successes.timer != nil || len(db.successes.pending) > 0 {
+				t.Error("invoices still pending after flush")
+			}
+		})
+	}
+}
+
+func TestSuccessBatchParams(t *testing.T) {
+	tests := []struct {
+		dialect sqlutil.Dialect
+		want    string
+	}{
+		{sqlutil.Postgres, "UPDATE invoice SET status = 2 WHERE number IN ($1, $2, $3)"},
+		{sqlutil.MySQL, "UPDATE invoice SET status = 2 WHERE number IN (?, ?, ?)"},
+		{sqlutil.SQLServer, "UPDATE invoice SET status = 2 WHERE number IN (@p1, @p2, @p3)"},
+		{sqlutil.Oracle, "UPDATE invoice SET status = 2 WHERE number IN (:1, :2, :3)"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.dialect), func(t *testing.T) {
+			db := &Database{Dialect: tt.dialect, StatusUpdate: config.StatusUpdateConfig{
+				OnSuccessBatch: "UPDATE invoice SET status = 2 WHERE number IN ($invoices)",
+			}}
+			if got := db.successBatch(3); got != tt.want {
+				t.Errorf("statement = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func countStatus(t *testing.T, conn *sql.DB, status int) int {
+	t.Helper()
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM invoice WHERE status = $1", status).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,118 @@
+package source
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/purwaren/trx-push/internal/sqlutil"
+)
+
+// Position of the last handled row: its watermark column as text and its
+// invoice number, which breaks ties between rows sharing a value
+type watermark struct {
+	Cursor  string `json:"cursor"`
+	Invoice string `json:"invoice"`
+}
+
+// Restrict s to the rows after the stored watermark, ordered by the
+// watermark column, and select that column as the cursor
+func (db *Database) afterWatermark(ctx context.Context, s *selection) error {
+	wm, err := db.loadWatermark(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load watermark: %v", err)
+	}
+	col, id := db.Dialect.Quote(db.Watermark.Column), db.Dialect.Quote(db.Query.IDColumn)
+	s.columns += ", " + db.Dialect.Text(col)
+	s.where = fmt.Sprintf("(%s) AND %s IS NOT NULL", s.where, col)
+	switch {
+	case wm.Cursor == "":
+	case db.Dialect.RowValues():
+		s.args = append(s.args, wm.Cursor, wm.Invoice)
+		s.where += fmt.Sprintf(" AND (%s, %s) > (%s, %s)", col, id,
+			db.Dialect.Param(len(s.args)-1), db.Dialect.Param(len(s.args)))
+	default:
+		s.args = append(s.args, wm.Cursor, wm.Cursor, wm.Invoice)
+		n := len(s.args)
+		s.where += fmt.Sprintf(" AND (%s > %s OR (%s = %s AND %s > %s))", col, db.Dialect.Param(n-2),
+			col, db.Dialect.Param(n-1), id, db.Dialect.Param(n))
+	}
+	s.order = col + ", " + id
+	return nil
+}
+
+// Advance stores txn as the new watermark
+func (db *Database) Advance(ctx context.Context, txn Transaction) error {
+	ctx, cancel := db.timeout(ctx)
+	defer cancel()
+	wm := watermark{Cursor: txn.Cursor, Invoice: txn.InvoiceID}
+	if db.Watermark.Store == "file" {
+		data, _ := json.Marshal(wm)
+		tmp := db.Watermark.File + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, db.Watermark.File)
+	}
+
+	if err := db.createStateTable(ctx); err != nil {
+		return err
+	}
+	d := db.Dialect
+	table, cursor := d.QuoteQualified(db.Watermark.Table), d.Quote("cursor")
+	var query string
+	switch d {
+	case sqlutil.MySQL:
+		query = fmt.Sprintf(`INSERT INTO %[1]s (name, %[2]s, invoice, updated_at) VALUES (?, ?, ?, %[3]s)
+ON DUPLICATE KEY UPDATE %[2]s = VALUES(%[2]s), invoice = VALUES(invoice), updated_at = %[3]s`, table, cursor, d.Now())
+	case sqlutil.SQLServer, sqlutil.Oracle:
+		query = d.Merge(table, "name", "cur", "invoice") + fmt.Sprintf(`
+ON (d.name = s.name)
+WHEN MATCHED THEN UPDATE SET d.%[1]s = s.cur, d.invoice = s.invoice, d.updated_at = %[2]s
+WHEN NOT MATCHED THEN INSERT (name, %[1]s, invoice, updated_at) VALUES (s.name, s.cur, s.invoice, %[2]s)`, cursor, d.Now()) + d.EndMerge()
+	default:
+		query = fmt.Sprintf(`INSERT INTO %[1]s (name, %[2]s, invoice, updated_at) VALUES ($1, $2, $3, %[3]s)
+ON CONFLICT (name) DO UPDATE SET %[2]s = EXCLUDED.%[2]s, invoice = EXCLUDED.invoice, updated_at = %[3]s`, table, cursor, d.Now())
+	}
+	_, err := db.Write.ExecContext(ctx, query, db.Watermark.Name, wm.Cursor, wm.Invoice)
+	return err
+}
+
+// The zero watermark (select everything) when none was stored yet
+func (db *Database) loadWatermark(ctx context.Context) (watermark, error) {
+	var wm watermark
+	if db.Watermark.Store == "file" {
+		data, err := os.ReadFile(db.Watermark.File)
+		if errors.Is(err, os.ErrNotExist) {
+			return wm, nil
+		}
+		if err != nil {
+			return wm, err
+		}
+		return wm, json.Unmarshal(data, &wm)
+	}
+
+	if err := db.createStateTable(ctx); err != nil {
+		return wm, err
+	}
+	query := fmt.Sprintf("SELECT %s, invoice FROM %s WHERE name = %s",
+		db.Dialect.Quote("cursor"), db.Dialect.QuoteQualified(db.Watermark.Table), db.Dialect.Param(1))
+	err := db.Write.QueryRowContext(ctx, query, db.Watermark.Name).Scan(&wm.Cursor, &wm.Invoice)
+	if errors.Is(err, sql.ErrNoRows) {
+		return wm, nil
+	}
+	return wm, err
+}
+
+func (db *Database) createStateTable(ctx context.Context) error {
+	d := db.Dialect
+	_, err := db.Write.ExecContext(ctx, d.CreateTable(d.QuoteQualified(db.Watermark.Table),
+		"name "+d.Type(sqlutil.String)+" PRIMARY KEY",
+		d.Quote("cursor")+" "+d.Type(sqlutil.String),
+		"invoice "+d.Type(sqlutil.String),
+		"updated_at "+d.Type(sqlutil.Timestamp)))
+	return err
+}